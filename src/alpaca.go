@@ -0,0 +1,505 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ASCOM Alpaca (https://ascom-standards.org/api/) exposes each configured site as
+// a SafetyMonitor and an ObservingConditions device, both with device number = site index.
+const (
+	AlpacaDiscoveryPort    = 32227
+	alpacaDiscoveryMessage = "alpacadiscovery1"
+	alpacaDriverVersion    = "1.0"
+	alpacaSampleTTL        = time.Minute // how long the current forecast hour is reused between polls
+)
+
+// Alpaca error numbers, returned with HTTP 200 in the ErrorNumber field
+const (
+	alpacaErrNotImplemented       = 0x400
+	alpacaErrInvalidValue         = 0x401
+	alpacaErrNotConnected         = 0x407
+	alpacaErrActionNotImplemented = 0x40C
+	alpacaErrDriver               = 0x500
+)
+
+// alpacaResponse is the common envelope of every Alpaca device and management reply.
+// Value is left out for PUT methods.
+type alpacaResponse struct {
+	Value               any    `json:"Value,omitempty"`
+	ClientTransactionID uint32 `json:"ClientTransactionID"`
+	ServerTransactionID uint32 `json:"ServerTransactionID"`
+	ErrorNumber         int    `json:"ErrorNumber"`
+	ErrorMessage        string `json:"ErrorMessage"`
+}
+
+type alpacaDescription struct {
+	ServerName          string `json:"ServerName"`
+	Manufacturer        string `json:"Manufacturer"`
+	ManufacturerVersion string `json:"ManufacturerVersion"`
+	Location            string `json:"Location"`
+}
+
+type alpacaDevice struct {
+	DeviceName   string `json:"DeviceName"`
+	DeviceType   string `json:"DeviceType"`
+	DeviceNumber int    `json:"DeviceNumber"`
+	UniqueID     string `json:"UniqueID"`
+}
+
+// alpacaError is returned by property getters and setters and mapped to ErrorNumber/ErrorMessage
+type alpacaError struct {
+	Number  int
+	Message string
+}
+
+func (e *alpacaError) Error() string {
+	return fmt.Sprintf("alpaca error 0x%X: %s", e.Number, e.Message)
+}
+
+func notImplemented(name string) *alpacaError {
+	return &alpacaError{Number: alpacaErrNotImplemented, Message: name + " is not implemented by the forecast driver"}
+}
+
+func notConnected() *alpacaError {
+	return &alpacaError{Number: alpacaErrNotConnected, Message: "device is not connected"}
+}
+
+// alpacaSample is the forecast hour served to clients, reused for alpacaSampleTTL
+type alpacaSample struct {
+	point     DataPoint
+	fetchedAt time.Time
+}
+
+// alpacaServer serves the Alpaca management and device API for the configured sites
+type alpacaServer struct {
+	sites     []Site
+	serverTxn atomic.Uint32
+
+	mu        sync.Mutex
+	connected map[string]bool // "<devicetype>/<number>"
+	samples   map[int]alpacaSample
+
+	now      func() time.Time
+	forecast func(ctx context.Context, lat, lon float64) (DataPoints, error)
+}
+
+func newAlpacaServer(sites []Site) *alpacaServer {
+	return &alpacaServer{
+		sites:     sites,
+		connected: map[string]bool{},
+		samples:   map[int]alpacaSample{},
+		now:       time.Now,
+		forecast:  fetchForecast,
+	}
+}
+
+// Handler returns the Alpaca HTTP routes
+func (s *alpacaServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/management/apiversions", s.handleAPIVersions)
+	mux.HandleFunc("/management/v1/description", s.handleDescription)
+	mux.HandleFunc("/management/v1/configureddevices", s.handleConfiguredDevices)
+	mux.HandleFunc("/api/v1/{device}/{number}/{method}", s.handleDevice)
+	return mux
+}
+
+func (s *alpacaServer) handleAPIVersions(w http.ResponseWriter, r *http.Request) {
+	s.reply(w, r, []int{1}, nil)
+}
+
+func (s *alpacaServer) handleDescription(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.sites))
+	for _, site := range s.sites {
+		names = append(names, site.Name)
+	}
+	s.reply(w, r, alpacaDescription{
+		ServerName:          "aweather",
+		Manufacturer:        "aweather",
+		ManufacturerVersion: alpacaDriverVersion,
+		Location:            strings.Join(names, ", "),
+	}, nil)
+}
+
+func (s *alpacaServer) handleConfiguredDevices(w http.ResponseWriter, r *http.Request) {
+	devices := []alpacaDevice{}
+	for _, deviceType := range []string{"SafetyMonitor", "ObservingConditions"} {
+		for i, site := range s.sites {
+			devices = append(devices, alpacaDevice{
+				DeviceName:   fmt.Sprintf("aweather %s %s", site.Name, deviceType),
+				DeviceType:   deviceType,
+				DeviceNumber: i,
+				UniqueID:     alpacaUniqueID(site, deviceType),
+			})
+		}
+	}
+	s.reply(w, r, devices, nil)
+}
+
+// handleDevice serves /api/v1/{device}/{number}/{method} for both device types
+func (s *alpacaServer) handleDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	device := r.PathValue("device")
+	method := r.PathValue("method")
+	number, err := strconv.Atoi(r.PathValue("number"))
+	if err != nil || number < 0 || number >= len(s.sites) {
+		http.Error(w, "Unknown device number", http.StatusBadRequest)
+		return
+	}
+	if device != "safetymonitor" && device != "observingconditions" {
+		http.Error(w, "Unknown device type", http.StatusBadRequest)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form data", http.StatusBadRequest)
+		return
+	}
+
+	site := s.sites[number]
+	key := device + "/" + strconv.Itoa(number)
+
+	if r.Method == http.MethodPut {
+		putErr, ok := s.put(r, key, device, number, method)
+		if !ok {
+			http.Error(w, "Unknown method "+method, http.StatusBadRequest)
+			return
+		}
+		s.reply(w, r, nil, putErr)
+		return
+	}
+
+	if value, ok := s.commonGet(device, site, key, method); ok {
+		s.reply(w, r, value, nil)
+		return
+	}
+
+	if device == "safetymonitor" && method == "issafe" && !s.isConnected(key) {
+		// ISafetyMonitor requires IsSafe to be false, not an error, while disconnected
+		s.reply(w, r, false, nil)
+		return
+	}
+
+	var value any
+	var getErr *alpacaError
+	var known bool
+	if device == "safetymonitor" {
+		value, getErr, known = s.safetyMonitorGet(r.Context(), number, method)
+	} else {
+		value, getErr, known = s.observingConditionsGet(r, number, method, s.isConnected(key))
+	}
+	if !known {
+		http.Error(w, "Unknown method "+method, http.StatusBadRequest)
+		return
+	}
+	if getErr == nil && !s.isConnected(key) {
+		value, getErr = nil, notConnected()
+	}
+	s.reply(w, r, value, getErr)
+}
+
+// commonGet answers the properties every Alpaca device has
+func (s *alpacaServer) commonGet(device string, site Site, key, method string) (any, bool) {
+	switch method {
+	case "connected":
+		return s.isConnected(key), true
+	case "description":
+		if device == "safetymonitor" {
+			return fmt.Sprintf("Forecast-based safety monitor for %s (%.3f, %.3f)", site.Name, site.Lat, site.Lon), true
+		}
+		return fmt.Sprintf("Forecast observing conditions for %s (%.3f, %.3f)", site.Name, site.Lat, site.Lon), true
+	case "driverinfo":
+		return "aweather Open-Meteo forecast driver", true
+	case "driverversion":
+		return alpacaDriverVersion, true
+	case "interfaceversion":
+		return 1, true
+	case "name":
+		if device == "safetymonitor" {
+			return "aweather " + site.Name + " SafetyMonitor", true
+		}
+		return "aweather " + site.Name + " ObservingConditions", true
+	case "supportedactions":
+		return []string{}, true
+	}
+	return nil, false
+}
+
+// put handles PUT methods; ok is false for unknown methods
+func (s *alpacaServer) put(r *http.Request, key, device string, number int, method string) (*alpacaError, bool) {
+	switch method {
+	case "connected":
+		connected, err := strconv.ParseBool(alpacaParam(r, "Connected"))
+		if err != nil {
+			return &alpacaError{Number: alpacaErrInvalidValue, Message: "Connected must be true or false"}, true
+		}
+		s.mu.Lock()
+		s.connected[key] = connected
+		s.mu.Unlock()
+		return nil, true
+	case "action":
+		return &alpacaError{Number: alpacaErrActionNotImplemented, Message: "no actions are supported"}, true
+	case "commandblind", "commandbool", "commandstring":
+		return notImplemented(method), true
+	}
+
+	if device != "observingconditions" {
+		return nil, false
+	}
+	switch method {
+	case "averageperiod":
+		period, err := strconv.ParseFloat(alpacaParam(r, "AveragePeriod"), 64)
+		if err != nil || period != 0 {
+			return &alpacaError{Number: alpacaErrInvalidValue, Message: "only an average period of 0 (instantaneous) is supported"}, true
+		}
+		return nil, true
+	case "refresh":
+		// Drop the reused sample so the next read goes through the forecast cache again
+		s.mu.Lock()
+		delete(s.samples, number)
+		s.mu.Unlock()
+		return nil, true
+	}
+	return nil, false
+}
+
+func (s *alpacaServer) safetyMonitorGet(ctx context.Context, number int, method string) (any, *alpacaError, bool) {
+	if method != "issafe" {
+		return nil, nil, false
+	}
+	point, err := s.current(ctx, number)
+	if err != nil {
+		// Fail safe: an unreachable forecast never reports safe conditions
+		slog.WarnContext(ctx, "alpaca safety monitor", "site", s.sites[number].Name, "error", err)
+		return false, nil, true
+	}
+	return isSafe(point), nil, true
+}
+
+// isSafe is true when the hour is "ok" with default thresholds and no precipitation is forecast
+func isSafe(point DataPoint) bool {
+	maxCloud, maxWind := PrintOptions{}.thresholds()
+	return point.isGood(maxCloud, maxWind) && point.Precipitation == 0
+}
+
+// observingConditionsSensors maps implemented sensor names to their descriptions
+var observingConditionsSensors = map[string]string{
+	"cloudcover":  "Forecast cloud cover (%), cloudiest of the low, mid and high layers",
+	"dewpoint":    "Forecast dew point at 2 m (°C)",
+	"humidity":    "Relative humidity (%) derived from forecast temperature and dew point",
+	"rainrate":    "Forecast precipitation (mm/h)",
+	"starfwhm":    "aweather seeing index (0.5 best - 5 worst), not a measured FWHM",
+	"temperature": "Forecast temperature at 2 m (°C)",
+	"windgust":    "Forecast wind gusts at 10 m (m/s)",
+	"windspeed":   "Forecast wind speed at 10 m (m/s)",
+}
+
+// observingConditionsGet answers the sensor reads; a disconnected device gets NotConnected
+// without the forecast being fetched
+func (s *alpacaServer) observingConditionsGet(r *http.Request, number int, method string, connected bool) (any, *alpacaError, bool) {
+	switch method {
+	case "averageperiod":
+		return 0.0, nil, true
+	case "pressure", "skybrightness", "skyquality", "skytemperature", "winddirection":
+		return nil, notImplemented(method), true
+	case "sensordescription", "timesincelastupdate":
+		sensor := strings.ToLower(alpacaParam(r, "SensorName"))
+		if _, ok := observingConditionsSensors[sensor]; !ok && sensor != "" {
+			return nil, notImplemented(sensor), true
+		}
+		if method == "sensordescription" {
+			if sensor == "" {
+				return nil, &alpacaError{Number: alpacaErrInvalidValue, Message: "SensorName is required"}, true
+			}
+			return observingConditionsSensors[sensor], nil, true
+		}
+		if !connected {
+			return nil, notConnected(), true
+		}
+		// Values come from the forecast for the whole hour
+		point, err := s.current(r.Context(), number)
+		if err != nil {
+			return nil, &alpacaError{Number: alpacaErrDriver, Message: err.Error()}, true
+		}
+		return math.Max(0, s.now().Sub(point.Time).Seconds()), nil, true
+	}
+
+	if _, ok := observingConditionsSensors[method]; !ok {
+		return nil, nil, false
+	}
+	if !connected {
+		return nil, notConnected(), true
+	}
+	point, err := s.current(r.Context(), number)
+	if err != nil {
+		return nil, &alpacaError{Number: alpacaErrDriver, Message: err.Error()}, true
+	}
+	switch method {
+	case "cloudcover":
+		return float64(max(point.LowClouds, point.MidClouds, point.HighClouds)), nil, true
+	case "dewpoint":
+		return point.DewPoint, nil, true
+	case "humidity":
+		return relativeHumidity(point.Temperature2M, point.DewPoint), nil, true
+	case "rainrate":
+		return point.Precipitation, nil, true
+	case "starfwhm":
+		return point.Seeing, nil, true
+	case "temperature":
+		return point.Temperature2M, nil, true
+	case "windgust":
+		return point.WindGusts / 3.6, nil, true
+	default: // windspeed
+		return point.WindSpeed / 3.6, nil, true
+	}
+}
+
+// current returns the site's current forecast hour, reusing the last sample for alpacaSampleTTL
+func (s *alpacaServer) current(ctx context.Context, number int) (DataPoint, error) {
+	now := s.now()
+	s.mu.Lock()
+	sample, ok := s.samples[number]
+	s.mu.Unlock()
+	if ok && now.Sub(sample.fetchedAt) < alpacaSampleTTL && now.Sub(sample.point.Time) < time.Hour {
+		return sample.point, nil
+	}
+
+	site := s.sites[number]
+	points, err := s.forecast(ctx, site.Lat, site.Lon)
+	if err != nil {
+		return DataPoint{}, fmt.Errorf("fetch forecast: %w", err)
+	}
+	point, err := points.current(now)
+	if err != nil {
+		return DataPoint{}, err
+	}
+
+	s.mu.Lock()
+	s.samples[number] = alpacaSample{point: point, fetchedAt: now}
+	s.mu.Unlock()
+	return point, nil
+}
+
+func (s *alpacaServer) isConnected(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connected[key]
+}
+
+// reply writes the Alpaca JSON envelope. Alpaca errors are reported in the body with HTTP 200.
+func (s *alpacaServer) reply(w http.ResponseWriter, r *http.Request, value any, err *alpacaError) {
+	clientTxn, _ := strconv.ParseUint(alpacaParam(r, "ClientTransactionID"), 10, 32)
+	resp := alpacaResponse{
+		Value:               value,
+		ClientTransactionID: uint32(clientTxn),
+		ServerTransactionID: s.serverTxn.Add(1),
+	}
+	if err != nil {
+		resp.Value = nil
+		resp.ErrorNumber = err.Number
+		resp.ErrorMessage = err.Message
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if encErr := json.NewEncoder(w).Encode(resp); encErr != nil {
+		slog.Error("encoding alpaca response", "error", encErr)
+	}
+}
+
+// alpacaParam returns a query or form parameter; Alpaca parameter names are case-insensitive
+func alpacaParam(r *http.Request, name string) string {
+	if r.Form == nil {
+		_ = r.ParseForm()
+	}
+	for key, values := range r.Form {
+		if strings.EqualFold(key, name) && len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+	}
+	return ""
+}
+
+// alpacaUniqueID derives a stable UUID-formatted ID from the site and device type
+func alpacaUniqueID(site Site, deviceType string) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("aweather/%s/%.4f,%.4f/%s", site.Name, site.Lat, site.Lon, deviceType)))
+	sum[6] = sum[6]&0x0f | 0x50 // version 5
+	sum[8] = sum[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// relativeHumidity uses the Magnus formula to derive humidity (%) from temperature and dew point (°C)
+func relativeHumidity(temp, dewPoint float64) float64 {
+	const b, c = 17.625, 243.04
+	rh := 100 * math.Exp(b*dewPoint/(c+dewPoint)) / math.Exp(b*temp/(c+temp))
+	return math.Max(0, math.Min(100, rh))
+}
+
+// startAlpaca starts the Alpaca HTTP server on port and the discovery responder on AlpacaDiscoveryPort
+func startAlpaca(port int, sites []Site) (*http.Server, net.PacketConn, error) {
+	if len(sites) == 0 {
+		return nil, nil, fmt.Errorf("alpaca needs at least one site in AWEATHER_SITES")
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, nil, fmt.Errorf("alpaca listen: %w", err)
+	}
+	discovery, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", AlpacaDiscoveryPort))
+	if err != nil {
+		listener.Close()
+		return nil, nil, fmt.Errorf("alpaca discovery listen: %w", err)
+	}
+
+	srv := &http.Server{
+		Handler:           newAlpacaServer(sites).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("alpaca server", "error", err)
+		}
+	}()
+	go serveAlpacaDiscovery(discovery, port)
+
+	slog.Info("alpaca devices started", "sites", len(sites), "port", port, "discovery_port", AlpacaDiscoveryPort)
+	return srv, discovery, nil
+}
+
+// serveAlpacaDiscovery answers Alpaca discovery broadcasts with the HTTP port until conn is closed
+func serveAlpacaDiscovery(conn net.PacketConn, alpacaPort int) {
+	reply, _ := json.Marshal(struct {
+		AlpacaPort int `json:"AlpacaPort"`
+	}{alpacaPort})
+
+	buf := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("alpaca discovery read", "error", err)
+			}
+			return
+		}
+		if !strings.HasPrefix(string(buf[:n]), alpacaDiscoveryMessage) {
+			continue
+		}
+		if _, err := conn.WriteTo(reply, addr); err != nil {
+			slog.Warn("alpaca discovery reply", "addr", addr.String(), "error", err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alpacaTestClient is a minimal Alpaca client, polling the way NINA does
+type alpacaTestClient struct {
+	t    *testing.T
+	base string
+	txn  int
+}
+
+func (c *alpacaTestClient) do(method, path string, params url.Values) alpacaResponse {
+	c.t.Helper()
+	c.txn++
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("ClientID", "42")
+	params.Set("ClientTransactionID", fmt.Sprint(c.txn))
+
+	var req *http.Request
+	var err error
+	if method == http.MethodPut {
+		req, err = http.NewRequest(method, c.base+path, strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		req, err = http.NewRequest(method, c.base+path+"?"+params.Encode(), nil)
+	}
+	if err != nil {
+		c.t.Fatalf("build request: %v", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		c.t.Fatalf("%s %s: status %d", method, path, res.StatusCode)
+	}
+	var resp alpacaResponse
+	if err := json.NewDecoder(res.Body).Decode(&resp); err != nil {
+		c.t.Fatalf("%s %s: decode: %v", method, path, err)
+	}
+	if resp.ClientTransactionID != uint32(c.txn) {
+		c.t.Errorf("%s %s: expected client transaction %d, got %d", method, path, c.txn, resp.ClientTransactionID)
+	}
+	return resp
+}
+
+func newAlpacaTestServer(t *testing.T, point DataPoint, fetchErr error) (*alpacaTestClient, *alpacaServer) {
+	t.Helper()
+	now := time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)
+	s := newAlpacaServer([]Site{{Name: "home", Lat: 50.45, Lon: 30.52}})
+	s.now = func() time.Time { return now }
+	s.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) {
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		// 21:00, 22:00 and 23:00 with the same values; now is within the 22:00 hour
+		points := DataPoints{}
+		for h := 21; h <= 23; h++ {
+			point.Time = time.Date(2024, 3, 1, h, 0, 0, 0, time.UTC)
+			points = append(points, point)
+		}
+		return points, nil
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return &alpacaTestClient{t: t, base: ts.URL}, s
+}
+
+func TestAlpaca_Management(t *testing.T) {
+	client, _ := newAlpacaTestServer(t, DataPoint{}, nil)
+
+	versions := client.do(http.MethodGet, "/management/apiversions", nil)
+	if fmt.Sprint(versions.Value) != "[1]" {
+		t.Errorf("unexpected api versions %v", versions.Value)
+	}
+
+	devices := client.do(http.MethodGet, "/management/v1/configureddevices", nil)
+	list, ok := devices.Value.([]any)
+	if !ok || len(list) != 2 {
+		t.Fatalf("expected 2 configured devices, got %v", devices.Value)
+	}
+	first := list[0].(map[string]any)
+	if first["DeviceType"] != "SafetyMonitor" || first["DeviceNumber"] != 0.0 || len(first["UniqueID"].(string)) != 36 {
+		t.Errorf("unexpected device %v", first)
+	}
+
+	again := client.do(http.MethodGet, "/management/v1/configureddevices", nil)
+	if again.Value.([]any)[1].(map[string]any)["UniqueID"] != list[1].(map[string]any)["UniqueID"] {
+		t.Errorf("unique IDs must be stable")
+	}
+}
+
+func TestAlpaca_SafetyMonitor(t *testing.T) {
+	clear := DataPoint{WindSpeed: 5, WindGusts: 8}
+	tests := []struct {
+		name  string
+		point DataPoint
+		err   error
+		safe  bool
+	}{
+		{"clear", clear, nil, true},
+		{"cloudy", DataPoint{LowClouds: 80, WindSpeed: 5}, nil, false},
+		{"rain", DataPoint{Precipitation: 0.4}, nil, false},
+		{"upstream down", clear, errors.New("boom"), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, _ := newAlpacaTestServer(t, tc.point, tc.err)
+
+			// IsSafe is false until a client connects, as ISafetyMonitor requires
+			resp := client.do(http.MethodGet, "/api/v1/safetymonitor/0/issafe", nil)
+			if resp.ErrorNumber != 0 || resp.Value != false {
+				t.Fatalf("expected IsSafe false while disconnected, got %+v", resp)
+			}
+
+			resp = client.do(http.MethodPut, "/api/v1/safetymonitor/0/connected", url.Values{"Connected": {"True"}})
+			if resp.ErrorNumber != 0 || resp.Value != nil {
+				t.Fatalf("unexpected connect response %+v", resp)
+			}
+			if resp := client.do(http.MethodGet, "/api/v1/safetymonitor/0/connected", nil); resp.Value != true {
+				t.Fatalf("expected connected, got %+v", resp)
+			}
+
+			resp = client.do(http.MethodGet, "/api/v1/safetymonitor/0/issafe", nil)
+			if resp.ErrorNumber != 0 || resp.Value != tc.safe {
+				t.Fatalf("expected IsSafe %v, got %+v", tc.safe, resp)
+			}
+		})
+	}
+}
+
+func TestAlpaca_ObservingConditions(t *testing.T) {
+	point := DataPoint{Temperature2M: 10, DewPoint: 5, LowClouds: 10, MidClouds: 30, HighClouds: 20, WindSpeed: 36, WindGusts: 54, Seeing: 1.5, Precipitation: 0.2}
+	client, s := newAlpacaTestServer(t, point, nil)
+	fetches := 0
+	forecast := s.forecast
+	s.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) {
+		fetches++
+		return forecast(ctx, lat, lon)
+	}
+	// Sensor reads before connecting report NotConnected, without fetching the forecast
+	for _, method := range []string{"temperature", "timesincelastupdate"} {
+		if resp := client.do(http.MethodGet, "/api/v1/observingconditions/0/"+method, nil); resp.ErrorNumber != alpacaErrNotConnected {
+			t.Fatalf("%s: expected NotConnected, got %+v", method, resp)
+		}
+	}
+	if fetches != 0 {
+		t.Fatalf("expected no forecast fetch while disconnected, got %d", fetches)
+	}
+	client.do(http.MethodPut, "/api/v1/observingconditions/0/connected", url.Values{"connected": {"true"}})
+
+	want := map[string]float64{
+		"cloudcover":          30,
+		"dewpoint":            5,
+		"rainrate":            0.2,
+		"starfwhm":            1.5,
+		"temperature":         10,
+		"windspeed":           10,
+		"windgust":            15,
+		"averageperiod":       0,
+		"timesincelastupdate": 1800,
+	}
+	for method, value := range want {
+		resp := client.do(http.MethodGet, "/api/v1/observingconditions/0/"+method, nil)
+		if resp.ErrorNumber != 0 || resp.Value != value {
+			t.Errorf("%s: expected %v, got %+v", method, value, resp)
+		}
+	}
+
+	humidity := client.do(http.MethodGet, "/api/v1/observingconditions/0/humidity", nil)
+	if h, ok := humidity.Value.(float64); !ok || h < 70 || h > 72 {
+		t.Errorf("expected humidity around 71%%, got %+v", humidity)
+	}
+
+	if resp := client.do(http.MethodGet, "/api/v1/observingconditions/0/pressure", nil); resp.ErrorNumber != alpacaErrNotImplemented {
+		t.Errorf("expected pressure to be not implemented, got %+v", resp)
+	}
+	if resp := client.do(http.MethodGet, "/api/v1/observingconditions/0/sensordescription", url.Values{"SensorName": {"CloudCover"}}); resp.ErrorNumber != 0 || !strings.Contains(resp.Value.(string), "cloud cover") {
+		t.Errorf("unexpected sensor description %+v", resp)
+	}
+	if resp := client.do(http.MethodPut, "/api/v1/observingconditions/0/averageperiod", url.Values{"AveragePeriod": {"1"}}); resp.ErrorNumber != alpacaErrInvalidValue {
+		t.Errorf("expected InvalidValue for non-zero average period, got %+v", resp)
+	}
+	if resp := client.do(http.MethodPut, "/api/v1/observingconditions/0/refresh", nil); resp.ErrorNumber != 0 {
+		t.Errorf("unexpected refresh response %+v", resp)
+	}
+}
+
+func TestAlpaca_InvalidRequests(t *testing.T) {
+	client, _ := newAlpacaTestServer(t, DataPoint{}, nil)
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/api/v1/safetymonitor/1/issafe", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/telescope/0/connected", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/safetymonitor/0/cloudcover", http.StatusBadRequest},
+		{http.MethodDelete, "/api/v1/safetymonitor/0/connected", http.StatusMethodNotAllowed},
+	}
+	for _, tc := range tests {
+		req, _ := http.NewRequest(tc.method, client.base+tc.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.method, tc.path, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.status, res.StatusCode)
+		}
+	}
+}
+
+func TestAlpaca_SampleReused(t *testing.T) {
+	_, s := newAlpacaTestServer(t, DataPoint{}, nil)
+	calls := 0
+	forecast := s.forecast
+	s.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) {
+		calls++
+		return forecast(ctx, lat, lon)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := s.current(context.Background(), 0); err != nil {
+			t.Fatalf("current: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 forecast call, got %d", calls)
+	}
+}
+
+func TestAlpacaDiscovery(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go serveAlpacaDiscovery(conn, 11111)
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("client listen: %v", err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	if _, err := client.WriteTo([]byte("not alpaca"), conn.LocalAddr()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := client.WriteTo([]byte(alpacaDiscoveryMessage), conn.LocalAddr()); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	buf := make([]byte, 256)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got := string(buf[:n]); got != `{"AlpacaPort":11111}` {
+		t.Fatalf("unexpected discovery reply %q", got)
+	}
+}
+
+func TestRelativeHumidity(t *testing.T) {
+	if rh := relativeHumidity(10, 10); rh != 100 {
+		t.Errorf("expected 100%% at dew point, got %.2f", rh)
+	}
+	if rh := relativeHumidity(20, 0); rh < 25 || rh > 27 {
+		t.Errorf("expected about 26%%, got %.2f", rh)
+	}
+}
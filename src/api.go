@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// APIForecast is the JSON served by /api/forecast
+type APIForecast struct {
+	Latitude  float64      `json:"latitude"`
+	Longitude float64      `json:"longitude"`
+	FetchedAt time.Time    `json:"fetched_at"`
+	Stale     bool         `json:"stale"` // served from the cache because Open-Meteo failed
+	Nights    []EmbedNight `json:"nights"`
+}
+
+// handleAPIForecast serves every night in the forecast range that has not ended yet
+func handleAPIForecast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	lat, lon, ok := parseCoordinates(q.Get("lat"), q.Get("lon"))
+	if !ok {
+		http.Error(w, "Valid latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+	attrs := []any{coords(lat, lon)}
+	if key := apiKeyFromContext(r.Context()); key != nil {
+		attrs = append(attrs, "api_key", key.ID)
+	}
+	slog.InfoContext(r.Context(), "API forecast requested", attrs...)
+
+	points, freshness, err := fetchForecastFreshness(r.Context(), lat, lon)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching weather from Open-Meteo", "error", err)
+		http.Error(w, "Upstream weather service unavailable", http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now()
+	if setForecastCaching(w, r, freshness, hourVariant(now)) {
+		return
+	}
+	if points, err = withAstronomy(r.Context(), points, freshness); err != nil {
+		forecastCancelled(w)
+		return
+	}
+
+	maxCloud, maxWind := parsePrintOptions(q).thresholds()
+	forecast := APIForecast{
+		Latitude:  lat,
+		Longitude: lon,
+		FetchedAt: freshness.FetchedAt.UTC(),
+		Stale:     freshness.Stale,
+		Nights:    []EmbedNight{},
+	}
+	for _, night := range points.Nights(maxCloud, maxWind) {
+		if night.End.After(now) {
+			forecast.Nights = append(forecast.Nights, *newEmbedNight(night, maxCloud, maxWind))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(forecast); err != nil {
+		slog.ErrorContext(r.Context(), "encoding API forecast", "error", err)
+	}
+}
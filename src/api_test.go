@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleAPIForecast(t *testing.T) {
+	setupCache()
+	fakeForecastServer(t, func(i int) int64 { return 0 })
+
+	rec := httptest.NewRecorder()
+	handleAPIForecast(rec, httptest.NewRequest(http.MethodGet, "/api/forecast?lat=50.45&lon=30.52", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var got APIForecast
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Latitude != 50.45 || got.Longitude != 30.52 || got.Stale || got.FetchedAt.IsZero() {
+		t.Errorf("unexpected forecast %+v", got)
+	}
+	if len(got.Nights) < 2 {
+		t.Fatalf("expected every night in the range, got %d", len(got.Nights))
+	}
+	for _, night := range got.Nights {
+		if len(night.Hours) == 0 || night.BestWindow == nil {
+			t.Errorf("night %s: %d hours, best window %+v", night.Date, len(night.Hours), night.BestWindow)
+		}
+	}
+}
+
+func TestHandleAPIForecast_BadRequests(t *testing.T) {
+	for _, tt := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/api/forecast", http.StatusBadRequest},
+		{http.MethodGet, "/api/forecast?lat=91&lon=0", http.StatusBadRequest},
+		{http.MethodPost, "/api/forecast?lat=1&lon=1", http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		handleAPIForecast(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	apiKeysBucket  = "api_keys"
+	apiUsageBucket = "api_usage"
+	apiKeyPrefix   = "aw_"
+
+	apiUsageFlushInterval = 10 * time.Second
+	apiUsageRetention     = 90 // days of usage kept in the store
+)
+
+// APIKey identifies a programmatic client of /api/*. Only a hash of the secret is kept.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	SecretHash string     `json:"secret_hash"` // hex SHA-256 of the secret part of the key
+	DailyQuota int        `json:"daily_quota"` // requests per UTC day; 0 means unlimited
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+var (
+	errInvalidAPIKey = errors.New("invalid API key")
+	errQuotaExceeded = errors.New("daily quota exceeded")
+)
+
+// APIKeys authenticates /api/* requests and counts their usage per key and day. Counts are
+// kept in memory and saved to the store by Run, so that requests do not write to the database.
+type APIKeys struct {
+	store    *Store
+	required bool // reject /api/* requests without a key instead of treating them as anonymous
+	now      func() time.Time
+
+	mu    sync.Mutex
+	usage map[string]int  // counts by apiUsageKey, ahead of the store
+	dirty map[string]bool // counts not saved yet
+}
+
+func newAPIKeys(store *Store, required bool) *APIKeys {
+	return &APIKeys{store: store, required: required, now: time.Now, usage: map[string]int{}, dirty: map[string]bool{}}
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the key a request was authenticated with, or nil
+func apiKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key
+}
+
+// Issue creates a key and returns it together with the token the client sends, which is not stored
+func (k *APIKeys) Issue(name string, dailyQuota int) (APIKey, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return APIKey{}, "", errors.New("a name is required")
+	}
+	if dailyQuota < 0 {
+		return APIKey{}, "", errors.New("the quota cannot be negative")
+	}
+	secret := randomHex(24)
+	key := APIKey{
+		ID:         randomHex(4),
+		Name:       strings.TrimSpace(name),
+		SecretHash: hashAPISecret(secret),
+		DailyQuota: dailyQuota,
+		CreatedAt:  k.now().UTC(),
+	}
+	if err := k.store.Put(apiKeysBucket, key.ID, key); err != nil {
+		return APIKey{}, "", err
+	}
+	return key, apiKeyPrefix + key.ID + "_" + secret, nil
+}
+
+// Revoke disables a key for good
+func (k *APIKeys) Revoke(id string) error {
+	var key APIKey
+	if err := k.store.Get(apiKeysBucket, id, &key); err != nil {
+		return err
+	}
+	if key.RevokedAt == nil {
+		now := k.now().UTC()
+		key.RevokedAt = &now
+	}
+	return k.store.Put(apiKeysBucket, id, key)
+}
+
+// List returns all keys, oldest first
+func (k *APIKeys) List() ([]APIKey, error) {
+	var keys []APIKey
+	err := k.store.ForEach(apiKeysBucket, func(_ string, data []byte) error {
+		var key APIKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, err
+}
+
+// Usage returns the number of requests made with a key on the UTC day of t
+func (k *APIKeys) Usage(id string, t time.Time) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.loadUsage(apiUsageKey(id, t))
+}
+
+// loadUsage returns a count from memory, or from the store the first time; call it with mu held
+func (k *APIKeys) loadUsage(usageKey string) (int, error) {
+	if n, ok := k.usage[usageKey]; ok {
+		return n, nil
+	}
+	var n int
+	if err := k.store.Get(apiUsageBucket, usageKey, &n); err != nil && !errors.Is(err, errNotFound) {
+		return 0, err
+	}
+	return n, nil
+}
+
+// authenticate finds the key for a token
+func (k *APIKeys) authenticate(token string) (*APIKey, error) {
+	id, secret, ok := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil, errInvalidAPIKey
+	}
+	var key APIKey
+	if err := k.store.Get(apiKeysBucket, id, &key); err != nil {
+		if errors.Is(err, errNotFound) {
+			return nil, errInvalidAPIKey
+		}
+		return nil, err
+	}
+	if key.RevokedAt != nil || subtle.ConstantTimeCompare([]byte(hashAPISecret(secret)), []byte(key.SecretHash)) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	return &key, nil
+}
+
+// count records a request made with key and returns the day's count including it,
+// or errQuotaExceeded without counting it when the quota is used up
+func (k *APIKeys) count(key *APIKey, now time.Time) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	usageKey := apiUsageKey(key.ID, now)
+	n, err := k.loadUsage(usageKey)
+	if err != nil {
+		return 0, err
+	}
+	k.usage[usageKey] = n
+	if key.DailyQuota > 0 && n >= key.DailyQuota {
+		return n, errQuotaExceeded
+	}
+	n++
+	k.usage[usageKey], k.dirty[usageKey] = n, true
+	return n, nil
+}
+
+// Run saves the usage counts periodically and deletes those older than apiUsageRetention days,
+// until ctx is cancelled
+func (k *APIKeys) Run(ctx context.Context) {
+	ticker := time.NewTicker(apiUsageFlushInterval)
+	defer ticker.Stop()
+	pruned := ""
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := k.flush(); err != nil {
+			slog.Error("saving API key usage", "error", err)
+		}
+		if today := k.now().UTC().Format("2006-01-02"); today != pruned {
+			if err := k.prune(); err != nil {
+				slog.Error("pruning API key usage", "error", err)
+				continue
+			}
+			pruned = today
+		}
+	}
+}
+
+// Shutdown saves the usage counts, once the server has finished its requests
+func (k *APIKeys) Shutdown() error {
+	return k.flush()
+}
+
+// flush saves the changed counts in one transaction and forgets those of past days
+func (k *APIKeys) flush() error {
+	k.mu.Lock()
+	changed := make(map[string]any, len(k.dirty))
+	for usageKey := range k.dirty {
+		changed[usageKey] = k.usage[usageKey]
+	}
+	clear(k.dirty)
+	today := k.now().UTC().Format("2006-01-02")
+	for usageKey := range k.usage {
+		if !strings.HasSuffix(usageKey, "/"+today) {
+			delete(k.usage, usageKey)
+		}
+	}
+	k.mu.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+	err := k.store.PutAll(apiUsageBucket, changed)
+	if err != nil {
+		// Keep the counts for the next flush; requests counted meanwhile only raised them
+		k.mu.Lock()
+		for usageKey, n := range changed {
+			if k.usage[usageKey] < n.(int) {
+				k.usage[usageKey] = n.(int)
+			}
+			k.dirty[usageKey] = true
+		}
+		k.mu.Unlock()
+	}
+	return err
+}
+
+// prune deletes the stored counts of days more than apiUsageRetention days ago
+func (k *APIKeys) prune() error {
+	oldest := k.now().UTC().AddDate(0, 0, -apiUsageRetention).Format("2006-01-02")
+	var old []string
+	err := k.store.ForEach(apiUsageBucket, func(usageKey string, _ []byte) error {
+		if _, day, ok := strings.Cut(usageKey, "/"); ok && day < oldest {
+			old = append(old, usageKey)
+		}
+		return nil
+	})
+	if err != nil || len(old) == 0 {
+		return err
+	}
+	return k.store.DeleteAll(apiUsageBucket, old)
+}
+
+// Wrap authenticates requests to /api/*. Requests with a valid key count against its quota
+// and are exempt from the per-IP rate limits; requests without one are anonymous unless keys
+// are required. A nil APIKeys leaves all requests anonymous.
+func (k *APIKeys) Wrap(next http.Handler) http.Handler {
+	if k == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := apiKeyFromRequest(r)
+		if token == "" && !k.required {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aweather"`)
+			http.Error(w, "API key required", http.StatusUnauthorized)
+			return
+		}
+
+		key, err := k.authenticate(token)
+		if errors.Is(err, errInvalidAPIKey) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aweather", error="invalid_token"`)
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "loading API key", "error", err)
+			http.Error(w, "Unable to check API key", http.StatusInternalServerError)
+			return
+		}
+
+		now := k.now().UTC()
+		n, err := k.count(key, now)
+		if key.DailyQuota > 0 {
+			w.Header().Set("X-Quota-Limit", strconv.Itoa(key.DailyQuota))
+			w.Header().Set("X-Quota-Remaining", strconv.Itoa(max(key.DailyQuota-n, 0)))
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			apiQuotaExceeded.Inc()
+			reset := now.Truncate(24 * time.Hour).Add(24 * time.Hour)
+			w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(now).Seconds())+1))
+			http.Error(w, "Daily quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "counting API key usage", "api_key", key.ID, "error", err)
+			http.Error(w, "Unable to check API key", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	})
+}
+
+// apiKeyFromRequest reads the key from "Authorization: Bearer" or X-API-Key
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+func hashAPISecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiUsageKey(id string, t time.Time) string {
+	return id + "/" + t.UTC().Format("2006-01-02")
+}
+
+// apiKeyStatus is a key as the admin API and "aweather apikey list" show it
+type apiKeyStatus struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	DailyQuota int        `json:"daily_quota"`
+	UsedToday  int        `json:"used_today"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Token      string     `json:"token,omitempty"` // only in the response that creates the key
+}
+
+// apiKeyAdmin manages keys, either in the database or through the admin API of a running server
+type apiKeyAdmin interface {
+	Issue(name string, dailyQuota int) (APIKey, string, error)
+	Revoke(id string) error
+	Statuses() ([]apiKeyStatus, error)
+}
+
+// Statuses lists all keys with today's usage, oldest first
+func (k *APIKeys) Statuses() ([]apiKeyStatus, error) {
+	keys, err := k.List()
+	if err != nil {
+		return nil, err
+	}
+	now := k.now()
+	statuses := make([]apiKeyStatus, 0, len(keys))
+	for _, key := range keys {
+		used, err := k.Usage(key.ID, now)
+		if err != nil {
+			return nil, err
+		}
+		statuses = append(statuses, apiKeyStatus{ID: key.ID, Name: key.Name, DailyQuota: key.DailyQuota, UsedToday: used, CreatedAt: key.CreatedAt, RevokedAt: key.RevokedAt})
+	}
+	return statuses, nil
+}
+
+// startAdmin serves the /admin/* API on addr, a listener of its own so that the API is not
+// reachable on the public port
+func startAdmin(addr, token string, keys *APIKeys) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/apikeys", withAdminToken(token, keys.handleAdminKeys))
+	mux.HandleFunc("/admin/apikeys/{id}", withAdminToken(token, keys.handleAdminKey))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("admin listen: %w", err)
+	}
+
+	srv := &http.Server{
+		Addr:              listener.Addr().String(),
+		Handler:           withRequestLog(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			slog.Error("admin server", "error", err)
+		}
+	}()
+	slog.Info("admin api started", "addr", srv.Addr)
+	return srv, nil
+}
+
+// adminBaseURL is the URL of the admin API listening on addr, through loopback when it
+// listens on all interfaces
+func adminBaseURL(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// withAdminToken lets through only requests with "Authorization: Bearer <token>"
+func withAdminToken(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if len(auth) <= 7 || !strings.EqualFold(auth[:7], "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[7:])), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="aweather admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleAdminKeys lists the keys on GET and creates one from {"name", "daily_quota"} on POST
+func (k *APIKeys) handleAdminKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		statuses, err := k.Statuses()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "listing API keys", "error", err)
+			http.Error(w, "Unable to list API keys", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			slog.ErrorContext(r.Context(), "encoding API keys", "error", err)
+		}
+	case http.MethodPost:
+		var req struct {
+			Name       string `json:"name"`
+			DailyQuota int    `json:"daily_quota"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		key, token, err := k.Issue(req.Name, req.DailyQuota)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.InfoContext(r.Context(), "created API key", "api_key", key.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		status := apiKeyStatus{ID: key.ID, Name: key.Name, DailyQuota: key.DailyQuota, CreatedAt: key.CreatedAt, Token: token}
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			slog.ErrorContext(r.Context(), "encoding API key", "error", err)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminKey revokes a key on DELETE
+func (k *APIKeys) handleAdminKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	err := k.Revoke(id)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "revoking API key", "api_key", id, "error", err)
+		http.Error(w, "Unable to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "revoked API key", "api_key", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiKeysClient manages keys through the admin API of a running server
+type apiKeysClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func (c *apiKeysClient) Issue(name string, dailyQuota int) (APIKey, string, error) {
+	var status apiKeyStatus
+	body := map[string]any{"name": name, "daily_quota": dailyQuota}
+	if err := c.do(http.MethodPost, "/admin/apikeys", body, &status); err != nil {
+		return APIKey{}, "", err
+	}
+	return APIKey{ID: status.ID, Name: status.Name, DailyQuota: status.DailyQuota, CreatedAt: status.CreatedAt}, status.Token, nil
+}
+
+func (c *apiKeysClient) Revoke(id string) error {
+	return c.do(http.MethodDelete, "/admin/apikeys/"+url.PathEscape(id), nil, nil)
+}
+
+func (c *apiKeysClient) Statuses() ([]apiKeyStatus, error) {
+	var statuses []apiKeyStatus
+	err := c.do(http.MethodGet, "/admin/apikeys", nil, &statuses)
+	return statuses, err
+}
+
+// do sends a request to the admin API and decodes the response into out; 404 is errNotFound
+func (c *apiKeysClient) do(method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("server: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// runAPIKeyCommand implements "aweather apikey create|list|revoke"
+func runAPIKeyCommand(keys apiKeyAdmin, args []string, out io.Writer) error {
+	usage := errors.New("usage: aweather apikey [-config file] [flags] create -name NAME [-quota N] | list | revoke ID")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		name := fs.String("name", "", "who the key is for")
+		quota := fs.Int("quota", 0, "requests per UTC day, 0 for unlimited")
+		if err := fs.Parse(args[1:]); err != nil || fs.NArg() != 0 {
+			return usage
+		}
+		key, token, err := keys.Issue(*name, *quota)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created key %s for %s. Give this token to the client, it is not shown again:\n%s\n", key.ID, key.Name, token)
+		return nil
+
+	case "list":
+		list, err := keys.Statuses()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tQUOTA\tTODAY\tCREATED\tSTATUS")
+		for _, key := range list {
+			quota, status := "unlimited", "active"
+			if key.DailyQuota > 0 {
+				quota = strconv.Itoa(key.DailyQuota)
+			}
+			if key.RevokedAt != nil {
+				status = "revoked " + key.RevokedAt.Format("2006-01-02")
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", key.ID, key.Name, quota, key.UsedToday, key.CreatedAt.Format("2006-01-02"), status)
+		}
+		return tw.Flush()
+
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		if err := keys.Revoke(args[1]); err != nil {
+			if errors.Is(err, errNotFound) {
+				return fmt.Errorf("no key %s", args[1])
+			}
+			return err
+		}
+		fmt.Fprintf(out, "Revoked key %s\n", args[1])
+		return nil
+	}
+	return usage
+}
+
+// runAPIKeyCommandLine runs "aweather apikey [config flags] command ...": the database and the
+// admin API are found with the same flags, environment and -config file as the server.
+func runAPIKeyCommandLine(args []string, getenv func(string) string, out io.Writer) error {
+	cfg, _, rest, err := loadConfigArgs(args, getenv)
+	if err != nil {
+		return err
+	}
+	keys, release, err := apiKeyAdminForCommand(cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return runAPIKeyCommand(keys, rest, out)
+}
+
+// apiKeyAdminForCommand opens the configured database for the apikey command. While a server
+// has it open, the command goes through that server's admin API instead, which needs admin_token.
+// The returned function releases what was opened.
+func apiKeyAdminForCommand(cfg Config) (apiKeyAdmin, func(), error) {
+	if cfg.DB == "" {
+		return nil, nil, errors.New("db is not set")
+	}
+	store, err := openStoreTimeout(cfg.DB, time.Second)
+	if err == nil {
+		return newAPIKeys(store, false), func() { store.Close() }, nil
+	}
+	if !errors.Is(err, bolt.ErrTimeout) {
+		return nil, nil, err
+	}
+	if cfg.AdminToken == "" {
+		return nil, nil, errors.New("the database is in use by a running server; set admin_token for both to manage keys through it, or stop the server first")
+	}
+	client := &apiKeysClient{
+		baseURL: adminBaseURL(cfg.AdminAddr),
+		token:   cfg.AdminToken,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	return client, func() {}, nil
+}
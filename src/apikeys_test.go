@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAPIKeys(t *testing.T, required bool) (*APIKeys, *time.Time) {
+	t.Helper()
+	keys := newAPIKeys(openTestStore(t), required)
+	now := time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC)
+	keys.now = func() time.Time { return now }
+	return keys, &now
+}
+
+func TestAPIKeys_Quota(t *testing.T) {
+	keys, now := testAPIKeys(t, false)
+	key, token, err := keys.Issue("partner club", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, "aw_"+key.ID+"_") || strings.Contains(token, key.SecretHash) {
+		t.Fatalf("unexpected token %q for key %+v", token, key)
+	}
+	h := keys.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if k := apiKeyFromContext(r.Context()); k == nil || k.ID != key.ID {
+			t.Errorf("handler saw key %+v", k)
+		}
+	}))
+	send := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/forecast?lat=1&lon=2", nil)
+		req.Header.Set(header, value)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("Authorization", "Bearer "+token)
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Quota-Limit") != "2" || rec.Header().Get("X-Quota-Remaining") != "1" {
+		t.Fatalf("first request: %d, headers %v", rec.Code, rec.Header())
+	}
+	if rec := send("X-API-Key", token); rec.Code != http.StatusOK || rec.Header().Get("X-Quota-Remaining") != "0" {
+		t.Fatalf("second request: %d, headers %v", rec.Code, rec.Header())
+	}
+	rec = send("X-API-Key", token)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "3601" {
+		t.Fatalf("over quota: %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if n, err := keys.Usage(key.ID, *now); err != nil || n != 2 {
+		t.Errorf("usage = %d, %v; rejected requests are not counted", n, err)
+	}
+	// /metrics is public, so the rejection count does not say which key it was
+	var metrics strings.Builder
+	apiQuotaExceeded.write(&metrics)
+	if strings.Contains(metrics.String(), key.ID) || !strings.Contains(metrics.String(), "aweather_api_quota_exceeded_total ") {
+		t.Errorf("unexpected quota metric %q", metrics.String())
+	}
+
+	// The quota starts over on the next UTC day
+	*now = now.Add(time.Hour)
+	if rec := send("X-API-Key", token); rec.Code != http.StatusOK {
+		t.Errorf("next day: %d", rec.Code)
+	}
+	if n, _ := keys.Usage(key.ID, now.Add(-time.Hour)); n != 2 {
+		t.Errorf("yesterday's usage = %d", n)
+	}
+}
+
+func TestAPIKeys_Authentication(t *testing.T) {
+	keys, _ := testAPIKeys(t, false)
+	key, token, err := keys.Issue("scripts", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen *APIKey
+	h := keys.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = apiKeyFromContext(r.Context()) }))
+	send := func(path, token string) int {
+		seen = nil
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := send("/api/forecast", token); code != http.StatusOK || seen == nil || seen.ID != key.ID {
+		t.Fatalf("valid key: %d, %+v", code, seen)
+	}
+	if code := send("/api/forecast", ""); code != http.StatusOK || seen != nil {
+		t.Errorf("anonymous request: %d, %+v", code, seen)
+	}
+	if code := send("/weather", "garbage"); code != http.StatusOK {
+		t.Errorf("keys are not checked outside /api/: %d", code)
+	}
+	for _, bad := range []string{"garbage", "aw_" + key.ID + "_" + strings.Repeat("0", 48), "aw_ffffffff_x", token + "x"} {
+		if code := send("/api/forecast", bad); code != http.StatusUnauthorized {
+			t.Errorf("key %q: %d", bad, code)
+		}
+	}
+
+	if err := keys.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if code := send("/api/forecast", token); code != http.StatusUnauthorized {
+		t.Errorf("revoked key: %d", code)
+	}
+
+	keys.required = true
+	if code := send("/api/forecast", ""); code != http.StatusUnauthorized {
+		t.Errorf("anonymous request with keys required: %d", code)
+	}
+	if code := send("/weather", ""); code != http.StatusOK {
+		t.Errorf("/weather needs no key: %d", code)
+	}
+}
+
+// Requests with a key are not held to the per-IP limits
+func TestAPIKeys_ExemptFromRateLimits(t *testing.T) {
+	keys, _ := testAPIKeys(t, false)
+	_, token, _ := keys.Issue("scripts", 0)
+	limiter, _ := testLimiter(t, "/api/=1/m", "", "")
+	h := keys.Wrap(limiter.Wrap(okHandler))
+
+	send := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/forecast", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if token != "" {
+			req.Header.Set("X-API-Key", token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	send("")
+	if code := send(""); code != http.StatusTooManyRequests {
+		t.Errorf("anonymous: %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := send(token); code != http.StatusOK {
+			t.Errorf("with a key: %d", code)
+		}
+	}
+}
+
+func TestAPIKeys_UsageIsBatched(t *testing.T) {
+	keys, now := testAPIKeys(t, false)
+	key, token, err := keys.Issue("scripts", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := keys.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/forecast?lat=1&lon=2", nil)
+		req.Header.Set("X-API-Key", token)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	stored := func(t time.Time) int {
+		var n int
+		keys.store.Get(apiUsageBucket, apiUsageKey(key.ID, t), &n)
+		return n
+	}
+	if n, _ := keys.Usage(key.ID, *now); n != 3 || stored(*now) != 0 {
+		t.Fatalf("usage %d, stored %d before the flush", n, stored(*now))
+	}
+	if err := keys.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if stored(*now) != 3 {
+		t.Fatalf("stored %d after the flush", stored(*now))
+	}
+
+	// Past days are dropped from memory, and from the store after apiUsageRetention days
+	old := now.AddDate(0, 0, -apiUsageRetention-1)
+	keys.store.Put(apiUsageBucket, apiUsageKey(key.ID, old), 7)
+	*now = now.Add(time.Hour)
+	keys.flush()
+	if len(keys.usage) != 0 {
+		t.Errorf("yesterday's counts are still in memory: %v", keys.usage)
+	}
+	if err := keys.prune(); err != nil {
+		t.Fatal(err)
+	}
+	if stored(old) != 0 || stored(now.Add(-time.Hour)) != 3 {
+		t.Errorf("prune: old day %d, yesterday %d", stored(old), stored(now.Add(-time.Hour)))
+	}
+}
+
+func TestAPIKeyCommand(t *testing.T) {
+	keys, _ := testAPIKeys(t, false)
+	testAPIKeyCommand(t, keys, keys)
+}
+
+// The command works through the admin API while a server has the database open
+func TestAPIKeyCommand_ThroughServer(t *testing.T) {
+	keys, _ := testAPIKeys(t, false)
+	server, err := startAdmin("127.0.0.1:0", "0123456789abcdef", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	testAPIKeyCommand(t, keys, &apiKeysClient{baseURL: adminBaseURL(server.Addr), token: "0123456789abcdef", client: http.DefaultClient})
+
+	wrong := &apiKeysClient{baseURL: adminBaseURL(server.Addr), token: "fedcba9876543210", client: http.DefaultClient}
+	if _, err := wrong.Statuses(); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("wrong admin token: %v", err)
+	}
+}
+
+func testAPIKeyCommand(t *testing.T, keys *APIKeys, admin apiKeyAdmin) {
+	t.Helper()
+	var out bytes.Buffer
+	if err := runAPIKeyCommand(admin, []string{"create", "-name", "Lviv club", "-quota", "500"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	token := strings.TrimSpace(out.String()[strings.LastIndex(strings.TrimSpace(out.String()), "\n"):])
+	key, err := keys.authenticate(token)
+	if err != nil || key.Name != "Lviv club" || key.DailyQuota != 500 {
+		t.Fatalf("created key %+v, %v from output %q", key, err, out.String())
+	}
+
+	out.Reset()
+	if err := runAPIKeyCommand(admin, []string{"revoke", key.ID}, &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runAPIKeyCommand(admin, []string{"list"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"ID", key.ID, "Lviv club", "500", "revoked 2024-03-01"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("list output %q does not contain %q", out.String(), want)
+		}
+	}
+
+	for _, args := range [][]string{nil, {"create"}, {"create", "-quota", "-1", "-name", "x"}, {"revoke"}, {"revoke", "nope"}, {"rotate"}} {
+		if err := runAPIKeyCommand(admin, args, &out); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestAPIKeyAdminForCommand(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.DB = filepath.Join(t.TempDir(), "aweather.db")
+	admin, release, err := apiKeyAdminForCommand(cfg)
+	if _, ok := admin.(*APIKeys); err != nil || !ok {
+		t.Fatalf("expected the database while no server runs, got %T, %v", admin, err)
+	}
+	defer release()
+
+	// The database stays locked while it is open, as it is by a running server
+	if _, _, err := apiKeyAdminForCommand(cfg); err == nil || !strings.Contains(err.Error(), "admin_token") {
+		t.Errorf("locked database without admin_token: %v", err)
+	}
+	cfg.AdminToken = "0123456789abcdef"
+	if admin, _, err := apiKeyAdminForCommand(cfg); err != nil || admin.(*apiKeysClient).baseURL != "http://127.0.0.1:8089" {
+		t.Errorf("locked database with admin_token: %T, %v", admin, err)
+	}
+}
+
+// The apikey command reads the same config flags and -config file as the server
+func TestRunAPIKeyCommandLine(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "aweather.db")
+	var out bytes.Buffer
+	if err := runAPIKeyCommandLine([]string{"-db", db, "create", "-name", "Lviv club"}, envMap(nil), &out); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	config := writeConfigFile(t, "aweather.toml", fmt.Sprintf("db = %q\n", db))
+	if err := runAPIKeyCommandLine([]string{"-config", config, "list"}, envMap(nil), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Lviv club") {
+		t.Errorf("list output %q does not contain the key created with -db", out.String())
+	}
+
+	if err := runAPIKeyCommandLine([]string{"list"}, envMap(nil), &out); err == nil || !strings.Contains(err.Error(), "db is not set") {
+		t.Errorf("without a database: %v", err)
+	}
+}
+
+func TestAdminBaseURL(t *testing.T) {
+	for addr, want := range map[string]string{
+		"127.0.0.1:8089": "http://127.0.0.1:8089",
+		":8089":          "http://127.0.0.1:8089",
+		"0.0.0.0:9000":   "http://127.0.0.1:9000",
+		"[::1]:9000":     "http://[::1]:9000",
+		"admin.lan:9000": "http://admin.lan:9000",
+	} {
+		if got := adminBaseURL(addr); got != want {
+			t.Errorf("adminBaseURL(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// errBotUnauthorized stops the bot: retrying with a rejected token is pointless
+var errBotUnauthorized = errors.New("bot token rejected")
+
+// ChatMessage is an incoming message from any chat provider
+type ChatMessage struct {
+	ChatID    string
+	MessageID string
+	From      string
+	Text      string
+}
+
+// ChatReply is an answer to a command; Code is rendered in a monospace block
+type ChatReply struct {
+	Text string
+	Code string
+}
+
+// ChatProvider connects the bot to a chat service such as Telegram, Discord or Matrix
+type ChatProvider interface {
+	Name() string
+	// Poll blocks until new messages arrive, the poll times out or ctx is cancelled
+	Poll(ctx context.Context) ([]ChatMessage, error)
+	Reply(ctx context.Context, to ChatMessage, reply ChatReply) error
+}
+
+// Bot answers chat commands with forecasts
+type Bot struct {
+	provider ChatProvider
+	sites    []Site
+	site     string // default site for /tonight
+
+	now      func() time.Time
+	forecast func(ctx context.Context, lat, lon float64) (DataPoints, error)
+	suggest  func(ctx context.Context, query string) ([]Suggestion, error)
+}
+
+func newBot(provider ChatProvider, sites []Site, site string) *Bot {
+	return &Bot{provider: provider, sites: sites, site: site, now: time.Now, forecast: fetchForecast, suggest: fetchSuggestions}
+}
+
+// botsFromConfig configures the enabled chat bots; bot_site picks the /tonight site (default the first one)
+func botsFromConfig(cfg Config, sites []Site) ([]*Bot, error) {
+	site := cfg.BotSite
+	if site != "" {
+		if _, ok := findSite(sites, site); !ok {
+			return nil, fmt.Errorf("bot_site %q is not in sites", site)
+		}
+	}
+
+	bots := []*Bot{}
+	if token := cfg.TelegramToken; token != "" {
+		telegram := newTelegram(token)
+		if endpoint := cfg.TelegramAPI; endpoint != "" {
+			telegram.endpoint = strings.TrimRight(endpoint, "/")
+		}
+		bots = append(bots, newBot(telegram, sites, site))
+	}
+	return bots, nil
+}
+
+// findSite returns the site with the given name
+func findSite(sites []Site, name string) (Site, bool) {
+	for _, site := range sites {
+		if strings.EqualFold(site.Name, name) {
+			return site, true
+		}
+	}
+	return Site{}, false
+}
+
+// Run polls the provider and answers commands until ctx is cancelled
+func (b *Bot) Run(ctx context.Context) {
+	slog.Info("bot started", "provider", b.provider.Name())
+	backoff := time.Second
+	for ctx.Err() == nil {
+		messages, err := b.provider.Poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, errBotUnauthorized) {
+				slog.Error("bot stopped", "provider", b.provider.Name(), "error", err)
+				return
+			}
+			slog.Warn("bot poll failed", "provider", b.provider.Name(), "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+
+		for _, msg := range messages {
+			reply, ok := b.handle(ctx, msg)
+			if !ok {
+				continue
+			}
+			if err := b.provider.Reply(ctx, msg, reply); err != nil {
+				slog.Warn("bot reply failed", "provider", b.provider.Name(), "chat_id", msg.ChatID, "error", err)
+			}
+		}
+	}
+}
+
+// handle answers a single message; ok is false for messages that are not bot commands
+func (b *Bot) handle(ctx context.Context, msg ChatMessage) (ChatReply, bool) {
+	command, arg := parseBotCommand(msg.Text)
+	switch command {
+	case "forecast":
+		return b.forecastCommand(ctx, arg), true
+	case "tonight":
+		return b.tonightCommand(ctx, arg), true
+	case "start", "help":
+		return ChatReply{Text: botHelp}, true
+	default:
+		return ChatReply{}, false
+	}
+}
+
+const botHelp = "aweather – astronomical weather\n" +
+	"/forecast <city> – tonight's hourly table for a city\n" +
+	"/tonight [site] – tonight at the club site"
+
+// parseBotCommand splits "/forecast@aweather_bot Kyiv" into "forecast" and "Kyiv"
+func parseBotCommand(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "/") {
+		return "", ""
+	}
+	command, arg, _ := strings.Cut(text[1:], " ")
+	command, _, _ = strings.Cut(command, "@")
+	return strings.ToLower(command), strings.TrimSpace(arg)
+}
+
+func (b *Bot) forecastCommand(ctx context.Context, query string) ChatReply {
+	if query == "" {
+		return ChatReply{Text: "Usage: /forecast <city>"}
+	}
+	suggestions, err := b.suggest(ctx, query)
+	if err != nil {
+		slog.ErrorContext(ctx, "bot suggestions", "query", query, "error", err)
+		return ChatReply{Text: "Unable to look up the location, try again later."}
+	}
+	if len(suggestions) == 0 {
+		return ChatReply{Text: fmt.Sprintf("No location found for %q.", query)}
+	}
+	s := suggestions[0]
+	name := s.Name
+	for _, part := range []string{s.Admin1, s.Country} {
+		if part != "" && part != name {
+			name += ", " + part
+		}
+	}
+	return b.nightReply(ctx, name, s.Lat, s.Lon)
+}
+
+func (b *Bot) tonightCommand(ctx context.Context, name string) ChatReply {
+	if name == "" {
+		name = b.site
+	}
+	if name == "" && len(b.sites) > 0 {
+		name = b.sites[0].Name
+	}
+	site, ok := findSite(b.sites, name)
+	if !ok {
+		if len(b.sites) == 0 {
+			return ChatReply{Text: "No club site is configured, use /forecast <city>."}
+		}
+		names := make([]string, 0, len(b.sites))
+		for _, s := range b.sites {
+			names = append(names, s.Name)
+		}
+		return ChatReply{Text: fmt.Sprintf("Unknown site %q. Known sites: %s.", name, strings.Join(names, ", "))}
+	}
+	return b.nightReply(ctx, site.Name, site.Lat, site.Lon)
+}
+
+// nightReply summarises the next night at a location with its hourly table
+func (b *Bot) nightReply(ctx context.Context, name string, lat, lon float64) ChatReply {
+	points, err := b.forecast(ctx, lat, lon)
+	if err != nil {
+		slog.ErrorContext(ctx, "bot forecast", "location", name, "error", err)
+		return ChatReply{Text: "Unable to fetch the forecast, try again later."}
+	}
+	night, ok := points.Nights(MaxCloudCover, MaxWindSpeed).Next(b.now())
+	if !ok {
+		return ChatReply{Text: fmt.Sprintf("%s: no dark hours in the forecast.", name)}
+	}
+	opts := PrintOptions{}
+	return ChatReply{
+		Text: fmt.Sprintf("%s – %s: %s night\n%s", name, night.Date.Format("Monday, January 2"), night.Verdict(), night.Summary(opts)),
+		Code: night.Points.PrintWithOptions(opts),
+	}
+}
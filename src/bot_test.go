@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBot() *Bot {
+	b := newBot(nil, []Site{{Name: "home", Lat: 50.45, Lon: 30.52}, {Name: "club", Lat: 49.84, Lon: 24.03}}, "club")
+	b.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	b.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) {
+		if lat == 49.84 {
+			return feedTestPoints(90), nil
+		}
+		return nil, errors.New("unexpected location")
+	}
+	b.suggest = func(ctx context.Context, query string) ([]Suggestion, error) {
+		if query == "Lviv" {
+			return []Suggestion{{Name: "Lviv", Admin1: "Lviv Oblast", Country: "Ukraine", Lat: 49.84, Lon: 24.03}}, nil
+		}
+		return nil, nil
+	}
+	return b
+}
+
+func TestParseBotCommand(t *testing.T) {
+	for _, tt := range []struct{ text, command, arg string }{
+		{"/forecast Kyiv", "forecast", "Kyiv"},
+		{"  /Forecast@aweather_bot   New York ", "forecast", "New York"},
+		{"/tonight", "tonight", ""},
+		{"hello /forecast", "", ""},
+	} {
+		command, arg := parseBotCommand(tt.text)
+		if command != tt.command || arg != tt.arg {
+			t.Errorf("parseBotCommand(%q) = %q, %q", tt.text, command, arg)
+		}
+	}
+}
+
+func TestBot_Forecast(t *testing.T) {
+	b := newTestBot()
+	reply, ok := b.handle(context.Background(), ChatMessage{Text: "/forecast Lviv"})
+	if !ok {
+		t.Fatalf("expected a reply")
+	}
+	if !strings.HasPrefix(reply.Text, "Lviv, Lviv Oblast, Ukraine – Friday, March 1: good night") || !strings.Contains(reply.Text, "best window 19:00 – 05:00 (10h)") {
+		t.Errorf("unexpected text %q", reply.Text)
+	}
+	if !strings.Contains(reply.Code, "hour | ok?") || !strings.Contains(reply.Code, "March 2 - Saturday") {
+		t.Errorf("expected the night's table, got %q", reply.Code)
+	}
+
+	if reply, _ := b.handle(context.Background(), ChatMessage{Text: "/forecast Atlantis"}); !strings.Contains(reply.Text, "No location found") {
+		t.Errorf("unexpected reply %q", reply.Text)
+	}
+	if reply, _ := b.handle(context.Background(), ChatMessage{Text: "/forecast"}); !strings.HasPrefix(reply.Text, "Usage") {
+		t.Errorf("unexpected reply %q", reply.Text)
+	}
+}
+
+func TestBot_Tonight(t *testing.T) {
+	b := newTestBot()
+	if reply, _ := b.handle(context.Background(), ChatMessage{Text: "/tonight"}); !strings.HasPrefix(reply.Text, "club – Friday, March 1") || reply.Code == "" {
+		t.Errorf("expected the club site by default, got %+v", reply)
+	}
+	if reply, _ := b.handle(context.Background(), ChatMessage{Text: "/tonight home"}); !strings.Contains(reply.Text, "Unable to fetch") {
+		t.Errorf("expected fetch error for home, got %q", reply.Text)
+	}
+	if reply, _ := b.handle(context.Background(), ChatMessage{Text: "/tonight mars"}); !strings.Contains(reply.Text, "Known sites: home, club") {
+		t.Errorf("unexpected reply %q", reply.Text)
+	}
+	if _, ok := b.handle(context.Background(), ChatMessage{Text: "clear skies everyone"}); ok {
+		t.Errorf("expected plain messages to be ignored")
+	}
+}
+
+func TestBotsFromConfig(t *testing.T) {
+	cfg := defaultConfig()
+	sites := []Site{{Name: "club", Lat: 49.84, Lon: 24.03}}
+	if bots, err := botsFromConfig(cfg, sites); err != nil || len(bots) != 0 {
+		t.Fatalf("expected no bots, got %v, %v", bots, err)
+	}
+
+	cfg.TelegramToken = "123:abc"
+	cfg.TelegramAPI = "http://127.0.0.1:9999/"
+	bots, err := botsFromConfig(cfg, sites)
+	if err != nil || len(bots) != 1 || bots[0].provider.(*Telegram).endpoint != "http://127.0.0.1:9999" {
+		t.Fatalf("unexpected bots %v, %v", bots, err)
+	}
+
+	cfg.BotSite = "mars"
+	if _, err := botsFromConfig(cfg, sites); err == nil {
+		t.Errorf("expected error for unknown bot_site")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+// Cache stores payloads by key. Entries expire on their own once they are older than the
+// TTL the backend was opened with; Get returns an error for missing and expired keys alike.
+type Cache interface {
+	Get(key string) ([]byte, error)
+	Set(key string, entry []byte) error
+	Delete(key string) error
+}
+
+var cache Cache
+
+var errCacheMiss = errors.New("cache miss")
+
+// cacheFromConfig opens the cache backend named by the cache setting:
+//
+//	memory (default)                 bigcache in this process
+//	redis://[user:pass@]host[/db]    a Redis server shared between instances; rediss:// for TLS
+//	file:///path/to/dir              one file per entry, kept across runs
+//
+// Forecasts are kept for cache_stale_ttl, to be served while Open-Meteo is down.
+func cacheFromConfig(cfg Config) (Cache, error) {
+	raw, ttl := cfg.Cache, cfg.CacheStaleTTL
+	if raw == "" || raw == "memory" {
+		return newMemoryCache(ttl, cfg.CacheSizeMB)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("cache: %w", err)
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		return newRedisCache(u, ttl)
+	case "file":
+		if u.Path == "" {
+			return nil, fmt.Errorf("cache: %q has no directory", raw)
+		}
+		return newDiskCache(u.Path, ttl)
+	default:
+		return nil, fmt.Errorf("cache must be memory, a redis:// or a file:// URL, got %q", raw)
+	}
+}
+
+// newMemoryCache keeps entries in this process, bounded to sizeMB
+func newMemoryCache(ttl time.Duration, sizeMB int) (*bigcache.BigCache, error) {
+	config := bigcache.DefaultConfig(ttl)
+	config.MaxEntrySize = 128 * 1024 // bytes; weather payloads can be large
+	config.HardMaxCacheSize = sizeMB // keeps memory bounded on Cloud Run
+	return bigcache.New(context.Background(), config)
+}
+
+// Cached forecasts outlive CacheTTL so that an old copy can be served while Open-Meteo is down.
+// Such entries start with cacheEntryMagic and the time they were fetched.
+const cacheEntryMagic = "\x00aw1"
+
+// encodeCacheEntry prefixes a payload with the time it was fetched
+func encodeCacheEntry(data []byte, fetchedAt time.Time) []byte {
+	out := make([]byte, 0, len(cacheEntryMagic)+8+len(data))
+	out = append(out, cacheEntryMagic...)
+	out = binary.BigEndian.AppendUint64(out, uint64(fetchedAt.UnixNano()))
+	return append(out, data...)
+}
+
+// decodeCacheEntry splits an entry into its payload and fetch time. Entries stored without
+// a timestamp have a zero time.
+func decodeCacheEntry(raw []byte) ([]byte, time.Time) {
+	header := len(cacheEntryMagic) + 8
+	if len(raw) < header || !bytes.HasPrefix(raw, []byte(cacheEntryMagic)) {
+		return raw, time.Time{}
+	}
+	fetchedAt := time.Unix(0, int64(binary.BigEndian.Uint64(raw[len(cacheEntryMagic):header])))
+	return raw[header:], fetchedAt
+}
+
+// Freshness tells how old the upstream data behind a response is
+type Freshness struct {
+	FetchedAt time.Time // zero when unknown
+	Stale     bool      // Open-Meteo failed and an expired copy was served instead
+	Digest    string    // hash of the Open-Meteo payload, which identifies the forecast in ETags
+}
+
+// Age is the time since the data was fetched from Open-Meteo, or 0 when unknown
+func (f Freshness) Age(now time.Time) time.Duration {
+	if f.FetchedAt.IsZero() || now.Before(f.FetchedAt) {
+		return 0
+	}
+	return now.Sub(f.FetchedAt)
+}
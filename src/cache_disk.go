@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskCache keeps one file per entry in a directory, so that short-lived processes such as
+// command line runs start warm. Files older than the TTL are removed when they are read.
+type diskCache struct {
+	dir string
+	ttl time.Duration
+}
+
+func newDiskCache(dir string, ttl time.Duration) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create cache directory: %w", err)
+	}
+	return &diskCache{dir: dir, ttl: ttl}, nil
+}
+
+// path names the file for a key; keys hold coordinates and queries, so they are hashed
+func (c *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+func (c *diskCache) Get(key string) ([]byte, error) {
+	path := c.path(key)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errCacheMiss
+	}
+	if time.Since(info.ModTime()) >= c.ttl {
+		os.Remove(path)
+		return nil, errCacheMiss
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errCacheMiss
+	}
+	return data, nil
+}
+
+// Set writes the entry to a temporary file first, so that readers never see half of it
+func (c *diskCache) Set(key string, entry []byte) error {
+	f, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(entry); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), c.path(key)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (c *diskCache) Delete(key string) error {
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir() + "/cache"
+	c, err := newDiskCache(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("weather:1,2:x"); err != errCacheMiss {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	if err := c.Set("weather:1,2:x", []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new process reading the same directory finds the entry
+	c, err = newDiskCache(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get("weather:1,2:x")
+	if err != nil || string(got) != "payload" {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || len(entries[0].Name()) != 64 {
+		t.Errorf("unexpected files: %v", entries)
+	}
+
+	// Entries older than the TTL are gone
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(c.path("weather:1,2:x"), old, old)
+	if _, err := c.Get("weather:1,2:x"); err != errCacheMiss {
+		t.Errorf("expected an expired entry to miss, got %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the expired file to be removed, got %v", entries)
+	}
+
+	if err := c.Set("geo:x", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("geo:x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("geo:x"); err != nil {
+		t.Errorf("deleting a missing entry: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	redisKeyPrefix = "aweather:" // keeps our keys apart on a shared server
+	redisTimeout   = 2 * time.Second
+	redisMaxIdle   = 8 // connections kept open between commands
+)
+
+// redisCache shares cached entries between instances through a Redis server. It speaks just
+// enough RESP for AUTH, SELECT, GET, SET and DEL.
+type redisCache struct {
+	addr      string
+	tlsConfig *tls.Config // nil for plain TCP
+	username  string
+	password  string
+	db        int
+	ttl       time.Duration
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply from the server; the connection stays usable after one
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func newRedisCache(u *url.URL, ttl time.Duration) (*redisCache, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("AWEATHER_CACHE: redis URL has no host")
+	}
+	c := &redisCache{addr: u.Host, ttl: ttl}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		c.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+		// redis://:password@host is the usual form without ACL users
+		if _, ok := u.User.Password(); !ok {
+			c.username, c.password = "", c.username
+		}
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("AWEATHER_CACHE: invalid redis database %q", db)
+		}
+		c.db = n
+	}
+	return c, nil
+}
+
+func (c *redisCache) Get(key string) ([]byte, error) {
+	reply, err := c.do("GET", redisKeyPrefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, errCacheMiss
+	}
+	return reply, nil
+}
+
+func (c *redisCache) Set(key string, entry []byte) error {
+	_, err := c.do("SET", redisKeyPrefix+key, entry, "PX", strconv.FormatInt(c.ttl.Milliseconds(), 10))
+	return err
+}
+
+func (c *redisCache) Delete(key string) error {
+	_, err := c.do("DEL", redisKeyPrefix+key)
+	return err
+}
+
+// do runs one command on a pooled connection and returns its reply; a nil reply is a nil bulk string
+func (c *redisCache) do(args ...any) ([]byte, error) {
+	conn, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.command(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be out of step with the server
+		conn.Close()
+		return nil, err
+	}
+	c.release(conn)
+	return reply, err
+}
+
+func (c *redisCache) conn() (*redisConn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var nc net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		nc, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig)
+	} else {
+		nc, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis dial: %w", err)
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	if c.password != "" {
+		args := []any{"AUTH", c.password}
+		if c.username != "" {
+			args = []any{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.command(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisCache) release(conn *redisConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= redisMaxIdle {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// command writes args as a RESP array of bulk strings and reads the reply
+func (conn *redisConn) command(args ...any) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	var b []byte
+	b = fmt.Appendf(b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var v []byte
+		switch a := arg.(type) {
+		case string:
+			v = []byte(a)
+		case []byte:
+			v = a
+		default:
+			return nil, fmt.Errorf("redis: unsupported argument %T", arg)
+		}
+		b = fmt.Appendf(b, "$%d\r\n", len(v))
+		b = append(b, v...)
+		b = append(b, "\r\n"...)
+	}
+	if _, err := conn.Write(b); err != nil {
+		return nil, fmt.Errorf("redis write: %w", err)
+	}
+	return conn.readReply()
+}
+
+func (conn *redisConn) readReply() ([]byte, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis read: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, data); err != nil {
+			return nil, fmt.Errorf("redis read: %w", err)
+		}
+		return data[:n], nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process Redis server with the commands redisCache uses
+type fakeRedis struct {
+	addr     string
+	password string
+
+	mu       sync.Mutex
+	data     map[string][]byte
+	expires  map[string]time.Time
+	commands [][]string
+	conns    int
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{addr: ln.Addr().String(), password: password, data: map[string][]byte{}, expires: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		reply := f.reply(args, &authed)
+		f.mu.Unlock()
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// reply runs a command, with f.mu held
+func (f *fakeRedis) reply(args []string, authed *bool) string {
+	cmd := strings.ToUpper(args[0])
+	if cmd == "AUTH" {
+		if args[len(args)-1] != f.password {
+			return "-WRONGPASS invalid username-password pair\r\n"
+		}
+		*authed = true
+		return "+OK\r\n"
+	}
+	if !*authed {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		value, ok := f.data[args[1]]
+		if !ok || time.Now().After(f.expires[args[1]]) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "SET":
+		ms, _ := strconv.Atoi(args[4])
+		f.data[args[1]] = []byte(args[2])
+		f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := f.data[args[1]]
+		delete(f.data, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) url(userinfo, path string) *url.URL {
+	u, _ := url.Parse("redis://" + userinfo + f.addr + path)
+	return u
+}
+
+func TestRedisCache(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	c, err := newRedisCache(f.url(":secret@", "/2"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Get("weather:1,2:x"); err != errCacheMiss {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+	entry := []byte("binary\x00\r\npayload")
+	if err := c.Set("weather:1,2:x", entry); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Get("weather:1,2:x")
+	if err != nil || string(got) != string(entry) {
+		t.Fatalf("Get = %q, %v", got, err)
+	}
+	if err := c.Delete("weather:1,2:x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("weather:1,2:x"); err != errCacheMiss {
+		t.Fatalf("expected a miss after Delete, got %v", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns != 1 {
+		t.Errorf("expected the connection to be reused, got %d connections", f.conns)
+	}
+	want := [][]string{
+		{"AUTH", "secret"},
+		{"SELECT", "2"},
+		{"GET", "aweather:weather:1,2:x"},
+		{"SET", "aweather:weather:1,2:x", string(entry), "PX", "3600000"},
+	}
+	for i, cmd := range want {
+		if strings.Join(f.commands[i], " ") != strings.Join(cmd, " ") {
+			t.Errorf("command %d = %q, want %q", i, f.commands[i], cmd)
+		}
+	}
+}
+
+func TestRedisCache_Expiry(t *testing.T) {
+	f := newFakeRedis(t, "")
+	c, err := newRedisCache(f.url("", ""), 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("geo:x", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Get("geo:x"); err != errCacheMiss {
+		t.Errorf("expected the entry to expire, got %v", err)
+	}
+}
+
+func TestRedisCache_Errors(t *testing.T) {
+	f := newFakeRedis(t, "secret")
+	c, err := newRedisCache(f.url(":wrong@", ""), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("geo:x"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("expected the AUTH error, got %v", err)
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	u, _ := url.Parse("redis://" + addr)
+	c, err = newRedisCache(u, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("geo:x"); err == nil {
+		t.Error("expected an error without a server")
+	}
+
+	for _, raw := range []string{"redis://", "redis://host/db"} {
+		u, _ := url.Parse(raw)
+		if _, err := newRedisCache(u, time.Hour); err == nil {
+			t.Errorf("expected an error for %q", raw)
+		}
+	}
+}
+
+// Instances sharing a Redis cache share the forecasts they fetch
+func TestRedisCache_SharedBetweenInstances(t *testing.T) {
+	f := newFakeRedis(t, "")
+	calls := 0
+	payload := fakeForecastJSON(time.Now().UTC().Truncate(24*time.Hour), 72, func(int) int64 { return 0 })
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write(payload)
+	}))
+	defer upstream.Close()
+	original, originalCache := OpenMeteoAPIEndpoint, cache
+	OpenMeteoAPIEndpoint = upstream.URL + "?"
+	defer func() { OpenMeteoAPIEndpoint, cache = original, originalCache }()
+
+	for i := 0; i < 2; i++ {
+		// A new client stands for another instance
+		c, err := newRedisCache(f.url("", ""), CacheStaleTTL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache = c
+		rec := httptest.NewRecorder()
+		handleWeather(rec, httptest.NewRequest(http.MethodGet, "/weather?lat=50.45&lon=30.52", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+	if calls != 1 {
+		t.Errorf("upstream calls = %d, want 1", calls)
+	}
+}
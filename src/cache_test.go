@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheEntry(t *testing.T) {
+	fetchedAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	data, got := decodeCacheEntry(encodeCacheEntry([]byte(`{"latitude":1}`), fetchedAt))
+	if string(data) != `{"latitude":1}` || !got.Equal(fetchedAt) {
+		t.Errorf("round trip = %q, %v", data, got)
+	}
+
+	// Entries stored without a timestamp are returned as they are
+	for _, raw := range [][]byte{[]byte(`{"latitude":1}`), []byte("\x00aw1"), nil} {
+		data, got := decodeCacheEntry(raw)
+		if !bytes.Equal(data, raw) || !got.IsZero() {
+			t.Errorf("decodeCacheEntry(%q) = %q, %v", raw, data, got)
+		}
+	}
+
+	f := Freshness{FetchedAt: fetchedAt}
+	if age := f.Age(fetchedAt.Add(90 * time.Second)); age != 90*time.Second {
+		t.Errorf("age = %v", age)
+	}
+	if age := (Freshness{}).Age(time.Now()); age != 0 {
+		t.Errorf("unknown age = %v", age)
+	}
+}
+
+func TestCacheFromConfig(t *testing.T) {
+	cfg := defaultConfig()
+	for _, tt := range []struct {
+		value string
+		want  string
+	}{
+		{"", "*bigcache.BigCache"},
+		{"memory", "*bigcache.BigCache"},
+		{"redis://:secret@cache.internal/1", "*main.redisCache"},
+		{"rediss://cache.internal:6380", "*main.redisCache"},
+		{"file://" + t.TempDir(), "*main.diskCache"},
+	} {
+		cfg.Cache = tt.value
+		c, err := cacheFromConfig(cfg)
+		if err != nil {
+			t.Errorf("%q: %v", tt.value, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", c); got != tt.want {
+			t.Errorf("%q opened %s, want %s", tt.value, got, tt.want)
+		}
+	}
+
+	for _, value := range []string{"memcached://cache:11211", "file://", "redis:///0"} {
+		cfg.Cache = value
+		if _, err := cacheFromConfig(cfg); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+// seedForecast caches a forecast for the coordinates as if it had been fetched age ago
+func seedForecast(t *testing.T, lat, lon float64, age time.Duration) {
+	t.Helper()
+	now := time.Now().UTC()
+	payload := fakeForecastJSON(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), 72, func(int) int64 { return 0 })
+	key := "weather:" + float64ToString(lat) + "," + float64ToString(lon) + ":" + OpenMeteoAPIParams
+	if err := cache.Set(key, encodeCacheEntry(payload, time.Now().Add(-age))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingUpstream stands in for Open-Meteo, answering with status and counting the calls
+func countingUpstream(t *testing.T, status int) *atomic.Int32 {
+	t.Helper()
+	var calls atomic.Int32
+	now := time.Now().UTC()
+	payload := fakeForecastJSON(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), 72, func(int) int64 { return 0 })
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write(payload)
+		}
+	}))
+	original := OpenMeteoAPIEndpoint
+	OpenMeteoAPIEndpoint = upstream.URL + "?"
+	t.Cleanup(func() {
+		OpenMeteoAPIEndpoint = original
+		upstream.Close()
+	})
+	return &calls
+}
+
+func TestHandleWeather_Freshness(t *testing.T) {
+	tests := []struct {
+		name      string
+		age       time.Duration
+		status    int
+		wantCalls int32
+		wantAge   time.Duration // approximate
+		wantStale bool
+	}{
+		{"fresh entry", 2 * time.Minute, http.StatusOK, 0, 2 * time.Minute, false},
+		{"expired entry is refetched", 2 * time.Hour, http.StatusOK, 1, 0, false},
+		{"expired entry served while Open-Meteo fails", 2 * time.Hour, http.StatusInternalServerError, 3, 2 * time.Hour, true}, // with retries
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupCache()
+			calls := countingUpstream(t, tt.status)
+			seedForecast(t, 50.45, 30.52, tt.age)
+
+			rec := httptest.NewRecorder()
+			handleWeather(rec, httptest.NewRequest(http.MethodGet, "/weather?lat=50.45&lon=30.52", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstream calls = %d, want %d", got, tt.wantCalls)
+			}
+			age, err := strconv.Atoi(rec.Header().Get("Age"))
+			if err != nil || (time.Duration(age)*time.Second-tt.wantAge).Abs() > 5*time.Second {
+				t.Errorf("Age = %q, want about %v", rec.Header().Get("Age"), tt.wantAge)
+			}
+			if stale := rec.Header().Get("X-Forecast-Stale") == "1"; stale != tt.wantStale {
+				t.Errorf("stale = %v, want %v", stale, tt.wantStale)
+			}
+		})
+	}
+}
+
+func TestHandleWeather_NothingCached(t *testing.T) {
+	setupCache()
+	countingUpstream(t, http.StatusInternalServerError)
+
+	rec := httptest.NewRecorder()
+	handleWeather(rec, httptest.NewRequest(http.MethodGet, "/weather?lat=50.45&lon=30.52", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestFetchData_RefreshesInBackground(t *testing.T) {
+	setupCache()
+	calls := countingUpstream(t, http.StatusOK)
+	seedForecast(t, 50.45, 30.52, CacheTTL+time.Minute)
+
+	var response OpenMeteoAPIResponse
+	if err := response.FetchData(context.Background(), OpenMeteoAPIEndpoint, OpenMeteoAPIParams, float64ToString(50.45), float64ToString(30.52)); err != nil {
+		t.Fatal(err)
+	}
+	if age := response.Freshness.Age(time.Now()); age < CacheTTL || response.Freshness.Stale {
+		t.Errorf("expected the cached forecast, got %+v", response.Freshness)
+	}
+
+	// The cached entry is replaced by the one fetched in the background
+	deadline := time.Now().Add(5 * time.Second)
+	key := "weather:" + float64ToString(50.45) + "," + float64ToString(30.52) + ":" + OpenMeteoAPIParams
+	for {
+		raw, _ := cache.Get(key)
+		if _, fetchedAt := decodeCacheEntry(raw); time.Since(fetchedAt) < time.Minute {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("forecast was not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream calls = %d, want 1", got)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Chart geometry (SVG user units)
+const (
+	chartWidth        = 760
+	chartMarginLeft   = 44
+	chartMarginRight  = 16
+	chartMarginTop    = 22
+	chartPanelGap     = 22
+	chartCloudHeight  = 120
+	chartWindHeight   = 80
+	chartSeeingHeight = 60
+	chartAxisHeight   = 20
+	chartLegendHeight = 18
+	chartMaxSeeing    = 5.0 // seeing index is clamped to 0.5–5.0
+)
+
+// chartPanel is a horizontal band of the chart with its own y scale
+type chartPanel struct {
+	top, height float64
+	min, max    float64
+}
+
+func (p chartPanel) y(v float64) float64 {
+	if p.max == p.min {
+		return p.top + p.height
+	}
+	v = math.Max(p.min, math.Min(p.max, v))
+	return p.top + p.height - (v-p.min)/(p.max-p.min)*p.height
+}
+
+func (p chartPanel) bottom() float64 {
+	return p.top + p.height
+}
+
+// renderChart draws cloud layers, wind and seeing over time as an SVG image.
+// Dark hours are shaded, and dark hours with the Moon up get a lighter tint.
+// Output depends only on the points and options, so it can be covered by golden files.
+func renderChart(points DataPoints, opts PrintOptions) []byte {
+	maxCloud, maxWind := opts.thresholds()
+	windUnit := "km/h"
+	windFactor := 1.0
+	if strings.ToLower(strings.TrimSpace(opts.WindSpeedUnit)) == "mph" {
+		windUnit = "mph"
+		windFactor = 1 / 1.609344
+	}
+
+	plotWidth := float64(chartWidth - chartMarginLeft - chartMarginRight)
+	clouds := chartPanel{top: chartMarginTop, height: chartCloudHeight, min: 0, max: 100}
+	wind := chartPanel{top: clouds.bottom() + chartPanelGap, height: chartWindHeight}
+	seeing := chartPanel{top: wind.bottom() + chartPanelGap, height: chartSeeingHeight, min: 0, max: chartMaxSeeing}
+	height := seeing.bottom() + chartAxisHeight + chartLegendHeight
+
+	// Wind scale: fit the strongest gust and the threshold, rounded up to 10
+	windMax := maxWind * 1.5
+	for _, p := range points {
+		windMax = math.Max(windMax, p.WindGusts)
+	}
+	wind.max = math.Ceil(windMax*windFactor/10) * 10
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%.0f" viewBox="0 0 %d %.0f" font-family="ui-monospace, Menlo, Consolas, monospace" font-size="10">`+"\n", chartWidth, height, chartWidth, height)
+	fmt.Fprintf(&b, `<rect x="0" y="0" width="%d" height="%.0f" fill="#ffffff"/>`+"\n", chartWidth, height)
+
+	if len(points) == 0 {
+		fmt.Fprintf(&b, `<text x="%d" y="%.0f" text-anchor="middle" fill="#64748b">no forecast data</text>`+"\n", chartWidth/2, height/2)
+		b.WriteString("</svg>\n")
+		return []byte(b.String())
+	}
+
+	step := plotWidth / float64(len(points))
+	x := func(i int) float64 { return chartMarginLeft + float64(i)*step }
+	cx := func(i int) float64 { return x(i) + step/2 }
+	top, bottom := clouds.top, seeing.bottom()
+
+	// Darkness and Moon-up shading, merged into runs of consecutive hours
+	shade := func(match func(DataPoint) bool, fill, opacity string) {
+		for i := 0; i < len(points); {
+			if !match(points[i]) {
+				i++
+				continue
+			}
+			j := i
+			for j < len(points) && match(points[j]) {
+				j++
+			}
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s" fill-opacity="%s"/>`+"\n", x(i), top, x(j)-x(i), bottom-top, fill, opacity)
+			i = j
+		}
+	}
+	shade(func(p DataPoint) bool { return p.Dark }, "#1e293b", "0.14")
+	shade(func(p DataPoint) bool { return p.Dark && p.MoonUp }, "#facc15", "0.22")
+
+	// Day separators and labels
+	for i, p := range points {
+		if i == 0 || p.Time.Day() != points[i-1].Time.Day() {
+			fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#cbd5e1"/>`+"\n", x(i), top-12, x(i), bottom)
+			fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" fill="#334155">%s</text>`+"\n", x(i)+3, top-4, p.Time.Format("Mon Jan 2"))
+		}
+	}
+
+	// Panel frames, titles and y labels
+	panel := func(p chartPanel, title, unit string, ticks []float64) {
+		fmt.Fprintf(&b, `<rect x="%d" y="%.1f" width="%.1f" height="%.1f" fill="none" stroke="#e5e7eb"/>`+"\n", chartMarginLeft, p.top, plotWidth, p.height)
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" fill="#0f172a" font-weight="bold">%s</text>`+"\n", chartMarginLeft+4, p.top+11, title)
+		for _, t := range ticks {
+			fmt.Fprintf(&b, `<text x="%d" y="%.1f" fill="#64748b" text-anchor="end">%s</text>`+"\n", chartMarginLeft-4, p.y(t)+3, formatTick(t)+unit)
+		}
+	}
+	panel(clouds, "cloud", "%", []float64{0, 50, 100})
+	panel(wind, "wind", "", []float64{0, wind.max / 2, wind.max})
+	panel(seeing, "seeing", "", []float64{1, 3, 5})
+
+	// Threshold lines
+	threshold := func(p chartPanel, v float64) {
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#dc2626" stroke-dasharray="4 3" stroke-opacity="0.6"/>`+"\n", chartMarginLeft, p.y(v), chartMarginLeft+plotWidth, p.y(v))
+	}
+	threshold(clouds, float64(maxCloud))
+	threshold(wind, maxWind*windFactor)
+
+	// Series
+	series := func(p chartPanel, value func(DataPoint) float64, color, dash string) {
+		coords := make([]string, 0, len(points))
+		for i, pt := range points {
+			coords = append(coords, fmt.Sprintf("%.1f,%.1f", cx(i), p.y(value(pt))))
+		}
+		extra := ""
+		if dash != "" {
+			extra = fmt.Sprintf(` stroke-dasharray="%s"`, dash)
+		}
+		fmt.Fprintf(&b, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"%s/>`+"\n", strings.Join(coords, " "), color, extra)
+	}
+	series(clouds, func(p DataPoint) float64 { return float64(p.HighClouds) }, "#94a3b8", "")
+	series(clouds, func(p DataPoint) float64 { return float64(p.MidClouds) }, "#64748b", "")
+	series(clouds, func(p DataPoint) float64 { return float64(p.LowClouds) }, "#334155", "")
+	series(wind, func(p DataPoint) float64 { return p.WindGusts * windFactor }, "#93c5fd", "3 2")
+	series(wind, func(p DataPoint) float64 { return p.WindSpeed * windFactor }, "#2563eb", "")
+	series(seeing, func(p DataPoint) float64 { return p.Seeing }, "#7c3aed", "")
+
+	// "ok" hours as a strip under the cloud panel
+	for i, p := range points {
+		if p.isGood(maxCloud, maxWind) {
+			fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="%.1f" height="4" fill="#16a34a"/>`+"\n", x(i), clouds.bottom()+2, step)
+		}
+	}
+
+	// Hour ticks every 6 hours
+	for i, p := range points {
+		if p.Time.Hour()%6 != 0 {
+			continue
+		}
+		label := p.Time.Format("15")
+		if opts.Use12Hour {
+			label = p.Time.Format("3pm")
+		}
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" fill="#64748b" text-anchor="middle">%s</text>`+"\n", x(i), bottom+13, label)
+	}
+
+	// Legend
+	legend := []struct{ color, label string }{
+		{"#334155", "low"}, {"#64748b", "mid"}, {"#94a3b8", "high"},
+		{"#2563eb", "wind " + windUnit}, {"#93c5fd", "gusts"}, {"#7c3aed", "seeing"},
+		{"#16a34a", "ok"}, {"#facc15", "moon up"},
+	}
+	lx, ly := float64(chartMarginLeft), bottom+chartAxisHeight+8
+	for _, item := range legend {
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%.1f" width="8" height="8" fill="%s"/>`+"\n", lx, ly-8, item.color)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%.1f" fill="#334155">%s</text>`+"\n", lx+11, ly, item.label)
+		lx += float64(len(item.label)*6 + 24)
+	}
+
+	b.WriteString("</svg>\n")
+	return []byte(b.String())
+}
+
+// formatTick prints axis values without trailing zeros
+func formatTick(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.1f", v)
+}
+
+func handleChart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	lat, lon, ok := parseCoordinates(q.Get("lat"), q.Get("lon"))
+	if !ok {
+		http.Error(w, "Valid latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+
+	points, freshness, err := fetchForecastFreshness(r.Context(), lat, lon)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching weather from Open-Meteo", "error", err)
+		http.Error(w, "Upstream weather service unavailable", http.StatusBadGateway)
+		return
+	}
+	now := time.Now()
+	if setForecastCaching(w, r, freshness, hourVariant(now)) {
+		return
+	}
+	if points, err = withAstronomy(r.Context(), points, freshness); err != nil {
+		forecastCancelled(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	if _, err := w.Write(renderChart(points.upcoming(now), parsePrintOptions(q))); err != nil {
+		slog.ErrorContext(r.Context(), "writing chart", "error", err)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// chartTestPoints returns two days of synthetic hourly data with fixed darkness and Moon flags
+func chartTestPoints() DataPoints {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	points := DataPoints{}
+	for i := 0; i < 48; i++ {
+		t := start.Add(time.Duration(i) * time.Hour)
+		hour := t.Hour()
+		points = append(points, DataPoint{
+			Time:       t,
+			LowClouds:  int64((i * 7) % 100),
+			MidClouds:  int64((i * 13) % 60),
+			HighClouds: int64((i * 3) % 40),
+			WindSpeed:  float64(i%20) + 0.5,
+			WindGusts:  float64(i%20)*1.5 + 2,
+			Seeing:     0.5 + float64(i%9)*0.5,
+			Dark:       hour >= 20 || hour < 5,
+			MoonUp:     hour >= 23 || hour < 2,
+		})
+	}
+	return points
+}
+
+func TestRenderChart_Golden(t *testing.T) {
+	cases := []struct {
+		name string
+		opts PrintOptions
+	}{
+		{"chart_default", PrintOptions{}},
+		{"chart_mph_12h", PrintOptions{WindSpeedUnit: "mph", Use12Hour: true, MaxCloudCover: 40}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := renderChart(chartTestPoints(), tc.opts)
+			path := filepath.Join("testdata", tc.name+".golden.svg")
+			if *updateGolden {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatalf("write golden: %v", err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read golden (run with -update to create): %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("chart differs from %s; run go test -run TestRenderChart_Golden -update to accept", path)
+			}
+		})
+	}
+}
+
+func TestRenderChart_Deterministic(t *testing.T) {
+	a := renderChart(chartTestPoints(), PrintOptions{})
+	b := renderChart(chartTestPoints(), PrintOptions{})
+	if !bytes.Equal(a, b) {
+		t.Fatal("expected identical output for identical input")
+	}
+	// Must be well-formed XML
+	dec := xml.NewDecoder(bytes.NewReader(a))
+	for {
+		if _, err := dec.Token(); err != nil {
+			if err.Error() == "EOF" {
+				break
+			}
+			t.Fatalf("invalid SVG: %v", err)
+		}
+	}
+}
+
+func TestRenderChart_Empty(t *testing.T) {
+	out := string(renderChart(DataPoints{}, PrintOptions{}))
+	if !strings.Contains(out, "no forecast data") {
+		t.Fatalf("expected placeholder text, got: %s", out)
+	}
+}
+
+func TestHandleChart(t *testing.T) {
+	setupCache()
+	fakeForecastServer(t, func(i int) int64 { return int64(i % 100) })
+
+	req := httptest.NewRequest(http.MethodGet, "/chart.svg?lat=50.45&lon=30.52", nil)
+	rec := httptest.NewRecorder()
+	handleChart(rec, req)
+
+	res := rec.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "image/svg+xml" {
+		t.Fatalf("expected image/svg+xml, got %s", ct)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "<svg") {
+		t.Fatalf("expected SVG body, got: %.80s", rec.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/chart.svg?lat=abc", nil)
+	rec = httptest.NewRecorder()
+	handleChart(rec, req)
+	if rec.Result().StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for invalid coordinates, got %d", rec.Result().StatusCode)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// upstreamCalls coalesces Open-Meteo requests by cache key, so that an expired popular entry
+// costs one upstream call however many requests miss it at once
+var upstreamCalls = &flightGroup{}
+
+// coalesceUpstream fetches the payload for a cache key through upstreamCalls. fetch gets a
+// context that is cancelled once every caller waiting for it has given up.
+func coalesceUpstream(ctx context.Context, key string, fetch func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	data, err, shared := upstreamCalls.Do(ctx, key, fetch)
+	if shared {
+		upstreamCoalesced.Inc(cacheSpace(key))
+		slog.DebugContext(ctx, "shared an upstream call already in flight", "space", cacheSpace(key))
+	}
+	return data, err
+}
+
+var errFlightAborted = errors.New("coalesced upstream call did not complete")
+
+// flightGroup runs at most one call per key at a time. Callers arriving while a call is in
+// flight wait for it and share its result instead of starting their own.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done    chan struct{}
+	data    []byte
+	err     error
+	callers int // callers still waiting for the result, guarded by flightGroup.mu
+	cancel  context.CancelFunc
+}
+
+// Do runs fn for key, or waits for the call already in flight for it. shared reports
+// whether the result came from another caller's call. fn runs on its own goroutine, so that
+// any caller whose ctx is done stops waiting, the one that started the call included; fn's
+// context is cancelled when no caller is left.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) ([]byte, error)) (data []byte, err error, shared bool) {
+	g.mu.Lock()
+	call, shared := g.calls[key]
+	if shared {
+		call.callers++
+	} else {
+		if g.calls == nil {
+			g.calls = map[string]*flightCall{}
+		}
+		// The call keeps the values of ctx, such as the trace, but not its cancellation
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &flightCall{done: make(chan struct{}), err: errFlightAborted, callers: 1, cancel: cancel}
+		g.calls[key] = call
+		go g.run(callCtx, key, call, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.data, call.err, shared
+	case <-ctx.Done():
+		g.leave(key, call)
+		return nil, ctx.Err(), shared
+	}
+}
+
+// run calls fn and releases the callers waiting for it. They get errFlightAborted if fn panics.
+func (g *flightGroup) run(ctx context.Context, key string, call *flightCall, fn func(ctx context.Context) ([]byte, error)) {
+	defer func() {
+		if p := recover(); p != nil {
+			call.data, call.err = nil, errFlightAborted
+			slog.ErrorContext(ctx, "coalesced upstream call panicked", "panic", p, "stack", string(debug.Stack()))
+		}
+		g.mu.Lock()
+		if g.calls[key] == call {
+			delete(g.calls, key)
+		}
+		g.mu.Unlock()
+		call.cancel()
+		close(call.done)
+	}()
+	call.data, call.err = fn(ctx)
+}
+
+// leave drops a caller that gave up, and cancels the call when it was the last one. Later
+// callers for the key then start a new call rather than join the cancelled one.
+func (g *flightGroup) leave(key string, call *flightCall) {
+	g.mu.Lock()
+	call.callers--
+	last := call.callers == 0
+	if last && g.calls[key] == call {
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	if last {
+		call.cancel()
+	}
+}
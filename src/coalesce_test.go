@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitForCallers blocks until n callers are waiting on the call in flight for key, so that
+// the stub upstream is released only after they all had the chance to start their own call
+func waitForCallers(t *testing.T, g *flightGroup, key string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		call, ok := g.calls[key]
+		waiting := ok && call.callers == n
+		g.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d callers on %q", n, key)
+}
+
+// coalescedCount reads aweather_upstream_coalesced_total for the key space of key
+func coalescedCount(key string) float64 {
+	upstreamCoalesced.mu.Lock()
+	defer upstreamCoalesced.mu.Unlock()
+	return upstreamCoalesced.values[renderLabels([]string{"space"}, []string{cacheSpace(key)})]
+}
+
+func TestFlightGroup(t *testing.T) {
+	g := &flightGroup{}
+	release := make(chan struct{})
+	var calls atomic.Int32
+
+	const n = 10
+	var wg sync.WaitGroup
+	results := make([]string, n)
+	sharedCount := atomic.Int32{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err, shared := g.Do(context.Background(), "key", func(context.Context) ([]byte, error) {
+				calls.Add(1)
+				<-release
+				return []byte("payload"), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			if shared {
+				sharedCount.Add(1)
+			}
+			results[i] = string(data)
+		}(i)
+	}
+	waitForCallers(t, g, "key", n)
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 || sharedCount.Load() != n-1 {
+		t.Errorf("calls = %d, shared = %d", calls.Load(), sharedCount.Load())
+	}
+	for i, r := range results {
+		if r != "payload" {
+			t.Errorf("caller %d got %q", i, r)
+		}
+	}
+
+	// Once done, the next call for the key runs again, and errors are shared as well
+	boom := errors.New("boom")
+	if _, err, shared := g.Do(context.Background(), "key", func(context.Context) ([]byte, error) { return nil, boom }); err != boom || shared {
+		t.Errorf("got %v, shared %v", err, shared)
+	}
+	if len(g.calls) != 0 {
+		t.Errorf("finished calls are kept: %v", g.calls)
+	}
+}
+
+func TestFlightGroup_Panic(t *testing.T) {
+	g := &flightGroup{}
+	started := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		g.Do(context.Background(), "key", func(context.Context) ([]byte, error) {
+			close(started)
+			waitForCallers(t, g, "key", 2)
+			panic("upstream parser bug")
+		})
+	}()
+	<-started
+	if _, err, _ := g.Do(context.Background(), "key", func(context.Context) ([]byte, error) { return nil, nil }); err != errFlightAborted {
+		t.Errorf("waiter got %v, want errFlightAborted", err)
+	}
+}
+
+// The shared call keeps running while any caller waits for it, and is cancelled with the last one
+func TestFlightGroup_Cancel(t *testing.T) {
+	g := &flightGroup{}
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	defer cancelSecond()
+	callCancelled := make(chan struct{})
+	started := make(chan struct{})
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err, _ := g.Do(first, "key", func(ctx context.Context) ([]byte, error) {
+			close(started)
+			<-ctx.Done()
+			close(callCancelled)
+			return nil, ctx.Err()
+		})
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, err, _ := g.Do(second, "key", func(context.Context) ([]byte, error) { return nil, nil })
+		errs <- err
+	}()
+	waitForCallers(t, g, "key", 2)
+
+	cancelFirst()
+	select {
+	case <-callCancelled:
+		t.Fatal("call cancelled while a caller still waits for it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	select {
+	case <-callCancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call not cancelled after every caller left")
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	}
+
+	// A new caller starts a fresh call instead of joining the cancelled one
+	if data, err, shared := g.Do(context.Background(), "key", func(context.Context) ([]byte, error) { return []byte("fresh"), nil }); string(data) != "fresh" || err != nil || shared {
+		t.Errorf("got %q, %v, shared %v", data, err, shared)
+	}
+}
+
+// The caller that started a call stops waiting at its own deadline, like the others do
+func TestFlightGroup_LeaderDeadline(t *testing.T) {
+	g := &flightGroup{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	leaderCtx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	leader := make(chan error, 1)
+	go func() {
+		_, err, _ := g.Do(leaderCtx, "key", func(ctx context.Context) ([]byte, error) {
+			close(started)
+			select {
+			case <-release:
+				return []byte("payload"), nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+		leader <- err
+	}()
+	<-started
+	follower := make(chan []byte, 1)
+	go func() {
+		data, _, _ := g.Do(context.Background(), "key", nil)
+		follower <- data
+	}()
+	waitForCallers(t, g, "key", 2)
+
+	select {
+	case err := <-leader:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("leader got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("leader kept waiting past its deadline")
+	}
+
+	// The call goes on for the follower
+	close(release)
+	if data := <-follower; string(data) != "payload" {
+		t.Errorf("follower got %q", data)
+	}
+}
+
+// TestCoalescing_Handlers sends parallel requests for the same location or query through the
+// handlers and checks that the httptest upstream is hit once per endpoint
+func TestCoalescing_Handlers(t *testing.T) {
+	now := time.Now().UTC()
+	forecast := fakeForecastJSON(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), 72, func(int) int64 { return 0 })
+
+	for _, tt := range []struct {
+		name     string
+		endpoint *string
+		payload  []byte
+		handler  http.HandlerFunc
+		url      string
+		key      string
+	}{
+		{"weather", &OpenMeteoAPIEndpoint, forecast, handleWeather,
+			"/weather?lat=50.45&lon=30.52", "weather:50.450000,30.520000:" + OpenMeteoAPIParams},
+		{"suggestions", &OpenMeteoGeoAPIEndpoint, []byte(`{"results":[{"name":"Kyiv","latitude":50.45,"longitude":30.52}]}`), handleSuggestions,
+			"/suggestions?q=Kyiv", "geo:Kyiv"},
+		{"reverse geocoding", &OpenMeteoGeoReverseAPIEndpoint, []byte(`{"results":[{"name":"Kyiv","latitude":50.45,"longitude":30.52}]}`), handleReverseGeocoding,
+			"/reverse-geocoding?lat=50.45&lon=30.52", "reverse:50.450,30.520"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setupCache()
+			var hits atomic.Int32
+			release := make(chan struct{})
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				<-release
+				w.Write(tt.payload)
+			}))
+			defer upstream.Close()
+			original := *tt.endpoint
+			*tt.endpoint = upstream.URL
+			if tt.endpoint == &OpenMeteoAPIEndpoint {
+				*tt.endpoint += "?"
+			}
+			defer func() { *tt.endpoint = original }()
+
+			const n = 20
+			before := coalescedCount(tt.key)
+			var wg sync.WaitGroup
+			codes := make([]int, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					rec := httptest.NewRecorder()
+					tt.handler(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+					codes[i] = rec.Code
+				}(i)
+			}
+			waitForCallers(t, upstreamCalls, tt.key, n)
+			close(release)
+			wg.Wait()
+
+			if got := hits.Load(); got != 1 {
+				t.Errorf("upstream hits = %d, want 1", got)
+			}
+			for i, code := range codes {
+				if code != http.StatusOK {
+					t.Errorf("request %d: status %d", i, code)
+				}
+			}
+			if after := coalescedCount(tt.key); after-before != n-1 {
+				t.Errorf("coalesced counter grew by %v, want %d", after-before, n-1)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Responses shorter than this are sent as they are: compressing them saves little and costs a
+// round of CPU on every request
+const minCompressSize = 1024
+
+// encoder is the part of gzip.Writer and brotli.Writer used by compressWriter
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// Encoders keep large internal buffers, so they are reused across responses
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() any { return brotli.NewWriterLevel(nil, 5) }},
+	"gzip": {New: func() any {
+		zw, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return zw
+	}},
+}
+
+// withCompression compresses text responses with brotli or gzip, whichever the client prefers
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Byte ranges refer to the uncompressed body, and HEAD has none
+		if r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding"))}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the content coding for an Accept-Encoding header: br or gzip with
+// the highest quality, br on a tie, or "" when the client accepts neither
+func negotiateEncoding(header string) string {
+	quality := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			quality[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, name := range []string{"br", "gzip"} {
+		q, ok := quality[name]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressible tells whether a Content-Type is text worth compressing
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/event-stream":
+		return false // each event has to reach the client as soon as it is written
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until it knows whether the response is
+// worth compressing, then sends it either through an encoder or as it is
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string // "" when the client accepts no supported coding
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.decided || code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status != 0 {
+		return
+	}
+	cw.status = code
+	// These responses have no body to wait for
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		cw.decide()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < minCompressSize {
+			return len(b), nil
+		}
+		if err := cw.decide(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide sends the header and the buffered start of the body
+func (cw *compressWriter) decide() error {
+	cw.decided = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	bodyless := cw.status == http.StatusNoContent || cw.status == http.StatusNotModified
+	if compressible(h.Get("Content-Type")) || bodyless && h.Get("ETag") != "" {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	if cw.encoding != "" && !bodyless && cw.status != http.StatusPartialContent && len(cw.buf) >= minCompressSize &&
+		h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		// The compressed bytes differ from the ones the tag was computed for
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.enc = encoderPools[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what has been written so far, compressed or not
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide()
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close sends a short response as it is, or finishes the compressed stream
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return nil // the handler wrote nothing; the server sends an empty 200 itself
+		}
+		if err := cw.decide(); err != nil {
+			return err
+		}
+	}
+	if cw.enc == nil {
+		return nil
+	}
+	err := cw.enc.Close()
+	cw.enc.Reset(nil)
+	encoderPools[cw.encoding].Put(cw.enc)
+	cw.enc = nil
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                          "",
+		"identity":                  "",
+		"gzip":                      "gzip",
+		"gzip, deflate, br, zstd":   "br",
+		"br;q=0.5, gzip":            "gzip",
+		"BR;q=1.0, gzip;q=1.0":      "br",
+		"*":                         "br",
+		"*;q=0.5, br;q=0":           "gzip",
+		"gzip;q=0, br;q=0":          "",
+		"gzip;q=nonsense, br;q=0.1": "br",
+		" gzip ; q=0.8 , deflate ":  "gzip",
+	} {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+// compressedRequest sends a request with Accept-Encoding to withCompression around h and
+// returns the response with its decoded body
+func compressedRequest(t *testing.T, h http.Handler, method, path, encoding string) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if encoding != "" {
+		req.Header.Set("Accept-Encoding", encoding)
+	}
+	rec := httptest.NewRecorder()
+	withCompression(h).ServeHTTP(rec, req)
+
+	var body io.Reader = rec.Body
+	switch rec.Header().Get("Content-Encoding") {
+	case "gzip":
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = zr
+	case "br":
+		body = brotli.NewReader(rec.Body)
+	}
+	decoded, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec, string(decoded)
+}
+
+func TestWithCompression(t *testing.T) {
+	text := strings.Repeat("22:00  clear  5%  3 km/h\n", 200)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		io.WriteString(w, text[:len(text)/2])
+		io.WriteString(w, text[len(text)/2:])
+	})
+
+	for _, encoding := range []string{"gzip", "br"} {
+		rec, body := compressedRequest(t, h, http.MethodGet, "/weather", encoding)
+		if rec.Header().Get("Content-Encoding") != encoding || body != text {
+			t.Errorf("%s: Content-Encoding %q, body intact %v", encoding, rec.Header().Get("Content-Encoding"), body == text)
+		}
+		if rec.Body.Len() >= len(text)/4 {
+			t.Errorf("%s: %d bytes compressed to %d", encoding, len(text), rec.Body.Len())
+		}
+		if rec.Header().Get("ETag") != `W/"v1"` || rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: headers %v", encoding, rec.Header())
+		}
+	}
+
+	rec, body := compressedRequest(t, h, http.MethodGet, "/weather", "")
+	if rec.Header().Get("Content-Encoding") != "" || body != text || rec.Header().Get("ETag") != `"v1"` {
+		t.Errorf("identity: headers %v", rec.Header())
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Error("identity responses vary by Accept-Encoding as well")
+	}
+}
+
+func TestWithCompression_Skipped(t *testing.T) {
+	large := strings.Repeat("a", 4*minCompressSize)
+	for _, tt := range []struct {
+		name    string
+		method  string
+		handler http.HandlerFunc
+	}{
+		{"small response", http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"nights":[]}`)
+		}},
+		{"image", http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		}},
+		{"already encoded", http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "identity")
+			io.WriteString(w, large)
+		}},
+		{"not modified", http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusNotModified)
+		}},
+		{"HEAD", http.MethodHead, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, large)
+		}},
+	} {
+		rec, _ := compressedRequest(t, tt.handler, tt.method, "/", "gzip, br")
+		if enc := rec.Header().Get("Content-Encoding"); enc == "gzip" || enc == "br" {
+			t.Errorf("%s: compressed with %s", tt.name, enc)
+		}
+		if tt.name == "not modified" && (rec.Code != http.StatusNotModified || rec.Header().Get("ETag") != `"v1"`) {
+			t.Errorf("%s: status %d, headers %v", tt.name, rec.Code, rec.Header())
+		}
+	}
+}
+
+// Static files are compressed too, and the status of a short error is kept
+func TestWithCompression_Static(t *testing.T) {
+	staticRoot, err := fs.Sub(StaticFiles, "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := http.StripPrefix("/static/", http.FileServer(http.FS(staticRoot)))
+
+	var script string
+	fs.WalkDir(staticRoot, ".", func(path string, d fs.DirEntry, err error) error {
+		if info, _ := d.Info(); script == "" && strings.HasSuffix(path, ".js") && info.Size() >= minCompressSize {
+			script = path
+		}
+		return nil
+	})
+	if script == "" {
+		t.Skip("no static script large enough to compress")
+	}
+	want, _ := fs.ReadFile(staticRoot, script)
+
+	rec, body := compressedRequest(t, files, http.MethodGet, "/static/"+script, "br")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "br" || body != string(want) {
+		t.Errorf("%s: status %d, headers %v", script, rec.Code, rec.Header())
+	}
+	if rec.Header().Get("Content-Length") != "" || rec.Header().Get("Accept-Ranges") != "" {
+		t.Errorf("%s: the length and ranges of the uncompressed file are advertised", script)
+	}
+
+	rec, _ = compressedRequest(t, files, http.MethodGet, "/static/missing.js", "gzip")
+	if rec.Code != http.StatusNotFound || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("missing file: status %d, headers %v", rec.Code, rec.Header())
+	}
+}
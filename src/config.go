@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the effective runtime configuration. Every setting is taken from its command-line
+// flag (the name with dashes, e.g. -cache-ttl), else its environment variable, else the config
+// file, else the default below.
+type Config struct {
+	Port              int           `config:"port" env:"AWEATHER_PORT" help:"HTTP port"`
+	ReadTimeout       time.Duration `config:"read_timeout" env:"AWEATHER_READ_TIMEOUT" help:"limit for reading a request, body included"`
+	ReadHeaderTimeout time.Duration `config:"read_header_timeout" env:"AWEATHER_READ_HEADER_TIMEOUT" help:"limit for reading request headers"`
+	IdleTimeout       time.Duration `config:"idle_timeout" env:"AWEATHER_IDLE_TIMEOUT" help:"how long idle keep-alive connections are kept"`
+	RequestTimeout    time.Duration `config:"request_timeout" env:"AWEATHER_REQUEST_TIMEOUT" help:"deadline for handling a request, upstream calls included"`
+	UpstreamTimeout   time.Duration `config:"upstream_timeout" env:"AWEATHER_UPSTREAM_TIMEOUT" help:"limit for each Open-Meteo call, retries included"`
+	LogLevel          string        `config:"log_level" env:"AWEATHER_LOG_LEVEL" help:"debug, info, warn or error"`
+
+	ReadyProbeUpstream bool          `config:"ready_probe_upstream" env:"AWEATHER_READY_PROBE_UPSTREAM" help:"make /readyz fail while Open-Meteo does not answer"`
+	ReadyProbeInterval time.Duration `config:"ready_probe_interval" env:"AWEATHER_READY_PROBE_INTERVAL" help:"how long an upstream probe result is reused"`
+
+	Cache              string        `config:"cache" env:"AWEATHER_CACHE" help:"memory, redis://… or file:///dir"`
+	CacheTTL           time.Duration `config:"cache_ttl" env:"AWEATHER_CACHE_TTL" help:"age until which cached forecasts are used as is"`
+	CacheRevalidateTTL time.Duration `config:"cache_revalidate_ttl" env:"AWEATHER_CACHE_REVALIDATE_TTL" help:"age until which cached forecasts are used while refreshed in the background"`
+	CacheStaleTTL      time.Duration `config:"cache_stale_ttl" env:"AWEATHER_CACHE_STALE_TTL" help:"how long forecasts are kept to serve when Open-Meteo fails"`
+	CacheSizeMB        int           `config:"cache_size_mb" env:"AWEATHER_CACHE_SIZE_MB" help:"size limit of the in-memory cache"`
+
+	ForecastEndpoint         string `config:"forecast_endpoint" env:"AWEATHER_FORECAST_ENDPOINT" help:"Open-Meteo forecast API URL"`
+	GeocodingEndpoint        string `config:"geocoding_endpoint" env:"AWEATHER_GEOCODING_ENDPOINT" help:"Open-Meteo geocoding search URL"`
+	ReverseGeocodingEndpoint string `config:"reverse_geocoding_endpoint" env:"AWEATHER_REVERSE_GEOCODING_ENDPOINT" help:"reverse geocoding URL"`
+	ForecastParams           string `config:"forecast_params" env:"AWEATHER_FORECAST_PARAMS" help:"hourly variables requested from Open-Meteo"`
+	UserAgent                string `config:"user_agent" env:"AWEATHER_USER_AGENT" help:"User-Agent of upstream calls"`
+
+	MaxCloudCover int64   `config:"max_cloud_cover" env:"AWEATHER_MAX_CLOUD_COVER" help:"default cloud cover limit for ok hours, percent"`
+	MaxWindSpeed  float64 `config:"max_wind_speed" env:"AWEATHER_MAX_WIND_SPEED" help:"default wind limit for ok hours, km/h"`
+
+	PublicURL           string        `config:"public_url" env:"AWEATHER_PUBLIC_URL" help:"URL the site is reached at, for links in pages, feeds, emails and notifications"`
+	DB                  string        `config:"db" env:"AWEATHER_DB" help:"database file; enables subscriptions, push, digests and API keys"`
+	Sites               string        `config:"sites" env:"AWEATHER_SITES" help:"named sites, e.g. home=50.45,30.52; club=49.84,24.03"`
+	SchedulerInterval   time.Duration `config:"scheduler_interval" env:"AWEATHER_SCHEDULER_INTERVAL" help:"time between subscription checks"`
+	MaxSubscriptions    int           `config:"max_subscriptions" env:"AWEATHER_MAX_SUBSCRIPTIONS" help:"most webhook, push and digest subscriptions kept of each kind, 0 for no limit"`
+	MetricsSites        bool          `config:"metrics_sites" env:"AWEATHER_METRICS_SITES" help:"export forecast gauges for the sites"`
+	WebhookAllowPrivate bool          `config:"webhook_allow_private" env:"AWEATHER_WEBHOOK_ALLOW_PRIVATE" help:"allow webhooks and push endpoints on private addresses"`
+	APIKeysRequired     bool          `config:"api_keys_required" env:"AWEATHER_API_KEYS_REQUIRED" help:"reject /api/* requests without a key"`
+	AdminToken          string        `config:"admin_token" env:"AWEATHER_ADMIN_TOKEN" secret:"true" help:"bearer token of the /admin/* API"`
+	AdminAddr           string        `config:"admin_addr" env:"AWEATHER_ADMIN_ADDR" help:"listen address of the /admin/* API, kept off the public port"`
+	RateLimits          string        `config:"rate_limits" env:"AWEATHER_RATE_LIMITS" help:"per-client limits over the defaults, or off"`
+	TrustedProxies      string        `config:"trusted_proxies" env:"AWEATHER_TRUSTED_PROXIES" help:"proxies whose X-Forwarded-For is believed"`
+	RateLimitAllow      string        `config:"rate_limit_allow" env:"AWEATHER_RATE_LIMIT_ALLOW" help:"clients that are never rate limited"`
+
+	AlpacaPort    int           `config:"alpaca_port" env:"AWEATHER_ALPACA_PORT" help:"ASCOM Alpaca port, 0 to disable"`
+	IndiPort      int           `config:"indi_port" env:"AWEATHER_INDI_PORT" help:"INDI port, 0 to disable"`
+	MQTTBroker    string        `config:"mqtt_broker" env:"AWEATHER_MQTT_BROKER" help:"MQTT broker to publish the sites to"`
+	MQTTInterval  time.Duration `config:"mqtt_interval" env:"AWEATHER_MQTT_INTERVAL" help:"time between MQTT publishes"`
+	MQTTUsername  string        `config:"mqtt_username" env:"AWEATHER_MQTT_USERNAME"`
+	MQTTPassword  string        `config:"mqtt_password" env:"AWEATHER_MQTT_PASSWORD" secret:"true"`
+	MQTTClientID  string        `config:"mqtt_client_id" env:"AWEATHER_MQTT_CLIENT_ID"`
+	MQTTPrefix    string        `config:"mqtt_prefix" env:"AWEATHER_MQTT_PREFIX" help:"MQTT topic prefix"`
+	TelegramToken string        `config:"telegram_token" env:"AWEATHER_TELEGRAM_TOKEN" secret:"true" help:"Telegram bot token"`
+	TelegramAPI   string        `config:"telegram_api" env:"AWEATHER_TELEGRAM_API" help:"Telegram Bot API base URL"`
+	BotSite       string        `config:"bot_site" env:"AWEATHER_BOT_SITE" help:"default site of /tonight"`
+	SMTPAddr      string        `config:"smtp_addr" env:"AWEATHER_SMTP_ADDR" help:"SMTP relay host:port for digests"`
+	SMTPFrom      string        `config:"smtp_from" env:"AWEATHER_SMTP_FROM"`
+	SMTPUsername  string        `config:"smtp_username" env:"AWEATHER_SMTP_USERNAME"`
+	SMTPPassword  string        `config:"smtp_password" env:"AWEATHER_SMTP_PASSWORD" secret:"true"`
+	VAPIDSubject  string        `config:"vapid_subject" env:"AWEATHER_VAPID_SUBJECT" help:"contact for push services"`
+	OTLPEndpoint  string        `config:"otlp_endpoint" env:"AWEATHER_OTLP_ENDPOINT" help:"OTLP/HTTP collector for traces"`
+	OTLPHeaders   string        `config:"otlp_headers" env:"AWEATHER_OTLP_HEADERS" secret:"true"`
+	OTLPService   string        `config:"otlp_service" env:"AWEATHER_OTLP_SERVICE"`
+}
+
+// defaultConfig is the configuration when nothing is set
+func defaultConfig() Config {
+	return Config{
+		Port:              8080,
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		RequestTimeout:    RequestTimeout,
+		UpstreamTimeout:   12 * time.Second,
+		LogLevel:          "info",
+
+		ReadyProbeInterval: time.Minute,
+
+		Cache:              "memory",
+		CacheTTL:           10 * time.Minute,
+		CacheRevalidateTTL: 30 * time.Minute,
+		CacheStaleTTL:      6 * time.Hour,
+		CacheSizeMB:        32,
+
+		ForecastEndpoint:         "https://api.open-meteo.com/v1/forecast?",
+		GeocodingEndpoint:        "https://geocoding-api.open-meteo.com/v1/search",
+		ReverseGeocodingEndpoint: "https://geocoding-api.open-meteo.com/v1/reverse",
+		ForecastParams:           defaultForecastParams,
+		UserAgent:                "aweather",
+
+		MaxCloudCover: 25,
+		MaxWindSpeed:  15,
+
+		AdminAddr:         "127.0.0.1:8089",
+		SchedulerInterval: SchedulerInterval,
+		MaxSubscriptions:  10000,
+		MQTTInterval:      MQTTInterval,
+		MQTTPrefix:        "aweather",
+		TelegramAPI:       "https://api.telegram.org",
+		OTLPService:       "aweather",
+	}
+}
+
+// configSetting is one field of Config with the sources it can be set from
+type configSetting struct {
+	name, env, help string
+	secret          bool
+	field           reflect.Value
+}
+
+func (c *Config) settings() []configSetting {
+	v := reflect.ValueOf(c).Elem()
+	settings := make([]configSetting, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		settings = append(settings, configSetting{
+			name:   f.Tag.Get("config"),
+			env:    f.Tag.Get("env"),
+			help:   f.Tag.Get("help"),
+			secret: f.Tag.Get("secret") == "true",
+			field:  v.Field(i),
+		})
+	}
+	return settings
+}
+
+// loadConfig resolves the configuration from command-line args, the environment and the
+// file named by -config or AWEATHER_CONFIG. It returns all invalid settings at once.
+// The second result tells where each setting came from: flag, env, file or default.
+func loadConfig(args []string, getenv func(string) string) (Config, map[string]string, error) {
+	cfg, sources, rest, err := loadConfigArgs(args, getenv)
+	if len(rest) > 0 {
+		return cfg, nil, fmt.Errorf("unexpected argument %q", rest[0])
+	}
+	return cfg, sources, err
+}
+
+// loadConfigArgs is loadConfig for subcommands: the config flags come first, and the
+// arguments after them are returned for the subcommand.
+func loadConfigArgs(args []string, getenv func(string) string) (Config, map[string]string, []string, error) {
+	cfg := defaultConfig()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("aweather", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	configFile := fs.String("config", getenv("AWEATHER_CONFIG"), "YAML or TOML config file")
+	flags := map[string]*configFlag{}
+	for _, s := range settings {
+		f := &configFlag{isBool: s.field.Kind() == reflect.Bool}
+		flags[s.name] = f
+		fs.Var(f, strings.ReplaceAll(s.name, "_", "-"), s.help)
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, nil, nil, err
+	}
+
+	file := map[string]string{}
+	if *configFile != "" {
+		var err error
+		if file, err = readConfigFile(*configFile); err != nil {
+			return cfg, nil, nil, err
+		}
+	}
+
+	sources := map[string]string{}
+	var errs []error
+	known := map[string]bool{}
+	for _, s := range settings {
+		known[s.name] = true
+		value, source := "", "default"
+		if f := flags[s.name]; f.set {
+			value, source = f.value, "flag"
+		} else if v := getenv(s.env); v != "" {
+			value, source = v, "env"
+		} else if v := file[s.name]; v != "" {
+			value, source = v, "file"
+		}
+		sources[s.name] = source
+		if source == "default" {
+			continue
+		}
+		if err := setConfigField(s.field, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s): %w", s.name, source, err))
+		}
+	}
+	for name := range file {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("%s: unknown setting in %s", name, *configFile))
+		}
+	}
+	if len(errs) == 0 {
+		errs = cfg.validate()
+	}
+	return cfg, sources, fs.Args(), errors.Join(errs...)
+}
+
+// validate checks settings against each other and their allowed ranges
+func (c Config) validate() []error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	for _, p := range []struct {
+		name     string
+		port     int
+		optional bool
+	}{{"port", c.Port, false}, {"alpaca_port", c.AlpacaPort, true}, {"indi_port", c.IndiPort, true}} {
+		check((p.optional && p.port == 0) || (p.port > 0 && p.port <= 65535), "%s: %d is not a valid port", p.name, p.port)
+	}
+	check(c.AlpacaPort == 0 || c.AlpacaPort != c.Port, "alpaca_port: %d is already used by port", c.AlpacaPort)
+	check(c.IndiPort == 0 || (c.IndiPort != c.Port && c.IndiPort != c.AlpacaPort), "indi_port: %d is already in use", c.IndiPort)
+
+	for _, d := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"read_timeout", c.ReadTimeout}, {"read_header_timeout", c.ReadHeaderTimeout}, {"idle_timeout", c.IdleTimeout},
+		{"request_timeout", c.RequestTimeout}, {"upstream_timeout", c.UpstreamTimeout}, {"cache_ttl", c.CacheTTL},
+		{"scheduler_interval", c.SchedulerInterval}, {"mqtt_interval", c.MQTTInterval}, {"ready_probe_interval", c.ReadyProbeInterval},
+	} {
+		check(d.d > 0, "%s: must be positive", d.name)
+	}
+	check(c.CacheRevalidateTTL >= c.CacheTTL, "cache_revalidate_ttl: must not be shorter than cache_ttl")
+	check(c.CacheStaleTTL >= c.CacheRevalidateTTL, "cache_stale_ttl: must not be shorter than cache_revalidate_ttl")
+	check(c.CacheSizeMB > 0, "cache_size_mb: must be positive")
+	check(c.MaxSubscriptions >= 0, "max_subscriptions: must not be negative")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log_level: %q is not debug, info, warn or error", c.LogLevel)
+
+	for _, e := range []struct{ name, url string }{
+		{"forecast_endpoint", c.ForecastEndpoint}, {"geocoding_endpoint", c.GeocodingEndpoint},
+		{"reverse_geocoding_endpoint", c.ReverseGeocodingEndpoint},
+	} {
+		u, err := url.Parse(e.url)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "%s: %q is not an http(s) URL", e.name, e.url)
+	}
+	check(strings.TrimSpace(c.ForecastParams) != "", "forecast_params: must not be empty")
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.RawQuery == "", "public_url: %q is not an http(s) URL", c.PublicURL)
+	}
+	check(c.AdminToken == "" || len(c.AdminToken) >= 16, "admin_token: must be at least 16 characters")
+	adminPort := 0
+	if _, port, err := net.SplitHostPort(c.AdminAddr); err == nil {
+		adminPort, _ = strconv.Atoi(port)
+	}
+	check(adminPort > 0 && adminPort <= 65535, "admin_addr: %q is not a host:port address", c.AdminAddr)
+	check(adminPort != c.Port, "admin_addr: port %d is already used by port", adminPort)
+	check(c.SMTPAddr == "" || c.PublicURL != "", "public_url: must be set for the links in digest emails when smtp_addr is")
+
+	check(c.MaxCloudCover > 0 && c.MaxCloudCover <= 100, "max_cloud_cover: %d is not within 1-100", c.MaxCloudCover)
+	check(c.MaxWindSpeed > 0 && c.MaxWindSpeed <= 200, "max_wind_speed: %g is not within 0-200", c.MaxWindSpeed)
+
+	if _, err := parseSites(c.Sites); err != nil {
+		errs = append(errs, fmt.Errorf("sites: %w", err))
+	}
+	if c.RateLimits != "off" {
+		if _, err := parseRateRules(c.RateLimits, nil); err != nil {
+			errs = append(errs, fmt.Errorf("rate_limits: %w", err))
+		}
+	}
+	if _, err := parsePrefixes(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	if _, err := parsePrefixes(c.RateLimitAllow); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit_allow: %w", err))
+	}
+	return errs
+}
+
+// setGlobals replaces the package-level defaults that handlers and fetchers read directly.
+// Every other setting is passed to the constructor that needs it.
+func (c Config) setGlobals() {
+	CacheTTL, CacheRevalidateTTL, CacheStaleTTL = c.CacheTTL, c.CacheRevalidateTTL, c.CacheStaleTTL
+	OpenMeteoAPIEndpoint = c.ForecastEndpoint
+	OpenMeteoGeoAPIEndpoint = c.GeocodingEndpoint
+	OpenMeteoGeoReverseAPIEndpoint = c.ReverseGeocodingEndpoint
+	OpenMeteoAPIParams = c.ForecastParams
+	MaxCloudCover, MaxWindSpeed = c.MaxCloudCover, c.MaxWindSpeed
+	PublicURL = strings.TrimSuffix(c.PublicURL, "/")
+	httpClient.Timeout = c.UpstreamTimeout
+	if t, ok := httpClient.Transport.(*userAgentRoundTripper); ok {
+		t.userAgent = c.UserAgent
+	}
+}
+
+// print writes the configuration as YAML that can be used as a config file, with secrets
+// masked and the source of each setting in a comment
+func (c Config) print(w io.Writer, sources map[string]string) {
+	for _, s := range c.settings() {
+		value := formatConfigField(s.field)
+		if s.secret && value != "" {
+			value = "********"
+		}
+		fmt.Fprintf(w, "%s: %s # %s, %s\n", s.name, strconv.Quote(value), sources[s.name], s.env)
+	}
+}
+
+// runConfigCommand implements "aweather config print"
+func runConfigCommand(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "print" {
+		return errors.New("usage: aweather config print [-config file] [flags]")
+	}
+	cfg, sources, err := loadConfig(args[1:], os.Getenv)
+	if err != nil {
+		return err
+	}
+	cfg.print(out, sources)
+	return nil
+}
+
+// configFlag records a flag's raw value; it is parsed together with the other sources
+type configFlag struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *configFlag) String() string   { return f.value }
+func (f *configFlag) IsBoolFlag() bool { return f.isBool }
+func (f *configFlag) Set(v string) error {
+	f.value, f.set = v, true
+	return nil
+}
+
+func setConfigField(field reflect.Value, value string) error {
+	switch {
+	case field.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration like 30s or 10m", value)
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		field.SetString(value)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Int || field.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		field.SetInt(n)
+	case field.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// formatConfigField is the inverse of setConfigField; zero numbers and false are empty
+func formatConfigField(field reflect.Value) string {
+	if field.IsZero() {
+		return ""
+	}
+	switch {
+	case field.Type() == reflect.TypeOf(time.Duration(0)):
+		return formatDuration(time.Duration(field.Int()))
+	case field.Kind() == reflect.Float64:
+		return strconv.FormatFloat(field.Float(), 'f', -1, 64)
+	}
+	return fmt.Sprint(field.Interface())
+}
+
+// formatDuration drops the zero units that time.Duration.String adds, e.g. "10m" instead of "10m0s"
+func formatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// readConfigFile reads a flat YAML (key: value) or TOML (key = value) file, chosen by its
+// extension. Values may be quoted; nested maps, lists and tables are not supported.
+func readConfigFile(path string) (map[string]string, error) {
+	sep := ""
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		sep = ":"
+	case ".toml":
+		sep = "="
+	default:
+		return nil, fmt.Errorf("config file %s: want a .yaml, .yml or .toml file", path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "-") {
+			return nil, fmt.Errorf("%s:%d: only flat key%svalue settings are supported", path, n, sep)
+		}
+		key, raw, ok := strings.Cut(trimmed, sep)
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: want key%svalue", path, n, sep)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, key, err)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, n, key)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	return values, nil
+}
+
+// parseConfigValue unquotes a "double" or 'single' quoted value, or strips a trailing
+// comment from a bare one
+func parseConfigValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'") {
+		end := closingQuote(raw)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string %s", raw)
+		}
+		if rest := strings.TrimSpace(raw[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after string %s", rest, raw[:end+1])
+		}
+		if raw[0] == '"' {
+			return strconv.Unquote(raw[:end+1])
+		}
+		return raw[1:end], nil
+	}
+	if i := strings.Index(raw, " #"); i >= 0 {
+		raw = raw[:i]
+	}
+	return strings.TrimSpace(raw), nil
+}
+
+// closingQuote returns the index of the quote that ends the string raw starts with, or -1.
+// Double-quoted strings may contain backslash-escaped quotes, single-quoted ones no escapes.
+func closingQuote(raw string) int {
+	quote := raw[0]
+	for i := 1; i < len(raw); i++ {
+		switch {
+		case raw[i] == '\\' && quote == '"':
+			i++
+		case raw[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func envMap(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestLoadConfig_Defaults(t *testing.T) {
+	cfg, sources, err := loadConfig(nil, envMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != defaultConfig() {
+		t.Errorf("got %+v", cfg)
+	}
+	if cfg.Port != 8080 || cfg.CacheTTL != 10*time.Minute || cfg.ForecastEndpoint != OpenMeteoAPIEndpoint || cfg.MaxCloudCover != 25 {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+	if sources["port"] != "default" {
+		t.Errorf("sources = %v", sources)
+	}
+}
+
+func TestLoadConfig_Precedence(t *testing.T) {
+	path := writeConfigFile(t, "aweather.yaml", `# deployment settings
+---
+port: 9000
+cache_ttl: "5m"
+max_cloud_cover: 30 # percent
+sites: 'home=50.45,30.52; club=49.84,24.03'
+metrics_sites: true
+`)
+	env := map[string]string{
+		"AWEATHER_CONFIG":    path,
+		"AWEATHER_PORT":      "9100",
+		"AWEATHER_CACHE_TTL": "7m",
+	}
+	cfg, sources, err := loadConfig([]string{"-port", "9200", "-webhook-allow-private"}, envMap(env))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		got    any
+		want   any
+		source string
+	}{
+		{"port", cfg.Port, 9200, "flag"},
+		{"webhook_allow_private", cfg.WebhookAllowPrivate, true, "flag"},
+		{"cache_ttl", cfg.CacheTTL, 7 * time.Minute, "env"},
+		{"max_cloud_cover", cfg.MaxCloudCover, int64(30), "file"},
+		{"sites", cfg.Sites, "home=50.45,30.52; club=49.84,24.03", "file"},
+		{"metrics_sites", cfg.MetricsSites, true, "file"},
+		{"max_wind_speed", cfg.MaxWindSpeed, float64(15), "default"},
+	} {
+		if tt.got != tt.want || sources[tt.name] != tt.source {
+			t.Errorf("%s = %v from %s, want %v from %s", tt.name, tt.got, sources[tt.name], tt.want, tt.source)
+		}
+	}
+}
+
+func TestLoadConfig_TOML(t *testing.T) {
+	path := writeConfigFile(t, "aweather.toml", `
+port = 8081
+forecast_endpoint = "http://localhost:9999/v1/forecast?" # a mirror
+cache_revalidate_ttl = "1h"
+user_agent = "aweather (club \"north\")"
+`)
+	cfg, _, err := loadConfig([]string{"-config", path}, envMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 8081 || cfg.ForecastEndpoint != "http://localhost:9999/v1/forecast?" || cfg.CacheRevalidateTTL != time.Hour || cfg.UserAgent != `aweather (club "north")` {
+		t.Errorf("got %+v", cfg)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		args  []string
+		env   map[string]string
+		file  string
+		wants []string
+	}{
+		{name: "invalid values are all reported",
+			env:   map[string]string{"AWEATHER_PORT": "http", "AWEATHER_CACHE_TTL": "10"},
+			args:  []string{"-metrics-sites=maybe"},
+			wants: []string{"port (env)", "cache_ttl (env)", "metrics_sites (flag)"}},
+		{name: "ranges and relations",
+			args:  []string{"-port", "70000", "-cache-ttl", "1h", "-max-cloud-cover", "0", "-forecast-endpoint", "api.open-meteo.com", "-alpaca-port", "8080", "-port", "8080"},
+			wants: []string{"cache_revalidate_ttl", "max_cloud_cover", "forecast_endpoint", "alpaca_port"}},
+		{name: "settings parsed by their features",
+			args:  []string{"-sites", "home", "-rate-limits", "/weather=fast", "-trusted-proxies", "10.0.0.0/40", "-log-level", "loud"},
+			wants: []string{"sites:", "rate_limits:", "trusted_proxies:", "log_level:"}},
+		{name: "digests without a public URL", args: []string{"-smtp-addr", "mail:25"}, wants: []string{"public_url"}},
+		{name: "public URL", args: []string{"-public-url", "aweather.example.com"}, wants: []string{"public_url:"}},
+		{name: "admin address", args: []string{"-admin-addr", "localhost"}, wants: []string{"admin_addr:"}},
+		{name: "admin address on the public port", args: []string{"-admin-addr", "127.0.0.1:8080"}, wants: []string{"admin_addr: port 8080"}},
+		{name: "unknown flag", args: []string{"-colour", "red"}, wants: []string{"colour"}},
+		{name: "stray argument", args: []string{"serve"}, wants: []string{`unexpected argument "serve"`}},
+		{name: "unknown file setting", file: "port: 8080\ncolour: red\n", wants: []string{"colour: unknown setting"}},
+		{name: "nested yaml", file: "server:\n  port: 8080\n", wants: []string{":2: only flat"}},
+		{name: "duplicate setting", file: "port: 1\nport: 2\n", wants: []string{"port is set twice"}},
+		{name: "unterminated string", file: "user_agent: \"aweather\n", wants: []string{"unterminated"}},
+		{name: "text after string", file: "user_agent: \"a\" b\n", wants: []string{`unexpected "b" after string`}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, "aweather.yml", tt.file)}, args...)
+			}
+			_, _, err := loadConfig(args, envMap(tt.env))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tt.wants {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+
+	if _, _, err := loadConfig([]string{"-config", "aweather.json"}, envMap(nil)); err == nil || !strings.Contains(err.Error(), ".toml") {
+		t.Errorf("unsupported format: %v", err)
+	}
+}
+
+// The printed configuration works as a config file and does not show secrets
+func TestConfigPrint(t *testing.T) {
+	cfg, sources, err := loadConfig([]string{"-port", "9000", "-smtp-password", "hunter2", "-sites", "home=50.45,30.52", "-indi-port", "7624"}, envMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cfg.print(&out, sources)
+	printed := out.String()
+	for _, want := range []string{`port: "9000" # flag, AWEATHER_PORT`, `cache_ttl: "10m" # default`, `cache_stale_ttl: "6h" #`, `smtp_password: "********"`, `alpaca_port: "" #`} {
+		if !strings.Contains(printed, want) {
+			t.Errorf("output does not contain %q:\n%s", want, printed)
+		}
+	}
+	if strings.Contains(printed, "hunter2") {
+		t.Error("the password is printed")
+	}
+
+	reread, _, err := loadConfig([]string{"-config", writeConfigFile(t, "printed.yaml", printed)}, envMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reread.SMTPPassword = cfg.SMTPPassword
+	if reread != cfg {
+		t.Errorf("reading the printed config back gives\n%+v\nwant\n%+v", reread, cfg)
+	}
+}
+
+func TestParseConfigValue(t *testing.T) {
+	for raw, want := range map[string]string{
+		`"a" # it's`:        "a",
+		`'a' # say "hi"`:    "a",
+		`"say \"hi\"" # x`:  `say "hi"`,
+		`"a # b"`:           "a # b",
+		`'c:\dir' # path`:   `c:\dir`,
+		`bare value # note`: "bare value",
+		`url#fragment`:      "url#fragment",
+	} {
+		if got, err := parseConfigValue(raw); err != nil || got != want {
+			t.Errorf("parseConfigValue(%s) = %q, %v, want %q", raw, got, err, want)
+		}
+	}
+	for _, raw := range []string{`"a`, `"a\"`, `'a`, `"a" b "c"`} {
+		if got, err := parseConfigValue(raw); err == nil {
+			t.Errorf("parseConfigValue(%s) = %q, want an error", raw, got)
+		}
+	}
+}
+
+// The defaults stay the same after setGlobals applied another configuration
+func TestDefaultConfig_IgnoresGlobals(t *testing.T) {
+	want := defaultConfig()
+	t.Cleanup(want.setGlobals)
+
+	cfg := want
+	cfg.CacheTTL, cfg.MaxCloudCover, cfg.ForecastParams = time.Minute, 80, "temperature_2m"
+	cfg.setGlobals()
+	if got := defaultConfig(); got != want {
+		t.Errorf("defaults changed with the globals:\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestConfigSetGlobals(t *testing.T) {
+	t.Cleanup(defaultConfig().setGlobals)
+	t.Setenv("AWEATHER_MQTT_BROKER", "")
+
+	cfg := defaultConfig()
+	cfg.CacheTTL, cfg.MaxWindSpeed, cfg.UpstreamTimeout = 2*time.Minute, 20, 3*time.Second
+	cfg.ForecastEndpoint = "http://localhost:1/forecast?"
+	cfg.UserAgent = "aweather-test"
+	cfg.MQTTBroker, cfg.SMTPPassword = "broker:1883", "hunter2"
+	cfg.setGlobals()
+
+	if CacheTTL != 2*time.Minute || MaxWindSpeed != 20 || OpenMeteoAPIEndpoint != "http://localhost:1/forecast?" || httpClient.Timeout != 3*time.Second {
+		t.Errorf("globals not applied: %v %v %v %v", CacheTTL, MaxWindSpeed, OpenMeteoAPIEndpoint, httpClient.Timeout)
+	}
+	if ua := httpClient.Transport.(*userAgentRoundTripper).userAgent; ua != "aweather-test" {
+		t.Errorf("user agent = %q", ua)
+	}
+	// The integrations get their settings from the Config; none of them leak into the environment
+	for _, name := range []string{"AWEATHER_MQTT_BROKER", "AWEATHER_SMTP_PASSWORD", "AWEATHER_CACHE_TTL"} {
+		if got := os.Getenv(name); got != "" {
+			t.Errorf("%s = %q", name, got)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math"
 	"strings"
@@ -23,18 +25,37 @@ type DataPoint struct {
 	WindSpeed850hPa       float64
 	GeopotentialHeight850 float64
 	GeopotentialHeight500 float64
+	DewPoint              float64 // °C
+	Precipitation         float64 // mm over the preceding hour
 	Elevation             float64
 	Lat                   float64
 	Lon                   float64
+	Dark                  bool // Sun below darknessSunAltitude
+	MoonUp                bool // Moon above the horizon
 }
 
 type DataPoints []DataPoint
 
-// PrintOptions controls display units and time formatting
+// PrintOptions controls display units, time formatting and "ok" thresholds
 type PrintOptions struct {
 	TemperatureUnit string // "c" or "f"
 	WindSpeedUnit   string // "kmh" or "mph"
 	Use12Hour       bool
+	MaxCloudCover   int64   // percentage; 0 means MaxCloudCover
+	MaxWindSpeed    float64 // km/h; 0 means MaxWindSpeed
+}
+
+// thresholds returns the cloud and wind limits to use for the "ok" column
+func (opts PrintOptions) thresholds() (int64, float64) {
+	maxCloud := opts.MaxCloudCover
+	if maxCloud <= 0 {
+		maxCloud = MaxCloudCover
+	}
+	maxWind := opts.MaxWindSpeed
+	if maxWind <= 0 {
+		maxWind = MaxWindSpeed
+	}
+	return maxCloud, maxWind
 }
 
 // Shared column widths for printing header and rows
@@ -126,6 +147,72 @@ func (dp DataPoints) setSeeing() DataPoints {
 	return updatedPoints
 }
 
+// setSunAndMoon() sets Dark and MoonUp values for point in DataPoints.
+// It stops with ctx's error once ctx is done.
+func (dp DataPoints) setSunAndMoon(ctx context.Context) (DataPoints, error) {
+	updatedPoints := make(DataPoints, 0, len(dp))
+
+	for _, point := range dp {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		point.Dark = sunAltitude(point.Time, point.Lat, point.Lon) < darknessSunAltitude
+		point.MoonUp = moonAltitude(point.Time, point.Lat, point.Lon) > 0
+		updatedPoints = append(updatedPoints, point)
+	}
+
+	return updatedPoints, nil
+}
+
+// astronomyFlags() packs Dark and MoonUp of each point into a byte, for caching
+func (dp DataPoints) astronomyFlags() []byte {
+	flags := make([]byte, len(dp))
+	for i, point := range dp {
+		if point.Dark {
+			flags[i] |= 1
+		}
+		if point.MoonUp {
+			flags[i] |= 2
+		}
+	}
+	return flags
+}
+
+// setAstronomyFlags() sets Dark and MoonUp values from astronomyFlags
+func (dp DataPoints) setAstronomyFlags(flags []byte) DataPoints {
+	updatedPoints := make(DataPoints, 0, len(dp))
+
+	for i, point := range dp {
+		point.Dark = flags[i]&1 != 0
+		point.MoonUp = flags[i]&2 != 0
+		updatedPoints = append(updatedPoints, point)
+	}
+
+	return updatedPoints
+}
+
+// upcoming() returns points starting from the hour that contains now
+func (dp DataPoints) upcoming(now time.Time) DataPoints {
+	for i, point := range dp {
+		if point.Time.Add(time.Hour).After(now) {
+			return dp[i:]
+		}
+	}
+	return DataPoints{}
+}
+
+// errNoCurrentHour is returned for a forecast that does not cover the current hour
+var errNoCurrentHour = errors.New("no forecast for the current hour")
+
+// current() returns the point of the hour that contains now
+func (dp DataPoints) current(now time.Time) (DataPoint, error) {
+	upcoming := dp.upcoming(now)
+	if len(upcoming) == 0 || upcoming[0].Time.After(now) {
+		return DataPoint{}, errNoCurrentHour
+	}
+	return upcoming[0], nil
+}
+
 // Print() returns Markdown string which represents DataPoints
 func (dp DataPoints) Print() string {
 	out := ""
@@ -226,6 +313,13 @@ func (dp DataPoints) Print() string {
 
 // PrintWithOptions returns Markdown-like string using provided formatting options
 func (dp DataPoints) PrintWithOptions(opts PrintOptions) string {
+	out, _ := dp.PrintWithOptionsContext(context.Background(), opts)
+	return out
+}
+
+// PrintWithOptionsContext is PrintWithOptions with the per-day rise and set calculations traced
+// under ctx. It stops with ctx's error once ctx is done.
+func (dp DataPoints) PrintWithOptionsContext(ctx context.Context, opts PrintOptions) (string, error) {
 	// normalize options
 	tempUnit := strings.ToLower(strings.TrimSpace(opts.TemperatureUnit))
 	if tempUnit != "f" {
@@ -235,6 +329,7 @@ func (dp DataPoints) PrintWithOptions(opts PrintOptions) string {
 	if windUnit != "mph" {
 		windUnit = "kmh"
 	}
+	maxCloud, maxWind := opts.thresholds()
 
 	out := ""
 	currentDate := ""
@@ -248,8 +343,14 @@ func (dp DataPoints) PrintWithOptions(opts PrintOptions) string {
 				out += "\n"
 			}
 			// Get Moon and Sun rise and set time
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			_, span := startSpan(ctx, "calculateRiseSet", spanKindInternal)
+			span.SetAttr("date", point.Time.Format("2006-01-02"))
 			moonRise, moonSet := calculateRiseSet(point.Time, point.Lat, point.Lon, "moon")
 			sunRise, sunSet := calculateRiseSet(point.Time, point.Lat, point.Lon, "sun")
+			span.End()
 
 			// Format time strings depending on 12/24h preference
 			timeFmt := "15:04"
@@ -307,7 +408,7 @@ func (dp DataPoints) PrintWithOptions(opts PrintOptions) string {
 		}
 
 		status := "-"
-		if point.isGood(MaxCloudCover, MaxWindSpeed) {
+		if point.isGood(maxCloud, maxWind) {
 			status = "ok"
 		}
 
@@ -365,5 +466,5 @@ func (dp DataPoints) PrintWithOptions(opts PrintOptions) string {
 			colWidthSeeing, seeingStr)
 	}
 
-	return out
+	return out, nil
 }
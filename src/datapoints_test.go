@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -180,3 +182,48 @@ func TestPrintWithOptions_DefaultsNormalization(t *testing.T) {
 		t.Fatalf("expected default headers present, got: %s", out)
 	}
 }
+
+func TestPrintWithOptions_CustomThresholds(t *testing.T) {
+	points := DataPoints{{
+		Time:       time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC),
+		LowClouds:  35,
+		MidClouds:  0,
+		HighClouds: 0,
+		WindSpeed:  5,
+		WindGusts:  5,
+	}}
+	if out := points.PrintWithOptions(PrintOptions{}); strings.Contains(out, " ok ") {
+		t.Fatalf("expected default thresholds to reject 35%% clouds, got: %s", out)
+	}
+	if out := points.PrintWithOptions(PrintOptions{MaxCloudCover: 40}); !strings.Contains(out, " ok ") {
+		t.Fatalf("expected custom threshold to accept 35%% clouds, got: %s", out)
+	}
+}
+
+func TestAstronomy_Cancelled(t *testing.T) {
+	points := feedTestPoints(90)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := points.setSunAndMoon(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("setSunAndMoon: expected context.Canceled, got %v", err)
+	}
+	if _, err := points.PrintWithOptionsContext(ctx, PrintOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("PrintWithOptionsContext: expected context.Canceled, got %v", err)
+	}
+	if _, err := points.setSunAndMoon(context.Background()); err != nil {
+		t.Errorf("setSunAndMoon: %v", err)
+	}
+}
+
+func TestCurrent(t *testing.T) {
+	start := time.Date(2024, 3, 1, 21, 0, 0, 0, time.UTC)
+	points := DataPoints{{Time: start}, {Time: start.Add(time.Hour)}}
+	if p, err := points.current(start.Add(90 * time.Minute)); err != nil || !p.Time.Equal(start.Add(time.Hour)) {
+		t.Fatalf("expected the 22:00 hour, got %v, %v", p.Time, err)
+	}
+	for _, now := range []time.Time{start.Add(-time.Minute), start.Add(2 * time.Hour)} {
+		if _, err := points.current(now); !errors.Is(err, errNoCurrentHour) {
+			t.Fatalf("%v: expected errNoCurrentHour, got %v", now, err)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates/digest.txt
+var digestText string
+
+//go:embed templates/digest.html
+var digestHTML string
+
+var (
+	digestTextTmpl = texttemplate.Must(texttemplate.New("digest.txt").Parse(digestText))
+	digestHTMLTmpl = htmltemplate.Must(htmltemplate.New("digest.html").Parse(digestHTML))
+)
+
+const (
+	digestsBucket      = "digests"
+	digestNights       = 3
+	digestMaxLocations = 5
+	digestCheckEvery   = time.Minute
+)
+
+// Digest is a daily email with the next nights for a few saved locations
+type Digest struct {
+	ID            string           `json:"id"`
+	Email         string           `json:"email"`
+	Locations     []DigestLocation `json:"locations"`
+	SendAt        string           `json:"send_at"`  // HH:MM in Timezone
+	Timezone      string           `json:"timezone"` // IANA name; default UTC
+	UnitTemp      string           `json:"unit_temp,omitempty"`
+	UnitWind      string           `json:"unit_wind,omitempty"`
+	Time12h       bool             `json:"time_12h,omitempty"`
+	MaxCloudCover int64            `json:"max_cloud_cover,omitempty"`
+	MaxWindSpeed  float64          `json:"max_wind_speed,omitempty"`
+	Token         string           `json:"token,omitempty"` // sent by email only; confirms and unsubscribes
+	Confirmed     bool             `json:"confirmed"`
+	LastSent      string           `json:"last_sent,omitempty"` // YYYY-MM-DD in Timezone
+	CreatedAt     time.Time        `json:"created_at"`
+}
+
+type DigestLocation struct {
+	Name      string  `json:"name"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// printOptions converts the digest preferences to table options
+func (d Digest) printOptions() PrintOptions {
+	q := url.Values{}
+	q.Set("unit_temp", d.UnitTemp)
+	q.Set("unit_wind", d.UnitWind)
+	if d.Time12h {
+		q.Set("time_12h", "1")
+	}
+	opts := parsePrintOptions(q)
+	opts.MaxCloudCover = d.MaxCloudCover
+	opts.MaxWindSpeed = d.MaxWindSpeed
+	return opts
+}
+
+// Digests serves the digest API and sends due digests
+type Digests struct {
+	store      *Store
+	mailer     *Mailer
+	publicURL  string // links in emails point here, never to the Host a request came with
+	maxRecords int    // digests kept at most, 0 for no limit
+
+	now      func() time.Time
+	forecast func(ctx context.Context, lat, lon float64) (DataPoints, error)
+}
+
+func newDigests(store *Store, mailer *Mailer, publicURL string, maxRecords int) *Digests {
+	return &Digests{
+		store:      store,
+		mailer:     mailer,
+		publicURL:  strings.TrimSuffix(publicURL, "/"),
+		maxRecords: maxRecords,
+		now:        time.Now,
+		forecast:   fetchForecast,
+	}
+}
+
+// handleCreate registers a digest and emails a confirmation link
+func (d *Digests) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var digest Digest
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&digest); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := validateDigest(&digest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	digest.ID = randomHex(16)
+	digest.Token = randomHex(16)
+	digest.Confirmed = false
+	digest.LastSent = ""
+	digest.CreatedAt = d.now().UTC()
+
+	err := d.store.Insert(digestsBucket, digest.ID, digest, d.maxRecords)
+	if errors.Is(err, errStoreFull) {
+		slog.WarnContext(r.Context(), "digest limit reached", "limit", d.maxRecords)
+		http.Error(w, "No more digests can be created", http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "saving digest", "error", err)
+		http.Error(w, "Unable to save digest", http.StatusInternalServerError)
+		return
+	}
+
+	link := fmt.Sprintf("%s/digests/%s/confirm?token=%s", d.publicURL, digest.ID, digest.Token)
+	err = d.mailer.Send(Email{
+		To:      digest.Email,
+		Subject: "Confirm your aweather digest",
+		Text:    "Confirm your daily aweather digest by opening this link:\n\n" + link + "\n\nIf you did not ask for it, ignore this email.\n",
+		HTML:    `<p>Confirm your daily aweather digest: <a href="` + htmltemplate.HTMLEscapeString(link) + `">confirm</a>.</p><p>If you did not ask for it, ignore this email.</p>`,
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "sending digest confirmation", "error", err)
+		_ = d.store.Delete(digestsBucket, digest.ID)
+		http.Error(w, "Unable to send confirmation email", http.StatusBadGateway)
+		return
+	}
+	slog.InfoContext(r.Context(), "created digest", "digest", digest.ID)
+
+	digest.Token = ""
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/digests/"+digest.ID)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(digest); err != nil {
+		slog.ErrorContext(r.Context(), "encoding digest", "error", err)
+	}
+}
+
+// handleItem returns or deletes a digest by ID
+func (d *Digests) handleItem(w http.ResponseWriter, r *http.Request) {
+	digest, ok := d.load(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		digest.Token = ""
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(digest); err != nil {
+			slog.ErrorContext(r.Context(), "encoding digest", "error", err)
+		}
+	case http.MethodDelete:
+		d.delete(w, r, digest)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleConfirm enables a digest from the link in the confirmation email
+func (d *Digests) handleConfirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	digest, ok := d.loadWithToken(w, r)
+	if !ok {
+		return
+	}
+	digest.Confirmed = true
+	if err := d.store.Put(digestsBucket, digest.ID, digest); err != nil {
+		slog.ErrorContext(r.Context(), "confirming digest", "digest", digest.ID, "error", err)
+		http.Error(w, "Unable to confirm digest", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "confirmed digest", "digest", digest.ID)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Your aweather digest is confirmed. It will arrive daily at %s (%s).\n", digest.SendAt, digest.Timezone)
+}
+
+// handleUnsubscribe deletes a digest from the link in every digest email
+func (d *Digests) handleUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	digest, ok := d.loadWithToken(w, r)
+	if !ok {
+		return
+	}
+	d.delete(w, r, digest)
+}
+
+func (d *Digests) load(w http.ResponseWriter, r *http.Request) (Digest, bool) {
+	id := r.PathValue("id")
+	var digest Digest
+	err := d.store.Get(digestsBucket, id, &digest)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Digest not found", http.StatusNotFound)
+		return Digest{}, false
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "loading digest", "digest", id, "error", err)
+		http.Error(w, "Unable to load digest", http.StatusInternalServerError)
+		return Digest{}, false
+	}
+	return digest, true
+}
+
+func (d *Digests) loadWithToken(w http.ResponseWriter, r *http.Request) (Digest, bool) {
+	digest, ok := d.load(w, r)
+	if !ok {
+		return Digest{}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("token")), []byte(digest.Token)) != 1 {
+		http.Error(w, "Invalid token", http.StatusForbidden)
+		return Digest{}, false
+	}
+	return digest, true
+}
+
+func (d *Digests) delete(w http.ResponseWriter, r *http.Request, digest Digest) {
+	if err := d.store.Delete(digestsBucket, digest.ID); err != nil {
+		slog.ErrorContext(r.Context(), "deleting digest", "digest", digest.ID, "error", err)
+		http.Error(w, "Unable to delete digest", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "deleted digest", "digest", digest.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateDigest checks user input and fills in defaults
+func validateDigest(digest *Digest) error {
+	addr, err := mail.ParseAddress(digest.Email)
+	if err != nil || addr.Name != "" {
+		return errors.New("email must be a plain email address")
+	}
+	digest.Email = addr.Address
+
+	if len(digest.Locations) == 0 || len(digest.Locations) > digestMaxLocations {
+		return fmt.Errorf("between 1 and %d locations are required", digestMaxLocations)
+	}
+	for i, loc := range digest.Locations {
+		if _, _, ok := parseCoordinates(float64ToString(loc.Latitude), float64ToString(loc.Longitude)); !ok {
+			return fmt.Errorf("location %d: latitude and longitude are out of range", i+1)
+		}
+		digest.Locations[i].Name = strings.TrimSpace(loc.Name)
+		if len(digest.Locations[i].Name) > 100 {
+			return fmt.Errorf("location %d: name is too long", i+1)
+		}
+	}
+
+	if _, err := time.Parse("15:04", digest.SendAt); err != nil {
+		return errors.New("send_at must be HH:MM")
+	}
+	if digest.Timezone == "" {
+		digest.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(digest.Timezone); err != nil {
+		return errors.New("timezone must be an IANA name like Europe/Kyiv")
+	}
+	if digest.MaxCloudCover < 0 || digest.MaxCloudCover > 100 {
+		return errors.New("max_cloud_cover must be between 1 and 100")
+	}
+	if digest.MaxWindSpeed < 0 || digest.MaxWindSpeed > 200 {
+		return errors.New("max_wind_speed must be between 1 and 200")
+	}
+	return nil
+}
+
+// Run sends due digests every minute until ctx is cancelled
+func (d *Digests) Run(ctx context.Context) {
+	ticker := time.NewTicker(digestCheckEvery)
+	defer ticker.Stop()
+	for {
+		d.runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce sends every confirmed digest whose send time has passed today and that was not sent yet
+func (d *Digests) runOnce(ctx context.Context) {
+	digests := []Digest{}
+	err := d.store.ForEach(digestsBucket, func(key string, data []byte) error {
+		var digest Digest
+		if err := json.Unmarshal(data, &digest); err != nil {
+			slog.Warn("skipping unreadable digest", "digest", key, "error", err)
+			return nil
+		}
+		digests = append(digests, digest)
+		return nil
+	})
+	if err != nil {
+		slog.Error("listing digests", "error", err)
+		return
+	}
+
+	for _, digest := range digests {
+		if ctx.Err() != nil {
+			return
+		}
+		today, due := digestDue(digest, d.now())
+		if !due {
+			continue
+		}
+		email, err := d.render(ctx, digest)
+		if err != nil {
+			// Retried on the next check
+			slog.Warn("digest failed", "digest", digest.ID, "error", err)
+			continue
+		}
+		if err := d.mailer.Send(email); err != nil {
+			slog.Warn("digest failed", "digest", digest.ID, "error", err)
+			continue
+		}
+		digest.LastSent = today
+		if err := d.store.Put(digestsBucket, digest.ID, digest); err != nil {
+			slog.Error("saving digest", "digest", digest.ID, "error", err)
+		}
+		slog.Info("sent digest", "digest", digest.ID, "day", today)
+	}
+}
+
+// digestDue reports whether a digest should be sent at now, and the local date it would be sent for
+func digestDue(digest Digest, now time.Time) (string, bool) {
+	if !digest.Confirmed {
+		return "", false
+	}
+	loc, err := time.LoadLocation(digest.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	today := local.Format("2006-01-02")
+	if digest.LastSent == today {
+		return today, false
+	}
+	sendAt, err := time.Parse("15:04", digest.SendAt)
+	if err != nil {
+		return today, false
+	}
+	due := time.Date(local.Year(), local.Month(), local.Day(), sendAt.Hour(), sendAt.Minute(), 0, 0, loc)
+	return today, !local.Before(due)
+}
+
+type digestView struct {
+	Date        string
+	Locations   []digestLocationView
+	Unsubscribe string
+}
+
+type digestLocationView struct {
+	Name   string
+	Error  string
+	Nights []digestNightView
+	Link   string
+}
+
+type digestNightView struct {
+	Title   string
+	Summary string
+	Table   string
+}
+
+// render builds the digest email with the next nights of every location.
+// It fails only when no location could be fetched, so one bad location does not block the rest.
+func (d *Digests) render(ctx context.Context, digest Digest) (Email, error) {
+	opts := digest.printOptions()
+	maxCloud, maxWind := opts.thresholds()
+	now := d.now()
+	loc, err := time.LoadLocation(digest.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	unsubscribe := fmt.Sprintf("%s/digests/%s/unsubscribe?token=%s", d.publicURL, digest.ID, digest.Token)
+	view := digestView{Date: now.In(loc).Format("Monday, January 2"), Unsubscribe: unsubscribe}
+	failed := 0
+	for _, location := range digest.Locations {
+		name := location.Name
+		if name == "" {
+			name = fmt.Sprintf("%.3f, %.3f", location.Latitude, location.Longitude)
+		}
+		q := url.Values{"unit_temp": {digest.UnitTemp}, "unit_wind": {digest.UnitWind}}
+		lv := digestLocationView{Name: name, Link: d.publicURL + permalinkPath(location.Name, location.Latitude, location.Longitude, q)}
+
+		points, err := d.forecast(ctx, location.Latitude, location.Longitude)
+		if err != nil {
+			slog.WarnContext(ctx, "digest forecast failed", "digest", digest.ID, "location", name, "error", err)
+			lv.Error = "Forecast is temporarily unavailable."
+			failed++
+			view.Locations = append(view.Locations, lv)
+			continue
+		}
+		for _, night := range points.Nights(maxCloud, maxWind) {
+			if !night.End.After(now) {
+				continue
+			}
+			if len(lv.Nights) == digestNights {
+				break
+			}
+			lv.Nights = append(lv.Nights, digestNightView{
+				Title:   fmt.Sprintf("%s: %s night", night.Date.Format("Monday, January 2"), night.Verdict()),
+				Summary: night.Summary(opts),
+				Table:   night.Points.PrintWithOptions(opts),
+			})
+		}
+		view.Locations = append(view.Locations, lv)
+	}
+	if failed == len(digest.Locations) {
+		return Email{}, errors.New("no forecast available")
+	}
+
+	var text, html bytes.Buffer
+	if err := digestTextTmpl.Execute(&text, view); err != nil {
+		return Email{}, fmt.Errorf("render text: %w", err)
+	}
+	if err := digestHTMLTmpl.Execute(&html, view); err != nil {
+		return Email{}, fmt.Errorf("render html: %w", err)
+	}
+	return Email{
+		To:      digest.Email,
+		Subject: "aweather: the next nights, " + view.Date,
+		Text:    text.String(),
+		HTML:    html.String(),
+		Headers: map[string]string{"List-Unsubscribe": "<" + unsubscribe + ">", "List-Unsubscribe-Post": "List-Unsubscribe=One-Click"},
+	}, nil
+}
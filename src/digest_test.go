@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpStandIn is a minimal in-process SMTP server that records received messages
+type smtpStandIn struct {
+	l    net.Listener
+	mu   sync.Mutex
+	msgs []string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	s := &smtpStandIn{l: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = io.WriteString(conn, line+"\r\n") }
+	reply("220 localhost ESMTP stand-in")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"), strings.HasPrefix(cmd, "RSET"), strings.HasPrefix(cmd, "NOOP"):
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			s.mu.Lock()
+			s.msgs = append(s.msgs, data.String())
+			s.mu.Unlock()
+			reply("250 OK queued")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func (s *smtpStandIn) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.msgs...)
+}
+
+// mailParts parses a received message into its headers and decoded text and HTML parts
+func mailParts(t *testing.T, raw string) (mail.Header, string, string) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("content type: %v", err)
+	}
+	var text, html string
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "text/html") {
+			html = string(body)
+		} else {
+			text = string(body)
+		}
+	}
+	return msg.Header, text, html
+}
+
+func newTestDigests(t *testing.T) (*Digests, *smtpStandIn) {
+	t.Helper()
+	server := newSMTPStandIn(t)
+	d := newDigests(openTestStore(t), &Mailer{Addr: server.l.Addr().String(), From: "aweather <noreply@example.com>"}, "https://aweather.test/", 0)
+	d.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	d.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) { return feedTestPoints(90), nil }
+	return d, server
+}
+
+func TestDigests_ConfirmAndSend(t *testing.T) {
+	d, server := newTestDigests(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/digests", d.handleCreate)
+	mux.HandleFunc("/digests/{id}", d.handleItem)
+	mux.HandleFunc("/digests/{id}/confirm", d.handleConfirm)
+	mux.HandleFunc("/digests/{id}/unsubscribe", d.handleUnsubscribe)
+
+	body := `{"email":"user@example.com","locations":[{"name":"Club","latitude":50.45,"longitude":30.52}],"send_at":"14:30"}`
+	// Links in emails point to the public URL, not to the Host the request came with
+	req := httptest.NewRequest(http.MethodPost, "http://attacker.example/digests", strings.NewReader(body))
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created Digest
+	_ = json.Unmarshal(rec.Body.Bytes(), &created)
+	if created.Token != "" || created.Confirmed || created.Timezone != "UTC" {
+		t.Fatalf("unexpected digest %+v", created)
+	}
+
+	// Nothing is sent before confirmation
+	d.now = func() time.Time { return time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC) }
+	d.runOnce(context.Background())
+	msgs := server.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("expected only the confirmation email, got %d", len(msgs))
+	}
+	_, text, _ := mailParts(t, msgs[0])
+	start := strings.Index(text, "https://aweather.test/digests/")
+	if start < 0 || strings.Contains(text, "attacker.example") {
+		t.Fatalf("no confirmation link in %q", text)
+	}
+	link := strings.Fields(text[start:])[0]
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, strings.Replace(link, "token=", "token=x", 1), nil))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a wrong token, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, link, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 on confirm, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	d.runOnce(context.Background())
+	msgs = server.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected the digest to be sent, got %d messages", len(msgs))
+	}
+	header, text, html := mailParts(t, msgs[1])
+	unsubscribe := strings.Trim(header.Get("List-Unsubscribe"), "<>")
+	if !strings.HasPrefix(unsubscribe, "https://aweather.test/digests/"+created.ID+"/unsubscribe?token=") {
+		t.Errorf("unexpected List-Unsubscribe %q", unsubscribe)
+	}
+	for _, part := range []string{text, html} {
+		for _, want := range []string{"Club", "Friday, March 1: good night", "best window 19:00 – 05:00 (10h)", "Saturday, March 2", "hour | ok?"} {
+			if !strings.Contains(part, want) {
+				t.Errorf("expected %q in digest:\n%s", want, part)
+			}
+		}
+	}
+	if !strings.Contains(html, "<pre") {
+		t.Errorf("expected the table in a <pre> block")
+	}
+
+	// Sent once per local day
+	d.runOnce(context.Background())
+	if n := len(server.messages()); n != 2 {
+		t.Fatalf("expected no second digest on the same day, got %d messages", n)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(unsubscribe, "https://aweather.test"), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 on unsubscribe, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/digests/"+created.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after unsubscribe, got %d", rec.Code)
+	}
+}
+
+func TestDigests_CreateInvalid(t *testing.T) {
+	d, server := newTestDigests(t)
+	for _, body := range []string{
+		`not json`,
+		`{"email":"not an email","locations":[{"latitude":50,"longitude":30}],"send_at":"07:00"}`,
+		`{"email":"user@example.com","locations":[],"send_at":"07:00"}`,
+		`{"email":"user@example.com","locations":[{"latitude":95,"longitude":30}],"send_at":"07:00"}`,
+		`{"email":"user@example.com","locations":[{"latitude":50,"longitude":30}],"send_at":"7am"}`,
+		`{"email":"user@example.com","locations":[{"latitude":50,"longitude":30}],"send_at":"07:00","timezone":"Mars/Base"}`,
+	} {
+		rec := httptest.NewRecorder()
+		d.handleCreate(rec, httptest.NewRequest(http.MethodPost, "/digests", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+	if n := len(server.messages()); n != 0 {
+		t.Errorf("expected no emails for invalid requests, got %d", n)
+	}
+}
+
+func TestDigests_CreateMailFailure(t *testing.T) {
+	d, _ := newTestDigests(t)
+	d.mailer.send = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		return errors.New("relay down")
+	}
+	body := `{"email":"user@example.com","locations":[{"latitude":50,"longitude":30}],"send_at":"07:00"}`
+	rec := httptest.NewRecorder()
+	d.handleCreate(rec, httptest.NewRequest(http.MethodPost, "/digests", strings.NewReader(body)))
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", rec.Code)
+	}
+	count := 0
+	_ = d.store.ForEach(digestsBucket, func(string, []byte) error { count++; return nil })
+	if count != 0 {
+		t.Fatalf("expected the unconfirmed digest to be removed, found %d", count)
+	}
+}
+
+func TestDigests_Limit(t *testing.T) {
+	d, server := newTestDigests(t)
+	d.maxRecords = 1
+	body := `{"email":"user@example.com","locations":[{"latitude":50,"longitude":30}],"send_at":"07:00"}`
+	for i, want := range []int{http.StatusCreated, http.StatusInsufficientStorage} {
+		rec := httptest.NewRecorder()
+		d.handleCreate(rec, httptest.NewRequest(http.MethodPost, "/digests", strings.NewReader(body)))
+		if rec.Code != want {
+			t.Fatalf("digest %d: expected %d, got %d", i+1, want, rec.Code)
+		}
+	}
+	if n := len(server.messages()); n != 1 {
+		t.Errorf("expected a confirmation only for the stored digest, got %d", n)
+	}
+}
+
+func TestDigestDue(t *testing.T) {
+	digest := Digest{Confirmed: true, SendAt: "07:00", Timezone: "Europe/Kyiv"}
+	// 04:30 UTC is 06:30 in Kyiv in winter
+	if _, due := digestDue(digest, time.Date(2024, 3, 1, 4, 30, 0, 0, time.UTC)); due {
+		t.Errorf("expected not due before 07:00 local")
+	}
+	today, due := digestDue(digest, time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC))
+	if !due || today != "2024-03-01" {
+		t.Errorf("expected due at 07:00 local, got %v %s", due, today)
+	}
+	digest.LastSent = "2024-03-01"
+	if _, due := digestDue(digest, time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)); due {
+		t.Errorf("expected not due twice on the same day")
+	}
+	// 22:30 UTC is already the next day in Kyiv
+	if today, due := digestDue(digest, time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)); due || today != "2024-03-02" {
+		t.Errorf("expected next local day before send time, got %v %s", due, today)
+	}
+	if _, due := digestDue(Digest{SendAt: "00:00"}, time.Now()); due {
+		t.Errorf("expected unconfirmed digest never to be due")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Atom feed document (RFC 4287), only the elements we use
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Summary string      `xml:"summary"`
+	Content atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedRequest holds the parameters shared by the feed and its entries
+type feedRequest struct {
+	Base     string // scheme and host, e.g. https://example.com
+	Name     string
+	Lat, Lon float64
+	MinHours int
+	Query    url.Values
+}
+
+// buildFeed turns upcoming nights with a clear window of at least MinHours into Atom entries.
+// An entry is updated when its content was first seen, so that refetching an unchanged
+// forecast does not bump it, and the feed is updated with its latest entry.
+func buildFeed(ctx context.Context, points DataPoints, opts PrintOptions, req feedRequest, fetchedAt, now time.Time) atomFeed {
+	host := strings.TrimPrefix(strings.TrimPrefix(req.Base, "https://"), "http://")
+	place := fmt.Sprintf("%.3f,%.3f", req.Lat, req.Lon)
+	title := req.Name
+	if title == "" {
+		title = place
+	}
+
+	permalink := req.Base + permalinkPath(req.Name, req.Lat, req.Lon, req.Query)
+	feed := atomFeed{
+		ID:     fmt.Sprintf("tag:%s,2024:feed/%s", host, place),
+		Title:  "aweather — observing nights for " + title,
+		Author: atomAuthor{Name: "aweather"},
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: req.Base + "/feed.atom?" + req.Query.Encode()},
+			{Rel: "alternate", Type: "text/html", Href: permalink},
+		},
+	}
+
+	if fetchedAt.IsZero() {
+		fetchedAt = now
+	}
+	var latest time.Time
+
+	maxCloud, maxWind := opts.thresholds()
+	for _, night := range points.Nights(maxCloud, maxWind) {
+		if !night.End.After(now) || night.Best.Hours < req.MinHours {
+			continue
+		}
+
+		summary := night.Summary(opts)
+		id := fmt.Sprintf("tag:%s,2024:night/%s/%s", host, place, night.Date.Format("2006-01-02"))
+
+		// Hourly table of the night, grouped per day like the main page
+		table := night.Points.PrintWithOptions(opts)
+		entry := atomEntry{
+			ID:      id,
+			Title:   fmt.Sprintf("%s: %s night, score %d", night.Date.Format("Monday, January 2"), night.Verdict(), night.Score()),
+			Link:    atomLink{Rel: "alternate", Type: "text/html", Href: permalink},
+			Summary: summary,
+			Content: atomContent{Type: "html", Body: "<p>" + html.EscapeString(summary) + "</p><pre>" + html.EscapeString(table) + "</pre>"},
+		}
+		updated := entryUpdated(ctx, entry, fetchedAt)
+		if updated.After(latest) {
+			latest = updated
+		}
+		entry.Updated = updated.UTC().Format(time.RFC3339)
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	if latest.IsZero() {
+		latest = fetchedAt
+	}
+	feed.Updated = latest.UTC().Format(time.RFC3339)
+	return feed
+}
+
+// entryUpdated returns when the entry's content was first seen, or seenAt when it is new. The
+// times are kept in the cache, next to the forecasts, under the entry ID and a hash of the
+// content; each read writes the time back so that it is kept while the night is in the feed.
+func entryUpdated(ctx context.Context, entry atomEntry, seenAt time.Time) time.Time {
+	sum := sha256.Sum256([]byte(entry.Title + "\n" + entry.Summary + "\n" + entry.Content.Body))
+	key := "feed:" + entry.ID + ":" + hex.EncodeToString(sum[:16])
+	if raw, err := cacheGet(ctx, key); err == nil {
+		if _, firstSeen := decodeCacheEntry(raw); !firstSeen.IsZero() {
+			seenAt = firstSeen
+		}
+	}
+	if err := cache.Set(key, encodeCacheEntry(nil, seenAt)); err != nil {
+		slog.WarnContext(ctx, "caching feed entry time failed", "error", err)
+	}
+	return seenAt
+}
+
+func handleFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	lat, lon, ok := parseCoordinates(q.Get("lat"), q.Get("lon"))
+	if !ok {
+		http.Error(w, "Valid latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+	minHours := 1
+	if v, err := strconv.Atoi(strings.TrimSpace(q.Get("min_hours"))); err == nil && v > 0 {
+		minHours = v
+	}
+
+	points, freshness, err := fetchForecastFreshness(r.Context(), lat, lon)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching weather from Open-Meteo", "error", err)
+		http.Error(w, "Upstream weather service unavailable", http.StatusBadGateway)
+		return
+	}
+	now := time.Now()
+	if setForecastCaching(w, r, freshness, hourVariant(now)) {
+		return
+	}
+	if points, err = withAstronomy(r.Context(), points, freshness); err != nil {
+		forecastCancelled(w)
+		return
+	}
+
+	req := feedRequest{Base: baseURL(r), Name: strings.TrimSpace(q.Get("name")), Lat: lat, Lon: lon, MinHours: minHours, Query: q}
+	feed := buildFeed(r.Context(), points, parsePrintOptions(q), req, freshness.FetchedAt, now)
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		slog.ErrorContext(r.Context(), "writing feed", "error", err)
+		return
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		slog.ErrorContext(r.Context(), "encoding feed", "error", err)
+	}
+}
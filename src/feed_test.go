@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// feedTestPoints returns two nights, 19:00-05:00, starting on 2024-03-01.
+// The first night is clear, the second one is overcast until 03:00.
+func feedTestPoints(secondNightCloud int64) DataPoints {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	points := DataPoints{}
+	for i := 0; i < 48; i++ {
+		t := start.Add(time.Duration(i) * time.Hour)
+		p := DataPoint{Time: t, Lat: 50.45, Lon: 30.52, Dark: t.Hour() >= 19 || t.Hour() < 5, MoonIllum: 20}
+		if i >= 24 && t.Hour() != 3 && t.Hour() != 4 {
+			p.LowClouds = secondNightCloud
+		}
+		points = append(points, p)
+	}
+	return points
+}
+
+func TestBuildFeed(t *testing.T) {
+	setupCache()
+	req := feedRequest{Base: "https://example.com", Name: "Club", Lat: 50.45, Lon: 30.52, MinHours: 1, Query: url.Values{"lat": {"50.45"}, "lon": {"30.52"}}}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	fetchedAt := now.Add(-5 * time.Minute)
+
+	feed := buildFeed(context.Background(), feedTestPoints(90), PrintOptions{}, req, fetchedAt, now)
+	if len(feed.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(feed.Entries))
+	}
+	first := feed.Entries[0]
+	if first.ID != "tag:example.com,2024:night/50.450,30.520/2024-03-01" {
+		t.Errorf("unexpected entry id %q", first.ID)
+	}
+	if !strings.Contains(first.Title, "Friday, March 1: good night") {
+		t.Errorf("unexpected entry title %q", first.Title)
+	}
+	if !strings.Contains(first.Summary, "best window 19:00 – 05:00 (10h)") {
+		t.Errorf("unexpected entry summary %q", first.Summary)
+	}
+	if !strings.Contains(feed.Entries[1].Summary, "best window 03:00 – 05:00 (2h)") {
+		t.Errorf("unexpected second entry summary %q", feed.Entries[1].Summary)
+	}
+	if first.Link.Href != "https://example.com/?lat=50.450000&lon=30.520000&name=Club" {
+		t.Errorf("unexpected entry link %q", first.Link.Href)
+	}
+
+	for i, entry := range feed.Entries {
+		if entry.Updated != fetchedAt.Format(time.RFC3339) {
+			t.Errorf("entry %d: updated %s, want the fetch time of its first appearance", i, entry.Updated)
+		}
+	}
+
+	// Refetching an unchanged forecast keeps the timestamps, on any instance sharing the cache
+	refetchedAt := fetchedAt.Add(time.Hour)
+	again := buildFeed(context.Background(), feedTestPoints(90), PrintOptions{}, req, refetchedAt, now.Add(time.Hour))
+	for i := range again.Entries {
+		if again.Entries[i].Updated != fetchedAt.Format(time.RFC3339) {
+			t.Errorf("entry %d: updated %s after an unchanged refetch", i, again.Entries[i].Updated)
+		}
+	}
+	if again.Updated != fetchedAt.Format(time.RFC3339) {
+		t.Errorf("feed updated %s after an unchanged refetch", again.Updated)
+	}
+
+	// Only the night whose content changed is bumped, and the feed follows its latest entry
+	changed := buildFeed(context.Background(), feedTestPoints(80), PrintOptions{}, req, refetchedAt, now.Add(time.Hour))
+	if changed.Entries[0].Updated != fetchedAt.Format(time.RFC3339) {
+		t.Errorf("unchanged night updated %s", changed.Entries[0].Updated)
+	}
+	if changed.Entries[1].Updated != refetchedAt.Format(time.RFC3339) || changed.Updated != refetchedAt.Format(time.RFC3339) {
+		t.Errorf("changed night updated %s, feed %s, want the refetch time", changed.Entries[1].Updated, changed.Updated)
+	}
+
+	// A feed without entries is as of the fetch, or of now without a known fetch time
+	none := feedRequest{Base: req.Base, Lat: req.Lat, Lon: req.Lon, MinHours: 24, Query: req.Query}
+	if got := buildFeed(context.Background(), feedTestPoints(90), PrintOptions{}, none, fetchedAt, now); got.Updated != fetchedAt.Format(time.RFC3339) {
+		t.Errorf("empty feed updated %s", got.Updated)
+	}
+	if got := buildFeed(context.Background(), feedTestPoints(90), PrintOptions{}, none, time.Time{}, now); got.Updated != now.Format(time.RFC3339) {
+		t.Errorf("empty feed updated %s without a fetch time", got.Updated)
+	}
+}
+
+func TestBuildFeed_MinHours(t *testing.T) {
+	setupCache()
+	req := feedRequest{Base: "https://example.com", Lat: 50.45, Lon: 30.52, MinHours: 3, Query: url.Values{}}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	feed := buildFeed(context.Background(), feedTestPoints(90), PrintOptions{}, req, now, now)
+	if len(feed.Entries) != 1 {
+		t.Fatalf("expected only the clear night, got %d entries", len(feed.Entries))
+	}
+
+	// Nights that have already ended are left out
+	feed = buildFeed(context.Background(), feedTestPoints(90), PrintOptions{}, req, now, now.Add(24*time.Hour))
+	if len(feed.Entries) != 0 {
+		t.Fatalf("expected no entries, got %d", len(feed.Entries))
+	}
+}
+
+func TestHandleFeed(t *testing.T) {
+	setupCache()
+	fakeForecastServer(t, func(i int) int64 { return 0 })
+
+	req := httptest.NewRequest(http.MethodGet, "/feed.atom?lat=50.45&lon=30.52&name=Club", nil)
+	rec := httptest.NewRecorder()
+	handleFeed(rec, req)
+
+	res := rec.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/atom+xml") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	var feed atomFeed
+	if err := xml.Unmarshal(rec.Body.Bytes(), &feed); err != nil {
+		t.Fatalf("invalid Atom XML: %v", err)
+	}
+	if !strings.Contains(feed.Title, "Club") {
+		t.Errorf("unexpected feed title %q", feed.Title)
+	}
+	if len(feed.Entries) == 0 {
+		t.Fatalf("expected entries for clear nights")
+	}
+	if !strings.Contains(feed.Entries[0].Content.Body, "<pre>") {
+		t.Errorf("expected hourly table in entry content")
+	}
+}
+
+func TestHandleFeed_BadCoordinates(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/feed.atom?lat=abc&lon=30.52", nil)
+	rec := httptest.NewRecorder()
+	handleFeed(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
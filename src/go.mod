@@ -4,11 +4,14 @@ go 1.23.4
 
 require (
 	github.com/allegro/bigcache/v3 v3.1.0
+	github.com/andybalholm/brotli v1.2.6
 	github.com/hablullah/go-sampa v1.0.0
 	github.com/soniakeys/meeus/v3 v3.0.1
+	go.etcd.io/bbolt v1.3.11
 )
 
 require (
 	github.com/hablullah/go-juliandays v1.0.1-0.20220316153050-f56193695a5b // indirect
 	github.com/soniakeys/unit v1.0.0 // indirect
+	golang.org/x/sys v0.4.0 // indirect
 )
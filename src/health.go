@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+// Set at build time with -ldflags "-X main.buildTime=… -X main.buildRevision=…", for builds
+// without VCS information such as the Docker image
+var (
+	buildTime     string
+	buildRevision string
+)
+
+// healthPaths are polled by load balancers and orchestrators; their requests are logged at debug level
+var healthPaths = map[string]bool{"/healthz": true, "/readyz": true, "/version": true}
+
+// handleHealthz reports that the process is up and serving
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, "ok\n")
+}
+
+// Readiness serves /readyz: whether the cache works and, optionally, whether Open-Meteo answers
+type Readiness struct {
+	probeUpstream bool
+	interval      time.Duration // how long an upstream probe result is reused
+	stopping      atomic.Bool   // set on shutdown so that traffic drains before the server stops
+	now           func() time.Time
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	upstream  error
+}
+
+func newReadiness(probeUpstream bool, interval time.Duration) *Readiness {
+	return &Readiness{probeUpstream: probeUpstream, interval: interval, now: time.Now}
+}
+
+// Stop makes /readyz fail from now on
+func (rd *Readiness) Stop() {
+	rd.stopping.Store(true)
+}
+
+func (rd *Readiness) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	checks := map[string]string{}
+	ready := true
+	report := func(name string, err error) {
+		checks[name] = "ok"
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+		}
+	}
+	if rd.stopping.Load() {
+		report("server", errors.New("shutting down"))
+	}
+	report("cache", checkCache())
+	if rd.probeUpstream {
+		report("upstream", rd.upstreamStatus(r.Context()))
+	}
+
+	status := http.StatusOK
+	body := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{"ok", checks}
+	if !ready {
+		status, body.Status = http.StatusServiceUnavailable, "unavailable"
+		slog.WarnContext(r.Context(), "not ready", "checks", checks)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// checkCache reads a key that is never written, which only fails when the backend does
+func checkCache() error {
+	if cache == nil {
+		return errors.New("not initialised")
+	}
+	_, err := cache.Get("readyz")
+	if err == nil || errors.Is(err, errCacheMiss) || errors.Is(err, bigcache.ErrEntryNotFound) {
+		return nil
+	}
+	return err
+}
+
+// upstreamStatus probes Open-Meteo at most once per interval; concurrent requests wait for
+// the probe in progress instead of starting their own
+func (rd *Readiness) upstreamStatus(ctx context.Context) error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	if !rd.checkedAt.IsZero() && rd.now().Sub(rd.checkedAt) < rd.interval {
+		return rd.upstream
+	}
+	rd.upstream = probeUpstream(ctx)
+	rd.checkedAt = rd.now()
+	return rd.upstream
+}
+
+// probeUpstream asks the geocoding API for a single name, the cheapest Open-Meteo call.
+// Any answer but a server error means it is reachable.
+func probeUpstream(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, OpenMeteoGeoAPIEndpoint+"?name=Kyiv&count=1", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// BuildInfo is served by /version
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // built from a working tree with uncommitted changes
+	CommitAt  string `json:"commit_time,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// readBuildInfo combines the module and VCS details embedded by the Go toolchain with the
+// values set through -ldflags
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{Version: "(devel)", Revision: buildRevision, BuildTime: buildTime}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.GoVersion = bi.GoVersion
+	if bi.Main.Version != "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.CommitAt = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(readBuildInfo()); err != nil {
+		slog.ErrorContext(r.Context(), "encoding build info", "error", err)
+	}
+}
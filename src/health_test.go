@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleHealthz(t *testing.T) {
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := httptest.NewRecorder()
+		handleHealthz(rec, httptest.NewRequest(method, "/healthz", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: status = %d, headers %v", method, rec.Code, rec.Header())
+		}
+	}
+	rec := httptest.NewRecorder()
+	handleHealthz(rec, httptest.NewRequest(http.MethodPost, "/healthz", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status = %d", rec.Code)
+	}
+}
+
+// failingCache is a backend that cannot be reached
+type failingCache struct{}
+
+func (failingCache) Get(string) ([]byte, error) { return nil, errors.New("connection refused") }
+func (failingCache) Set(string, []byte) error   { return errors.New("connection refused") }
+func (failingCache) Delete(string) error        { return errors.New("connection refused") }
+
+func readyz(t *testing.T, rd *Readiness) (int, map[string]string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	rd.handle(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var body struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, body.Checks
+}
+
+func TestReadiness_Cache(t *testing.T) {
+	original := cache
+	t.Cleanup(func() { cache = original })
+	rd := newReadiness(false, time.Minute)
+
+	setupCache()
+	if code, checks := readyz(t, rd); code != http.StatusOK || checks["cache"] != "ok" || checks["upstream"] != "" {
+		t.Errorf("memory cache: %d, %v", code, checks)
+	}
+	cache, _ = newDiskCache(t.TempDir(), time.Hour)
+	if code, _ := readyz(t, rd); code != http.StatusOK {
+		t.Errorf("disk cache: %d", code)
+	}
+	cache = failingCache{}
+	if code, checks := readyz(t, rd); code != http.StatusServiceUnavailable || checks["cache"] != "connection refused" {
+		t.Errorf("failing cache: %d, %v", code, checks)
+	}
+	cache = nil
+	if code, _ := readyz(t, rd); code != http.StatusServiceUnavailable {
+		t.Errorf("no cache: %d", code)
+	}
+
+	setupCache()
+	rd.Stop()
+	if code, checks := readyz(t, rd); code != http.StatusServiceUnavailable || checks["server"] != "shutting down" {
+		t.Errorf("stopping: %d, %v", code, checks)
+	}
+}
+
+func TestReadiness_UpstreamProbe(t *testing.T) {
+	setupCache()
+	healthy := true
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Query().Get("count") != "1" {
+			t.Errorf("unexpected probe %s", r.URL)
+		}
+		if !healthy {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"results":[]}`))
+	}))
+	defer ts.Close()
+	original := OpenMeteoGeoAPIEndpoint
+	OpenMeteoGeoAPIEndpoint = ts.URL
+	t.Cleanup(func() { OpenMeteoGeoAPIEndpoint = original })
+
+	rd := newReadiness(true, time.Minute)
+	now := time.Now()
+	rd.now = func() time.Time { return now }
+
+	if code, checks := readyz(t, rd); code != http.StatusOK || checks["upstream"] != "ok" {
+		t.Fatalf("healthy: %d, %v", code, checks)
+	}
+	// The result is reused until the interval has passed
+	healthy = false
+	readyz(t, rd)
+	if calls != 1 {
+		t.Errorf("probed %d times within the interval", calls)
+	}
+	now = now.Add(time.Minute)
+	if code, checks := readyz(t, rd); code != http.StatusServiceUnavailable || !strings.Contains(checks["upstream"], "502") {
+		t.Errorf("failing upstream: %d, %v", code, checks)
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	original := buildTime
+	buildTime = "2024-03-01T12:00:00Z"
+	t.Cleanup(func() { buildTime = original })
+
+	rec := httptest.NewRecorder()
+	handleVersion(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	var info BuildInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version == "" || !strings.HasPrefix(info.GoVersion, "go") || info.BuildTime != "2024-03-01T12:00:00Z" {
+		t.Errorf("unexpected build info %+v", info)
+	}
+}
+
+// Successful health checks are left out of the request log
+func TestWithRequestLog_HealthChecks(t *testing.T) {
+	buf := captureLogs(t, "")
+	failing := false
+	handler := withRequestLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	for _, path := range []string{"/healthz", "/readyz", "/version"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if buf.Len() != 0 {
+		t.Errorf("health checks were logged:\n%s", buf)
+	}
+
+	failing = true
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/weather", nil))
+	if lines := logLines(t, buf); len(lines) != 2 {
+		t.Errorf("expected the failed check and the other request, got:\n%v", lines)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// setForecastCaching sets the ETag, Cache-Control and freshness headers of a response rendered
+// from the forecast f, and answers a matching If-None-Match with 304 Not Modified. It returns
+// true when the response has been written; call it before setting the content headers.
+//
+// The ETag covers the upstream payload, the path and the query, so it changes with the forecast
+// and with any option; variant adds anything else the rendering depends on, such as the hour
+// for responses that leave out past nights. Caches may keep a fresh copy for CacheTTL counted
+// from when it was fetched, which Age tells them; copies served because Open-Meteo failed, or
+// whose age is unknown, have to be revalidated every time. Responses of /api/* depend on the
+// API key, which checks and counts every request, so only the client may cache them.
+func setForecastCaching(w http.ResponseWriter, r *http.Request, f Freshness, variant string) bool {
+	setFreshnessHeaders(w, f)
+	cacheControl := "public, "
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		cacheControl = "private, "
+	}
+	if f.Stale || f.FetchedAt.IsZero() {
+		cacheControl += "no-cache"
+	} else {
+		cacheControl += fmt.Sprintf("max-age=%d", int(CacheTTL.Seconds()))
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	if f.Digest == "" {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(f.Digest + "\n" + r.URL.Path + "\n" + r.URL.Query().Encode() + "\n" + variant))
+	etag := `"` + hex.EncodeToString(sum[:12]) + `"`
+	w.Header().Set("ETag", etag)
+	if !etagMatches(r.Header.Get("If-None-Match"), etag) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// forecastCancelled answers a request that the client gave up on, or whose deadline passed,
+// after setForecastCaching; the caching headers were meant for the forecast, not for the error
+func forecastCancelled(w http.ResponseWriter) {
+	for _, header := range []string{"ETag", "Cache-Control", "Age", "X-Forecast-Stale"} {
+		w.Header().Del(header)
+	}
+	http.Error(w, "Request cancelled", http.StatusServiceUnavailable)
+}
+
+// etagMatches compares an If-None-Match header with etag using the weak comparison, so that
+// tags weakened by compression still match
+func etagMatches(header, etag string) bool {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// hourVariant identifies the hour for responses that depend on the current time
+func hourVariant(now time.Time) string {
+	return now.UTC().Format("2006-01-02T15")
+}
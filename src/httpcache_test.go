@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// revalidate sends path to handler, then sends it again with the ETag it got
+func revalidate(t *testing.T, handler http.HandlerFunc, path string) (first, second *httptest.ResponseRecorder) {
+	t.Helper()
+	first = httptest.NewRecorder()
+	handler(first, httptest.NewRequest(http.MethodGet, path, nil))
+	if first.Code != http.StatusOK || first.Header().Get("ETag") == "" {
+		t.Fatalf("%s: status %d, ETag %q", path, first.Code, first.Header().Get("ETag"))
+	}
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", first.Header().Get("ETag"))
+	second = httptest.NewRecorder()
+	handler(second, req)
+	return first, second
+}
+
+func TestConditionalGet(t *testing.T) {
+	setupCache()
+	for _, tt := range []struct {
+		path    string
+		handler http.HandlerFunc
+	}{
+		{"/weather?lat=50.45&lon=30.52", handleWeather},
+		{"/api/forecast?lat=50.45&lon=30.52", handleAPIForecast},
+		{"/embed.json?lat=50.45&lon=30.52", handleEmbedJSON},
+		{"/embed?lat=50.45&lon=30.52", handleEmbed},
+		{"/chart.svg?lat=50.45&lon=30.52", handleChart},
+		{"/feed.atom?lat=50.45&lon=30.52", handleFeed},
+		{"/og.png?lat=50.45&lon=30.52", handleOGImage},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			calls := countingUpstream(t, http.StatusOK)
+			seedForecast(t, 50.45, 30.52, 2*time.Minute)
+
+			first, second := revalidate(t, tt.handler, tt.path)
+			scope := "public"
+			if strings.HasPrefix(tt.path, "/api/") {
+				scope = "private" // the response belongs to the API key
+			}
+			if want := fmt.Sprintf("%s, max-age=%d", scope, int(CacheTTL.Seconds())); first.Header().Get("Cache-Control") != want {
+				t.Errorf("Cache-Control = %q, want %q", first.Header().Get("Cache-Control"), want)
+			}
+			if second.Code != http.StatusNotModified || second.Body.Len() != 0 {
+				t.Fatalf("revalidation: status %d, %d bytes", second.Code, second.Body.Len())
+			}
+			if second.Header().Get("ETag") != first.Header().Get("ETag") || second.Header().Get("Age") == "" || second.Header().Get("Content-Type") != "" {
+				t.Errorf("304 headers %v", second.Header())
+			}
+			if calls.Load() != 0 {
+				t.Errorf("upstream called %d times", calls.Load())
+			}
+		})
+	}
+}
+
+func TestConditionalGet_Mismatch(t *testing.T) {
+	setupCache()
+	countingUpstream(t, http.StatusOK)
+	seedForecast(t, 50.45, 30.52, 2*time.Minute)
+
+	first, _ := revalidate(t, handleWeather, "/weather?lat=50.45&lon=30.52")
+	etag := first.Header().Get("ETag")
+	for name, path := range map[string]string{
+		"other units":       "/weather?lat=50.45&lon=30.52&unit_temp=f",
+		"parameter order":   "/weather?lon=30.52&lat=50.45",
+		"other coordinates": "/weather?lat=50.45&lon=30.53",
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("If-None-Match", etag)
+		rec := httptest.NewRecorder()
+		handleWeather(rec, req)
+		changed := rec.Header().Get("ETag") != etag
+		if name == "parameter order" {
+			// The query is compared in its canonical form
+			if changed || rec.Code != http.StatusNotModified {
+				t.Errorf("%s: status %d, ETag %q", name, rec.Code, rec.Header().Get("ETag"))
+			}
+			continue
+		}
+		if !changed || rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Errorf("%s: status %d, ETag %q", name, rec.Code, rec.Header().Get("ETag"))
+		}
+	}
+}
+
+// A revalidated response is answered before the astronomy pass
+func TestConditionalGet_SkipsAstronomy(t *testing.T) {
+	setupCache()
+	countingUpstream(t, http.StatusOK)
+	seedForecast(t, 50.45, 30.52, 2*time.Minute)
+	collector := newCollectorStandIn(t)
+	tr := useTracer(t, collector.URL+"/v1/traces")
+
+	_, second := revalidate(t, handleAPIForecast, "/api/forecast?lat=50.45&lon=30.52")
+	if second.Code != http.StatusNotModified {
+		t.Fatalf("revalidation: status %d", second.Code)
+	}
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(collector.spans()["astronomy"]); n != 1 {
+		t.Errorf("astronomy ran %d times for a request and its revalidation", n)
+	}
+}
+
+func TestConditionalGet_StaleForecast(t *testing.T) {
+	setupCache()
+	countingUpstream(t, http.StatusInternalServerError)
+	seedForecast(t, 50.45, 30.52, 2*time.Hour)
+
+	first, second := revalidate(t, handleAPIForecast, "/api/forecast?lat=50.45&lon=30.52")
+	if cc := first.Header().Get("Cache-Control"); cc != "private, no-cache" || first.Header().Get("X-Forecast-Stale") != "1" {
+		t.Errorf("stale forecast: Cache-Control %q, headers %v", cc, first.Header())
+	}
+	// It can still be revalidated, so clients do not download it again
+	if second.Code != http.StatusNotModified {
+		t.Errorf("revalidation: status %d", second.Code)
+	}
+}
+
+func TestSetForecastCaching(t *testing.T) {
+	etag := func(f Freshness, variant string) string {
+		rec := httptest.NewRecorder()
+		setForecastCaching(rec, httptest.NewRequest(http.MethodGet, "/weather?lat=1&lon=2", nil), f, variant)
+		return rec.Header().Get("ETag")
+	}
+	f := Freshness{FetchedAt: time.Now(), Digest: "a"}
+	base := etag(f, "")
+	if !strings.HasPrefix(base, `"`) || !strings.HasSuffix(base, `"`) {
+		t.Errorf("ETag %q is not a quoted string", base)
+	}
+	if etag(Freshness{FetchedAt: time.Now(), Digest: "b"}, "") == base {
+		t.Error("the ETag does not change with the forecast")
+	}
+	if etag(f, hourVariant(time.Now().Add(time.Hour))) == base {
+		t.Error("the ETag does not change with the variant")
+	}
+	if got := etag(Freshness{FetchedAt: time.Now()}, ""); got != "" {
+		t.Errorf("ETag %q without a digest", got)
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	for _, tt := range []struct {
+		header, etag string
+		want         bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`"abc"`, `W/"abc"`, true},
+		{`"x", "abc"`, `"abc"`, true},
+		{`*`, `"abc"`, true},
+		{`"abd"`, `"abc"`, false},
+		{``, `"abc"`, false},
+	} {
+		if got := etagMatches(tt.header, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v", tt.header, tt.etag, got)
+		}
+	}
+}
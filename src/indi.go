@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// INDI (https://www.indilib.org/develop/developer-manual/104-scripting.html) weather driver.
+// Each configured site is a device named "aweather <site>" with the standard weather properties.
+const (
+	indiMinUpdate      = 10 * time.Second
+	indiDefaultUpdate  = time.Minute
+	indiTimestampFmt   = "2006-01-02T15:04:05"
+	indiGroupMain      = "Main Control"
+	indiGroupParams    = "Parameters"
+	indiGroupStatus    = "Status"
+	indiDriverName     = "aweather"
+	indiDriverExecName = "aweather"
+)
+
+// INDI property states; WEATHER_STATUS lights use Ok for OK, Busy for WARN and Alert for ALERT
+const (
+	indiIdle  = "Idle"
+	indiOk    = "Ok"
+	indiBusy  = "Busy"
+	indiAlert = "Alert"
+)
+
+// indiVector is any def*/set*Vector element sent to clients
+type indiVector struct {
+	XMLName   xml.Name
+	Device    string        `xml:"device,attr"`
+	Name      string        `xml:"name,attr"`
+	Label     string        `xml:"label,attr,omitempty"`
+	Group     string        `xml:"group,attr,omitempty"`
+	State     string        `xml:"state,attr,omitempty"`
+	Perm      string        `xml:"perm,attr,omitempty"`
+	Rule      string        `xml:"rule,attr,omitempty"`
+	Timeout   string        `xml:"timeout,attr,omitempty"`
+	Timestamp string        `xml:"timestamp,attr,omitempty"`
+	Elements  []indiElement `xml:",any"`
+}
+
+// indiElement is a single def*/one* member of a vector
+type indiElement struct {
+	XMLName xml.Name
+	Name    string `xml:"name,attr"`
+	Label   string `xml:"label,attr,omitempty"`
+	Format  string `xml:"format,attr,omitempty"`
+	Min     string `xml:"min,attr,omitempty"`
+	Max     string `xml:"max,attr,omitempty"`
+	Step    string `xml:"step,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+// indiDelProperty removes a property, or all properties of a device when Name is empty
+type indiDelProperty struct {
+	XMLName   xml.Name `xml:"delProperty"`
+	Device    string   `xml:"device,attr"`
+	Name      string   `xml:"name,attr,omitempty"`
+	Timestamp string   `xml:"timestamp,attr,omitempty"`
+}
+
+// indiNumberDef describes a read-only weather parameter
+type indiNumberDef struct {
+	name, label, format string
+	min, max            float64
+}
+
+var indiWeatherParameters = []indiNumberDef{
+	{"WEATHER_CLOUD_COVER", "Clouds (%)", "%.0f", 0, 100},
+	{"WEATHER_WIND_SPEED", "Wind (kph)", "%.1f", 0, 200},
+	{"WEATHER_WIND_GUST", "Gust (kph)", "%.1f", 0, 300},
+	{"WEATHER_RAIN_HOURLY", "Precip (mm)", "%.1f", 0, 100},
+	{"WEATHER_TEMPERATURE", "Temperature (C)", "%.1f", -60, 60},
+	{"WEATHER_DEWPOINT", "Dew point (C)", "%.1f", -60, 60},
+	{"WEATHER_SEEING", "Seeing index", "%.1f", 0.5, 5},
+}
+
+// indiWeatherStatusLights are the parameters graded in WEATHER_STATUS
+var indiWeatherStatusLights = []string{"WEATHER_CLOUD_COVER", "WEATHER_WIND_SPEED", "WEATHER_WIND_GUST", "WEATHER_RAIN_HOURLY"}
+
+// indiServer serves the INDI XML protocol for the configured sites
+type indiServer struct {
+	sites    []Site
+	interval time.Duration // default WEATHER_UPDATE period
+
+	now      func() time.Time
+	forecast func(ctx context.Context, lat, lon float64) (DataPoints, error)
+}
+
+func newIndiServer(sites []Site) *indiServer {
+	return &indiServer{
+		sites:    sites,
+		interval: indiDefaultUpdate,
+		now:      time.Now,
+		forecast: fetchForecast,
+	}
+}
+
+// Serve accepts INDI clients on l until it is closed
+func (s *indiServer) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		slog.Info("INDI client connected", "addr", conn.RemoteAddr().String())
+		go s.serveConn(conn)
+	}
+}
+
+// startIndi listens on port and serves INDI clients in the background
+func startIndi(port int, sites []Site) (net.Listener, error) {
+	if len(sites) == 0 {
+		return nil, fmt.Errorf("indi needs at least one site in AWEATHER_SITES")
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("indi listen: %w", err)
+	}
+	go func() {
+		if err := newIndiServer(sites).Serve(listener); err != nil {
+			slog.Error("indi server", "error", err)
+		}
+	}()
+	slog.Info("INDI weather devices started", "sites", len(sites), "port", port)
+	return listener, nil
+}
+
+// indiConn is the state of a single client connection
+type indiConn struct {
+	s    *indiServer
+	conn net.Conn
+	ctx  context.Context // cancelled when the client disconnects, aborting forecast fetches
+
+	mu        sync.Mutex // guards writes and the fields below
+	connected map[int]bool
+	period    time.Duration
+	reset     chan time.Duration
+}
+
+func (s *indiServer) serveConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &indiConn{s: s, conn: conn, ctx: ctx, connected: map[int]bool{}, period: s.interval, reset: make(chan time.Duration, 1)}
+	defer func() {
+		cancel()
+		conn.Close()
+	}()
+	go c.updateLoop()
+
+	dec := xml.NewDecoder(conn)
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("INDI client", "addr", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var msg indiVector
+		if err := dec.DecodeElement(&msg, &start); err != nil {
+			slog.Warn("INDI client", "addr", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+		if err := c.handle(msg); err != nil {
+			slog.Warn("INDI client", "addr", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+	}
+}
+
+// handle dispatches one client message. Messages for other devices are ignored, as INDI clients broadcast.
+func (c *indiConn) handle(msg indiVector) error {
+	switch msg.XMLName.Local {
+	case "getProperties":
+		for i := range c.s.sites {
+			if msg.Device == "" || msg.Device == c.s.deviceName(i) {
+				if err := c.define(i, msg.Name); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case "newSwitchVector", "newNumberVector":
+		i, ok := c.s.deviceIndex(msg.Device)
+		if !ok {
+			return nil
+		}
+		return c.update(i, msg)
+	}
+	return nil
+}
+
+// define sends the definitions of a device's properties (all when name is empty)
+func (c *indiConn) define(i int, name string) error {
+	c.mu.Lock()
+	connected := c.connected[i]
+	c.mu.Unlock()
+
+	vectors := []indiVector{c.s.connectionVector(i, connected, "def"), c.s.driverInfoVector(i)}
+	if connected {
+		vectors = append(vectors, c.weatherDefs(i)...)
+	}
+	for _, v := range vectors {
+		if name != "" && v.Name != name {
+			continue
+		}
+		if err := c.send(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update applies a newSwitchVector or newNumberVector from the client
+func (c *indiConn) update(i int, msg indiVector) error {
+	values := map[string]string{}
+	for _, e := range msg.Elements {
+		values[e.Name] = strings.TrimSpace(e.Value)
+	}
+
+	switch msg.Name {
+	case "CONNECTION":
+		connect := values["CONNECT"] == "On" || (values["DISCONNECT"] == "Off" && values["CONNECT"] == "")
+		c.mu.Lock()
+		wasConnected := c.connected[i]
+		c.connected[i] = connect
+		c.mu.Unlock()
+
+		if err := c.send(c.s.connectionVector(i, connect, "set")); err != nil {
+			return err
+		}
+		switch {
+		case connect && !wasConnected:
+			for _, v := range c.weatherDefs(i) {
+				if err := c.send(v); err != nil {
+					return err
+				}
+			}
+		case !connect && wasConnected:
+			for _, name := range []string{"WEATHER_STATUS", "WEATHER_PARAMETERS", "WEATHER_UPDATE", "WEATHER_REFRESH"} {
+				if err := c.send(indiDelProperty{Device: c.s.deviceName(i), Name: name, Timestamp: c.s.timestamp()}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+
+	case "WEATHER_REFRESH":
+		if !c.isConnected(i) {
+			return nil
+		}
+		if err := c.sendWeather(i); err != nil {
+			return err
+		}
+		refresh := c.s.refreshVector(i, "set")
+		refresh.State = indiOk
+		return c.send(refresh)
+
+	case "WEATHER_UPDATE":
+		if !c.isConnected(i) {
+			return nil
+		}
+		seconds, err := strconv.ParseFloat(values["PERIOD"], 64)
+		state := indiOk
+		if err != nil || time.Duration(seconds*float64(time.Second)) < indiMinUpdate {
+			state = indiAlert
+		} else {
+			c.mu.Lock()
+			c.period = time.Duration(seconds * float64(time.Second))
+			c.mu.Unlock()
+			select {
+			case c.reset <- c.period:
+			default:
+			}
+		}
+		// The period applies to all devices of this connection
+		update := c.updateVector(i, "set")
+		update.State = state
+		return c.send(update)
+	}
+	return nil
+}
+
+// updateLoop pushes weather values to connected devices every WEATHER_UPDATE period
+func (c *indiConn) updateLoop() {
+	c.mu.Lock()
+	ticker := time.NewTicker(c.period)
+	c.mu.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case period := <-c.reset:
+			ticker.Reset(period)
+		case <-ticker.C:
+			for i := range c.s.sites {
+				if !c.isConnected(i) {
+					continue
+				}
+				if err := c.sendWeather(i); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// weatherDefs returns the weather property definitions filled with current values
+func (c *indiConn) weatherDefs(i int) []indiVector {
+	status, params := c.s.weatherVectors(c.ctx, i, "def")
+	return []indiVector{status, params, c.updateVector(i, "def"), c.s.refreshVector(i, "def")}
+}
+
+// sendWeather sends the current forecast values of a device
+func (c *indiConn) sendWeather(i int) error {
+	status, params := c.s.weatherVectors(c.ctx, i, "set")
+	if err := c.send(params); err != nil {
+		return err
+	}
+	return c.send(status)
+}
+
+func (c *indiConn) isConnected(i int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected[i]
+}
+
+// send writes a single XML message to the client
+func (c *indiConn) send(v any) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+func (c *indiConn) updateVector(i int, kind string) indiVector {
+	c.mu.Lock()
+	period := c.period
+	c.mu.Unlock()
+	v := indiVector{Name: "WEATHER_UPDATE", Label: "Update", Group: indiGroupMain, State: indiIdle, Perm: "rw", Timeout: "60"}
+	v.Elements = []indiElement{{Name: "PERIOD", Label: "Period (s)", Format: "%.0f", Min: "10", Max: "3600", Step: "10", Value: formatIndiNumber(period.Seconds())}}
+	return c.s.finish(v, i, kind, "Number")
+}
+
+func (s *indiServer) deviceName(i int) string {
+	return "aweather " + s.sites[i].Name
+}
+
+func (s *indiServer) deviceIndex(name string) (int, bool) {
+	for i := range s.sites {
+		if s.deviceName(i) == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+func (s *indiServer) timestamp() string {
+	return s.now().UTC().Format(indiTimestampFmt)
+}
+
+func (s *indiServer) connectionVector(i int, connected bool, kind string) indiVector {
+	on, off := "Off", "On"
+	if connected {
+		on, off = "On", "Off"
+	}
+	v := indiVector{Name: "CONNECTION", Label: "Connection", Group: indiGroupMain, State: indiOk, Perm: "rw", Rule: "OneOfMany", Timeout: "60"}
+	v.Elements = []indiElement{{Name: "CONNECT", Label: "Connect", Value: on}, {Name: "DISCONNECT", Label: "Disconnect", Value: off}}
+	return s.finish(v, i, kind, "Switch")
+}
+
+func (s *indiServer) driverInfoVector(i int) indiVector {
+	v := indiVector{Name: "DRIVER_INFO", Label: "Driver Info", Group: "General Info", State: indiIdle, Perm: "ro", Timeout: "60"}
+	v.Elements = []indiElement{
+		{Name: "DRIVER_NAME", Label: "Name", Value: indiDriverName},
+		{Name: "DRIVER_EXEC", Label: "Exec", Value: indiDriverExecName},
+		{Name: "DRIVER_VERSION", Label: "Version", Value: "1.0"},
+		{Name: "DRIVER_INTERFACE", Label: "Interface", Value: "128"}, // WEATHER_INTERFACE
+	}
+	return s.finish(v, i, "def", "Text")
+}
+
+func (s *indiServer) refreshVector(i int, kind string) indiVector {
+	v := indiVector{Name: "WEATHER_REFRESH", Label: "Refresh", Group: indiGroupMain, State: indiIdle, Perm: "rw", Rule: "AtMostOne", Timeout: "60"}
+	v.Elements = []indiElement{{Name: "REFRESH", Label: "Refresh", Value: "Off"}}
+	return s.finish(v, i, kind, "Switch")
+}
+
+// weatherVectors returns WEATHER_STATUS and WEATHER_PARAMETERS for the current forecast hour.
+// Both are in Alert state when the forecast is unavailable.
+func (s *indiServer) weatherVectors(ctx context.Context, i int, kind string) (indiVector, indiVector) {
+	status := indiVector{Name: "WEATHER_STATUS", Label: "Status", Group: indiGroupStatus, State: indiIdle}
+	params := indiVector{Name: "WEATHER_PARAMETERS", Label: "Parameters", Group: indiGroupParams, State: indiIdle, Perm: "ro", Timeout: "60"}
+
+	point, err := s.current(ctx, i)
+	if err != nil {
+		slog.WarnContext(ctx, "indi forecast failed", "site", s.sites[i].Name, "error", err)
+		status.State, params.State = indiAlert, indiAlert
+		for _, name := range indiWeatherStatusLights {
+			status.Elements = append(status.Elements, indiElement{Name: name, Label: name, Value: indiAlert})
+		}
+		for _, p := range indiWeatherParameters {
+			params.Elements = append(params.Elements, p.element(0))
+		}
+		return s.finish(status, i, kind, "Light"), s.finish(params, i, kind, "Number")
+	}
+
+	values := map[string]float64{
+		"WEATHER_CLOUD_COVER": float64(max(point.LowClouds, point.MidClouds, point.HighClouds)),
+		"WEATHER_WIND_SPEED":  point.WindSpeed,
+		"WEATHER_WIND_GUST":   point.WindGusts,
+		"WEATHER_RAIN_HOURLY": point.Precipitation,
+		"WEATHER_TEMPERATURE": point.Temperature2M,
+		"WEATHER_DEWPOINT":    point.DewPoint,
+		"WEATHER_SEEING":      point.Seeing,
+	}
+	for _, p := range indiWeatherParameters {
+		params.Elements = append(params.Elements, p.element(values[p.name]))
+	}
+	params.State = indiOk
+
+	lights := weatherStatus(point, PrintOptions{})
+	status.State = indiOk
+	for _, name := range indiWeatherStatusLights {
+		status.Elements = append(status.Elements, indiElement{Name: name, Label: name, Value: lights[name]})
+		status.State = worseIndiState(status.State, lights[name])
+	}
+	return s.finish(status, i, kind, "Light"), s.finish(params, i, kind, "Number")
+}
+
+// current fetches the site's forecast and returns its current hour
+func (s *indiServer) current(ctx context.Context, i int) (DataPoint, error) {
+	site := s.sites[i]
+	points, err := s.forecast(ctx, site.Lat, site.Lon)
+	if err != nil {
+		return DataPoint{}, fmt.Errorf("fetch forecast: %w", err)
+	}
+	return points.current(s.now())
+}
+
+// finish fills in device, timestamp and the element names for a def or set message.
+// Set messages only carry name, state, timeout and values.
+func (s *indiServer) finish(v indiVector, i int, kind, typ string) indiVector {
+	v.Device = s.deviceName(i)
+	v.Timestamp = s.timestamp()
+	v.XMLName = xml.Name{Local: kind + typ + "Vector"}
+	element := "def" + typ
+	if kind == "set" {
+		element = "one" + typ
+		v.Label, v.Group, v.Perm, v.Rule = "", "", "", ""
+	}
+	for j := range v.Elements {
+		v.Elements[j].XMLName = xml.Name{Local: element}
+		if kind == "set" {
+			e := &v.Elements[j]
+			e.Label, e.Format, e.Min, e.Max, e.Step = "", "", "", "", ""
+		}
+	}
+	return v
+}
+
+func (p indiNumberDef) element(value float64) indiElement {
+	return indiElement{
+		Name:   p.name,
+		Label:  p.label,
+		Format: p.format,
+		Min:    formatIndiNumber(p.min),
+		Max:    formatIndiNumber(p.max),
+		Step:   "0",
+		Value:  formatIndiNumber(value),
+	}
+}
+
+func formatIndiNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// weatherStatus grades the parameters behind isGood: Ok within the threshold,
+// Busy (warning) up to twice the cloud or 1.5× the wind limit, Alert beyond that or with any precipitation
+func weatherStatus(point DataPoint, opts PrintOptions) map[string]string {
+	maxCloud, maxWind := opts.thresholds()
+	grade := func(value, limit, warnLimit float64) string {
+		switch {
+		case value <= limit:
+			return indiOk
+		case value <= warnLimit:
+			return indiBusy
+		default:
+			return indiAlert
+		}
+	}
+	cloud := float64(max(point.LowClouds, point.MidClouds, point.HighClouds))
+	rain := indiOk
+	if point.Precipitation > 0 {
+		rain = indiAlert
+	}
+	return map[string]string{
+		"WEATHER_CLOUD_COVER": grade(cloud, float64(maxCloud), 2*float64(maxCloud)),
+		"WEATHER_WIND_SPEED":  grade(point.WindSpeed, maxWind, 1.5*maxWind),
+		"WEATHER_WIND_GUST":   grade(point.WindGusts, maxWind, 1.5*maxWind),
+		"WEATHER_RAIN_HOURLY": rain,
+	}
+}
+
+// worseIndiState returns the more severe of two states
+func worseIndiState(a, b string) string {
+	rank := map[string]int{indiIdle: 0, indiOk: 1, indiBusy: 2, indiAlert: 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// indiTestClient reads INDI messages from a driver connection
+type indiTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *xml.Decoder
+}
+
+func newIndiTestClient(t *testing.T, point DataPoint, fetchErr error, interval time.Duration) *indiTestClient {
+	t.Helper()
+	s := newIndiServer([]Site{{Name: "home", Lat: 50.45, Lon: 30.52}, {Name: "club", Lat: 49.84, Lon: 24.03}})
+	s.interval = interval
+	s.now = func() time.Time { return time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC) }
+	s.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) {
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		point.Time = time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC)
+		return DataPoints{point}, nil
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go s.Serve(listener)
+	t.Cleanup(func() { listener.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &indiTestClient{t: t, conn: conn, dec: xml.NewDecoder(conn)}
+}
+
+func (c *indiTestClient) send(msg string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(msg)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// next returns the next message, skipping messages for other devices or properties
+func (c *indiTestClient) next(tag, device, name string) indiVector {
+	c.t.Helper()
+	for {
+		var v indiVector
+		if err := c.dec.Decode(&v); err != nil {
+			c.t.Fatalf("waiting for %s %s: %v", tag, name, err)
+		}
+		if v.XMLName.Local == tag && v.Device == device && v.Name == name {
+			return v
+		}
+	}
+}
+
+func elementValues(v indiVector) map[string]string {
+	values := map[string]string{}
+	for _, e := range v.Elements {
+		values[e.Name] = e.Value
+	}
+	return values
+}
+
+func TestIndi_ConnectAndReadWeather(t *testing.T) {
+	point := DataPoint{LowClouds: 40, WindSpeed: 5, WindGusts: 30, Temperature2M: 8, DewPoint: 2, Seeing: 1.2}
+	c := newIndiTestClient(t, point, nil, time.Hour)
+
+	c.send(`<getProperties version="1.7"/>`)
+	conn := c.next("defSwitchVector", "aweather home", "CONNECTION")
+	if elementValues(conn)["DISCONNECT"] != "On" || conn.Elements[0].XMLName.Local != "defSwitch" {
+		t.Fatalf("unexpected CONNECTION definition %+v", conn)
+	}
+	c.next("defSwitchVector", "aweather club", "CONNECTION")
+
+	c.send(`<newSwitchVector device="aweather home" name="CONNECTION"><oneSwitch name="CONNECT">On</oneSwitch><oneSwitch name="DISCONNECT">Off</oneSwitch></newSwitchVector>`)
+	if v := c.next("setSwitchVector", "aweather home", "CONNECTION"); elementValues(v)["CONNECT"] != "On" {
+		t.Fatalf("expected connected, got %+v", v)
+	}
+
+	status := c.next("defLightVector", "aweather home", "WEATHER_STATUS")
+	lights := elementValues(status)
+	if status.State != indiAlert || lights["WEATHER_CLOUD_COVER"] != indiBusy || lights["WEATHER_WIND_SPEED"] != indiOk || lights["WEATHER_WIND_GUST"] != indiAlert {
+		t.Fatalf("unexpected WEATHER_STATUS %+v", status)
+	}
+
+	params := c.next("defNumberVector", "aweather home", "WEATHER_PARAMETERS")
+	values := elementValues(params)
+	if values["WEATHER_CLOUD_COVER"] != "40" || values["WEATHER_TEMPERATURE"] != "8" || values["WEATHER_DEWPOINT"] != "2" || values["WEATHER_SEEING"] != "1.2" {
+		t.Fatalf("unexpected WEATHER_PARAMETERS %+v", params)
+	}
+
+	// Refresh pushes values as set messages without definitions
+	c.send(`<newSwitchVector device="aweather home" name="WEATHER_REFRESH"><oneSwitch name="REFRESH">On</oneSwitch></newSwitchVector>`)
+	set := c.next("setNumberVector", "aweather home", "WEATHER_PARAMETERS")
+	if set.Elements[0].XMLName.Local != "oneNumber" || set.Elements[0].Min != "" {
+		t.Fatalf("unexpected set message %+v", set)
+	}
+	c.next("setLightVector", "aweather home", "WEATHER_STATUS")
+
+	// Disconnecting removes the weather properties
+	c.send(`<newSwitchVector device="aweather home" name="CONNECTION"><oneSwitch name="DISCONNECT">On</oneSwitch></newSwitchVector>`)
+	c.next("setSwitchVector", "aweather home", "CONNECTION")
+	var del indiDelProperty
+	if err := c.dec.Decode(&del); err != nil || del.Name != "WEATHER_STATUS" {
+		t.Fatalf("expected delProperty for WEATHER_STATUS, got %+v (%v)", del, err)
+	}
+}
+
+func TestIndi_PeriodicUpdates(t *testing.T) {
+	c := newIndiTestClient(t, DataPoint{}, nil, 20*time.Millisecond)
+	c.send(`<newSwitchVector device="aweather club" name="CONNECTION"><oneSwitch name="CONNECT">On</oneSwitch></newSwitchVector>`)
+	for i := 0; i < 2; i++ {
+		status := c.next("setLightVector", "aweather club", "WEATHER_STATUS")
+		if status.State != indiOk {
+			t.Fatalf("expected Ok status for a clear hour, got %+v", status)
+		}
+	}
+}
+
+func TestIndi_UpstreamError(t *testing.T) {
+	c := newIndiTestClient(t, DataPoint{}, errors.New("boom"), time.Hour)
+	c.send(`<newSwitchVector device="aweather home" name="CONNECTION"><oneSwitch name="CONNECT">On</oneSwitch></newSwitchVector>`)
+	if status := c.next("defLightVector", "aweather home", "WEATHER_STATUS"); status.State != indiAlert {
+		t.Fatalf("expected Alert when the forecast is unavailable, got %+v", status)
+	}
+}
+
+func TestIndi_UpdatePeriod(t *testing.T) {
+	c := newIndiTestClient(t, DataPoint{}, nil, time.Hour)
+	c.send(`<newSwitchVector device="aweather home" name="CONNECTION"><oneSwitch name="CONNECT">On</oneSwitch></newSwitchVector>`)
+	c.next("defNumberVector", "aweather home", "WEATHER_UPDATE")
+
+	c.send(`<newNumberVector device="aweather home" name="WEATHER_UPDATE"><oneNumber name="PERIOD">5</oneNumber></newNumberVector>`)
+	if v := c.next("setNumberVector", "aweather home", "WEATHER_UPDATE"); v.State != indiAlert || elementValues(v)["PERIOD"] != "3600" {
+		t.Fatalf("expected a too short period to be rejected, got %+v", v)
+	}
+	c.send(`<newNumberVector device="aweather home" name="WEATHER_UPDATE"><oneNumber name="PERIOD">120</oneNumber></newNumberVector>`)
+	if v := c.next("setNumberVector", "aweather home", "WEATHER_UPDATE"); v.State != indiOk || elementValues(v)["PERIOD"] != "120" {
+		t.Fatalf("expected period 120, got %+v", v)
+	}
+}
+
+func TestWeatherStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		point DataPoint
+		opts  PrintOptions
+		want  map[string]string
+	}{
+		{"clear", DataPoint{}, PrintOptions{}, map[string]string{"WEATHER_CLOUD_COVER": indiOk, "WEATHER_WIND_SPEED": indiOk, "WEATHER_WIND_GUST": indiOk, "WEATHER_RAIN_HOURLY": indiOk}},
+		{"warn", DataPoint{HighClouds: 50, WindSpeed: 20, WindGusts: 22.5}, PrintOptions{}, map[string]string{"WEATHER_CLOUD_COVER": indiBusy, "WEATHER_WIND_SPEED": indiBusy, "WEATHER_WIND_GUST": indiBusy, "WEATHER_RAIN_HOURLY": indiOk}},
+		{"alert", DataPoint{MidClouds: 51, WindSpeed: 23, Precipitation: 0.1}, PrintOptions{}, map[string]string{"WEATHER_CLOUD_COVER": indiAlert, "WEATHER_WIND_SPEED": indiAlert, "WEATHER_WIND_GUST": indiOk, "WEATHER_RAIN_HOURLY": indiAlert}},
+		{"custom thresholds", DataPoint{LowClouds: 50, WindSpeed: 20}, PrintOptions{MaxCloudCover: 60, MaxWindSpeed: 25}, map[string]string{"WEATHER_CLOUD_COVER": indiOk, "WEATHER_WIND_SPEED": indiOk, "WEATHER_WIND_GUST": indiOk, "WEATHER_RAIN_HOURLY": indiOk}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := weatherStatus(tc.point, tc.opts)
+			for name, want := range tc.want {
+				if got[name] != want {
+					t.Errorf("%s: expected %s, got %s", name, want, got[name])
+				}
+			}
+		})
+	}
+}
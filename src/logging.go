@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logLevel is shared by the default logger so the level can be set once at startup
+var logLevel = new(slog.LevelVar)
+
+// setupLogging makes a JSON logger the default. The log package is routed through it too,
+// so output from dependencies ends up as JSON as well.
+func setupLogging(w io.Writer, level string) error {
+	if level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	slog.SetDefault(newLogger(w, logLevel, os.Getenv("GOOGLE_CLOUD_PROJECT")))
+	return nil
+}
+
+// newLogger writes JSON lines in the format Cloud Logging parses
+func newLogger(w io.Writer, level slog.Leveler, project string) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level, ReplaceAttr: cloudLoggingAttr})
+	return slog.New(&contextHandler{Handler: handler, project: project})
+}
+
+// cloudLoggingAttr renames the level and message keys to the ones Cloud Logging understands
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		severity := a.Value.String()
+		if severity == "WARN" {
+			severity = "WARNING"
+		}
+		return slog.String("severity", severity)
+	case slog.MessageKey:
+		a.Key = "message"
+	}
+	return a
+}
+
+// contextHandler adds the request ID from the context to every record
+type contextHandler struct {
+	slog.Handler
+	project string // Google Cloud project, links log lines to their Cloud Trace
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info, ok := ctx.Value(requestInfoKey{}).(requestInfo); ok {
+		r.AddAttrs(slog.String("request_id", info.id))
+		if (info.traced || tracer != nil) && h.project != "" {
+			r.AddAttrs(slog.String("logging.googleapis.com/trace", "projects/"+h.project+"/traces/"+info.id))
+		}
+	}
+	if span, ok := ctx.Value(spanKey{}).(*Span); ok && span != nil {
+		r.AddAttrs(slog.String("logging.googleapis.com/spanId", hex.EncodeToString(span.spanID[:])))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs), project: h.project}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name), project: h.project}
+}
+
+type requestInfoKey struct{}
+
+type requestInfo struct {
+	id     string
+	traced bool   // id is a trace ID propagated by the load balancer or the caller
+	parent string // caller's span ID in hex, when traced
+}
+
+// requestInfoFromHeaders takes the trace ID from X-Cloud-Trace-Context or traceparent,
+// or generates a random ID when neither is present or valid
+func requestInfoFromHeaders(h http.Header) requestInfo {
+	// X-Cloud-Trace-Context: TRACE_ID/SPAN_ID;o=OPTIONS
+	if v := h.Get("X-Cloud-Trace-Context"); v != "" {
+		trace, rest, _ := strings.Cut(v, "/")
+		if isTraceID(trace) {
+			info := requestInfo{id: strings.ToLower(trace), traced: true}
+			// The span ID is decimal here
+			spanID, _, _ := strings.Cut(rest, ";")
+			if n, err := strconv.ParseUint(spanID, 10, 64); err == nil && n != 0 {
+				info.parent = fmt.Sprintf("%016x", n)
+			}
+			return info
+		}
+	}
+	// traceparent: VERSION-TRACE_ID-PARENT_ID-FLAGS (W3C Trace Context)
+	if parts := strings.Split(h.Get("traceparent"), "-"); len(parts) == 4 && isTraceID(parts[1]) {
+		info := requestInfo{id: strings.ToLower(parts[1]), traced: true}
+		if len(parts[2]) == 16 && strings.Trim(parts[2], "0") != "" {
+			if _, err := hex.DecodeString(parts[2]); err == nil {
+				info.parent = strings.ToLower(parts[2])
+			}
+		}
+		return info
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return requestInfo{id: hex.EncodeToString(id)}
+}
+
+// isTraceID reports whether s is 32 hex digits and not all zeros
+func isTraceID(s string) bool {
+	if len(s) != 32 || strings.Trim(s, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// withRequestLog tags each request with an ID and logs it once it has been served
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := requestInfoFromHeaders(r.Header)
+		ctx := context.WithValue(r.Context(), requestInfoKey{}, info)
+		w.Header().Set("X-Request-Id", info.id)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// Health checks arrive every few seconds, so they are only logged when they fail
+		level := slog.LevelInfo
+		if healthPaths[r.URL.Path] && rec.status < 400 {
+			level = slog.LevelDebug
+		}
+
+		// httpRequest is the structured request entry Cloud Logging shows in its request view
+		slog.Log(ctx, level, "request", slog.Group("httpRequest",
+			"requestMethod", r.Method,
+			"requestUrl", r.URL.Path,
+			"status", rec.status,
+			"userAgent", r.UserAgent(),
+			"remoteIp", r.RemoteAddr,
+			"latency", fmt.Sprintf("%.3fs", time.Since(start).Seconds()),
+		))
+	})
+}
+
+// roundCoord rounds a coordinate to two decimals (about 1 km), enough to debug a forecast
+// without pinpointing where somebody lives
+func roundCoord(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// coords is a log attribute for a location at reduced precision
+func coords(lat, lon float64) slog.Attr {
+	return slog.Group("location", "lat", roundCoord(lat), "lon", roundCoord(lon))
+}
+
+// fatal logs an error and exits, for configuration problems at startup
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs makes a JSON logger writing to the returned buffer the default for the test
+func captureLogs(t *testing.T, project string) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(newLogger(&buf, slog.LevelInfo, project))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// logLines decodes the JSON lines written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var lines []map[string]any
+	dec := json.NewDecoder(buf)
+	for {
+		var line map[string]any
+		if err := dec.Decode(&line); err == io.EOF {
+			return lines
+		} else if err != nil {
+			t.Fatalf("log output is not JSON: %v", err)
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestRequestInfoFromHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name, header, value string
+		id                  string
+		traced              bool
+	}{
+		{"cloud trace", "X-Cloud-Trace-Context", "4BF92F3577B34DA6A3CE929D0E0E4736/1;o=1", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"traceparent", "traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736", true},
+		{"invalid traceparent", "traceparent", "00-nothex-00f067aa0ba902b7-01", "", false},
+		{"zero trace", "X-Cloud-Trace-Context", "00000000000000000000000000000000/1", "", false},
+		{"none", "", "", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.header != "" {
+				h.Set(tt.header, tt.value)
+			}
+			info := requestInfoFromHeaders(h)
+			if info.traced != tt.traced {
+				t.Errorf("traced = %v, want %v", info.traced, tt.traced)
+			}
+			if tt.id != "" && info.id != tt.id {
+				t.Errorf("id = %q, want %q", info.id, tt.id)
+			}
+			if !isTraceID(info.id) {
+				t.Errorf("id %q is not 32 hex digits", info.id)
+			}
+		})
+	}
+
+	// Generated IDs differ between requests
+	if a, b := requestInfoFromHeaders(http.Header{}), requestInfoFromHeaders(http.Header{}); a.id == b.id {
+		t.Errorf("generated the same ID twice: %s", a.id)
+	}
+}
+
+func TestWithRequestLog(t *testing.T) {
+	buf := captureLogs(t, "my-project")
+	handler := withRequestLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slog.InfoContext(r.Context(), "inside handler", coords(50.450123, 30.523456))
+		slog.Warn("no request context")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/weather?lat=50.450123&lon=30.523456", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("X-Cloud-Trace-Context", "4bf92f3577b34da6a3ce929d0e0e4736/1;o=1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Request-Id"); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("X-Request-Id = %q", got)
+	}
+
+	lines := logLines(t, buf)
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 log lines, got %d:\n%s", len(lines), buf.String())
+	}
+	inside, outside, access := lines[0], lines[1], lines[2]
+
+	if inside["message"] != "inside handler" || inside["severity"] != "INFO" {
+		t.Errorf("unexpected handler line: %v", inside)
+	}
+	if inside["request_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("handler line lacks the request ID: %v", inside)
+	}
+	if inside["logging.googleapis.com/trace"] != "projects/my-project/traces/4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("handler line lacks the trace: %v", inside)
+	}
+	location, _ := inside["location"].(map[string]any)
+	if location["lat"] != 50.45 || location["lon"] != 30.52 {
+		t.Errorf("location not rounded: %v", inside["location"])
+	}
+
+	if outside["severity"] != "WARNING" {
+		t.Errorf("severity = %v, want WARNING", outside["severity"])
+	}
+	if _, ok := outside["request_id"]; ok {
+		t.Errorf("line logged without the request context has a request ID: %v", outside)
+	}
+
+	httpRequest, _ := access["httpRequest"].(map[string]any)
+	if access["request_id"] != "4bf92f3577b34da6a3ce929d0e0e4736" || httpRequest == nil {
+		t.Fatalf("unexpected access log line: %v", access)
+	}
+	if httpRequest["requestUrl"] != "/weather" || httpRequest["status"] != float64(http.StatusTeapot) || httpRequest["userAgent"] != "test-agent" {
+		t.Errorf("unexpected httpRequest: %v", httpRequest)
+	}
+	// Query strings carry full coordinates and are not logged
+	if strings.Contains(buf.String(), "50.450123") {
+		t.Errorf("log output contains full-precision coordinates")
+	}
+}
+
+func TestSetupLogging_Level(t *testing.T) {
+	previous := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(previous)
+		logLevel.Set(slog.LevelInfo)
+	})
+
+	var buf bytes.Buffer
+	if err := setupLogging(&buf, "warn"); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("hidden")
+	slog.Error("shown")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, `"severity":"ERROR"`) {
+		t.Errorf("unexpected output at warn level: %s", out)
+	}
+
+	if err := setupLogging(&buf, "verbose"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
+
+func TestFetchData_LogsRequestID(t *testing.T) {
+	setupCache()
+	buf := captureLogs(t, "")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"latitude": 52.52}`))
+	}))
+	defer server.Close()
+
+	handler := withRequestLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response OpenMeteoAPIResponse
+		if err := response.FetchData(r.Context(), server.URL+"?", "temperature_2m", "52.520008", "13.404954"); err != nil {
+			t.Error(err)
+		}
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/weather", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := logLines(t, buf)
+	if len(lines) == 0 || lines[0]["message"] != "fetching forecast from Open-Meteo" {
+		t.Fatalf("expected an upstream fetch log line, got:\n%s", buf.String())
+	}
+	for _, line := range lines {
+		if line["request_id"] != "0af7651916cd43dd8448eb211c80319c" {
+			t.Errorf("line without the request ID: %v", line)
+		}
+	}
+	if strings.Contains(buf.String(), "52.520008") {
+		t.Errorf("log output contains full-precision coordinates")
+	}
+}
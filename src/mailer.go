@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mailer sends multipart emails through an SMTP relay
+type Mailer struct {
+	Addr     string // host:port
+	Username string // optional; PLAIN auth is used when set
+	Password string
+	From     string
+
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// mailerFromConfig configures a Mailer from the smtp_* settings; it returns nil when smtp_addr is not set
+func mailerFromConfig(cfg Config) (*Mailer, error) {
+	addr := cfg.SMTPAddr
+	if addr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("smtp_addr must be host:port: %w", err)
+	}
+	if cfg.SMTPFrom == "" {
+		return nil, fmt.Errorf("smtp_from is required")
+	}
+	return &Mailer{
+		Addr:     addr,
+		Username: cfg.SMTPUsername,
+		Password: cfg.SMTPPassword,
+		From:     cfg.SMTPFrom,
+		send:     smtp.SendMail,
+	}, nil
+}
+
+// Email is a message with plain-text and HTML alternatives
+type Email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+	Headers map[string]string // extra headers, e.g. List-Unsubscribe
+}
+
+// Send delivers the email. smtp.SendMail upgrades to STARTTLS when the server offers it.
+func (m *Mailer) Send(email Email) error {
+	msg, err := m.buildMessage(email, time.Now())
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	send := m.send
+	if send == nil {
+		send = smtp.SendMail
+	}
+	if err := send(m.Addr, auth, m.From, []string{email.To}, msg); err != nil {
+		return fmt.Errorf("smtp send: %w", err)
+	}
+	return nil
+}
+
+// buildMessage renders a multipart/alternative MIME message with quoted-printable parts
+func (m *Mailer) buildMessage(email Email, now time.Time) ([]byte, error) {
+	for _, v := range []string{email.To, email.Subject} {
+		if strings.ContainsAny(v, "\r\n") {
+			return nil, fmt.Errorf("invalid header value %q", v)
+		}
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+	header("From", m.From)
+	header("To", email.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", email.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@aweather>", randomHex(16)))
+	header("MIME-Version", "1.0")
+	names := make([]string, 0, len(email.Headers))
+	for name := range email.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.ContainsAny(name+email.Headers[name], "\r\n") {
+			return nil, fmt.Errorf("invalid header %q", name)
+		}
+		header(name, email.Headers[name])
+	}
+	header("Content-Type", "multipart/alternative; boundary="+parts.Boundary())
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
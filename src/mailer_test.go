@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildMessage(t *testing.T) {
+	m := &Mailer{From: "aweather <noreply@example.com>"}
+	email := Email{
+		To:      "user@example.com",
+		Subject: "Ясне небо tonight",
+		Text:    "plain body with a long line " + strings.Repeat("x", 100),
+		HTML:    "<p>html body</p>",
+		Headers: map[string]string{"List-Unsubscribe": "<https://example.com/u>"},
+	}
+	raw, err := m.buildMessage(email, time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject")); subject != email.Subject {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if msg.Header.Get("List-Unsubscribe") != "<https://example.com/u>" || msg.Header.Get("To") != "user@example.com" {
+		t.Errorf("unexpected headers %v", msg.Header)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("unexpected content type %q: %v", mediaType, err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	bodies := map[string]string{}
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("next part: %v", err)
+		}
+		body, _ := io.ReadAll(part) // quoted-printable is decoded by NextPart
+		bodies[part.Header.Get("Content-Type")] = string(body)
+	}
+	if bodies["text/plain; charset=utf-8"] != email.Text || bodies["text/html; charset=utf-8"] != email.HTML {
+		t.Errorf("unexpected parts %q", bodies)
+	}
+}
+
+func TestBuildMessage_RejectsHeaderInjection(t *testing.T) {
+	m := &Mailer{From: "noreply@example.com"}
+	for _, email := range []Email{
+		{To: "user@example.com\r\nBcc: other@example.com"},
+		{To: "user@example.com", Subject: "hi\nBcc: other@example.com"},
+		{To: "user@example.com", Headers: map[string]string{"X-Test": "a\r\nBcc: other@example.com"}},
+	} {
+		if _, err := m.buildMessage(email, time.Now()); err == nil {
+			t.Errorf("expected error for %+v", email)
+		}
+	}
+}
+
+func TestMailer_SendUsesAuth(t *testing.T) {
+	var gotAuth smtp.Auth
+	var gotTo []string
+	m := &Mailer{Addr: "smtp.example.com:587", Username: "user", Password: "pass", From: "noreply@example.com",
+		send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			gotAuth, gotTo = a, to
+			return nil
+		}}
+	if err := m.Send(Email{To: "user@example.com", Text: "hi"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if gotAuth == nil || len(gotTo) != 1 || gotTo[0] != "user@example.com" {
+		t.Errorf("unexpected send call %v %v", gotAuth, gotTo)
+	}
+}
+
+func TestMailerFromConfig(t *testing.T) {
+	cfg := defaultConfig()
+	if m, err := mailerFromConfig(cfg); m != nil || err != nil {
+		t.Fatalf("expected no mailer without smtp_addr, got %v, %v", m, err)
+	}
+	cfg.SMTPAddr = "localhost"
+	if _, err := mailerFromConfig(cfg); err == nil {
+		t.Errorf("expected error for address without port")
+	}
+	cfg.SMTPAddr = "localhost:25"
+	if _, err := mailerFromConfig(cfg); err == nil {
+		t.Errorf("expected error without smtp_from")
+	}
+	cfg.SMTPFrom = "noreply@example.com"
+	if m, err := mailerFromConfig(cfg); err != nil || m.Addr != "localhost:25" {
+		t.Errorf("unexpected mailer %+v, %v", m, err)
+	}
+}
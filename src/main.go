@@ -4,47 +4,92 @@ import (
 	"context"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
-
-	"github.com/allegro/bigcache/v3"
 )
 
-const (
-	MaxCloudCover = 25               // percentage
-	MaxWindSpeed  = 15               // km/h
-	CacheTTL      = 10 * time.Minute // cache TTL
-)
+const RequestTimeout = 10 * time.Second // default deadline for handling a request, upstream calls included
 
+// Defaults of the settings in Config; Config.setGlobals replaces them with the effective values
 var (
+	MaxCloudCover      int64   = 25               // percentage
+	MaxWindSpeed       float64 = 15               // km/h
+	CacheTTL                   = 10 * time.Minute // cache TTL
+	CacheRevalidateTTL         = 30 * time.Minute // older forecasts are served while refreshed in the background
+	CacheStaleTTL              = 6 * time.Hour    // forecasts are kept this long to serve when Open-Meteo fails
+	PublicURL                  = ""               // where the site is reached; empty to go by each request's Host
+
 	OpenMeteoAPIEndpoint           = "https://api.open-meteo.com/v1/forecast?"
 	OpenMeteoGeoAPIEndpoint        = "https://geocoding-api.open-meteo.com/v1/search"
 	OpenMeteoGeoReverseAPIEndpoint = "https://geocoding-api.open-meteo.com/v1/reverse"
-	OpenMeteoAPIParams             = "temperature_2m,cloud_cover_low,cloud_cover_mid,cloud_cover_high,wind_speed_10m,wind_gusts_10m,wind_speed_200hPa,temperature_500hPa,temperature_850hPa,wind_speed_850hPa,geopotential_height_850hPa,geopotential_height_500hPa"
+	OpenMeteoAPIParams             = defaultForecastParams
 )
 
-var cache *bigcache.BigCache
+// defaultForecastParams are the hourly variables requested from Open-Meteo
+const defaultForecastParams = "temperature_2m,cloud_cover_low,cloud_cover_mid,cloud_cover_high,wind_speed_10m,wind_gusts_10m,wind_speed_200hPa,temperature_500hPa,temperature_850hPa,wind_speed_850hPa,geopotential_height_850hPa,geopotential_height_500hPa,dew_point_2m,precipitation"
 
 func main() {
-	// Initialize cache with bounded size
-	cacheConfig := bigcache.DefaultConfig(CacheTTL)
-	cacheConfig.MaxEntrySize = 128 * 1024 // bytes; weather payloads can be large
-	cacheConfig.HardMaxCacheSize = 32     // MB, keeps memory bounded on Cloud Run
-	c, err := bigcache.New(context.Background(), cacheConfig)
+	// Admin subcommands print their result and exit
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfigCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "apikey" {
+		if err := runAPIKeyCommandLine(os.Args[2:], os.Getenv, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Flags > environment > config file > defaults
+	cfg, _, err := loadConfig(os.Args[1:], os.Getenv)
 	if err != nil {
-		log.Fatalf("failed to init cache: %v", err)
+		log.Fatalf("invalid configuration:\n%v", err)
+	}
+	cfg.setGlobals()
+	if err := setupLogging(os.Stderr, cfg.LogLevel); err != nil {
+		log.Fatalf("log level: %v", err)
+	}
+
+	// Forecasts are kept past CacheTTL to be served while Open-Meteo is down
+	c, err := cacheFromConfig(cfg)
+	if err != nil {
+		fatal("failed to init cache", "error", err)
 	}
 	cache = c
 
+	// Named observing sites used by the device integrations
+	sites, err := parseSites(cfg.Sites)
+	if err != nil {
+		fatal("invalid sites", "error", err)
+	}
+
+	// Optional embedded database for subscriptions
+	store, err := storeFromConfig(cfg)
+	if err != nil {
+		fatal("failed to open store", "error", err)
+	}
+	if store != nil {
+		defer store.Close()
+	}
+
+	// Background jobs stop when the server shuts down
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
 	mux := http.NewServeMux()
 
 	// Handle static files (favicon, icons, JS)
 	staticRoot, err := fs.Sub(StaticFiles, "static")
 	if err != nil {
-		log.Fatalf("failed to set static sub FS: %v", err)
+		fatal("failed to set static sub FS", "error", err)
 	}
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(staticRoot))))
 
@@ -55,39 +100,193 @@ func main() {
 	mux.HandleFunc("/robots.txt", handleRobots)
 	mux.HandleFunc("/sitemap.xml", handleSitemap)
 	mux.HandleFunc("/favicon.ico", handleFavicon)
+	mux.HandleFunc("/embed", handleEmbed)
+	mux.HandleFunc("/embed.json", handleEmbedJSON)
+	mux.HandleFunc("/chart.svg", handleChart)
+	mux.HandleFunc("/og.png", handleOGImage)
+	mux.HandleFunc("/feed.atom", handleFeed)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/api/forecast", handleAPIForecast)
+
+	// Probes for load balancers and orchestrators
+	readiness := newReadiness(cfg.ReadyProbeUpstream, cfg.ReadyProbeInterval)
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", readiness.handle)
+	mux.HandleFunc("/version", handleVersion)
+
+	// Forecast gauges for the configured sites are opt-in: each scrape reads their forecast
+	if cfg.MetricsSites {
+		metricsSites = sites
+	}
+
+	// Clear-night webhook subscriptions need the store
+	if store != nil {
+		subs := newSubscriptions(store, cfg.WebhookAllowPrivate, cfg.MaxSubscriptions)
+		mux.HandleFunc("/subscriptions", subs.handleCreate)
+		mux.HandleFunc("/subscriptions/{id}", subs.handleItem)
+
+		// Browser notifications use VAPID keys kept in the store
+		push, err := pushFromConfig(cfg, store)
+		if err != nil {
+			fatal("failed to init web push", "error", err)
+		}
+		if push != nil {
+			mux.HandleFunc("/sw.js", handleServiceWorker)
+			mux.HandleFunc("/push/key", push.handleKey)
+			mux.HandleFunc("/push/subscriptions", push.handleCreate)
+			mux.HandleFunc("/push/subscriptions/{id}", push.handleItem)
+			subs.addNotifier(push)
+		} else {
+			slog.Warn("browser notifications need AWEATHER_VAPID_SUBJECT or AWEATHER_PUBLIC_URL")
+		}
+		go subs.Run(background, cfg.SchedulerInterval)
+	}
+
+	// Daily email digests need the store and an SMTP relay
+	mailer, err := mailerFromConfig(cfg)
+	if err != nil {
+		fatal("invalid SMTP configuration", "error", err)
+	}
+	if store != nil && mailer != nil {
+		digests := newDigests(store, mailer, cfg.PublicURL, cfg.MaxSubscriptions)
+		mux.HandleFunc("/digests", digests.handleCreate)
+		mux.HandleFunc("/digests/{id}", digests.handleItem)
+		mux.HandleFunc("/digests/{id}/confirm", digests.handleConfirm)
+		mux.HandleFunc("/digests/{id}/unsubscribe", digests.handleUnsubscribe)
+		go digests.Run(background)
+	} else if mailer != nil {
+		slog.Warn("AWEATHER_SMTP_ADDR is set but digests need AWEATHER_DB")
+	}
+
+	// Chat bots answer commands in group chats
+	bots, err := botsFromConfig(cfg, sites)
+	if err != nil {
+		fatal("invalid bot configuration", "error", err)
+	}
+	for _, bot := range bots {
+		go bot.Run(background)
+	}
+
+	// Optional MQTT publisher for home automation
+	mqtt, err := mqttFromConfig(cfg, sites)
+	if err != nil {
+		fatal("invalid MQTT configuration", "error", err)
+	}
+	if mqtt != nil {
+		go mqtt.Run(background)
+	}
+
+	// Optional OpenTelemetry traces, exported to an OTLP/HTTP collector
+	t, err := tracerFromConfig(cfg)
+	if err != nil {
+		fatal("invalid tracing configuration", "error", err)
+	}
+	if t != nil {
+		tracer = t
+		go tracer.Run(background)
+	}
 
 	// Root index
 	mux.HandleFunc("/", handleIndex)
 
+	// API keys need the store; without one, all API requests are anonymous
+	var apiKeys *APIKeys
+	if store != nil {
+		apiKeys = newAPIKeys(store, cfg.APIKeysRequired)
+		go apiKeys.Run(background)
+	}
+
+	// The admin API has a listener of its own, on loopback unless admin_addr says otherwise
+	var adminSrv *http.Server
+	if apiKeys != nil && cfg.AdminToken != "" {
+		if adminSrv, err = startAdmin(cfg.AdminAddr, cfg.AdminToken, apiKeys); err != nil {
+			fatal("failed to start admin api", "error", err)
+		}
+	}
+
+	// Per-client limits, so that a single scraper cannot use up the Open-Meteo quota
+	limiter, err := rateLimiterFromConfig(cfg)
+	if err != nil {
+		fatal("invalid rate limits", "error", err)
+	}
+
 	// Harden server with reasonable timeouts
 	srv := &http.Server{
-		Addr:              ":8080",
-		Handler:           mux,
-		ReadTimeout:       10 * time.Second,
-		ReadHeaderTimeout: 10 * time.Second,
-		WriteTimeout:      15 * time.Second,
-		IdleTimeout:       60 * time.Second,
+		Addr:              ":" + strconv.Itoa(cfg.Port),
+		Handler:           serverHandler(mux, cfg.RequestTimeout, apiKeys, limiter),
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.RequestTimeout + 5*time.Second, // room to write the response once the deadline passes
+		IdleTimeout:       cfg.IdleTimeout,
 		MaxHeaderBytes:    1 << 20, // 1MB
 	}
 
-	log.Println("Server started on :8080")
+	build := readBuildInfo()
+	slog.Info("server started", "addr", srv.Addr, "version", build.Version, "revision", build.Revision)
 
 	// Run server and handle graceful shutdown
 	go func() {
 		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v", err)
+			fatal("server error", "error", err)
 		}
 	}()
 
+	// Optional ASCOM Alpaca SafetyMonitor/ObservingConditions devices
+	var alpacaSrv *http.Server
+	if port := cfg.AlpacaPort; port != 0 {
+		srv, discovery, err := startAlpaca(port, sites)
+		if err != nil {
+			fatal("failed to start alpaca", "error", err)
+		}
+		alpacaSrv = srv
+		defer discovery.Close()
+	}
+
+	// Optional INDI weather devices (KStars/Ekos)
+	if port := cfg.IndiPort; port != 0 {
+		listener, err := startIndi(port, sites)
+		if err != nil {
+			fatal("failed to start indi", "error", err)
+		}
+		defer listener.Close()
+	}
+
 	// Wait for termination signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
+	readiness.Stop()
+	stopBackground()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Printf("server shutdown error: %v", err)
+		slog.Error("server shutdown", "error", err)
+	}
+	if alpacaSrv != nil {
+		if err := alpacaSrv.Shutdown(ctx); err != nil {
+			slog.Error("alpaca shutdown", "error", err)
+		}
 	}
-	log.Println("Server stopped")
+	if adminSrv != nil {
+		if err := adminSrv.Shutdown(ctx); err != nil {
+			slog.Error("admin shutdown", "error", err)
+		}
+	}
+	if apiKeys != nil {
+		if err := apiKeys.Shutdown(); err != nil {
+			slog.Error("saving API key usage", "error", err)
+		}
+	}
+	if tracer != nil {
+		if err := tracer.Shutdown(ctx); err != nil {
+			slog.Error("exporting traces", "error", err)
+		}
+	}
+	slog.Info("server stopped")
+}
+
+// serverHandler wraps the routes in the middlewares every request goes through
+func serverHandler(mux *http.ServeMux, requestTimeout time.Duration, apiKeys *APIKeys, limiter *RateLimiter) http.Handler {
+	return withRequestLog(withTracing(withMetrics(withCompression(apiKeys.Wrap(limiter.Wrap(withDeadline(requestTimeout, withRoute(mux))))))))
 }
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+// Prometheus metrics in the text exposition format (version 0.0.4)
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newCounterVec("aweather_http_requests_total",
+		"HTTP requests by route pattern, method and status code.", "handler", "method", "code")
+	httpDuration = newHistogramVec("aweather_http_request_duration_seconds",
+		"HTTP request latency by route pattern.", durationBuckets, "handler")
+	upstreamRequests = newCounterVec("aweather_upstream_requests_total",
+		"Open-Meteo API calls by endpoint and status code (\"error\" when no response was received).", "endpoint", "code")
+	upstreamDuration = newHistogramVec("aweather_upstream_request_duration_seconds",
+		"Open-Meteo API latency by endpoint.", durationBuckets, "endpoint")
+	cacheLookups = newCounterVec("aweather_cache_lookups_total",
+		"Cache lookups by key space and result (hit or miss).", "space", "result")
+	upstreamCoalesced = newCounterVec("aweather_upstream_coalesced_total",
+		"Cache misses that waited for an Open-Meteo call already in flight instead of making their own, by key space.", "space")
+	upstreamRetries = newCounterVec("aweather_upstream_retries_total",
+		"Open-Meteo API calls repeated after an error, timeout or 5xx/429 response, by endpoint.", "endpoint")
+	upstreamRejected = newCounterVec("aweather_upstream_circuit_open_total",
+		"Open-Meteo API calls failed fast while the circuit breaker was open, by endpoint.", "endpoint")
+	rateLimited = newCounterVec("aweather_rate_limited_total",
+		"Requests rejected with 429 for exceeding a client's rate limit, by rule path.", "rule")
+	apiQuotaExceeded = newCounterVec("aweather_api_quota_exceeded_total",
+		"API requests rejected with 429 because the key's daily quota was used up.")
+)
+
+// metricsSites are the sites exported as forecast gauges; nil disables them
+var metricsSites []Site
+
+// counterVec is a counter with labels
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // keyed by the rendered label set
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// Inc adds one to the series with the given label values
+func (c *counterVec) Inc(values ...string) {
+	key := renderLabels(c.labels, values)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram with labels
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mu         sync.Mutex
+	series     map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+}
+
+// Observe records a value for the series with the given label values
+func (h *histogramVec) Observe(v float64, values ...string) {
+	key := renderLabels(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		// Insert le into the existing label set
+		prefix := "{"
+		if key != "" {
+			prefix = key[:len(key)-1] + ","
+		}
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %d\n", h.name, prefix, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// gauge is a single sample of a gauge family computed at scrape time
+type gauge struct {
+	labels []string // name, value pairs
+	value  float64
+}
+
+func writeGauges(w io.Writer, name, help, kind string, samples []gauge) {
+	if len(samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		names, values := []string{}, []string{}
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			names = append(names, s.labels[i])
+			values = append(values, s.labels[i+1])
+		}
+		fmt.Fprintf(w, "%s%s %s\n", name, renderLabels(names, values), formatFloat(s.value))
+	}
+}
+
+// renderLabels formats {a="x",b="y"}, or "" without labels
+func renderLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cacheSpace returns the key space of a cache key such as "weather:50.45,30.52:..."
+func cacheSpace(key string) string {
+	space, _, ok := strings.Cut(key, ":")
+	switch {
+	case !ok:
+		return "other"
+	case space == "weather", space == "geo", space == "reverse", space == "og", space == "astro", space == "feed":
+		return space
+	default:
+		return "other"
+	}
+}
+
+// cacheGet looks up a key and counts the hit or miss for its key space
+func cacheGet(ctx context.Context, key string) ([]byte, error) {
+	_, span := startSpan(ctx, "cache.get", spanKindInternal)
+	defer span.End()
+	data, err := cache.Get(key)
+	result := "hit"
+	if err != nil {
+		result = "miss"
+	}
+	cacheLookups.Inc(cacheSpace(key), result)
+	span.SetAttr("cache.space", cacheSpace(key))
+	span.SetAttr("cache.hit", err == nil)
+	return data, err
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withMetrics counts requests and their latency by the ServeMux pattern that matched
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		r, route := trackRoute(r)
+		next.ServeHTTP(rec, r)
+
+		// withRoute records the pattern the mux matched; unmatched requests share one label
+		handler := route.pattern
+		if handler == "" {
+			handler = "unmatched"
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		httpRequests.Inc(handler, methodLabel(r.Method), strconv.Itoa(rec.status))
+		httpDuration.Observe(time.Since(start).Seconds(), handler)
+	})
+}
+
+type routeKey struct{}
+
+// requestRoute receives the ServeMux pattern that matched a request. The middlewares around the
+// mux hold their own copy of the request, so withRoute records the pattern here instead.
+type requestRoute struct {
+	pattern string
+}
+
+// trackRoute returns r with a route holder in its context, or r itself when it already has one
+func trackRoute(r *http.Request) (*http.Request, *requestRoute) {
+	if route, ok := r.Context().Value(routeKey{}).(*requestRoute); ok {
+		return r, route
+	}
+	route := &requestRoute{}
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, route)), route
+}
+
+// withRoute wraps the mux and records the pattern it matched in the request's route holder
+func withRoute(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if route, ok := r.Context().Value(routeKey{}).(*requestRoute); ok {
+			route.pattern = r.Pattern
+		}
+	})
+}
+
+// methodLabel keeps the method label bounded: the server accepts any token as a method
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// upstreamMetricsRoundTripper counts and times Open-Meteo API calls
+type upstreamMetricsRoundTripper struct {
+	base http.RoundTripper
+}
+
+func (t *upstreamMetricsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint := upstreamEndpoint(req.URL.String())
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	upstreamDuration.Observe(time.Since(start).Seconds(), endpoint)
+	if err != nil {
+		upstreamRequests.Inc(endpoint, "error")
+		return nil, err
+	}
+	upstreamRequests.Inc(endpoint, strconv.Itoa(resp.StatusCode))
+	return resp, nil
+}
+
+// upstreamEndpoint names the Open-Meteo API a request goes to
+func upstreamEndpoint(u string) string {
+	switch {
+	case strings.HasPrefix(u, OpenMeteoAPIEndpoint):
+		return "forecast"
+	case strings.HasPrefix(u, OpenMeteoGeoReverseAPIEndpoint):
+		return "reverse_geocoding"
+	case strings.HasPrefix(u, OpenMeteoGeoAPIEndpoint):
+		return "geocoding"
+	default:
+		return "other"
+	}
+}
+
+// handleMetrics serves all metrics in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	writeMetrics(r.Context(), out, time.Now())
+	if err := out.Flush(); err != nil {
+		slog.ErrorContext(r.Context(), "writing metrics", "error", err)
+	}
+}
+
+func writeMetrics(ctx context.Context, w io.Writer, now time.Time) {
+	httpRequests.write(w)
+	httpDuration.write(w)
+	upstreamRequests.write(w)
+	upstreamDuration.write(w)
+	cacheLookups.write(w)
+	upstreamCoalesced.write(w)
+	upstreamRetries.write(w)
+	upstreamRejected.write(w)
+	rateLimited.write(w)
+	apiQuotaExceeded.write(w)
+	writeCacheStats(w)
+	writeSiteGauges(ctx, w, metricsSites, fetchForecast, now)
+}
+
+// writeCacheStats exports the bigcache counters when the cache is in memory
+func writeCacheStats(w io.Writer) {
+	bc, ok := cache.(*bigcache.BigCache)
+	if !ok {
+		return
+	}
+	stats := bc.Stats()
+	writeGauges(w, "aweather_bigcache_hits_total", "bigcache hits, including every key space.", "counter", []gauge{{value: float64(stats.Hits)}})
+	writeGauges(w, "aweather_bigcache_misses_total", "bigcache misses, including every key space.", "counter", []gauge{{value: float64(stats.Misses)}})
+	writeGauges(w, "aweather_bigcache_collisions_total", "bigcache key collisions.", "counter", []gauge{{value: float64(stats.Collisions)}})
+	writeGauges(w, "aweather_bigcache_entries", "Entries in bigcache.", "gauge", []gauge{{value: float64(bc.Len())}})
+	writeGauges(w, "aweather_bigcache_capacity_bytes", "Bytes allocated by bigcache.", "gauge", []gauge{{value: float64(bc.Capacity())}})
+}
+
+// writeSiteGauges exports the current forecast hour and the next night for each site
+func writeSiteGauges(ctx context.Context, w io.Writer, sites []Site, forecast func(ctx context.Context, lat, lon float64) (DataPoints, error), now time.Time) {
+	if len(sites) == 0 {
+		return
+	}
+	maxCloud, maxWind := PrintOptions{}.thresholds()
+	var clouds, wind, seeing, ok, moon, bestHours, score, up []gauge
+	for _, site := range sites {
+		points, err := forecast(ctx, site.Lat, site.Lon)
+		if err != nil {
+			slog.WarnContext(ctx, "metrics forecast failed", "site", site.Name, "error", err)
+			up = append(up, gauge{labels: []string{"site", site.Name}, value: 0})
+			continue
+		}
+		p, err := points.current(now)
+		if err != nil {
+			up = append(up, gauge{labels: []string{"site", site.Name}, value: 0})
+			continue
+		}
+		up = append(up, gauge{labels: []string{"site", site.Name}, value: 1})
+		clouds = append(clouds,
+			gauge{labels: []string{"site", site.Name, "layer", "low"}, value: float64(p.LowClouds)},
+			gauge{labels: []string{"site", site.Name, "layer", "mid"}, value: float64(p.MidClouds)},
+			gauge{labels: []string{"site", site.Name, "layer", "high"}, value: float64(p.HighClouds)},
+		)
+		wind = append(wind, gauge{labels: []string{"site", site.Name}, value: p.WindSpeed})
+		seeing = append(seeing, gauge{labels: []string{"site", site.Name}, value: p.Seeing})
+		moon = append(moon, gauge{labels: []string{"site", site.Name}, value: float64(p.MoonIllum)})
+		good := 0.0
+		if p.isGood(maxCloud, maxWind) {
+			good = 1
+		}
+		ok = append(ok, gauge{labels: []string{"site", site.Name}, value: good})
+		if night, found := points.Nights(maxCloud, maxWind).Next(now); found {
+			bestHours = append(bestHours, gauge{labels: []string{"site", site.Name}, value: float64(night.Best.Hours)})
+			score = append(score, gauge{labels: []string{"site", site.Name}, value: float64(night.Score())})
+		}
+	}
+	writeGauges(w, "aweather_site_forecast_up", "Whether a forecast for the current hour is available (1) or not (0).", "gauge", up)
+	writeGauges(w, "aweather_site_cloud_cover_percent", "Forecast cloud cover for the current hour by layer.", "gauge", clouds)
+	writeGauges(w, "aweather_site_wind_speed_kmh", "Forecast wind speed at 10 m for the current hour.", "gauge", wind)
+	writeGauges(w, "aweather_site_seeing", "Seeing index for the current hour (0.5 best - 5 worst).", "gauge", seeing)
+	writeGauges(w, "aweather_site_moon_illumination_percent", "Moon illumination for the current hour.", "gauge", moon)
+	writeGauges(w, "aweather_site_ok", "Whether the current hour is \"ok\" with default thresholds (1) or not (0).", "gauge", ok)
+	writeGauges(w, "aweather_site_tonight_best_window_hours", "Length of the best clear window of the next night.", "gauge", bestHours)
+	writeGauges(w, "aweather_site_tonight_score", "Score of the next night (0-100).", "gauge", score)
+}
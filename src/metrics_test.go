@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCounterAndHistogramFormat(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "kind")
+	c.Inc(`a"b`)
+	c.Inc(`a"b`)
+	c.Inc("c")
+	h := newHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "kind")
+	h.Observe(0.05, "x")
+	h.Observe(0.5, "x")
+	h.Observe(5, "x")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	h.write(&buf)
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{kind="a\"b"} 2
+test_total{kind="c"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{kind="x",le="0.1"} 1
+test_seconds_bucket{kind="x",le="1"} 2
+test_seconds_bucket{kind="x",le="+Inf"} 3
+test_seconds_sum{kind="x"} 5.55
+test_seconds_count{kind="x"} 3
+`
+	if buf.String() != want {
+		t.Errorf("unexpected exposition:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestCacheSpace(t *testing.T) {
+	for key, want := range map[string]string{
+		"weather:50.45,30.52:temperature_2m": "weather",
+		"geo:Kyiv":                           "geo",
+		"reverse:50.450,30.520":              "reverse",
+		"og:1,2":                             "og",
+		"astro:0a1b2c":                       "astro",
+		"Kyiv":                               "other",
+		"custom:1":                           "other",
+	} {
+		if got := cacheSpace(key); got != want {
+			t.Errorf("cacheSpace(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestWithMetrics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusGone)
+	})
+	handler := withMetrics(withRoute(mux))
+	for _, path := range []string{"/items/1", "/items/2", "/nothing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	for _, method := range []string{"FOOBAR1", "FOOBAR2"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/items/3", nil))
+	}
+
+	var buf bytes.Buffer
+	httpRequests.write(&buf)
+	httpDuration.write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		`aweather_http_requests_total{handler="/items/{id}",method="GET",code="410"} 2`,
+		`aweather_http_requests_total{handler="unmatched",method="GET",code="404"} 1`,
+		`aweather_http_requests_total{handler="/items/{id}",method="other",code="410"} 2`,
+		`aweather_http_request_duration_seconds_count{handler="/items/{id}"} 4`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "FOOBAR") {
+		t.Errorf("arbitrary methods get their own series:\n%s", out)
+	}
+}
+
+// Middlewares that pass a copy of the request down still see the route ServeMux matched
+func TestServerHandler_RouteLabels(t *testing.T) {
+	collector := newCollectorStandIn(t)
+	tr := useTracer(t, collector.URL+"/v1/traces")
+	keys, _ := testAPIKeys(t, false)
+	_, token, err := keys.Issue("scripts", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/api/things/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	handler := serverHandler(mux, time.Second, keys, nil)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	req := httptest.NewRequest(http.MethodGet, "/api/things/1", nil)
+	req.Header.Set("X-API-Key", token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var buf bytes.Buffer
+	httpRequests.write(&buf)
+	for _, want := range []string{
+		`aweather_http_requests_total{handler="/healthz",method="GET",code="200"}`,
+		`aweather_http_requests_total{handler="/api/things/{id}",method="GET",code="200"}`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in:\n%s", want, buf.String())
+		}
+	}
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans := collector.spans()
+	for _, name := range []string{"GET /healthz", "GET /api/things/{id}"} {
+		if len(spans[name]) != 1 {
+			t.Errorf("expected one %q span, got %v", name, spans)
+		}
+	}
+}
+
+func TestHandleMetrics_UpstreamAndCache(t *testing.T) {
+	setupCache()
+	fakeForecastServer(t, func(int) int64 { return 0 })
+
+	// A miss that calls the forecast API, then a hit
+	for i := 0; i < 2; i++ {
+		if _, err := fetchForecast(context.Background(), 10.5, 20.5); err != nil {
+			t.Fatalf("fetch: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	out := rec.Body.String()
+	for _, want := range []string{
+		`aweather_upstream_requests_total{endpoint="forecast",code="200"}`,
+		`aweather_upstream_request_duration_seconds_count{endpoint="forecast"}`,
+		`aweather_cache_lookups_total{space="weather",result="hit"}`,
+		`aweather_cache_lookups_total{space="weather",result="miss"}`,
+		`aweather_cache_lookups_total{space="astro",result="hit"}`,
+		`aweather_cache_lookups_total{space="astro",result="miss"}`,
+		"# TYPE aweather_bigcache_hits_total counter",
+		"aweather_bigcache_entries 2", // the forecast and its astronomy
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in metrics", want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handleMetrics(rec, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", rec.Code)
+	}
+}
+
+func TestWriteSiteGauges(t *testing.T) {
+	sites := []Site{{Name: "club", Lat: 50.45, Lon: 30.52}, {Name: "home", Lat: 1, Lon: 2}}
+	forecast := func(ctx context.Context, lat, lon float64) (DataPoints, error) {
+		if lat == 1 {
+			return nil, errors.New("upstream down")
+		}
+		return feedTestPoints(90), nil
+	}
+	var buf bytes.Buffer
+	writeSiteGauges(context.Background(), &buf, sites, forecast, time.Date(2024, 3, 1, 21, 30, 0, 0, time.UTC))
+	out := buf.String()
+	for _, want := range []string{
+		`aweather_site_forecast_up{site="club"} 1`,
+		`aweather_site_forecast_up{site="home"} 0`,
+		`aweather_site_cloud_cover_percent{site="club",layer="low"} 0`,
+		`aweather_site_ok{site="club"} 1`,
+		`aweather_site_tonight_best_window_hours{site="club"} 10`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `aweather_site_ok{site="home"}`) {
+		t.Errorf("expected no gauges for a site without forecast")
+	}
+}
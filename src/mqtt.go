@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MQTTInterval      = 10 * time.Minute // default time between publishes
+	mqttKeepAlive     = 60 * time.Second
+	mqttDefaultPrefix = "aweather"
+)
+
+// MQTT control packet types (MQTT 3.1.1)
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttClient is a minimal MQTT 3.1.1 client that publishes QoS 0 messages
+type mqttClient struct {
+	conn net.Conn
+	mu   sync.Mutex // serialises writes
+	done chan struct{}
+	err  error // set before done is closed
+}
+
+// mqttConnectOptions are the fields of a CONNECT packet
+type mqttConnectOptions struct {
+	ClientID    string
+	Username    string
+	Password    string
+	WillTopic   string // retained, sent by the broker when the connection drops
+	WillMessage string
+	KeepAlive   time.Duration
+}
+
+// dialMQTT connects to a broker given as host:port, tcp://host:port, mqtt://host:port or mqtts://host:port
+func dialMQTT(ctx context.Context, broker string, opts mqttConnectOptions) (*mqttClient, error) {
+	addr, useTLS := broker, false
+	if scheme, rest, ok := strings.Cut(broker, "://"); ok {
+		switch scheme {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			useTLS = true
+		default:
+			return nil, fmt.Errorf("unsupported broker scheme %q", scheme)
+		}
+		addr = rest
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if useTLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mqtt dial: %w", err)
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttConnectPacket(opts)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connect: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	kind, body, err := readMQTTPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connack: %w", err)
+	}
+	if kind != mqttConnack || len(body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connack: unexpected packet type %d", kind)
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connection refused: return code %d", body[1])
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	c := &mqttClient{conn: conn, done: make(chan struct{})}
+	go c.readLoop(r)
+	if opts.KeepAlive > 0 {
+		go c.pingLoop(opts.KeepAlive)
+	}
+	return c, nil
+}
+
+// readLoop consumes broker packets (only PINGRESP is expected for QoS 0 publishing) until the connection closes
+func (c *mqttClient) readLoop(r *bufio.Reader) {
+	for {
+		if _, _, err := readMQTTPacket(r); err != nil {
+			c.err = err
+			close(c.done)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func (c *mqttClient) pingLoop(keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write([]byte{mqttPingreq << 4, 0}); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// Err returns why the connection closed, or nil while it is open
+func (c *mqttClient) Err() error {
+	select {
+	case <-c.done:
+		if c.err == nil || errors.Is(c.err, io.EOF) || errors.Is(c.err, net.ErrClosed) {
+			return errors.New("mqtt connection closed")
+		}
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *mqttClient) write(packet []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// Publish sends a QoS 0 message
+func (c *mqttClient) Publish(topic string, payload []byte, retain bool) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	header := byte(mqttPublish << 4)
+	if retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	body = append(body, payload...)
+	return c.write(mqttPacket(header, body))
+}
+
+// Close sends DISCONNECT, so the broker discards the will, and closes the connection
+func (c *mqttClient) Close() error {
+	_ = c.write([]byte{mqttDisconnect << 4, 0})
+	return c.conn.Close()
+}
+
+func mqttConnectPacket(opts mqttConnectOptions) []byte {
+	flags := byte(0x02) // clean session
+	if opts.WillTopic != "" {
+		flags |= 0x04 | 0x20 // will flag, will retain, QoS 0
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		if opts.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags) // protocol level 4 = 3.1.1
+	body = binary.BigEndian.AppendUint16(body, uint16(opts.KeepAlive/time.Second))
+	body = appendMQTTString(body, opts.ClientID)
+	if opts.WillTopic != "" {
+		body = appendMQTTString(body, opts.WillTopic)
+		body = appendMQTTString(body, opts.WillMessage)
+	}
+	if opts.Username != "" {
+		body = appendMQTTString(body, opts.Username)
+		if opts.Password != "" {
+			body = appendMQTTString(body, opts.Password)
+		}
+	}
+	return mqttPacket(mqttConnect<<4, body)
+}
+
+// mqttPacket prefixes a body with the fixed header and its variable-length size
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTPacket reads one packet and returns its type, with the flags stripped, and its body
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+// MQTTNow is published retained to <prefix>/<site>/now
+type MQTTNow struct {
+	Site      string     `json:"site"`
+	Latitude  float64    `json:"latitude"`
+	Longitude float64    `json:"longitude"`
+	IsGood    bool       `json:"is_good"` // the current hour is "ok" with default thresholds
+	Dark      bool       `json:"dark"`
+	Current   MQTTHour   `json:"current"`
+	NextHour  *MQTTHour  `json:"next_hour"`
+	Tonight   *MQTTBrief `json:"tonight"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// MQTTHour is one forecast hour
+type MQTTHour struct {
+	EmbedHour
+	Temperature   float64 `json:"temperature"`   // °C
+	Precipitation float64 `json:"precipitation"` // mm
+}
+
+// MQTTBrief is the best window of the next night, repeated in the now topic for simple automations
+type MQTTBrief struct {
+	Verdict    string       `json:"verdict"`
+	BestWindow *EmbedWindow `json:"best_window"`
+}
+
+// MQTTTonight is published retained to <prefix>/<site>/tonight
+type MQTTTonight struct {
+	Site      string      `json:"site"`
+	Latitude  float64     `json:"latitude"`
+	Longitude float64     `json:"longitude"`
+	IsGood    bool        `json:"is_good"` // the night has at least one "ok" hour
+	Verdict   string      `json:"verdict"`
+	Score     int         `json:"score"`
+	Summary   string      `json:"summary"`
+	Warnings  []string    `json:"warnings"`
+	Night     *EmbedNight `json:"night"` // nil when there is no dark night in the forecast range
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// MQTTPublisher periodically publishes the forecast for the configured sites
+type MQTTPublisher struct {
+	broker   string
+	options  mqttConnectOptions
+	prefix   string
+	sites    []Site
+	interval time.Duration
+
+	now      func() time.Time
+	forecast func(ctx context.Context, lat, lon float64) (DataPoints, error)
+}
+
+// mqttFromConfig configures the publisher from the mqtt_* settings; it returns nil when mqtt_broker is not set
+func mqttFromConfig(cfg Config, sites []Site) (*MQTTPublisher, error) {
+	broker := cfg.MQTTBroker
+	if broker == "" {
+		return nil, nil
+	}
+	if len(sites) == 0 {
+		return nil, errors.New("mqtt needs at least one site in sites")
+	}
+	prefix := strings.Trim(cfg.MQTTPrefix, "/")
+	if prefix == "" {
+		prefix = mqttDefaultPrefix
+	}
+	if strings.ContainsAny(prefix, "+#") {
+		return nil, fmt.Errorf("mqtt_prefix must not contain wildcards")
+	}
+	p := newMQTTPublisher(broker, prefix, sites)
+	p.options.Username = cfg.MQTTUsername
+	p.options.Password = cfg.MQTTPassword
+	if id := cfg.MQTTClientID; id != "" {
+		p.options.ClientID = id
+	}
+	if cfg.MQTTInterval > 0 {
+		p.interval = cfg.MQTTInterval
+	}
+	return p, nil
+}
+
+func newMQTTPublisher(broker, prefix string, sites []Site) *MQTTPublisher {
+	return &MQTTPublisher{
+		broker: broker,
+		options: mqttConnectOptions{
+			ClientID:    "aweather-" + randomHex(4),
+			WillTopic:   prefix + "/status",
+			WillMessage: "offline",
+			KeepAlive:   mqttKeepAlive,
+		},
+		prefix:   prefix,
+		sites:    sites,
+		interval: MQTTInterval,
+		now:      time.Now,
+		forecast: fetchForecast,
+	}
+}
+
+// Run publishes now and then every interval, reconnecting as needed, until ctx is cancelled
+func (p *MQTTPublisher) Run(ctx context.Context) {
+	var client *mqttClient
+	defer func() {
+		if client != nil {
+			_ = client.Publish(p.prefix+"/status", []byte("offline"), true)
+			client.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if client != nil && client.Err() != nil {
+			slog.Warn("mqtt connection lost", "error", client.Err())
+			client.Close()
+			client = nil
+		}
+		if client == nil {
+			c, err := dialMQTT(ctx, p.broker, p.options)
+			if err != nil {
+				slog.Warn("mqtt connect failed", "error", err)
+			} else if err := c.Publish(p.prefix+"/status", []byte("online"), true); err != nil {
+				slog.Warn("mqtt status", "error", err)
+				c.Close()
+			} else {
+				slog.Info("connected to MQTT broker", "broker", p.broker)
+				client = c
+			}
+		}
+		if client != nil {
+			p.publishAll(ctx, client)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishAll publishes the now and tonight topics of every site
+func (p *MQTTPublisher) publishAll(ctx context.Context, client *mqttClient) {
+	for _, site := range p.sites {
+		points, err := p.forecast(ctx, site.Lat, site.Lon)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("mqtt forecast failed", "site", site.Name, "error", err)
+			continue
+		}
+		now, tonight, err := mqttPayloads(site, points, p.now())
+		if err != nil {
+			slog.Warn("mqtt payloads failed", "site", site.Name, "error", err)
+			continue
+		}
+		for topic, payload := range map[string]any{"now": now, "tonight": tonight} {
+			data, err := json.Marshal(payload)
+			if err != nil {
+				slog.Error("encoding mqtt payload", "site", site.Name, "topic", topic, "error", err)
+				continue
+			}
+			if err := client.Publish(p.prefix+"/"+site.Name+"/"+topic, data, true); err != nil {
+				slog.Warn("mqtt publish failed", "site", site.Name, "topic", topic, "error", err)
+				return
+			}
+		}
+	}
+}
+
+// mqttPayloads builds the now and tonight messages for a site
+func mqttPayloads(site Site, points DataPoints, now time.Time) (MQTTNow, MQTTTonight, error) {
+	current, err := points.current(now)
+	if err != nil {
+		return MQTTNow{}, MQTTTonight{}, err
+	}
+	maxCloud, maxWind := PrintOptions{}.thresholds()
+	hour := func(p DataPoint) MQTTHour {
+		return MQTTHour{
+			EmbedHour: EmbedHour{
+				Time:       p.Time,
+				OK:         p.isGood(maxCloud, maxWind),
+				LowClouds:  p.LowClouds,
+				MidClouds:  p.MidClouds,
+				HighClouds: p.HighClouds,
+				WindSpeed:  p.WindSpeed,
+				WindGusts:  p.WindGusts,
+				Seeing:     p.Seeing,
+				MoonUp:     p.MoonUp,
+			},
+			Temperature:   p.Temperature2M,
+			Precipitation: p.Precipitation,
+		}
+	}
+
+	nowMsg := MQTTNow{
+		Site:      site.Name,
+		Latitude:  site.Lat,
+		Longitude: site.Lon,
+		IsGood:    current.isGood(maxCloud, maxWind),
+		Dark:      current.Dark,
+		Current:   hour(current),
+		UpdatedAt: now.UTC(),
+	}
+	if upcoming := points.upcoming(now); len(upcoming) > 1 {
+		next := hour(upcoming[1])
+		nowMsg.NextHour = &next
+	}
+
+	tonight := MQTTTonight{
+		Site:      site.Name,
+		Latitude:  site.Lat,
+		Longitude: site.Lon,
+		Verdict:   "poor",
+		Warnings:  []string{},
+		UpdatedAt: now.UTC(),
+	}
+	if night, ok := points.Nights(maxCloud, maxWind).Next(now); ok {
+		tonight.IsGood = night.Best.Hours > 0
+		tonight.Verdict = night.Verdict()
+		tonight.Score = night.Score()
+		tonight.Summary = night.Summary(PrintOptions{})
+		tonight.Warnings = append(tonight.Warnings, night.Warnings()...)
+		tonight.Night = newEmbedForecast(points, PrintOptions{}, now).Night
+		nowMsg.Tonight = &MQTTBrief{Verdict: tonight.Verdict, BestWindow: tonight.Night.BestWindow}
+	}
+	return nowMsg, tonight, nil
+}
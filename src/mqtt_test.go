@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttBrokerStandIn is an embedded broker that accepts connections and keeps retained messages
+type mqttBrokerStandIn struct {
+	l        net.Listener
+	mu       sync.Mutex
+	connects []mqttConnectOptions
+	retained map[string][]byte
+	refuse   byte // CONNACK return code
+}
+
+type mqttMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+func newMQTTBrokerStandIn(t *testing.T) *mqttBrokerStandIn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	b := &mqttBrokerStandIn{l: l, retained: map[string][]byte{}}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *mqttBrokerStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	kind, body, err := readMQTTPacket(r)
+	if err != nil || kind != mqttConnect {
+		return
+	}
+	opts, will := parseMQTTConnect(body)
+
+	b.mu.Lock()
+	b.connects = append(b.connects, opts)
+	refuse := b.refuse
+	b.mu.Unlock()
+	if _, err := conn.Write([]byte{mqttConnack << 4, 2, 0, refuse}); err != nil || refuse != 0 {
+		return
+	}
+
+	clean := false
+	defer func() {
+		// Without DISCONNECT the broker publishes the will
+		if !clean && will != nil {
+			b.store(*will)
+		}
+	}()
+	for {
+		header, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		retain := header[0]&0x01 != 0
+		kind, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch kind {
+		case mqttPublish:
+			n := int(binary.BigEndian.Uint16(body))
+			b.store(mqttMessage{topic: string(body[2 : 2+n]), payload: body[2+n:], retain: retain})
+		case mqttPingreq:
+			_, _ = conn.Write([]byte{mqttPingresp << 4, 0})
+		case mqttDisconnect:
+			clean = true
+			return
+		}
+	}
+}
+
+func (b *mqttBrokerStandIn) store(msg mqttMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if msg.retain {
+		b.retained[msg.topic] = msg.payload
+	}
+}
+
+func (b *mqttBrokerStandIn) get(topic string) ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+func parseMQTTConnect(body []byte) (mqttConnectOptions, *mqttMessage) {
+	read := func() string {
+		n := int(binary.BigEndian.Uint16(body))
+		s := string(body[2 : 2+n])
+		body = body[2+n:]
+		return s
+	}
+	read() // protocol name
+	flags := body[1]
+	opts := mqttConnectOptions{KeepAlive: time.Duration(binary.BigEndian.Uint16(body[2:4])) * time.Second}
+	body = body[4:]
+	opts.ClientID = read()
+	var will *mqttMessage
+	if flags&0x04 != 0 {
+		opts.WillTopic, opts.WillMessage = read(), read()
+		will = &mqttMessage{topic: opts.WillTopic, payload: []byte(opts.WillMessage), retain: flags&0x20 != 0}
+	}
+	if flags&0x80 != 0 {
+		opts.Username = read()
+	}
+	if flags&0x40 != 0 {
+		opts.Password = read()
+	}
+	return opts, will
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMQTTPacket_RemainingLength(t *testing.T) {
+	for _, n := range []int{0, 127, 128, 16383, 16384, 2097151} {
+		packet := mqttPacket(mqttPublish<<4, make([]byte, n))
+		kind, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(packet)))
+		if err != nil || kind != mqttPublish || len(body) != n {
+			t.Errorf("length %d: got type %d, %d bytes, %v", n, kind, len(body), err)
+		}
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	broker := newMQTTBrokerStandIn(t)
+	p := newMQTTPublisher(broker.l.Addr().String(), "aweather", []Site{{Name: "club", Lat: 50.45, Lon: 30.52}})
+	p.options.Username, p.options.Password = "user", "pass"
+	p.now = func() time.Time { return time.Date(2024, 3, 1, 21, 30, 0, 0, time.UTC) }
+	p.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) { return feedTestPoints(90), nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	waitFor(t, "tonight topic", func() bool { _, ok := broker.get("aweather/club/tonight"); return ok })
+
+	if status, _ := broker.get("aweather/status"); string(status) != "online" {
+		t.Errorf("expected online status, got %q", status)
+	}
+	broker.mu.Lock()
+	connect := broker.connects[0]
+	broker.mu.Unlock()
+	if connect.Username != "user" || connect.Password != "pass" || connect.WillTopic != "aweather/status" || connect.KeepAlive != mqttKeepAlive {
+		t.Errorf("unexpected CONNECT %+v", connect)
+	}
+
+	var now MQTTNow
+	data, _ := broker.get("aweather/club/now")
+	if err := json.Unmarshal(data, &now); err != nil {
+		t.Fatalf("now payload: %v", err)
+	}
+	if !now.IsGood || !now.Dark || now.Current.Time.Hour() != 21 || now.NextHour == nil || now.NextHour.Time.Hour() != 22 {
+		t.Errorf("unexpected now payload %s", data)
+	}
+	if now.Tonight == nil || now.Tonight.Verdict != "good" || now.Tonight.BestWindow.Hours != 10 {
+		t.Errorf("expected tonight's best window in now payload, got %s", data)
+	}
+
+	var tonight MQTTTonight
+	data, _ = broker.get("aweather/club/tonight")
+	if err := json.Unmarshal(data, &tonight); err != nil {
+		t.Fatalf("tonight payload: %v", err)
+	}
+	if !tonight.IsGood || tonight.Night == nil || tonight.Night.Date != "2024-03-01" || tonight.Night.BestWindow.Hours != 10 || tonight.Summary == "" {
+		t.Errorf("unexpected tonight payload %s", data)
+	}
+
+	// A clean shutdown marks the publisher offline
+	cancel()
+	<-done
+	waitFor(t, "offline status", func() bool { status, _ := broker.get("aweather/status"); return string(status) == "offline" })
+}
+
+func TestDialMQTT_Refused(t *testing.T) {
+	broker := newMQTTBrokerStandIn(t)
+	broker.refuse = 5 // not authorised
+	if _, err := dialMQTT(context.Background(), "tcp://"+broker.l.Addr().String(), mqttConnectOptions{ClientID: "test"}); err == nil {
+		t.Fatalf("expected refused connection")
+	}
+	if _, err := dialMQTT(context.Background(), "ws://"+broker.l.Addr().String(), mqttConnectOptions{}); err == nil {
+		t.Fatalf("expected an error for an unsupported scheme")
+	}
+}
+
+func TestMQTTFromConfig(t *testing.T) {
+	cfg := defaultConfig()
+	sites := []Site{{Name: "club", Lat: 50.45, Lon: 30.52}}
+	if p, err := mqttFromConfig(cfg, sites); p != nil || err != nil {
+		t.Fatalf("expected no publisher, got %v, %v", p, err)
+	}
+	cfg.MQTTBroker = "localhost:1883"
+	if _, err := mqttFromConfig(cfg, nil); err == nil {
+		t.Errorf("expected error without sites")
+	}
+	cfg.MQTTPrefix = "home/#"
+	if _, err := mqttFromConfig(cfg, sites); err == nil {
+		t.Errorf("expected error for wildcard prefix")
+	}
+	cfg.MQTTPrefix = "/home/astro/"
+	p, err := mqttFromConfig(cfg, sites)
+	if err != nil || p.prefix != "home/astro" || p.options.WillTopic != "home/astro/status" || p.interval != MQTTInterval {
+		t.Errorf("unexpected publisher %+v, %v", p, err)
+	}
+}
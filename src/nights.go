@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Window is a run of consecutive "ok" hours within a night
+type Window struct {
+	Start time.Time
+	End   time.Time // end of the last hour
+	Hours int
+}
+
+// Night groups the dark hours between dusk and dawn
+type Night struct {
+	Date        time.Time  // local midnight of the evening the night starts
+	Start       time.Time  // first dark hour
+	End         time.Time  // end of the last dark hour
+	Points      DataPoints // dark hours only
+	Best        Window     // longest run of "ok" hours; Hours == 0 if there is none
+	GoodHours   int        // all "ok" hours, not necessarily consecutive
+	MoonIllum   int64      // Moon illumination in the middle of the night
+	MoonUpHours int        // dark hours with the Moon above the horizon
+}
+
+type Nights []Night
+
+// Nights() groups consecutive dark points into nights and finds the best observing window of each.
+// Points must have Dark and MoonUp set (see setSunAndMoon).
+func (dp DataPoints) Nights(maxCloudCover int64, maxWind float64) Nights {
+	nights := Nights{}
+
+	var current DataPoints
+	flush := func() {
+		if len(current) > 0 {
+			nights = append(nights, newNight(current, maxCloudCover, maxWind))
+			current = nil
+		}
+	}
+
+	for _, point := range dp {
+		if !point.Dark {
+			flush()
+			continue
+		}
+		// Split on gaps in the hourly series
+		if len(current) > 0 && point.Time.Sub(current[len(current)-1].Time) > time.Hour {
+			flush()
+		}
+		current = append(current, point)
+	}
+	flush()
+
+	return nights
+}
+
+// newNight builds a Night from consecutive dark points
+func newNight(points DataPoints, maxCloudCover int64, maxWind float64) Night {
+	first := points[0]
+	last := points[len(points)-1]
+
+	// Nights are named after the evening they start on, including the one already in progress at midnight
+	evening := first.Time.Add(-12 * time.Hour)
+	night := Night{
+		Date:      time.Date(evening.Year(), evening.Month(), evening.Day(), 0, 0, 0, 0, first.Time.Location()),
+		Start:     first.Time,
+		End:       last.Time.Add(time.Hour),
+		Points:    points,
+		MoonIllum: points[len(points)/2].MoonIllum,
+	}
+
+	run := Window{}
+	for _, point := range points {
+		if point.MoonUp {
+			night.MoonUpHours++
+		}
+		if !point.isGood(maxCloudCover, maxWind) {
+			run = Window{}
+			continue
+		}
+		night.GoodHours++
+		if run.Hours == 0 {
+			run.Start = point.Time
+		}
+		run.Hours++
+		run.End = point.Time.Add(time.Hour)
+		if run.Hours > night.Best.Hours {
+			night.Best = run
+		}
+	}
+
+	return night
+}
+
+// Verdict() summarises the night as "good", "fair" or "poor" based on its best window
+func (n Night) Verdict() string {
+	switch {
+	case n.Best.Hours >= 3 || (n.Best.Hours > 0 && n.Best.Hours*2 >= len(n.Points)):
+		return "good"
+	case n.Best.Hours > 0:
+		return "fair"
+	default:
+		return "poor"
+	}
+}
+
+// Score() rates the night from 0 to 100: the share of "ok" dark hours,
+// reduced by up to half when a bright Moon is up for the whole night
+func (n Night) Score() int {
+	if len(n.Points) == 0 {
+		return 0
+	}
+	hours := float64(len(n.Points))
+	clear := float64(n.GoodHours) / hours
+	moon := float64(n.MoonIllum) / 100 * float64(n.MoonUpHours) / hours
+	return int(math.Round(100 * clear * (1 - 0.5*moon)))
+}
+
+// Warnings() lists conditions worth knowing about beyond the "ok" verdict
+func (n Night) Warnings() []string {
+	warnings := []string{}
+	if n.MoonIllum >= 50 && n.MoonUpHours*2 >= len(n.Points) && len(n.Points) > 0 {
+		warnings = append(warnings, fmt.Sprintf("bright Moon (%d%%) up for most of the night", n.MoonIllum))
+	}
+	if n.Best.Hours == 1 {
+		warnings = append(warnings, "clear window is only one hour long")
+	}
+
+	// Seeing and jet stream during the best window
+	seeing, jet := 0.0, 0.0
+	count := 0
+	for _, p := range n.Points {
+		if p.Time.Before(n.Best.Start) || !p.Time.Before(n.Best.End) {
+			continue
+		}
+		seeing += p.Seeing
+		jet = math.Max(jet, p.WindSpeed200hPa)
+		count++
+	}
+	if count > 0 && seeing/float64(count) >= 3 {
+		warnings = append(warnings, fmt.Sprintf("poor seeing (index %.1f)", seeing/float64(count)))
+	}
+	if jet >= 150 {
+		warnings = append(warnings, fmt.Sprintf("strong jet stream (%.0f km/h at 200 hPa)", jet))
+	}
+	return warnings
+}
+
+// Summary() describes the night in one line: score, best window, Moon phase and warnings
+func (n Night) Summary(opts PrintOptions) string {
+	timeFmt := "15:04"
+	if opts.Use12Hour {
+		timeFmt = "3:04pm"
+	}
+	window := "no clear window"
+	if n.Best.Hours > 0 {
+		window = fmt.Sprintf("best window %s – %s (%dh)", n.Best.Start.Format(timeFmt), n.Best.End.Format(timeFmt), n.Best.Hours)
+	}
+	phase := ""
+	if len(n.Points) > 0 {
+		mid := n.Points[len(n.Points)/2]
+		phase = " " + moonPhase(mid.Time, mid.Lat, mid.Lon)
+	}
+
+	summary := fmt.Sprintf("score %d/100 | %s | moon %d%%%s", n.Score(), window, n.MoonIllum, phase)
+	if warnings := n.Warnings(); len(warnings) > 0 {
+		summary += " | warnings: " + strings.Join(warnings, "; ")
+	}
+	return summary
+}
+
+// Next() returns the first night that has not ended yet at the given time
+func (ns Nights) Next(now time.Time) (Night, bool) {
+	for _, night := range ns {
+		if night.End.After(now) {
+			return night, true
+		}
+	}
+	return Night{}, false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNights_GroupsDarkHoursAndBestWindow(t *testing.T) {
+	start := time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC)
+	points := DataPoints{}
+	// 18:00 light, 19:00-04:00 dark, 05:00 light
+	for i := 0; i < 12; i++ {
+		p := DataPoint{Time: start.Add(time.Duration(i) * time.Hour), Dark: i >= 1 && i <= 10, MoonIllum: int64(i)}
+		// Cloudy at 22:00 splits the night into a 3h and a 6h window
+		if i == 4 {
+			p.LowClouds = 90
+		}
+		p.MoonUp = i >= 8
+		points = append(points, p)
+	}
+
+	nights := points.Nights(MaxCloudCover, MaxWindSpeed)
+	if len(nights) != 1 {
+		t.Fatalf("expected 1 night, got %d", len(nights))
+	}
+	n := nights[0]
+	if !n.Date.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected night date %v", n.Date)
+	}
+	if !n.Start.Equal(start.Add(time.Hour)) || !n.End.Equal(start.Add(11*time.Hour)) {
+		t.Errorf("unexpected night bounds %v - %v", n.Start, n.End)
+	}
+	if n.Best.Hours != 6 || !n.Best.Start.Equal(start.Add(5*time.Hour)) || !n.Best.End.Equal(start.Add(11*time.Hour)) {
+		t.Errorf("unexpected best window %+v", n.Best)
+	}
+	if n.MoonUpHours != 3 {
+		t.Errorf("expected 3 moon-up hours, got %d", n.MoonUpHours)
+	}
+	if n.GoodHours != 9 {
+		t.Errorf("expected 9 good hours, got %d", n.GoodHours)
+	}
+}
+
+func TestNights_MidnightStartBelongsToPreviousEvening(t *testing.T) {
+	start := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	points := DataPoints{
+		{Time: start, Dark: true, LowClouds: 100},
+		{Time: start.Add(time.Hour), Dark: true, LowClouds: 100},
+		{Time: start.Add(2 * time.Hour)},
+	}
+	nights := points.Nights(MaxCloudCover, MaxWindSpeed)
+	if len(nights) != 1 || nights[0].Date.Day() != 1 {
+		t.Fatalf("expected one night dated March 1, got %+v", nights)
+	}
+	if nights[0].Best.Hours != 0 {
+		t.Fatalf("expected no clear window, got %+v", nights[0].Best)
+	}
+}
+
+func TestNights_Next(t *testing.T) {
+	first := time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)
+	nights := Nights{
+		{Start: first, End: first.Add(9 * time.Hour)},
+		{Start: first.Add(24 * time.Hour), End: first.Add(33 * time.Hour)},
+	}
+	if n, ok := nights.Next(first.Add(2 * time.Hour)); !ok || !n.Start.Equal(first) {
+		t.Errorf("expected the night in progress, got %+v", n)
+	}
+	if n, ok := nights.Next(first.Add(12 * time.Hour)); !ok || !n.Start.Equal(first.Add(24*time.Hour)) {
+		t.Errorf("expected the following night, got %+v", n)
+	}
+	if _, ok := nights.Next(first.Add(48 * time.Hour)); ok {
+		t.Errorf("expected no night after the forecast range")
+	}
+}
+
+func TestNight_Verdict(t *testing.T) {
+	tests := []struct {
+		best, hours int
+		want        string
+	}{
+		{4, 10, "good"},
+		{2, 4, "good"},
+		{1, 10, "fair"},
+		{0, 10, "poor"},
+	}
+	for _, tc := range tests {
+		n := Night{Best: Window{Hours: tc.best}, Points: make(DataPoints, tc.hours)}
+		if got := n.Verdict(); got != tc.want {
+			t.Errorf("best %dh of %dh: expected %s, got %s", tc.best, tc.hours, tc.want, got)
+		}
+	}
+}
+
+func TestNight_Score(t *testing.T) {
+	points := make(DataPoints, 10)
+	if got := (Night{Points: points, GoodHours: 5}).Score(); got != 50 {
+		t.Errorf("expected 50 without Moon, got %d", got)
+	}
+	if got := (Night{Points: points, GoodHours: 10, MoonIllum: 100, MoonUpHours: 10}).Score(); got != 50 {
+		t.Errorf("expected full Moon to halve the score, got %d", got)
+	}
+	if got := (Night{}).Score(); got != 0 {
+		t.Errorf("expected 0 for empty night, got %d", got)
+	}
+}
+
+func TestNight_Warnings(t *testing.T) {
+	start := time.Date(2024, 3, 1, 22, 0, 0, 0, time.UTC)
+	n := Night{
+		Points: DataPoints{
+			{Time: start, Seeing: 4, WindSpeed200hPa: 180},
+			{Time: start.Add(time.Hour), Seeing: 1},
+		},
+		Best:        Window{Start: start, End: start.Add(time.Hour), Hours: 1},
+		MoonIllum:   80,
+		MoonUpHours: 2,
+	}
+	got := strings.Join(n.Warnings(), "; ")
+	for _, want := range []string{"bright Moon (80%)", "only one hour", "poor seeing (index 4.0)", "strong jet stream (180 km/h"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected warning %q in %q", want, got)
+		}
+	}
+	if w := (Night{Points: make(DataPoints, 4), Best: Window{Hours: 4}}).Warnings(); len(w) != 0 {
+		t.Errorf("expected no warnings, got %v", w)
+	}
+}
+
+func TestNight_Summary(t *testing.T) {
+	start := time.Date(2024, 3, 1, 19, 0, 0, 0, time.UTC)
+	n := Night{
+		Points:    DataPoints{{Time: start}, {Time: start.Add(time.Hour)}, {Time: start.Add(2 * time.Hour)}, {Time: start.Add(3 * time.Hour)}},
+		Best:      Window{Start: start, End: start.Add(4 * time.Hour), Hours: 4},
+		GoodHours: 4,
+	}
+	got := n.Summary(PrintOptions{})
+	if !strings.HasPrefix(got, "score 100/100 | best window 19:00 – 23:00 (4h) | moon 0%") || strings.Contains(got, "warnings") {
+		t.Errorf("unexpected summary %q", got)
+	}
+	if got := n.Summary(PrintOptions{Use12Hour: true}); !strings.Contains(got, "7:00pm – 11:00pm") {
+		t.Errorf("expected 12-hour times, got %q", got)
+	}
+	if got := (Night{Points: DataPoints{{Time: start}}}).Summary(PrintOptions{}); !strings.Contains(got, "| no clear window |") {
+		t.Errorf("expected no clear window, got %q", got)
+	}
+}
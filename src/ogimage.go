@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Open Graph card size recommended by most link previews
+const (
+	ogImageWidth  = 1200
+	ogImageHeight = 630
+	ogMargin      = 60
+	ogPlaceScale  = 8 // the place name is the largest text on the card
+)
+
+var (
+	ogBackground = color.RGBA{0x0f, 0x17, 0x2a, 0xff}
+	ogText       = color.RGBA{0xf8, 0xfa, 0xfc, 0xff}
+	ogMuted      = color.RGBA{0x94, 0xa3, 0xb8, 0xff}
+	ogGood       = color.RGBA{0x22, 0xc5, 0x5e, 0xff}
+	ogFair       = color.RGBA{0xfa, 0xcc, 0x15, 0xff}
+	ogPoor       = color.RGBA{0xf8, 0x71, 0x71, 0xff}
+	ogCloud      = color.RGBA{0x47, 0x55, 0x69, 0xff}
+)
+
+// ogPalette keeps the PNG small enough for the cache
+var ogPalette = color.Palette{ogBackground, ogText, ogMuted, ogGood, ogFair, ogPoor, ogCloud}
+
+// summaryCard is the content of the Open Graph preview image
+type summaryCard struct {
+	Place   string
+	Verdict string // "good", "fair", "poor" or "" when there is no night in range
+	Window  string
+	Moon    string
+	Bars    []embedBar // hourly cloud cover of the night
+}
+
+// newSummaryCard describes the first night that has not ended at now
+func newSummaryCard(place string, points DataPoints, opts PrintOptions, now time.Time) summaryCard {
+	card := summaryCard{Place: place}
+	maxCloud, maxWind := opts.thresholds()
+	night, ok := points.Nights(maxCloud, maxWind).Next(now)
+	if !ok {
+		card.Window = "no dark night in the forecast range"
+		return card
+	}
+
+	timeFmt := "15:04"
+	if opts.Use12Hour {
+		timeFmt = "3:04pm"
+	}
+	card.Verdict = night.Verdict()
+	card.Window = "no clear window"
+	if night.Best.Hours > 0 {
+		card.Window = fmt.Sprintf("best %s-%s (%dh)", night.Best.Start.Format(timeFmt), night.Best.End.Format(timeFmt), night.Best.Hours)
+	}
+	mid := night.Points[len(night.Points)/2]
+	card.Moon = fmt.Sprintf("moon %d%% %s", night.MoonIllum, moonPhase(mid.Time, mid.Lat, mid.Lon))
+	for _, p := range night.Points {
+		card.Bars = append(card.Bars, embedBar{Height: max(p.LowClouds, p.MidClouds, p.HighClouds, 0), OK: p.isGood(maxCloud, maxWind)})
+	}
+	return card
+}
+
+// renderSummaryCard draws the card as a PNG using only the standard library
+func renderSummaryCard(card summaryCard) ([]byte, error) {
+	img := image.NewPaletted(image.Rect(0, 0, ogImageWidth, ogImageHeight), ogPalette)
+	draw.Draw(img, img.Bounds(), image.NewUniform(ogBackground), image.Point{}, draw.Src)
+
+	drawText(img, "aweather", ogMargin, ogMargin, 4, ogMuted)
+
+	place := card.Place
+	if place == "" {
+		place = "forecast"
+	}
+	drawText(img, fitText(place, ogPlaceScale), ogMargin, 130, ogPlaceScale, ogText)
+
+	verdictColor := ogPoor
+	switch card.Verdict {
+	case "good":
+		verdictColor = ogGood
+	case "fair":
+		verdictColor = ogFair
+	}
+	if card.Verdict != "" {
+		drawText(img, "tonight: "+card.Verdict, ogMargin, 240, 10, verdictColor)
+	}
+	drawText(img, fitText(card.Window, 5), ogMargin, 350, 5, ogText)
+	drawText(img, fitText(card.Moon, 5), ogMargin, 410, 5, ogMuted)
+
+	// Hourly cloud bars along the bottom, green when the hour is "ok"
+	if n := len(card.Bars); n > 0 {
+		areaTop, areaBottom := 480, ogImageHeight-ogMargin
+		slot := (ogImageWidth - 2*ogMargin) / n
+		for i, bar := range card.Bars {
+			c := ogCloud
+			if bar.OK {
+				c = ogGood
+			}
+			h := int(bar.Height) * (areaBottom - areaTop) / 100
+			if h < 4 {
+				h = 4
+			}
+			x := ogMargin + i*slot
+			fillRect(img, x, areaBottom-h, x+slot-4, areaBottom, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("encode png: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func handleOGImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	lat, lon, ok := parseCoordinates(q.Get("lat"), q.Get("lon"))
+	if !ok {
+		http.Error(w, "Valid latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+	name := ogPlaceName(q.Get("name"))
+	opts := parsePrintOptions(q)
+
+	points, freshness, err := fetchForecastFreshness(r.Context(), lat, lon)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching weather from Open-Meteo", "error", err)
+		http.Error(w, "Upstream weather service unavailable", http.StatusBadGateway)
+		return
+	}
+	now := time.Now()
+	if setForecastCaching(w, r, freshness, hourVariant(now)) {
+		return
+	}
+
+	// Cards are drawn once per forecast and hour: a refetched forecast has a new digest, so a
+	// card never outlives the forecast it was drawn from
+	cacheKey := fmt.Sprintf("og:%s:%s:%s:%d:%g:%t", freshness.Digest, hourVariant(now), name, opts.MaxCloudCover, opts.MaxWindSpeed, opts.Use12Hour)
+	pngData, err := cacheGet(r.Context(), cacheKey)
+	if err != nil || freshness.Digest == "" {
+		if points, err = withAstronomy(r.Context(), points, freshness); err != nil {
+			forecastCancelled(w)
+			return
+		}
+		pngData, err = renderSummaryCard(newSummaryCard(name, points, opts, now))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "rendering preview image", "error", err)
+			http.Error(w, "Image rendering error", http.StatusInternalServerError)
+			return
+		}
+		if freshness.Digest != "" {
+			if err := cache.Set(cacheKey, pngData); err != nil {
+				slog.WarnContext(r.Context(), "caching preview image failed", coords(lat, lon), "error", err)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if _, err := w.Write(pngData); err != nil {
+		slog.ErrorContext(r.Context(), "writing preview image", "error", err)
+	}
+}
+
+// ogPlaceName normalizes the place name of a card to what is drawn: one line of capitals,
+// cut to the card width, so that variants of a name share one cached image
+func ogPlaceName(name string) string {
+	return fitText(strings.ToUpper(strings.Join(strings.Fields(name), " ")), ogPlaceScale)
+}
+
+// fitText shortens s so that it fits the card width at the given scale
+func fitText(s string, scale int) string {
+	maxChars := (ogImageWidth - 2*ogMargin) / (glyphAdvance * scale)
+	runes := []rune(s)
+	if len(runes) <= maxChars {
+		return s
+	}
+	return string(runes[:maxChars-3]) + "..."
+}
+
+func fillRect(img draw.Image, x0, y0, x1, y1 int, c color.Color) {
+	draw.Draw(img, image.Rect(x0, y0, x1, y1), image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+// drawText renders s with the built-in 5x7 font; (x, y) is the top-left corner
+func drawText(img draw.Image, s string, x, y, scale int, c color.Color) {
+	for _, r := range strings.ToUpper(s) {
+		glyph, ok := font5x7[foldRune(r)]
+		if !ok {
+			glyph = font5x7['?']
+		}
+		for row, bits := range glyph {
+			for col := 0; col < 5; col++ {
+				if bits&(1<<(4-col)) != 0 {
+					fillRect(img, x+col*scale, y+row*scale, x+(col+1)*scale, y+(row+1)*scale, c)
+				}
+			}
+		}
+		x += glyphAdvance * scale
+	}
+}
+
+// foldRune maps common accented Latin letters (already upper-cased) to their base letter
+func foldRune(r rune) rune {
+	switch {
+	case strings.ContainsRune("ÀÁÂÃÄÅĀĂĄ", r):
+		return 'A'
+	case strings.ContainsRune("ÇĆČ", r):
+		return 'C'
+	case strings.ContainsRune("ÈÉÊËĒĘĚ", r):
+		return 'E'
+	case strings.ContainsRune("ÌÍÎÏĪİ", r):
+		return 'I'
+	case strings.ContainsRune("ÑŃŇ", r):
+		return 'N'
+	case strings.ContainsRune("ÒÓÔÕÖØŌŐ", r):
+		return 'O'
+	case strings.ContainsRune("ÙÚÛÜŪŮŰ", r):
+		return 'U'
+	case strings.ContainsRune("ÝŸ", r):
+		return 'Y'
+	case strings.ContainsRune("ŚŠŞ", r):
+		return 'S'
+	case strings.ContainsRune("ŹŻŽ", r):
+		return 'Z'
+	case strings.ContainsRune("ŁĽ", r):
+		return 'L'
+	case r == 'Ř':
+		return 'R'
+	case r == 'Ď':
+		return 'D'
+	case r == 'Ť':
+		return 'T'
+	case r == '–' || r == '—':
+		return '-'
+	}
+	return r
+}
+
+// glyphAdvance is the horizontal distance between characters in font units
+const glyphAdvance = 6
+
+// font5x7 is a minimal upper-case bitmap font; each row uses the lowest 5 bits
+var font5x7 = map[rune][7]uint8{
+	' ':  {0, 0, 0, 0, 0, 0, 0},
+	'A':  {0b01110, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'B':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10001, 0b10001, 0b11110},
+	'C':  {0b01110, 0b10001, 0b10000, 0b10000, 0b10000, 0b10001, 0b01110},
+	'D':  {0b11100, 0b10010, 0b10001, 0b10001, 0b10001, 0b10010, 0b11100},
+	'E':  {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b11111},
+	'F':  {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b10000},
+	'G':  {0b01110, 0b10001, 0b10000, 0b10111, 0b10001, 0b10001, 0b01111},
+	'H':  {0b10001, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'I':  {0b01110, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	'J':  {0b00111, 0b00010, 0b00010, 0b00010, 0b00010, 0b10010, 0b01100},
+	'K':  {0b10001, 0b10010, 0b10100, 0b11000, 0b10100, 0b10010, 0b10001},
+	'L':  {0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b11111},
+	'M':  {0b10001, 0b11011, 0b10101, 0b10101, 0b10001, 0b10001, 0b10001},
+	'N':  {0b10001, 0b10001, 0b11001, 0b10101, 0b10011, 0b10001, 0b10001},
+	'O':  {0b01110, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'P':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10000, 0b10000, 0b10000},
+	'Q':  {0b01110, 0b10001, 0b10001, 0b10001, 0b10101, 0b10010, 0b01101},
+	'R':  {0b11110, 0b10001, 0b10001, 0b11110, 0b10100, 0b10010, 0b10001},
+	'S':  {0b01111, 0b10000, 0b10000, 0b01110, 0b00001, 0b00001, 0b11110},
+	'T':  {0b11111, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100},
+	'U':  {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'V':  {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01010, 0b00100},
+	'W':  {0b10001, 0b10001, 0b10001, 0b10101, 0b10101, 0b10101, 0b01010},
+	'X':  {0b10001, 0b10001, 0b01010, 0b00100, 0b01010, 0b10001, 0b10001},
+	'Y':  {0b10001, 0b10001, 0b10001, 0b01010, 0b00100, 0b00100, 0b00100},
+	'Z':  {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0b11111},
+	'0':  {0b01110, 0b10001, 0b10011, 0b10101, 0b11001, 0b10001, 0b01110},
+	'1':  {0b00100, 0b01100, 0b00100, 0b00100, 0b00100, 0b00100, 0b01110},
+	'2':  {0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0b01000, 0b11111},
+	'3':  {0b11111, 0b00010, 0b00100, 0b00010, 0b00001, 0b10001, 0b01110},
+	'4':  {0b00010, 0b00110, 0b01010, 0b10010, 0b11111, 0b00010, 0b00010},
+	'5':  {0b11111, 0b10000, 0b11110, 0b00001, 0b00001, 0b10001, 0b01110},
+	'6':  {0b00110, 0b01000, 0b10000, 0b11110, 0b10001, 0b10001, 0b01110},
+	'7':  {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b01000, 0b01000},
+	'8':  {0b01110, 0b10001, 0b10001, 0b01110, 0b10001, 0b10001, 0b01110},
+	'9':  {0b01110, 0b10001, 0b10001, 0b01111, 0b00001, 0b00010, 0b01100},
+	'.':  {0, 0, 0, 0, 0, 0b01100, 0b01100},
+	',':  {0, 0, 0, 0, 0b01100, 0b00100, 0b01000},
+	':':  {0, 0b01100, 0b01100, 0, 0b01100, 0b01100, 0},
+	'-':  {0, 0, 0, 0b11111, 0, 0, 0},
+	'%':  {0b11000, 0b11001, 0b00010, 0b00100, 0b01000, 0b10011, 0b00011},
+	'(':  {0b00010, 0b00100, 0b01000, 0b01000, 0b01000, 0b00100, 0b00010},
+	')':  {0b01000, 0b00100, 0b00010, 0b00010, 0b00010, 0b00100, 0b01000},
+	'/':  {0, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0},
+	'\'': {0b01100, 0b00100, 0b01000, 0, 0, 0, 0},
+	'+':  {0, 0b00100, 0b00100, 0b11111, 0b00100, 0b00100, 0},
+	'&':  {0b01100, 0b10010, 0b10100, 0b01000, 0b10101, 0b10010, 0b01101},
+	'!':  {0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0, 0b00100},
+	'?':  {0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0, 0b00100},
+	'|':  {0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100},
+	'°':  {0b01100, 0b10010, 0b10010, 0b01100, 0, 0, 0},
+}
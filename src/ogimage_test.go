@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenderSummaryCard(t *testing.T) {
+	card := summaryCard{
+		Place:   "Zürich, Switzerland",
+		Verdict: "good",
+		Window:  "best 22:00-03:00 (5h)",
+		Moon:    "moon 45% Waxing Gibbous",
+		Bars:    []embedBar{{Height: 10, OK: true}, {Height: 80}, {Height: 0, OK: true}},
+	}
+	data, err := renderSummaryCard(card)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("invalid PNG: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != ogImageWidth || b.Dy() != ogImageHeight {
+		t.Fatalf("unexpected size %v", b)
+	}
+	// Must fit into a single cache entry
+	if len(data) > 128*1024 {
+		t.Fatalf("PNG too large for cache: %d bytes", len(data))
+	}
+}
+
+func TestNewSummaryCard(t *testing.T) {
+	start := time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC)
+	points := DataPoints{}
+	for i := 0; i < 12; i++ {
+		points = append(points, DataPoint{Time: start.Add(time.Duration(i) * time.Hour), Dark: i >= 2 && i <= 9, Lat: 50.45, Lon: 30.52, MoonIllum: 40})
+	}
+	card := newSummaryCard("Kyiv", points, PrintOptions{}, start)
+	if card.Verdict != "good" || card.Window != "best 20:00-04:00 (8h)" {
+		t.Fatalf("unexpected card: %+v", card)
+	}
+	if !strings.HasPrefix(card.Moon, "moon 40% ") || len(card.Bars) != 8 {
+		t.Fatalf("unexpected moon or bars: %+v", card)
+	}
+}
+
+func TestFitText(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	if got := fitText(long, 8); len(got) != (ogImageWidth-2*ogMargin)/(glyphAdvance*8) || !strings.HasSuffix(got, "...") {
+		t.Fatalf("unexpected fitted text %q", got)
+	}
+	if got := fitText("Kyiv", 8); got != "Kyiv" {
+		t.Fatalf("short text should be unchanged, got %q", got)
+	}
+}
+
+func TestHandleOGImage_CachesRenderedImage(t *testing.T) {
+	setupCache()
+	var calls int32
+	ts := fakeForecastServer(t, func(i int) int64 { return 0 })
+	handler := ts.Config.Handler
+	ts.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		handler.ServeHTTP(w, r)
+	})
+
+	// Spellings of a name that draw the same card share one cached image
+	for _, name := range []string{"Kyiv", "%20kyiv%20%20"} {
+		req := httptest.NewRequest(http.MethodGet, "/og.png?lat=50.45&lon=30.52&name="+name, nil)
+		rec := httptest.NewRecorder()
+		handleOGImage(rec, req)
+		res := rec.Result()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected 200, got %d", res.StatusCode)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "image/png" {
+			t.Fatalf("expected image/png, got %s", ct)
+		}
+		if cc := res.Header.Get("Cache-Control"); cc != "public, max-age=600" || res.Header.Get("ETag") == "" {
+			t.Fatalf("unexpected Cache-Control %q, ETag %q", cc, res.Header.Get("ETag"))
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected upstream called once, got %d", calls)
+	}
+	cardKey := func() string {
+		_, freshness, err := fetchForecastFreshness(context.Background(), 50.45, 30.52)
+		if err != nil {
+			t.Fatalf("fetching forecast: %v", err)
+		}
+		return "og:" + freshness.Digest + ":" + hourVariant(time.Now()) + ":KYIV:0:0:false"
+	}
+	drawn := cardKey()
+	if _, err := cache.Get(drawn); err != nil {
+		t.Fatalf("expected rendered image in cache: %v", err)
+	}
+
+	// A refetched forecast gets a new card instead of the one drawn from the old forecast
+	_ = cache.Delete("weather:50.450000,30.520000:" + OpenMeteoAPIParams)
+	fakeForecastServer(t, func(i int) int64 { return 90 })
+	rec := httptest.NewRecorder()
+	handleOGImage(rec, httptest.NewRequest(http.MethodGet, "/og.png?lat=50.45&lon=30.52&name=Kyiv", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	redrawn := cardKey()
+	if redrawn == drawn {
+		t.Fatalf("expected a new card key for the refetched forecast")
+	}
+	if _, err := cache.Get(redrawn); err != nil {
+		t.Fatalf("expected the new card in cache: %v", err)
+	}
+}
+
+func TestOGPlaceName(t *testing.T) {
+	if got := ogPlaceName("  new\t york  city "); got != "NEW YORK CITY" {
+		t.Fatalf("unexpected name %q", got)
+	}
+	if got := ogPlaceName(strings.Repeat("a", 1000)); got != fitText(strings.Repeat("A", 1000), ogPlaceScale) {
+		t.Fatalf("expected long names cut to the card width, got %d runes", len([]rune(got)))
+	}
+}
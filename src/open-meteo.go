@@ -1,13 +1,15 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"time"
 )
@@ -22,6 +24,8 @@ type OpenMeteoAPIResponse struct {
 	Elevation            float64     `json:"elevation"`
 	HourlyUnits          HourlyUnits `json:"hourly_units"`
 	Hourly               Hourly      `json:"hourly"`
+
+	Freshness Freshness `json:"-"` // age of the data, set by FetchData
 }
 
 type Hourly struct {
@@ -38,6 +42,8 @@ type Hourly struct {
 	WindSpeed850hPa       []float64 `json:"wind_speed_850hPa"`
 	GeopotentialHeight850 []float64 `json:"geopotential_height_850hPa"`
 	GeopotentialHeight500 []float64 `json:"geopotential_height_500hPa"`
+	DewPoint2M            []float64 `json:"dew_point_2m"`  // optional, older cached payloads lack it
+	Precipitation         []float64 `json:"precipitation"` // optional, mm over the preceding hour
 }
 
 type HourlyUnits struct {
@@ -54,6 +60,8 @@ type HourlyUnits struct {
 	WindSpeed850hPa       string `json:"wind_speed_850hPa"`
 	GeopotentialHeight850 string `json:"geopotential_height_850hPa"`
 	GeopotentialHeight500 string `json:"geopotential_height_500hPa"`
+	DewPoint2M            string `json:"dew_point_2m"`
+	Precipitation         string `json:"precipitation"`
 }
 
 type Suggestion struct {
@@ -68,7 +76,7 @@ type Suggestion struct {
 	Lon         float64 `json:"longitude"`
 }
 
-// shared HTTP client with reasonable timeout
+// shared HTTP client with reasonable timeout, which also bounds retries
 var httpClient = &http.Client{Timeout: 12 * time.Second}
 
 // userAgentRoundTripper injects a User-Agent header into all outbound requests made via httpClient
@@ -86,63 +94,74 @@ func (t *userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, er
 }
 
 func init() {
-	// Configure User-Agent from environment variable
-	ua := os.Getenv("AWEATHER_USER_AGENT")
-	if ua == "" {
-		ua = "aweather"
-	}
 	base := http.DefaultTransport
 	if httpClient.Transport != nil {
 		base = httpClient.Transport
 	}
-	httpClient.Transport = &userAgentRoundTripper{base: base, userAgent: ua}
+	// One client span per call; retries and metrics see each attempt
+	httpClient.Transport = &userAgentRoundTripper{
+		base:      &tracingRoundTripper{base: newResilientRoundTripper(&upstreamMetricsRoundTripper{base: base})},
+		userAgent: "aweather", // Config.setGlobals sets the configured one
+	}
 }
 
+// staleHeadroom is the time kept before a request's deadline to serve a stale forecast in
+const staleHeadroom = time.Second
+
 // FetchData goes to OpenMeteoEndpoint, makes HTTPS request and stores result as OpenMeteoAPIResponse object
-// Returns error when upstream is unavailable or response cannot be parsed.
-func (response *OpenMeteoAPIResponse) FetchData(apiEndpoint, parameters, lat, lon string) error {
+// Cached forecasts younger than CacheTTL are used as is, younger than CacheRevalidateTTL are used
+// while a fresh copy is fetched in the background, and older ones only when Open-Meteo fails.
+// Returns error when upstream is unavailable with nothing cached or response cannot be parsed.
+func (response *OpenMeteoAPIResponse) FetchData(ctx context.Context, apiEndpoint, parameters, lat, lon string) error {
 	cacheKey := fmt.Sprintf("weather:%s,%s:%s", lat, lon, parameters)
-	weatherData, err := cache.Get(cacheKey)
+	raw, err := cacheGet(ctx, cacheKey)
 
-	if err != nil {
-		log.Println("INFO: Making request to Open-Meteo API and parsing response")
-
-		// Set parameters
-		params := url.Values{}
-		params.Add("latitude", lat)
-		params.Add("longitude", lon)
-		params.Add("hourly", parameters)
-		params.Add("timezone", "auto")
+	// The cache key holds full coordinates, so logs get a rounded location instead
+	latF, _ := strconv.ParseFloat(lat, 64)
+	lonF, _ := strconv.ParseFloat(lon, 64)
+	location := coords(latF, lonF)
 
-		// Make request to Open-Meteo API
-		req, err := http.NewRequest("GET", apiEndpoint+params.Encode(), nil)
-		if err != nil {
-			return fmt.Errorf("create request: %w", err)
-		}
-
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			return fmt.Errorf("do request: %w", err)
-		}
-		defer resp.Body.Close()
+	fetch := func(ctx context.Context) ([]byte, error) {
+		return fetchForecastPayload(ctx, apiEndpoint, parameters, lat, lon, cacheKey, location)
+	}
 
-		// Read Response Body
-		if resp.StatusCode != http.StatusOK {
-			return fmt.Errorf("upstream status: %s", resp.Status)
+	var weatherData []byte
+	var freshness Freshness
+	cached := err == nil
+	if cached {
+		weatherData, freshness.FetchedAt = decodeCacheEntry(raw)
+	}
+	age := freshness.Age(time.Now())
+
+	switch {
+	case cached && age < CacheTTL:
+		slog.InfoContext(ctx, "using cached forecast", location)
+	case cached && age < CacheRevalidateTTL:
+		slog.InfoContext(ctx, "using cached forecast, refreshing in the background", location, "age", age.Round(time.Second).String())
+		// The refresh outlives this request, so that its result fills the cache
+		go func(ctx context.Context) {
+			if _, err := coalesceUpstream(ctx, cacheKey, fetch); err != nil {
+				slog.WarnContext(ctx, "refreshing forecast failed", location, "error", err)
+			}
+		}(context.WithoutCancel(ctx))
+	default:
+		waitCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok && cached {
+			// Stop waiting early enough to serve the stale copy before the deadline
+			var cancel context.CancelFunc
+			waitCtx, cancel = context.WithDeadline(ctx, deadline.Add(-staleHeadroom))
+			defer cancel()
 		}
-
-		log.Println("INFO: Got API response", resp.Status)
-		weatherData, err = io.ReadAll(resp.Body)
+		data, err := coalesceUpstream(waitCtx, cacheKey, fetch)
 		if err != nil {
-			return fmt.Errorf("read body: %w", err)
-		}
-
-		// Save response to cache
-		if err := cache.Set(cacheKey, weatherData); err != nil {
-			log.Printf("WARN: cache set weather failed for %s: %v", cacheKey, err)
+			if !cached || ctx.Err() != nil {
+				return err
+			}
+			slog.WarnContext(ctx, "serving stale forecast, Open-Meteo failed", location, "age", age.Round(time.Second).String(), "error", err)
+			freshness.Stale = true
+			break
 		}
-	} else {
-		log.Println("INFO: Using cached data for", cacheKey)
+		weatherData, freshness = data, Freshness{FetchedAt: time.Now()}
 	}
 
 	// Save response as OpenMeteoAPIResponse object
@@ -150,17 +169,61 @@ func (response *OpenMeteoAPIResponse) FetchData(apiEndpoint, parameters, lat, lo
 	if err != nil {
 		return fmt.Errorf("unmarshal weather json: %w", err)
 	}
+	sum := sha256.Sum256(weatherData)
+	freshness.Digest = hex.EncodeToString(sum[:16])
+	response.Freshness = freshness
 	return nil
 }
 
+// fetchForecastPayload requests a forecast from Open-Meteo and caches it with the time it was fetched
+func fetchForecastPayload(ctx context.Context, apiEndpoint, parameters, lat, lon, cacheKey string, location slog.Attr) ([]byte, error) {
+	slog.InfoContext(ctx, "fetching forecast from Open-Meteo", location)
+
+	// Set parameters
+	params := url.Values{}
+	params.Add("latitude", lat)
+	params.Add("longitude", lon)
+	params.Add("hourly", parameters)
+	params.Add("timezone", "auto")
+
+	// Make request to Open-Meteo API; it is aborted when ctx is cancelled
+	req, err := http.NewRequestWithContext(ctx, "GET", apiEndpoint+params.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Read Response Body
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream status: %s", resp.Status)
+	}
+
+	slog.DebugContext(ctx, "got Open-Meteo response", "status", resp.Status)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+
+	// Save response to cache
+	if err := cache.Set(cacheKey, encodeCacheEntry(data, time.Now())); err != nil {
+		slog.WarnContext(ctx, "caching forecast failed", location, "error", err)
+	}
+	return data, nil
+}
+
 // fetchSuggestions() makes request to OpenMeteoGeoAPI and returns Suggestion object
-func fetchSuggestions(query string) ([]Suggestion, error) {
+func fetchSuggestions(ctx context.Context, query string) ([]Suggestion, error) {
 	// Encode query
 	encodedQuery := url.QueryEscape(query)
 
 	// Check if query is in cache
 	cacheKey := "geo:" + encodedQuery
-	resultByte, err := cache.Get(cacheKey)
+	resultByte, err := cacheGet(ctx, cacheKey)
 	if err != nil {
 		// Fallback to legacy key used previously
 		if legacy, legacyErr := cache.Get(encodedQuery); legacyErr == nil {
@@ -171,102 +234,123 @@ func fetchSuggestions(query string) ([]Suggestion, error) {
 
 	// If not in cache, make request to OpenMeteoGeoAPI
 	if err != nil {
-		log.Println("INFO: Making request to Open-Meteo Geo API and parsing response for query: ", encodedQuery)
-		requestURL := fmt.Sprintf("%s?name=%s", OpenMeteoGeoAPIEndpoint, encodedQuery)
-		resp, err := httpClient.Get(requestURL)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
+		resultByte, err = coalesceUpstream(ctx, cacheKey, func(ctx context.Context) ([]byte, error) {
+			slog.InfoContext(ctx, "fetching suggestions from Open-Meteo", "query", query)
+			requestURL := fmt.Sprintf("%s?name=%s", OpenMeteoGeoAPIEndpoint, encodedQuery)
+			req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := httpClient.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
 
-		var result struct {
-			Results []Suggestion `json:"results"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			var result struct {
+				Results []Suggestion `json:"results"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return nil, err
+			}
+
+			// Save response to cache
+			jsonData, _ := json.Marshal(result.Results)
+			cache.Set(cacheKey, jsonData)
+			// Also store under legacy key for backward compatibility (tests rely on it)
+			cache.Set(encodedQuery, jsonData)
+			return jsonData, nil
+		})
+		if err != nil {
 			return nil, err
 		}
-
-		// Save response to cache
-		jsonData, _ := json.Marshal(result.Results)
-		cache.Set(cacheKey, jsonData)
-		// Also store under legacy key for backward compatibility (tests rely on it)
-		cache.Set(encodedQuery, jsonData)
-
-		// Return results
-		return result.Results, nil
 	} else {
-		log.Println("INFO: Using cached data for query", encodedQuery)
+		slog.InfoContext(ctx, "using cached suggestions", "query", query)
+	}
 
-		// Unmarshal cached data
-		result := []Suggestion{}
-		json.Unmarshal(resultByte, &result)
+	// Unmarshal cached or fetched data
+	result := []Suggestion{}
+	json.Unmarshal(resultByte, &result)
 
-		// Return results
-		return result, nil
-	}
+	// Return results
+	return result, nil
 }
 
 // fetchReverseGeocoding queries Open‑Meteo Reverse Geocoding API for a single best match
 // It caches the first result under key "reverse:lat,lon" and returns it.
-func fetchReverseGeocoding(lat string, lon string) (*Suggestion, error) {
+func fetchReverseGeocoding(ctx context.Context, lat string, lon string) (*Suggestion, error) {
 	// Normalize to 3 decimal places (~111m) to avoid cache misses due to small GPS jitter
 	// This significantly increases cache hit rate and reduces upstream calls.
 	normLat, normLon := lat, lon
-	if lf, err1 := strconv.ParseFloat(lat, 64); err1 == nil {
-		normLat = strconv.FormatFloat(lf, 'f', 3, 64)
+	latF, err1 := strconv.ParseFloat(lat, 64)
+	if err1 == nil {
+		normLat = strconv.FormatFloat(latF, 'f', 3, 64)
 	}
-	if lf, err2 := strconv.ParseFloat(lon, 64); err2 == nil {
-		normLon = strconv.FormatFloat(lf, 'f', 3, 64)
+	lonF, err2 := strconv.ParseFloat(lon, 64)
+	if err2 == nil {
+		normLon = strconv.FormatFloat(lonF, 'f', 3, 64)
 	}
+	location := coords(latF, lonF)
 
 	cacheKey := fmt.Sprintf("reverse:%s,%s", normLat, normLon)
 
-	if cached, err := cache.Get(cacheKey); err == nil {
+	if cached, err := cacheGet(ctx, cacheKey); err == nil {
 		var suggestion Suggestion
 		if err := json.Unmarshal(cached, &suggestion); err == nil {
-			log.Println("INFO: Using cached reverse geocoding for", cacheKey)
+			slog.InfoContext(ctx, "using cached reverse geocoding", location)
 			return &suggestion, nil
 		} else {
-			log.Println("WARN: Cached reverse geocoding unmarshal failed, refetching:", cacheKey, err)
+			slog.WarnContext(ctx, "cached reverse geocoding unreadable, refetching", location, "error", err)
 		}
 		// fallthrough to refetch on unmarshal error
-	} else {
-		log.Println("INFO: Reverse geocoding cache miss for", cacheKey, "reason:", err)
 	}
 
-	log.Println("INFO: Making request to Open-Meteo Reverse Geo API for:", normLat, normLon)
-	requestURL := fmt.Sprintf("%s?latitude=%s&longitude=%s", OpenMeteoGeoReverseAPIEndpoint, url.QueryEscape(normLat), url.QueryEscape(normLon))
-	resp, err := httpClient.Get(requestURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+	// The shared payload is the top result as JSON, or nil when there is none
+	data, err := coalesceUpstream(ctx, cacheKey, func(ctx context.Context) ([]byte, error) {
+		slog.InfoContext(ctx, "fetching reverse geocoding from Open-Meteo", location)
+		requestURL := fmt.Sprintf("%s?latitude=%s&longitude=%s", OpenMeteoGeoReverseAPIEndpoint, url.QueryEscape(normLat), url.QueryEscape(normLon))
+		req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		// Upstream returned non-200; treat as no result to avoid surfacing errors to clients
-		return nil, nil
-	}
+		if resp.StatusCode != http.StatusOK {
+			// Upstream returned non-200; treat as no result to avoid surfacing errors to clients
+			return nil, nil
+		}
 
-	var result struct {
-		Results []Suggestion `json:"results"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, err
-	}
+		var result struct {
+			Results []Suggestion `json:"results"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, err
+		}
 
-	if len(result.Results) == 0 {
-		return nil, nil
-	}
+		if len(result.Results) == 0 {
+			return nil, nil
+		}
 
-	top := result.Results[0]
-	if data, err := json.Marshal(top); err == nil {
+		data, err := json.Marshal(result.Results[0])
+		if err != nil {
+			return nil, err
+		}
 		if err := cache.Set(cacheKey, data); err != nil {
-			log.Println("WARN: Failed to cache reverse geocoding result for", cacheKey, "error:", err)
-		} else {
-			log.Println("INFO: Cached reverse geocoding for", cacheKey)
+			slog.WarnContext(ctx, "caching reverse geocoding failed", location, "error", err)
 		}
-	} else {
-		log.Println("WARN: Failed to marshal reverse geocoding result for", cacheKey, "error:", err)
+		return data, nil
+	})
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	var top Suggestion
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, err
 	}
 	return &top, nil
 }
@@ -299,7 +383,7 @@ func (data OpenMeteoAPIResponse) Points() DataPoints {
 	}
 
 	if minLen == 0 {
-		log.Println("WARN: Open-Meteo: no hourly data to build points")
+		slog.Warn("Open-Meteo response has no hourly data")
 		return points
 	}
 
@@ -317,12 +401,12 @@ func (data OpenMeteoAPIResponse) Points() DataPoints {
 		len(h.WindSpeed850hPa) != minLen ||
 		len(h.GeopotentialHeight850) != minLen ||
 		len(h.GeopotentialHeight500) != minLen {
-		log.Printf("WARN: Open-Meteo hourly array length mismatch; truncating to %d (time=%d t2m=%d t500=%d t850=%d cl=%d cm=%d ch=%d w10=%d gust=%d w200=%d w850=%d gph850=%d gph500=%d)",
-			minLen,
-			len(h.Time), len(h.Temperature2M), len(h.Temperature500hPa), len(h.Temperature850hPa),
-			len(h.CloudCoverLow), len(h.CloudCoverMid), len(h.CloudCoverHigh),
-			len(h.WindSpeed10M), len(h.WindGusts10M), len(h.WindSpeed200hPa), len(h.WindSpeed850hPa),
-			len(h.GeopotentialHeight850), len(h.GeopotentialHeight500))
+		slog.Warn("Open-Meteo hourly array length mismatch, truncating",
+			"length", minLen,
+			"time", len(h.Time), "t2m", len(h.Temperature2M), "t500", len(h.Temperature500hPa), "t850", len(h.Temperature850hPa),
+			"cl", len(h.CloudCoverLow), "cm", len(h.CloudCoverMid), "ch", len(h.CloudCoverHigh),
+			"w10", len(h.WindSpeed10M), "gust", len(h.WindGusts10M), "w200", len(h.WindSpeed200hPa), "w850", len(h.WindSpeed850hPa),
+			"gph850", len(h.GeopotentialHeight850), "gph500", len(h.GeopotentialHeight500))
 	}
 
 	// Resolve location once; fall back to UTC if unknown
@@ -358,6 +442,13 @@ func (data OpenMeteoAPIResponse) Points() DataPoints {
 			Lat:                   data.Latitude,
 			Lon:                   data.Longitude,
 		}
+		// Optional arrays are used only when present for this hour
+		if i < len(h.DewPoint2M) {
+			point.DewPoint = h.DewPoint2M[i]
+		}
+		if i < len(h.Precipitation) {
+			point.Precipitation = h.Precipitation[i]
+		}
 
 		points = append(points, point)
 	}
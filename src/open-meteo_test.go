@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -12,12 +13,63 @@ import (
 	"github.com/allegro/bigcache/v3"
 )
 
+// testCache is the cache made by the last setupCache call
+var testCache *bigcache.BigCache
+
 func setupCache() {
+	// Each bigcache preallocates its shards; close the previous one so that they can be freed
+	if testCache != nil {
+		testCache.Close()
+	}
 	var err error
-	cache, err = bigcache.New(context.Background(), bigcache.DefaultConfig(5*time.Minute))
+	testCache, err = bigcache.New(context.Background(), bigcache.DefaultConfig(5*time.Minute))
 	if err != nil {
 		log.Fatalf("Failed to initialize cache: %v", err)
 	}
+	cache = testCache
+}
+
+// fakeForecastJSON builds an Open-Meteo style response with hourly values starting at start (UTC).
+// cloud returns the low/mid/high cloud cover for hour i.
+func fakeForecastJSON(start time.Time, hours int, cloud func(i int) int64) []byte {
+	h := Hourly{}
+	for i := 0; i < hours; i++ {
+		c := cloud(i)
+		h.Time = append(h.Time, start.Add(time.Duration(i)*time.Hour).UTC().Format("2006-01-02T15:04"))
+		h.Temperature2M = append(h.Temperature2M, 10)
+		h.Temperature500hPa = append(h.Temperature500hPa, -20)
+		h.Temperature850hPa = append(h.Temperature850hPa, 2)
+		h.CloudCoverLow = append(h.CloudCoverLow, c)
+		h.CloudCoverMid = append(h.CloudCoverMid, c)
+		h.CloudCoverHigh = append(h.CloudCoverHigh, c)
+		h.WindSpeed10M = append(h.WindSpeed10M, 5)
+		h.WindGusts10M = append(h.WindGusts10M, 8)
+		h.WindSpeed200hPa = append(h.WindSpeed200hPa, 60)
+		h.WindSpeed850hPa = append(h.WindSpeed850hPa, 15)
+		h.GeopotentialHeight850 = append(h.GeopotentialHeight850, 1500)
+		h.GeopotentialHeight500 = append(h.GeopotentialHeight500, 5600)
+	}
+	data, _ := json.Marshal(OpenMeteoAPIResponse{Latitude: 50.45, Longitude: 30.52, Timezone: "UTC", Elevation: 180, Hourly: h})
+	return data
+}
+
+// fakeForecastServer serves fakeForecastJSON for three days starting at today's midnight (UTC)
+func fakeForecastServer(t *testing.T, cloud func(i int) int64) *httptest.Server {
+	t.Helper()
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	payload := fakeForecastJSON(start, 72, cloud)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(payload)
+	}))
+	original := OpenMeteoAPIEndpoint
+	OpenMeteoAPIEndpoint = ts.URL + "?"
+	t.Cleanup(func() {
+		OpenMeteoAPIEndpoint = original
+		ts.Close()
+	})
+	return ts
 }
 
 func TestFetchData_Success(t *testing.T) {
@@ -37,7 +89,7 @@ func TestFetchData_Success(t *testing.T) {
 	defer server.Close()
 
 	response := OpenMeteoAPIResponse{}
-	response.FetchData(server.URL+"?", "temperature_2m", "52.52", "13.405")
+	response.FetchData(context.Background(), server.URL+"?", "temperature_2m", "52.52", "13.405")
 
 	if response.Latitude != 52.52 {
 		t.Errorf("Expected latitude 52.52, got %f", response.Latitude)
@@ -63,7 +115,7 @@ func TestFetchData_UsesCache(t *testing.T) {
 	defer ts.Close()
 
 	resp := OpenMeteoAPIResponse{}
-	if err := resp.FetchData(ts.URL+"?", "temperature_2m", "1.000000", "2.000000"); err != nil {
+	if err := resp.FetchData(context.Background(), ts.URL+"?", "temperature_2m", "1.000000", "2.000000"); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 	if resp.Latitude != 1 || len(resp.Hourly.Time) != 1 {
@@ -80,7 +132,7 @@ func TestFetchData_Error(t *testing.T) {
 	defer server.Close()
 
 	response := OpenMeteoAPIResponse{}
-	response.FetchData(server.URL+"?", "temperature_2m", "52.52", "13.405")
+	response.FetchData(context.Background(), server.URL+"?", "temperature_2m", "52.52", "13.405")
 
 	if response.Latitude != 0 {
 		t.Error("Expected latitude 0 on error response")
@@ -104,7 +156,7 @@ func TestFetchSuggestions_Success(t *testing.T) {
 	defer server.Close()
 
 	OpenMeteoGeoAPIEndpoint = server.URL
-	suggestions, err := fetchSuggestions("Berlin")
+	suggestions, err := fetchSuggestions(context.Background(), "Berlin")
 
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
@@ -125,7 +177,7 @@ func TestFetchReverseGeocoding_CacheAndNormalize(t *testing.T) {
 	}
 
 	// Values with more precision should normalize to the same key
-	got, err := fetchReverseGeocoding("52.52000", "13.40500")
+	got, err := fetchReverseGeocoding(context.Background(), "52.52000", "13.40500")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -144,7 +196,7 @@ func TestFetchSuggestions_Cache(t *testing.T) {
 	jsonData, _ := json.Marshal(suggestion)
 	cache.Set("CachedCity", jsonData)
 
-	suggestions, err := fetchSuggestions("CachedCity")
+	suggestions, err := fetchSuggestions(context.Background(), "CachedCity")
 
 	if err != nil {
 		t.Fatalf("Unexpected error fetching cached data: %v", err)
@@ -187,6 +239,40 @@ func TestPoints(t *testing.T) {
 	}
 }
 
+func TestPoints_OptionalArrays(t *testing.T) {
+	hourly := func() Hourly {
+		return Hourly{
+			Time:                  []string{"2024-01-01T00:00", "2024-01-01T01:00"},
+			Temperature2M:         []float64{5, 4},
+			Temperature500hPa:     []float64{0, 0},
+			Temperature850hPa:     []float64{0, 0},
+			WindSpeed200hPa:       []float64{0, 0},
+			WindSpeed850hPa:       []float64{0, 0},
+			CloudCoverLow:         []int64{0, 0},
+			CloudCoverMid:         []int64{0, 0},
+			CloudCoverHigh:        []int64{0, 0},
+			WindSpeed10M:          []float64{0, 0},
+			WindGusts10M:          []float64{0, 0},
+			GeopotentialHeight850: []float64{0, 0},
+			GeopotentialHeight500: []float64{0, 0},
+		}
+	}
+
+	// Payloads cached before dew point and precipitation were requested still parse
+	points := OpenMeteoAPIResponse{Hourly: hourly()}.Points()
+	if len(points) != 2 || points[1].DewPoint != 0 || points[1].Precipitation != 0 {
+		t.Fatalf("unexpected points without optional arrays: %+v", points)
+	}
+
+	h := hourly()
+	h.DewPoint2M = []float64{1.5, 0.5}
+	h.Precipitation = []float64{0, 0.3}
+	points = OpenMeteoAPIResponse{Hourly: h}.Points()
+	if len(points) != 2 || points[0].DewPoint != 1.5 || points[1].Precipitation != 0.3 {
+		t.Fatalf("unexpected points with optional arrays: %+v", points)
+	}
+}
+
 func TestPoints_TimeParseFallback(t *testing.T) {
 	// Provide a time string that cannot be parsed with location but can with UTC fallback
 	response := OpenMeteoAPIResponse{
@@ -214,3 +300,56 @@ func TestPoints_TimeParseFallback(t *testing.T) {
 		t.Fatalf("Expected one point with non-zero time, got: %+v", pts)
 	}
 }
+
+// hangingUpstream accepts calls and holds them until the client cancels, reporting each cancellation
+func hangingUpstream(t *testing.T) (url string, started, cancelled chan struct{}) {
+	t.Helper()
+	started, cancelled = make(chan struct{}, 10), make(chan struct{}, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL, started, cancelled
+}
+
+func TestFetchers_CancelAbortsUpstream(t *testing.T) {
+	endpoint, started, cancelled := hangingUpstream(t)
+	originals := []string{OpenMeteoGeoAPIEndpoint, OpenMeteoGeoReverseAPIEndpoint}
+	OpenMeteoGeoAPIEndpoint, OpenMeteoGeoReverseAPIEndpoint = endpoint, endpoint
+	defer func() { OpenMeteoGeoAPIEndpoint, OpenMeteoGeoReverseAPIEndpoint = originals[0], originals[1] }()
+
+	for name, fetch := range map[string]func(ctx context.Context) error{
+		"forecast": func(ctx context.Context) error {
+			var response OpenMeteoAPIResponse
+			return response.FetchData(ctx, endpoint+"?", "temperature_2m", "1.5", "2.5")
+		},
+		"suggestions": func(ctx context.Context) error {
+			_, err := fetchSuggestions(ctx, "Lviv")
+			return err
+		},
+		"reverse": func(ctx context.Context) error {
+			_, err := fetchReverseGeocoding(ctx, "49.84", "24.03")
+			return err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			setupCache()
+			ctx, cancel := context.WithCancel(context.Background())
+			errc := make(chan error, 1)
+			go func() { errc <- fetch(ctx) }()
+
+			<-started
+			cancel()
+			select {
+			case <-cancelled:
+			case <-time.After(5 * time.Second):
+				t.Fatal("upstream call kept running after the caller cancelled")
+			}
+			if err := <-errc; !errors.Is(err, context.Canceled) {
+				t.Errorf("expected context.Canceled, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pushSubscriptionsBucket = "push_subscriptions"
+	pushStateBucket         = "push_state"
+	pushKeysBucket          = "push_keys"
+	pushKeysKey             = "vapid"
+)
+
+// PushSubscription asks for a browser notification when a clear window appears at a location
+type PushSubscription struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	MinHours  int       `json:"min_hours"`
+	Endpoint  string    `json:"endpoint"`
+	P256dh    string    `json:"p256dh"` // base64url client public key
+	Auth      string    `json:"auth"`   // base64url client auth secret
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PushMessage is the JSON payload shown by the service worker
+type PushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+	Tag   string `json:"tag"`
+}
+
+// Push serves the Web Push API and notifies browsers about clear windows
+type Push struct {
+	store        *Store
+	keys         *VAPIDKeys
+	client       *http.Client
+	subject      string // VAPID contact, a mailto: or https: URL
+	allowPrivate bool
+	maxRecords   int // subscriptions kept at most, 0 for no limit
+
+	now func() time.Time
+}
+
+var errPushGone = errors.New("push subscription expired")
+
+// pushFromConfig sets up browser notifications with vapid_subject, or public_url when it is not
+// set, as the contact for push services. It returns nil when neither is set.
+func pushFromConfig(cfg Config, store *Store) (*Push, error) {
+	subject := cfg.VAPIDSubject
+	if subject == "" {
+		subject = cfg.PublicURL
+	}
+	if subject == "" {
+		return nil, nil
+	}
+	return newPush(store, subject, cfg.WebhookAllowPrivate, cfg.MaxSubscriptions)
+}
+
+// newPush loads the VAPID keys from the store, generating them on first use. New
+// subscriptions are refused once maxRecords are stored.
+func newPush(store *Store, subject string, allowPrivate bool, maxRecords int) (*Push, error) {
+	keys := &VAPIDKeys{}
+	err := store.Get(pushKeysBucket, pushKeysKey, keys)
+	if errors.Is(err, errNotFound) {
+		if keys, err = generateVAPIDKeys(); err != nil {
+			return nil, fmt.Errorf("generate vapid keys: %w", err)
+		}
+		if err := store.Put(pushKeysBucket, pushKeysKey, keys); err != nil {
+			return nil, fmt.Errorf("save vapid keys: %w", err)
+		}
+		slog.Info("generated VAPID keys")
+	} else if err != nil {
+		return nil, fmt.Errorf("load vapid keys: %w", err)
+	}
+	return &Push{
+		store:        store,
+		keys:         keys,
+		client:       newWebhookClient(allowPrivate),
+		subject:      subject,
+		allowPrivate: allowPrivate,
+		maxRecords:   maxRecords,
+		now:          time.Now,
+	}, nil
+}
+
+// handleKey returns the VAPID public key for pushManager.subscribe
+func (p *Push) handleKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"public_key": p.keys.PublicKey()}); err != nil {
+		slog.ErrorContext(r.Context(), "encoding push key", "error", err)
+	}
+}
+
+// handleCreate stores a browser subscription for a location
+func (p *Push) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The subscription object is PushSubscription.toJSON() from the browser
+	var req struct {
+		Name         string  `json:"name"`
+		Latitude     float64 `json:"latitude"`
+		Longitude    float64 `json:"longitude"`
+		MinHours     int     `json:"min_hours"`
+		Subscription struct {
+			Endpoint       string   `json:"endpoint"`
+			ExpirationTime *float64 `json:"expirationTime"`
+			Keys           struct {
+				P256dh string `json:"p256dh"`
+				Auth   string `json:"auth"`
+			} `json:"keys"`
+		} `json:"subscription"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	sub := PushSubscription{
+		Name:      strings.TrimSpace(req.Name),
+		Latitude:  req.Latitude,
+		Longitude: req.Longitude,
+		MinHours:  req.MinHours,
+		Endpoint:  req.Subscription.Endpoint,
+		P256dh:    req.Subscription.Keys.P256dh,
+		Auth:      req.Subscription.Keys.Auth,
+	}
+	if err := p.validate(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub.ID = randomHex(16)
+	sub.CreatedAt = p.now().UTC()
+
+	err := p.store.Insert(pushSubscriptionsBucket, sub.ID, sub, p.maxRecords)
+	if errors.Is(err, errStoreFull) {
+		slog.WarnContext(r.Context(), "push subscription limit reached", "limit", p.maxRecords)
+		http.Error(w, "No more subscriptions can be created", http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "saving push subscription", "error", err)
+		http.Error(w, "Unable to save subscription", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "created push subscription", "subscription", sub.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/push/subscriptions/"+sub.ID)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(map[string]any{"id": sub.ID, "min_hours": sub.MinHours}); err != nil {
+		slog.ErrorContext(r.Context(), "encoding push subscription", "error", err)
+	}
+}
+
+// handleItem deletes a subscription by ID
+func (p *Push) handleItem(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.PathValue("id")
+	var sub PushSubscription
+	err := p.store.Get(pushSubscriptionsBucket, id, &sub)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = p.remove(id)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "deleting push subscription", "subscription", id, "error", err)
+		http.Error(w, "Unable to delete subscription", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "deleted push subscription", "subscription", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Push) remove(id string) error {
+	if err := p.store.Delete(pushSubscriptionsBucket, id); err != nil {
+		return err
+	}
+	return p.store.Delete(pushStateBucket, id)
+}
+
+// validate checks user input and fills in defaults
+func (p *Push) validate(sub *PushSubscription) error {
+	if _, _, ok := parseCoordinates(float64ToString(sub.Latitude), float64ToString(sub.Longitude)); !ok {
+		return errors.New("latitude and longitude are out of range")
+	}
+	if sub.MinHours == 0 {
+		sub.MinHours = defaultMinHours
+	}
+	if sub.MinHours < 1 || sub.MinHours > 12 {
+		return errors.New("min_hours must be between 1 and 12")
+	}
+	if len(sub.Name) > 100 {
+		return errors.New("name is too long")
+	}
+	u, err := url.Parse(sub.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && !(p.allowPrivate && u.Scheme == "http")) {
+		return errors.New("subscription endpoint must be an https URL")
+	}
+	if key, err := b64.DecodeString(sub.P256dh); err != nil || len(key) != 65 {
+		return errors.New("subscription p256dh key is invalid")
+	}
+	if auth, err := b64.DecodeString(sub.Auth); err != nil || len(auth) != 16 {
+		return errors.New("subscription auth secret is invalid")
+	}
+	return nil
+}
+
+// notify tells every browser subscription about newly appeared clear windows. It runs as a
+// notifier of the subscription scheduler.
+func (p *Push) notify(ctx context.Context, forecast forecastLookup) {
+	subs := []PushSubscription{}
+	err := p.store.ForEach(pushSubscriptionsBucket, func(key string, data []byte) error {
+		var sub PushSubscription
+		if err := json.Unmarshal(data, &sub); err != nil {
+			slog.Warn("skipping unreadable push subscription", "subscription", key, "error", err)
+			return nil
+		}
+		subs = append(subs, sub)
+		return nil
+	})
+	if err != nil {
+		slog.Error("listing push subscriptions", "error", err)
+		return
+	}
+
+	for _, sub := range subs {
+		if ctx.Err() != nil {
+			return
+		}
+		points, err := forecast(ctx, sub.Latitude, sub.Longitude)
+		if err != nil {
+			slog.Warn("push subscription forecast failed", "subscription", sub.ID, "error", err)
+			continue
+		}
+
+		var state subscriptionState
+		if err := p.store.Get(pushStateBucket, sub.ID, &state); err != nil && !errors.Is(err, errNotFound) {
+			slog.Warn("reading push subscription state", "subscription", sub.ID, "error", err)
+		}
+		events, next := evaluateSubscription(Subscription{
+			ID:        sub.ID,
+			Name:      sub.Name,
+			Latitude:  sub.Latitude,
+			Longitude: sub.Longitude,
+			MinHours:  sub.MinHours,
+		}, points, state, p.now())
+
+		gone := false
+		for _, event := range events {
+			// Only good news is pushed; a window that disappears just updates the state
+			if event.Event != eventWindowAppeared {
+				continue
+			}
+			err := p.send(ctx, sub, event)
+			if errors.Is(err, errPushGone) {
+				gone = true
+				break
+			}
+			if err != nil {
+				slog.Warn("push failed", "subscription", sub.ID, "error", err)
+				delete(next.Announced, event.Night) // retried on the next run
+				continue
+			}
+			slog.Info("sent push notification", "subscription", sub.ID, "night", event.Night)
+		}
+
+		if gone {
+			slog.Info("push subscription expired, removing it", "subscription", sub.ID)
+			if err := p.remove(sub.ID); err != nil {
+				slog.Error("removing push subscription", "subscription", sub.ID, "error", err)
+			}
+			continue
+		}
+		if err := p.store.Put(pushStateBucket, sub.ID, next); err != nil {
+			slog.Error("saving push subscription state", "subscription", sub.ID, "error", err)
+		}
+	}
+}
+
+// pushMessage describes a clear window as a notification
+func pushMessage(sub PushSubscription, event WebhookEvent) PushMessage {
+	place := sub.Name
+	if place == "" {
+		place = fmt.Sprintf("%.2f, %.2f", sub.Latitude, sub.Longitude)
+	}
+	w := event.Window
+	return PushMessage{
+		Title: "Clear night at " + place,
+		Body: fmt.Sprintf("%s: %s – %s (%dh), score %d/100",
+			w.Start.Format("Monday, January 2"), w.Start.Format("15:04"), w.End.Format("15:04"), w.Hours, event.Score),
+		URL: permalinkPath(sub.Name, sub.Latitude, sub.Longitude, nil),
+		Tag: "aweather-" + sub.ID + "-" + event.Night,
+	}
+}
+
+// send encrypts the notification and POSTs it to the browser's push service
+func (p *Push) send(ctx context.Context, sub PushSubscription, event WebhookEvent) error {
+	payload, err := json.Marshal(pushMessage(sub, event))
+	if err != nil {
+		return fmt.Errorf("encode message: %w", err)
+	}
+	p256dh, err := b64.DecodeString(sub.P256dh)
+	if err != nil {
+		return fmt.Errorf("decode p256dh: %w", err)
+	}
+	auth, err := b64.DecodeString(sub.Auth)
+	if err != nil {
+		return fmt.Errorf("decode auth: %w", err)
+	}
+	body, err := encryptPushPayload(p256dh, auth, payload)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+
+	authorization, err := p.keys.Authorization(sub.Endpoint, p.subject, p.now())
+	if err != nil {
+		return fmt.Errorf("vapid: %w", err)
+	}
+
+	// Keep the message until the window starts; after that it is stale
+	ttl := int(event.Window.Start.Sub(p.now()).Seconds())
+	ttl = max(ttl, 60)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(ttl))
+	req.Header.Set("Urgency", "normal")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("push service status: %s", resp.Status)
+	}
+	return nil
+}
+
+// handleServiceWorker serves the service worker from the root so it may control the whole site
+func handleServiceWorker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	serveEmbeddedFile(w, "static/sw.js", "text/javascript; charset=utf-8")
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pushServiceStandIn accepts Web Push requests and decrypts them with the browser's keys
+type pushServiceStandIn struct {
+	t         *testing.T
+	clientKey *ecdh.PrivateKey
+	auth      []byte
+
+	mu       sync.Mutex
+	messages []PushMessage
+	headers  []http.Header
+	status   int
+}
+
+func newPushServiceStandIn(t *testing.T) (*pushServiceStandIn, *httptest.Server) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("client key: %v", err)
+	}
+	ps := &pushServiceStandIn{t: t, clientKey: key, auth: []byte("authsecret123456")}
+	ts := httptest.NewServer(ps)
+	t.Cleanup(ts.Close)
+	return ps, ts
+}
+
+func (ps *pushServiceStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.status != 0 {
+		w.WriteHeader(ps.status)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	plain, err := decryptPushRecord(ps.clientKey, ps.auth, body)
+	if err != nil {
+		ps.t.Errorf("push service could not decrypt: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var msg PushMessage
+	if err := json.Unmarshal(plain, &msg); err != nil {
+		ps.t.Errorf("push payload: %v", err)
+	}
+	ps.messages = append(ps.messages, msg)
+	ps.headers = append(ps.headers, r.Header.Clone())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (ps *pushServiceStandIn) count() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.messages)
+}
+
+func (ps *pushServiceStandIn) subscriptionJSON(endpoint string) string {
+	return `{"endpoint":"` + endpoint + `","expirationTime":null,"keys":{"p256dh":"` +
+		b64.EncodeToString(ps.clientKey.PublicKey().Bytes()) + `","auth":"` + b64.EncodeToString(ps.auth) + `"}}`
+}
+
+func newTestPush(t *testing.T) *Push {
+	t.Helper()
+	p, err := newPush(openTestStore(t), "https://aweather.test", true, 0)
+	if err != nil {
+		t.Fatalf("new push: %v", err)
+	}
+	p.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	return p
+}
+
+func TestPush_KeysArePersisted(t *testing.T) {
+	store := openTestStore(t)
+	first, err := newPush(store, "", false, 0)
+	if err != nil {
+		t.Fatalf("new push: %v", err)
+	}
+	second, err := newPush(store, "", false, 0)
+	if err != nil {
+		t.Fatalf("new push: %v", err)
+	}
+	if first.keys.PublicKey() != second.keys.PublicKey() {
+		t.Fatalf("expected the stored VAPID key to be reused")
+	}
+
+	rec := httptest.NewRecorder()
+	first.handleKey(rec, httptest.NewRequest(http.MethodGet, "/push/key", nil))
+	var body map[string]string
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusOK || body["public_key"] != first.keys.PublicKey() {
+		t.Fatalf("unexpected key response %d %v", rec.Code, body)
+	}
+}
+
+func TestPushFromConfig(t *testing.T) {
+	store := openTestStore(t)
+	cfg := defaultConfig()
+	if p, err := pushFromConfig(cfg, store); p != nil || err != nil {
+		t.Fatalf("expected push to be off without a subject, got %v, %v", p, err)
+	}
+	cfg.PublicURL = "https://aweather.example.com"
+	if p, err := pushFromConfig(cfg, store); err != nil || p.subject != cfg.PublicURL {
+		t.Fatalf("expected the public URL as subject: %v", err)
+	}
+	cfg.VAPIDSubject = "mailto:admin@example.com"
+	if p, err := pushFromConfig(cfg, store); err != nil || p.subject != cfg.VAPIDSubject {
+		t.Fatalf("expected vapid_subject to win: %v", err)
+	}
+}
+
+func TestPush_SubscribeAndNotify(t *testing.T) {
+	ps, ts := newPushServiceStandIn(t)
+	p := newTestPush(t)
+	points := feedTestPoints(90)
+	forecast := func(ctx context.Context, lat, lon float64) (DataPoints, error) { return points, nil }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push/subscriptions", p.handleCreate)
+	mux.HandleFunc("/push/subscriptions/{id}", p.handleItem)
+
+	body := `{"name":"Club","latitude":50.45,"longitude":30.52,"min_hours":3,"subscription":` + ps.subscriptionJSON(ts.URL+"/push/abc") + `}`
+	// The VAPID subject is the configured one, whatever Host the browser subscribed on
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "http://attacker.example/push/subscriptions", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &created)
+
+	p.notify(context.Background(), forecast)
+	if ps.count() != 1 {
+		t.Fatalf("expected 1 push, got %d", ps.count())
+	}
+	msg, header := ps.messages[0], ps.headers[0]
+	if msg.Title != "Clear night at Club" || !strings.HasPrefix(msg.Body, "Friday, March 1: 19:00 – 05:00 (10h)") || !strings.Contains(msg.URL, "name=Club") {
+		t.Errorf("unexpected message %+v", msg)
+	}
+	if header.Get("Content-Encoding") != "aes128gcm" || header.Get("TTL") != "25200" {
+		t.Errorf("unexpected headers %v", header)
+	}
+	claims, _ := verifyVAPID(t, header.Get("Authorization"))
+	if claims["aud"] != ts.URL || claims["sub"] != "https://aweather.test" {
+		t.Errorf("unexpected VAPID claims %v", claims)
+	}
+
+	// Announced once
+	p.notify(context.Background(), forecast)
+	if ps.count() != 1 {
+		t.Fatalf("expected no repeated push, got %d", ps.count())
+	}
+
+	// A failed push is retried on the next run
+	points = feedTestPoints(0)
+	ps.mu.Lock()
+	ps.status = http.StatusTooManyRequests
+	ps.mu.Unlock()
+	p.notify(context.Background(), forecast)
+	ps.mu.Lock()
+	ps.status = 0
+	ps.mu.Unlock()
+	p.notify(context.Background(), forecast)
+	if ps.count() != 2 || !strings.HasPrefix(ps.messages[1].Body, "Saturday, March 2") {
+		t.Fatalf("expected the second night after a retry, got %+v", ps.messages)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/push/subscriptions/"+created.ID, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/push/subscriptions/"+created.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestPush_ExpiredSubscriptionIsRemoved(t *testing.T) {
+	ps, ts := newPushServiceStandIn(t)
+	ps.status = http.StatusGone
+	p := newTestPush(t)
+	forecast := func(ctx context.Context, lat, lon float64) (DataPoints, error) { return feedTestPoints(90), nil }
+
+	body := `{"latitude":50.45,"longitude":30.52,"subscription":` + ps.subscriptionJSON(ts.URL+"/push/abc") + `}`
+	rec := httptest.NewRecorder()
+	p.handleCreate(rec, httptest.NewRequest(http.MethodPost, "/push/subscriptions", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	p.notify(context.Background(), forecast)
+	count := 0
+	_ = p.store.ForEach(pushSubscriptionsBucket, func(string, []byte) error { count++; return nil })
+	if count != 0 {
+		t.Fatalf("expected the expired subscription to be removed, found %d", count)
+	}
+}
+
+func TestPush_CreateInvalid(t *testing.T) {
+	p, err := newPush(openTestStore(t), "", false, 0)
+	if err != nil {
+		t.Fatalf("new push: %v", err)
+	}
+	ps, _ := newPushServiceStandIn(t)
+	valid := ps.subscriptionJSON("https://push.example.com/abc")
+	for _, body := range []string{
+		`not json`,
+		`{"latitude":95,"longitude":30,"subscription":` + valid + `}`,
+		`{"latitude":50,"longitude":30,"min_hours":13,"subscription":` + valid + `}`,
+		`{"latitude":50,"longitude":30,"subscription":` + ps.subscriptionJSON("http://push.example.com/abc") + `}`,
+		`{"latitude":50,"longitude":30,"subscription":{"endpoint":"https://push.example.com/abc","keys":{"p256dh":"AAAA","auth":"AAAA"}}}`,
+	} {
+		rec := httptest.NewRecorder()
+		p.handleCreate(rec, httptest.NewRequest(http.MethodPost, "/push/subscriptions", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+}
+
+func TestPush_Limit(t *testing.T) {
+	p, err := newPush(openTestStore(t), "", false, 1)
+	if err != nil {
+		t.Fatalf("new push: %v", err)
+	}
+	ps, _ := newPushServiceStandIn(t)
+	body := `{"latitude":50.45,"longitude":30.52,"subscription":` + ps.subscriptionJSON("https://push.example.com/abc") + `}`
+	for i, want := range []int{http.StatusCreated, http.StatusInsufficientStorage} {
+		rec := httptest.NewRecorder()
+		p.handleCreate(rec, httptest.NewRequest(http.MethodPost, "/push/subscriptions", strings.NewReader(body)))
+		if rec.Code != want {
+			t.Fatalf("subscription %d: expected %d, got %d", i+1, want, rec.Code)
+		}
+	}
+}
+
+func TestHandleServiceWorker(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleServiceWorker(rec, httptest.NewRequest(http.MethodGet, "/sw.js", nil))
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/javascript") || !strings.Contains(rec.Body.String(), "showNotification") {
+		t.Fatalf("unexpected service worker response %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+}
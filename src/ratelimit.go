@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRateLimits are the budgets of the endpoints that call Open-Meteo, and of the ones
+// that create stored records. /suggestions is called as the user types, so it allows short
+// bursts.
+const defaultRateLimits = "/suggestions=5/s:20; /reverse-geocoding=30/m:10; /weather=60/m:20; " +
+	"/chart.svg=60/m:20; /embed=60/m:20; /embed.json=60/m:20; /og.png=60/m:20; /feed.atom=60/m:20; " +
+	"/api/=30/m:10; /subscriptions=10/h:5; /push/subscriptions=10/h:5; /digests=10/h:5"
+
+// rateLimitSweep is how often buckets that have refilled are forgotten
+const rateLimitSweep = time.Minute
+
+// rateRule is a token bucket budget: rate tokens a second, holding at most burst
+type rateRule struct {
+	path  string // exact path, a subtree ending in "/", or "*" for every other path
+	rate  float64
+	burst float64
+}
+
+// RateLimiter limits requests per client IP with a token bucket for each rule
+type RateLimiter struct {
+	rules   map[string]rateRule
+	trusted []netip.Prefix // proxies whose X-Forwarded-For is believed
+	allow   []netip.Prefix // clients that are never limited
+	now     func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+}
+
+type bucketKey struct {
+	rule   string
+	client netip.Prefix
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiterFromConfig configures limits from rate_limits on top of defaultRateLimits, or
+// returns nil when it is "off". trusted_proxies and rate_limit_allow are comma-separated IPs
+// or CIDR ranges.
+func rateLimiterFromConfig(cfg Config) (*RateLimiter, error) {
+	raw := strings.TrimSpace(cfg.RateLimits)
+	if raw == "off" {
+		return nil, nil
+	}
+	rules, err := parseRateRules(defaultRateLimits, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rules, err = parseRateRules(raw, rules); err != nil {
+		return nil, fmt.Errorf("rate_limits: %w", err)
+	}
+	trusted, err := parsePrefixes(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	allow, err := parsePrefixes(cfg.RateLimitAllow)
+	if err != nil {
+		return nil, fmt.Errorf("rate_limit_allow: %w", err)
+	}
+	return newRateLimiter(rules, trusted, allow), nil
+}
+
+func newRateLimiter(rules map[string]rateRule, trusted, allow []netip.Prefix) *RateLimiter {
+	return &RateLimiter{rules: rules, trusted: trusted, allow: allow, now: time.Now, buckets: map[bucketKey]*tokenBucket{}}
+}
+
+// parseRateRules reads "path=count/unit[:burst]" entries separated by ";" into rules,
+// where unit is s, m or h and "path=off" removes a rule. burst defaults to count.
+func parseRateRules(raw string, rules map[string]rateRule) (map[string]rateRule, error) {
+	if rules == nil {
+		rules = map[string]rateRule{}
+	}
+	for _, entry := range strings.Split(raw, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		path, limit, ok := strings.Cut(entry, "=")
+		path, limit = strings.TrimSpace(path), strings.TrimSpace(limit)
+		if !ok || (path != "*" && !strings.HasPrefix(path, "/")) {
+			return nil, fmt.Errorf("invalid entry %q, want path=count/unit[:burst]", entry)
+		}
+		if limit == "off" {
+			delete(rules, path)
+			continue
+		}
+		limit, burstText, hasBurst := strings.Cut(limit, ":")
+		countText, unit, ok := strings.Cut(limit, "/")
+		count, err := strconv.Atoi(countText)
+		if !ok || err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid rate in %q", entry)
+		}
+		per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+		if per == 0 {
+			return nil, fmt.Errorf("invalid unit in %q, want s, m or h", entry)
+		}
+		burst := count
+		if hasBurst {
+			if burst, err = strconv.Atoi(burstText); err != nil || burst <= 0 {
+				return nil, fmt.Errorf("invalid burst in %q", entry)
+			}
+		}
+		rules[path] = rateRule{path: path, rate: float64(count) / per.Seconds(), burst: float64(burst)}
+	}
+	return rules, nil
+}
+
+// parsePrefixes reads comma-separated IPs and CIDR ranges
+func parsePrefixes(raw string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "/") {
+			prefix, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap limits requests to next; a nil limiter lets everything through. Requests made with
+// an API key are limited by its quota instead.
+func (l *RateLimiter) Wrap(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := l.rule(r.URL.Path)
+		client := l.clientIP(r)
+		if !ok || !client.IsValid() || containsAddr(l.allow, client) || apiKeyFromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if wait, ok := l.take(rule, client); !ok {
+			rateLimited.Inc(rule.path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rule finds the budget for a path: an exact rule, else the longest subtree rule, else "*"
+func (l *RateLimiter) rule(path string) (rateRule, bool) {
+	if rule, ok := l.rules[path]; ok && !strings.HasSuffix(path, "/") {
+		return rule, true
+	}
+	var best rateRule
+	for p, rule := range l.rules {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) && len(p) > len(best.path) {
+			best = rule
+		}
+	}
+	if best.path != "" {
+		return best, true
+	}
+	rule, ok := l.rules["*"]
+	return rule, ok
+}
+
+// clientIP is the address the request came from. Behind trusted proxies it is the last
+// X-Forwarded-For hop that is not a trusted proxy, since earlier hops can be forged.
+func (l *RateLimiter) clientIP(r *http.Request) netip.Addr {
+	addr := remoteAddr(r.RemoteAddr)
+	if !addr.IsValid() || !containsAddr(l.trusted, addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !containsAddr(l.trusted, addr) {
+			break
+		}
+	}
+	return addr
+}
+
+// remoteAddr parses http.Request.RemoteAddr, which is "ip:port"
+func remoteAddr(s string) netip.Addr {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap()
+	}
+	addr, _ := netip.ParseAddr(s)
+	return addr.Unmap()
+}
+
+// take removes a token from the client's bucket, or reports how long until one is available
+func (l *RateLimiter) take(rule rateRule, client netip.Addr) (time.Duration, bool) {
+	// An IPv6 user usually has a whole /64, so it shares one bucket
+	bits := 32
+	if client.Is6() {
+		bits = 64
+	}
+	prefix, _ := client.Prefix(bits)
+	key := bucketKey{rule: rule.path, client: prefix}
+
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rule.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(rule.burst, b.tokens+now.Sub(b.updated).Seconds()*rule.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rule.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep forgets buckets that have refilled, which behave like new ones. Called with l.mu held.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweep {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		rule := l.rules[key.rule]
+		if b.tokens+now.Sub(b.updated).Seconds()*rule.rate >= rule.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLimiter runs on a fake clock that the test moves forward
+func testLimiter(t *testing.T, rules string, trusted, allow string) (*RateLimiter, *time.Time) {
+	t.Helper()
+	parsed, err := parseRateRules(rules, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedPrefixes, err := parsePrefixes(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newRateLimiter(parsed, trustedPrefixes, allowPrefixes)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func limitedRequest(h http.Handler, path, remote, forwarded string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = remote
+	if forwarded != "" {
+		req.Header.Set("X-Forwarded-For", forwarded)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestRateLimiter_Buckets(t *testing.T) {
+	l, now := testLimiter(t, "/suggestions=2/s:3; /weather=1/m", "", "")
+	h := l.Wrap(okHandler)
+
+	for i := 0; i < 3; i++ {
+		if rec := limitedRequest(h, "/suggestions?q=ky", "192.0.2.1:1234", ""); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: %d", i, rec.Code)
+		}
+	}
+	rec := limitedRequest(h, "/suggestions?q=kyi", "192.0.2.1:1234", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("over the burst: status = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Other clients and other endpoints have their own budgets
+	if rec := limitedRequest(h, "/suggestions", "192.0.2.2:1234", ""); rec.Code != http.StatusOK {
+		t.Errorf("another client: %d", rec.Code)
+	}
+	if rec := limitedRequest(h, "/weather", "192.0.2.1:1234", ""); rec.Code != http.StatusOK {
+		t.Errorf("another endpoint: %d", rec.Code)
+	}
+	rec = limitedRequest(h, "/weather", "192.0.2.1:1234", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("/weather over the limit: status = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Paths without a rule are not limited
+	for i := 0; i < 10; i++ {
+		if rec := limitedRequest(h, "/static/app.js", "192.0.2.1:1234", ""); rec.Code != http.StatusOK {
+			t.Fatalf("unlimited path: %d", rec.Code)
+		}
+	}
+
+	// Tokens come back at the configured rate
+	*now = now.Add(500 * time.Millisecond)
+	if rec := limitedRequest(h, "/suggestions", "192.0.2.1:1234", ""); rec.Code != http.StatusOK {
+		t.Errorf("after refill: %d", rec.Code)
+	}
+	if rec := limitedRequest(h, "/suggestions", "192.0.2.1:1234", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("refilled more than the rate: %d", rec.Code)
+	}
+}
+
+func TestRateLimiter_IPv6SharesPrefix(t *testing.T) {
+	l, _ := testLimiter(t, "/weather=1/m", "", "")
+	h := l.Wrap(okHandler)
+	limitedRequest(h, "/weather", "[2001:db8:1:2::1]:1234", "")
+	if rec := limitedRequest(h, "/weather", "[2001:db8:1:2::ffff]:1234", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("same /64: %d", rec.Code)
+	}
+	if rec := limitedRequest(h, "/weather", "[2001:db8:1:3::1]:1234", ""); rec.Code != http.StatusOK {
+		t.Errorf("another /64: %d", rec.Code)
+	}
+}
+
+func TestRateLimiter_Rules(t *testing.T) {
+	l, _ := testLimiter(t, "/push/=1/s; /push/subscribe=2/s; *=3/s", "", "")
+	for path, want := range map[string]string{
+		"/push/subscribe": "/push/subscribe",
+		"/push/test":      "/push/",
+		"/weather":        "*",
+		"/":               "*",
+	} {
+		if rule, ok := l.rule(path); !ok || rule.path != want {
+			t.Errorf("rule(%q) = %q, %v, want %q", path, rule.path, ok, want)
+		}
+	}
+}
+
+func TestRateLimiter_ClientIP(t *testing.T) {
+	l, _ := testLimiter(t, "*=1/s", "10.0.0.0/8, 192.0.2.10", "")
+	for _, tt := range []struct {
+		name, remote, forwarded, want string
+	}{
+		{"direct client", "198.51.100.7:1234", "", "198.51.100.7"},
+		{"untrusted peer cannot forge the header", "198.51.100.7:1234", "203.0.113.1", "198.51.100.7"},
+		{"trusted proxy", "10.0.0.5:1234", "203.0.113.1", "203.0.113.1"},
+		{"entries added by the client are ignored", "10.0.0.5:1234", "1.2.3.4, 203.0.113.1", "203.0.113.1"},
+		{"chain of trusted proxies", "10.0.0.5:1234", "203.0.113.1, 192.0.2.10, 10.1.1.1", "203.0.113.1"},
+		{"malformed hop stops the walk", "10.0.0.5:1234", "203.0.113.1, bogus", "10.0.0.5"},
+		{"proxy without a header", "10.0.0.5:1234", "", "10.0.0.5"},
+		{"IPv4-mapped address", "[::ffff:198.51.100.7]:1234", "", "198.51.100.7"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := l.clientIP(req); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("clientIP = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiter_Allowlist(t *testing.T) {
+	l, _ := testLimiter(t, "*=1/m", "10.0.0.1", "203.0.113.0/24")
+	h := l.Wrap(okHandler)
+	for i := 0; i < 5; i++ {
+		if rec := limitedRequest(h, "/weather", "10.0.0.1:1234", "203.0.113.9"); rec.Code != http.StatusOK {
+			t.Fatalf("allowlisted client behind a proxy: %d", rec.Code)
+		}
+	}
+	limitedRequest(h, "/weather", "10.0.0.1:1234", "198.51.100.7")
+	if rec := limitedRequest(h, "/weather", "10.0.0.1:1234", "198.51.100.7"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("other clients are still limited: %d", rec.Code)
+	}
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	l, now := testLimiter(t, "/weather=1/s:2", "", "")
+	h := l.Wrap(okHandler)
+	limitedRequest(h, "/weather", "192.0.2.1:1234", "")
+	*now = now.Add(rateLimitSweep)
+	limitedRequest(h, "/weather", "192.0.2.2:1234", "")
+	if len(l.buckets) != 1 {
+		t.Errorf("buckets = %d, want only the recently used one", len(l.buckets))
+	}
+}
+
+func TestRateLimiter_CreateEndpoints(t *testing.T) {
+	l, err := rateLimiterFromConfig(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	subs := newSubscriptions(openTestStore(t), false, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscriptions", subs.handleCreate)
+	mux.HandleFunc("/subscriptions/{id}", subs.handleItem)
+	h := l.Wrap(mux)
+
+	create := func(remote string) *httptest.ResponseRecorder {
+		body := `{"latitude":50.45,"longitude":30.52,"webhook_url":"https://example.com/hook"}`
+		req := httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	var location string
+	for i := 0; i < 5; i++ {
+		rec := create("192.0.2.1:1234")
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("subscription %d within the burst: %d", i+1, rec.Code)
+		}
+		location = rec.Header().Get("Location")
+	}
+	if rec := create("192.0.2.1:1234"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("subscription 6: expected 429, got %d", rec.Code)
+	}
+	if rec := create("192.0.2.2:1234"); rec.Code != http.StatusCreated {
+		t.Errorf("another client: %d", rec.Code)
+	}
+
+	// Reading a subscription is not a create and has no budget
+	for i := 0; i < 10; i++ {
+		if rec := limitedRequest(h, location, "192.0.2.1:1234", ""); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("GET %s was limited", location)
+		}
+	}
+	for _, path := range []string{"/push/subscriptions", "/digests"} {
+		if _, ok := l.rule(path); !ok {
+			t.Errorf("%s is limited by default", path)
+		}
+	}
+}
+
+func TestParseRateRules(t *testing.T) {
+	rules, err := parseRateRules(defaultRateLimits, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err = parseRateRules(" /weather = 120/h:30 ; /feed.atom=off;*=10/s", rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules["/weather"]; got.rate != 120.0/3600 || got.burst != 30 {
+		t.Errorf("/weather = %+v", got)
+	}
+	if got := rules["*"]; got.rate != 10 || got.burst != 10 {
+		t.Errorf("* = %+v, want the burst to default to the count", got)
+	}
+	if _, ok := rules["/feed.atom"]; ok {
+		t.Error("/feed.atom=off kept the rule")
+	}
+	if _, ok := rules["/suggestions"]; !ok {
+		t.Error("defaults that were not overridden are kept")
+	}
+
+	for _, bad := range []string{"weather=1/s", "/weather", "/weather=0/s", "/weather=x/s", "/weather=1/d", "/weather=1/s:0", "/weather=1/s:x"} {
+		if _, err := parseRateRules(bad, nil); err == nil {
+			t.Errorf("parseRateRules(%q) accepted", bad)
+		}
+	}
+	if _, err := parsePrefixes("10.0.0.0/8, not-an-ip"); err == nil {
+		t.Error("parsePrefixes accepted an invalid address")
+	}
+}
+
+func TestRateLimiterFromConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RateLimits = "off"
+	if l, err := rateLimiterFromConfig(cfg); l != nil || err != nil {
+		t.Errorf("off: %v, %v", l, err)
+	}
+	cfg.RateLimits = "/weather=nope"
+	if _, err := rateLimiterFromConfig(cfg); err == nil {
+		t.Error("expected an error for invalid limits")
+	}
+	cfg.RateLimits = ""
+	cfg.TrustedProxies = "10.0.0.0/33"
+	if _, err := rateLimiterFromConfig(cfg); err == nil {
+		t.Error("expected an error for invalid proxies")
+	}
+	cfg.TrustedProxies = ""
+	l, err := rateLimiterFromConfig(cfg)
+	if err != nil || l == nil {
+		t.Fatalf("defaults: %v, %v", l, err)
+	}
+	if _, ok := l.rule("/suggestions"); !ok {
+		t.Error("/suggestions is limited by default")
+	}
+	if _, ok := l.rule("/static/app.js"); ok {
+		t.Error("static files are not limited by default")
+	}
+
+	// A nil limiter lets everything through
+	var none *RateLimiter
+	if rec := limitedRequest(none.Wrap(okHandler), "/weather", "192.0.2.1:1234", ""); rec.Code != http.StatusOK {
+		t.Errorf("nil limiter: %d", rec.Code)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// resilientRoundTripper retries failed Open-Meteo calls and fails fast for a host that keeps
+// failing, so that requests fall back to stale cached forecasts instead of waiting on it
+type resilientRoundTripper struct {
+	base           http.RoundTripper
+	attempts       int           // tries per call, including the first
+	attemptTimeout time.Duration // limit for each try, so that a hung connection can be retried
+	backoff        time.Duration // delay before the first retry, doubled for each further one
+	maxBackoff     time.Duration
+	maxRetryAfter  time.Duration // a longer Retry-After is not waited for
+	threshold      int           // consecutive failed calls that open a host's breaker
+	cooldown       time.Duration // how long an open breaker fails calls before letting one through
+
+	mu       sync.Mutex
+	breakers map[string]*breaker // by host
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool // a call is finding out whether the host has recovered
+}
+
+func newResilientRoundTripper(base http.RoundTripper) *resilientRoundTripper {
+	return &resilientRoundTripper{
+		base:           base,
+		attempts:       3,
+		attemptTimeout: 5 * time.Second,
+		backoff:        100 * time.Millisecond,
+		maxBackoff:     2 * time.Second,
+		maxRetryAfter:  3 * time.Second,
+		threshold:      5,
+		cooldown:       30 * time.Second,
+	}
+}
+
+func (t *resilientRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Only requests without a body can be sent again as they are
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return t.base.RoundTrip(req)
+	}
+	host := req.URL.Host
+	if !t.allow(host) {
+		upstreamRejected.Inc(upstreamEndpoint(req.URL.String()))
+		return nil, fmt.Errorf("%w for %s", errCircuitOpen, host)
+	}
+
+	resp, err := t.retry(req)
+	if err != nil && req.Context().Err() != nil {
+		// The caller gave up, which says nothing about the upstream
+		t.release(host)
+	} else {
+		t.record(req.Context(), host, err != nil || retryableStatus(resp.StatusCode))
+	}
+	return resp, err
+}
+
+// retry sends req until it succeeds, fails in a way not worth retrying, or runs out of attempts
+func (t *resilientRoundTripper) retry(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	endpoint := upstreamEndpoint(req.URL.String())
+	for attempt := 1; ; attempt++ {
+		resp, err := t.attempt(req)
+		if attempt >= t.attempts {
+			return resp, err
+		}
+
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			wait = t.backoffDelay(attempt)
+		case retryableStatus(resp.StatusCode):
+			wait = t.backoffDelay(attempt)
+			if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if d > t.maxRetryAfter {
+					return resp, nil
+				}
+				wait = d
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+
+		upstreamRetries.Inc(endpoint)
+		slog.DebugContext(ctx, "retrying upstream call", "endpoint", endpoint, "attempt", attempt, "wait", wait.String(), "error", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt makes one try within attemptTimeout; the timeout keeps running while the body is read
+func (t *resilientRoundTripper) attempt(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.attemptTimeout)
+	resp, err := t.base.RoundTrip(req.Clone(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoffDelay grows exponentially with the attempt, with jitter so that instances do not retry in step
+func (t *resilientRoundTripper) backoffDelay(attempt int) time.Duration {
+	d := t.backoff << (attempt - 1)
+	if d <= 0 || d > t.maxBackoff {
+		d = t.maxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// allow reports whether a call to host may go ahead. Once the cooldown of an open breaker
+// has passed, a single call is let through to probe the host.
+func (t *resilientRoundTripper) allow(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.breakers[host]
+	if b == nil || b.failures < t.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// record counts the outcome of a call, opening the breaker after threshold failures in a row
+func (t *resilientRoundTripper) record(ctx context.Context, host string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.breakers == nil {
+		t.breakers = map[string]*breaker{}
+	}
+	b := t.breakers[host]
+	if b == nil {
+		b = &breaker{}
+		t.breakers[host] = b
+	}
+	b.probing = false
+	if !failed {
+		if b.failures >= t.threshold {
+			slog.InfoContext(ctx, "upstream recovered, closing circuit breaker", "host", host)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= t.threshold {
+		b.openUntil = time.Now().Add(t.cooldown)
+		slog.WarnContext(ctx, "upstream keeps failing, opening circuit breaker", "host", host, "failures", b.failures, "cooldown", t.cooldown.String())
+	}
+}
+
+// release ends a probe that finished without telling whether the host has recovered
+func (t *resilientRoundTripper) release(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.breakers[host]; b != nil {
+		b.probing = false
+	}
+}
+
+// retryableStatus reports whether a response means the upstream is overloaded or failing
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	when, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := when.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// cancelOnClose releases the attempt's timeout once the body has been read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
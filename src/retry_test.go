@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// faultyUpstream answers each call with the next handler in script, repeating the last one
+func faultyUpstream(t *testing.T, script ...http.HandlerFunc) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		script[min(n, len(script))-1](w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls
+}
+
+func failWith(code int, retryAfter string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		http.Error(w, "fault", code)
+	}
+}
+
+func succeed(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }
+
+// testTransport retries quickly, so that the tests do not wait on real backoff
+func testTransport() *resilientRoundTripper {
+	t := newResilientRoundTripper(http.DefaultTransport)
+	t.backoff, t.maxBackoff = time.Millisecond, 5*time.Millisecond
+	t.attemptTimeout = 200 * time.Millisecond
+	return t
+}
+
+func get(t *testing.T, rt http.RoundTripper, url string) (*http.Response, error) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := rt.RoundTrip(req)
+	if err == nil {
+		t.Cleanup(func() { resp.Body.Close() })
+	}
+	return resp, err
+}
+
+func TestResilient_Retries(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     []http.HandlerFunc
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"recovers after server errors", []http.HandlerFunc{failWith(503, ""), failWith(502, ""), succeed}, 200, 3},
+		{"retries rate limiting", []http.HandlerFunc{failWith(429, "0"), succeed}, 200, 2},
+		{"gives up after the last attempt", []http.HandlerFunc{failWith(500, "")}, 500, 3},
+		{"client errors are final", []http.HandlerFunc{failWith(404, "")}, 404, 1},
+		{"Retry-After beyond the limit is not waited for", []http.HandlerFunc{failWith(503, "120"), succeed}, 503, 1},
+		{"timeouts are retried", []http.HandlerFunc{func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}, succeed}, 200, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, calls := faultyUpstream(t, tt.script...)
+			resp, err := get(t, testTransport(), ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus || calls.Load() != tt.wantCalls {
+				t.Errorf("status = %d after %d calls, want %d after %d", resp.StatusCode, calls.Load(), tt.wantStatus, tt.wantCalls)
+			}
+			if tt.wantStatus == 200 {
+				if body, _ := io.ReadAll(resp.Body); string(body) != "ok" {
+					t.Errorf("body = %q", body)
+				}
+			}
+		})
+	}
+}
+
+func TestResilient_RetryAfter(t *testing.T) {
+	ts, calls := faultyUpstream(t, failWith(503, "1"), succeed)
+	start := time.Now()
+	resp, err := get(t, testTransport(), ts.URL)
+	if err != nil || resp.StatusCode != 200 || calls.Load() != 2 {
+		t.Fatalf("unexpected result: %v, %v, %d calls", resp, err, calls.Load())
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %v, before Retry-After", elapsed)
+	}
+}
+
+func TestResilient_CallerCancels(t *testing.T) {
+	ts, calls := faultyUpstream(t, failWith(503, "2"))
+	rt := testTransport()
+	rt.maxRetryAfter = 5 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	if _, err := rt.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the caller's deadline, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("calls = %d", calls.Load())
+	}
+}
+
+func TestResilient_CircuitBreaker(t *testing.T) {
+	healthy := atomic.Bool{}
+	ts, calls := faultyUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if healthy.Load() {
+			succeed(w, r)
+			return
+		}
+		failWith(500, "")(w, r)
+	})
+	rt := testTransport()
+	rt.attempts, rt.threshold, rt.cooldown = 1, 2, 100*time.Millisecond
+
+	for i := 0; i < 2; i++ {
+		if resp, err := get(t, rt, ts.URL); err != nil || resp.StatusCode != 500 {
+			t.Fatalf("call %d: %v, %v", i, resp, err)
+		}
+	}
+	// Open: calls fail without reaching the upstream
+	if _, err := get(t, rt, ts.URL); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected the breaker to be open, got %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("calls = %d while open", calls.Load())
+	}
+
+	// After the cooldown a failed probe opens it again
+	time.Sleep(rt.cooldown)
+	if resp, err := get(t, rt, ts.URL); err != nil || resp.StatusCode != 500 {
+		t.Fatalf("probe: %v, %v", resp, err)
+	}
+	if _, err := get(t, rt, ts.URL); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("expected the breaker to reopen, got %v", err)
+	}
+
+	// and a successful one closes it
+	healthy.Store(true)
+	time.Sleep(rt.cooldown)
+	for i := 0; i < 2; i++ {
+		if resp, err := get(t, rt, ts.URL); err != nil || resp.StatusCode != 200 {
+			t.Fatalf("after recovery: %v, %v", resp, err)
+		}
+	}
+	if calls.Load() != 5 {
+		t.Errorf("calls = %d", calls.Load())
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"3", 3 * time.Second, true},
+		{"Fri, 01 Mar 2024 12:00:10 GMT", 10 * time.Second, true},
+		{"Fri, 01 Mar 2024 11:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	} {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v", tt.value, got, ok)
+		}
+	}
+}
+
+// An open breaker makes FetchData serve the stale forecast without calling Open-Meteo
+func TestFetchData_StaleWhenCircuitOpen(t *testing.T) {
+	setupCache()
+	calls := countingUpstream(t, http.StatusServiceUnavailable)
+	rt := testTransport()
+	rt.threshold = 1
+	original := httpClient.Transport
+	httpClient.Transport = rt
+	defer func() { httpClient.Transport = original }()
+
+	for i := 0; i < 2; i++ {
+		seedForecast(t, 50.45, 30.52, 2*time.Hour)
+		rec := httptest.NewRecorder()
+		handleWeather(rec, httptest.NewRequest(http.MethodGet, "/weather?lat=50.45&lon=30.52", nil))
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Forecast-Stale") != "1" {
+			t.Fatalf("request %d: status = %d, stale = %q", i, rec.Code, rec.Header().Get("X-Forecast-Stale"))
+		}
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("upstream calls = %d, want the 3 attempts of the first request only", got)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Site is a named observing location configured by the operator
+type Site struct {
+	Name string
+	Lat  float64
+	Lon  float64
+}
+
+// parseSites reads a site list like "home=50.45,30.52; club=49.84,24.03".
+// Names must be unique and may only contain letters, digits, '-' and '_' so they can be used in URLs and topics.
+func parseSites(value string) ([]Site, error) {
+	sites := []Site{}
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, coords, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || !validSiteName(name) {
+			return nil, fmt.Errorf("site %q: expected name=lat,lon", entry)
+		}
+		latStr, lonStr, ok := strings.Cut(coords, ",")
+		if !ok {
+			return nil, fmt.Errorf("site %q: expected name=lat,lon", entry)
+		}
+		lat, lon, ok := parseCoordinates(latStr, lonStr)
+		if !ok {
+			return nil, fmt.Errorf("site %q: invalid coordinates", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("site %q: duplicate name", name)
+		}
+		seen[name] = true
+		sites = append(sites, Site{Name: name, Lat: lat, Lon: lon})
+	}
+	return sites, nil
+}
+
+func validSiteName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
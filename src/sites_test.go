@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSites(t *testing.T) {
+	sites, err := parseSites(" home=50.45,30.52; club_2 = -33.9, 18.4 ;")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []Site{{Name: "home", Lat: 50.45, Lon: 30.52}, {Name: "club_2", Lat: -33.9, Lon: 18.4}}
+	if !reflect.DeepEqual(sites, want) {
+		t.Fatalf("expected %+v, got %+v", want, sites)
+	}
+
+	if sites, err := parseSites(""); err != nil || len(sites) != 0 {
+		t.Fatalf("expected no sites, got %+v, %v", sites, err)
+	}
+}
+
+func TestParseSites_Invalid(t *testing.T) {
+	for _, value := range []string{
+		"home",
+		"home=50.45",
+		"home=95,30",
+		"my home=50,30",
+		"=50,30",
+		"home=50,30;home=51,31",
+	} {
+		if _, err := parseSites(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
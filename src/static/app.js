@@ -42,14 +42,20 @@ document.addEventListener("DOMContentLoaded", () => {
 
   loadCookies();
 
+  // Permalinks: fetch immediately when the page was opened with coordinates
+  const params = new URLSearchParams(window.location.search);
+  if (params.has("lat") && params.has("lon")) {
+    maybeRefetch();
+  }
+
   // Wire unit/time toggle listeners (if elements exist)
-  const maybeRefetch = () => {
+  function maybeRefetch() {
     const lat = latitudeInput.value;
     const lon = longitudeInput.value;
     if (lat && lon && !isNaN(lat) && !isNaN(lon)) {
       fetchWeather();
     }
-  };
+  }
 
   function setCookie(name, value) {
     const maxAge = "max-age=" + 365 * 24 * 60 * 60;
@@ -59,6 +65,7 @@ document.addEventListener("DOMContentLoaded", () => {
   if (unitTempC && unitTempF) {
     unitTempC.addEventListener("click", () => {
       setCookie("unitTemp", "c");
+      setPref("prefUnitTemp", "c");
       unitTempC.classList.add("bg-blue-600", "text-white");
       unitTempC.classList.remove("bg-white", "text-blue-600");
       unitTempF.classList.remove("bg-blue-600", "text-white");
@@ -67,6 +74,7 @@ document.addEventListener("DOMContentLoaded", () => {
     });
     unitTempF.addEventListener("click", () => {
       setCookie("unitTemp", "f");
+      setPref("prefUnitTemp", "f");
       unitTempF.classList.add("bg-blue-600", "text-white");
       unitTempF.classList.remove("bg-white", "text-blue-600");
       unitTempC.classList.remove("bg-blue-600", "text-white");
@@ -77,6 +85,7 @@ document.addEventListener("DOMContentLoaded", () => {
   if (unitWindKmh && unitWindMph) {
     unitWindKmh.addEventListener("click", () => {
       setCookie("unitWind", "kmh");
+      setPref("prefUnitWind", "kmh");
       unitWindKmh.classList.add("bg-blue-600", "text-white");
       unitWindKmh.classList.remove("bg-white", "text-blue-600");
       unitWindMph.classList.remove("bg-blue-600", "text-white");
@@ -85,6 +94,7 @@ document.addEventListener("DOMContentLoaded", () => {
     });
     unitWindMph.addEventListener("click", () => {
       setCookie("unitWind", "mph");
+      setPref("prefUnitWind", "mph");
       unitWindMph.classList.add("bg-blue-600", "text-white");
       unitWindMph.classList.remove("bg-white", "text-blue-600");
       unitWindKmh.classList.remove("bg-blue-600", "text-white");
@@ -95,6 +105,7 @@ document.addEventListener("DOMContentLoaded", () => {
   if (time24h && time12h) {
     time24h.addEventListener("click", () => {
       setCookie("time12h", "0");
+      setPref("prefTime12h", "0");
       time24h.classList.add("bg-blue-600", "text-white");
       time24h.classList.remove("bg-white", "text-blue-600");
       time12h.classList.remove("bg-blue-600", "text-white");
@@ -103,6 +114,7 @@ document.addEventListener("DOMContentLoaded", () => {
     });
     time12h.addEventListener("click", () => {
       setCookie("time12h", "1");
+      setPref("prefTime12h", "1");
       time12h.classList.add("bg-blue-600", "text-white");
       time12h.classList.remove("bg-white", "text-blue-600");
       time24h.classList.remove("bg-blue-600", "text-white");
@@ -128,6 +140,34 @@ function formatPlaceName(item) {
   return item.name + (regions ? ", " + regions : "") + ", " + country;
 }
 
+// Display preferences are rendered by the server (URL parameters win over cookies)
+function getPref(id, fallback) {
+  const el = document.getElementById(id);
+  return el && el.value ? el.value : fallback;
+}
+
+function setPref(id, value) {
+  const el = document.getElementById(id);
+  if (el) el.value = value;
+}
+
+// Reflect the current location and preferences in the address bar so it can be shared
+function updatePermalink(cityName, latitude, longitude) {
+  if (!window.history || !window.history.replaceState) return;
+  const params = new URLSearchParams();
+  if (cityName) params.set("name", cityName);
+  params.set("lat", latitude);
+  params.set("lon", longitude);
+  params.set("unit_temp", getPref("prefUnitTemp", "c"));
+  params.set("unit_wind", getPref("prefUnitWind", "kmh"));
+  params.set("time_12h", getPref("prefTime12h", "0"));
+  const maxCloud = getPref("prefMaxCloud", "");
+  const maxWind = getPref("prefMaxWind", "");
+  if (maxCloud) params.set("max_cloud", maxCloud);
+  if (maxWind) params.set("max_wind", maxWind);
+  window.history.replaceState(null, "", window.location.pathname + "?" + params.toString());
+}
+
 function parseCookies() {
   return document.cookie.split("; ").reduce((acc, cookie) => {
     const [k, v] = cookie.split("=");
@@ -258,23 +298,33 @@ async function fetchWeather() {
 
   const shortName = cityName ? cityName.split(",")[0].trim() : "my location";
   const country = cityName && cityName.includes(",") ? cityName.split(",").slice(-1)[0].trim() : "";
-  forecastDetails.textContent = `${shortName}${country ? ", " + country : ""}  |  ${latitude},  ${longitude}`;
+  const details = `${shortName}${country ? ", " + country : ""}  |  ${latitude},  ${longitude}`;
+  forecastDetails.textContent = details;
   forecastDetails.style.display = "block";
 
   weatherResult.innerHTML = "";
+  document.getElementById("chartWrap").style.display = "none";
   loaderEl.style.display = "block";
   fetchBtn.disabled = true;
   cityNameInput.disabled = true;
 
   try {
-    const cookies = parseCookies();
-    const unitTemp = (cookies.unitTemp || "c").toLowerCase();
-    const unitWind = (cookies.unitWind || "kmh").toLowerCase();
-    const time12h = cookies.time12h === "1" ? "1" : "0";
-    const resp = await fetch(`/weather?lat=${encodeURIComponent(latitude)}&lon=${encodeURIComponent(longitude)}&unit_temp=${encodeURIComponent(unitTemp)}&unit_wind=${encodeURIComponent(unitWind)}&time_12h=${encodeURIComponent(time12h)}`);
+    const unitTemp = getPref("prefUnitTemp", "c").toLowerCase();
+    const unitWind = getPref("prefUnitWind", "kmh").toLowerCase();
+    const time12h = getPref("prefTime12h", "0") === "1" ? "1" : "0";
+    const maxCloud = getPref("prefMaxCloud", "");
+    const maxWind = getPref("prefMaxWind", "");
+    let url = `/weather?lat=${encodeURIComponent(latitude)}&lon=${encodeURIComponent(longitude)}&unit_temp=${encodeURIComponent(unitTemp)}&unit_wind=${encodeURIComponent(unitWind)}&time_12h=${encodeURIComponent(time12h)}`;
+    if (maxCloud) url += `&max_cloud=${encodeURIComponent(maxCloud)}`;
+    if (maxWind) url += `&max_wind=${encodeURIComponent(maxWind)}`;
+    const resp = await fetch(url);
     if (!resp.ok) throw new Error("Error fetching weather data: " + resp.statusText);
     const text = await resp.text();
+    forecastDetails.textContent = details + forecastAge(resp.headers);
     renderWeather(text);
+    renderChart(url.replace("/weather?", "/chart.svg?"));
+    updatePermalink(cityName, latitude, longitude);
+    updateNotifyButton();
   } catch (err) {
     console.error(err);
     setError("Failed to fetch weather data. Please try again later.");
@@ -291,6 +341,31 @@ async function fetchWeather() {
   document.cookie = `longitude=${encodeURIComponent(longitude)}; path=/; ${maxAge}`;
 }
 
+// Describe how old the forecast is, from the Age and X-Forecast-Stale response headers
+function forecastAge(headers) {
+  const age = parseInt(headers.get("Age"), 10);
+  let text = "";
+  if (!isNaN(age)) {
+    const minutes = Math.floor(age / 60);
+    if (minutes < 1) text = "updated just now";
+    else if (minutes < 120) text = `updated ${minutes} min ago`;
+    else text = `updated ${Math.floor(minutes / 60)} h ago`;
+  }
+  if (headers.get("X-Forecast-Stale") === "1") {
+    text += (text ? ", " : "") + "Open-Meteo unavailable, showing an older forecast";
+  }
+  return text ? "  |  " + text : "";
+}
+
+// Show the server-rendered SVG chart above the tables
+function renderChart(src) {
+  const wrap = document.getElementById("chartWrap");
+  const img = document.getElementById("forecastChart");
+  img.onload = () => { wrap.style.display = "block"; };
+  img.onerror = () => { wrap.style.display = "none"; };
+  img.src = src;
+}
+
 function renderWeather(text) {
   const container = document.getElementById("weatherResult");
   container.innerHTML = "";
@@ -346,14 +421,20 @@ function loadCookies() {
   const cityNameInput = document.getElementById("city");
   const latitudeInput = document.getElementById("latitude");
   const longitudeInput = document.getElementById("longitude");
-  if (cookies.cityName) cityNameInput.value = cookies.cityName;
-  if (cookies.latitude) latitudeInput.value = cookies.latitude;
-  if (cookies.longitude) longitudeInput.value = cookies.longitude;
+  // Server-rendered values (from the URL or cookies) win; cookies only fill the gaps
+  if (!latitudeInput.value && !longitudeInput.value) {
+    if (cookies.cityName) cityNameInput.value = cookies.cityName;
+    if (cookies.latitude) latitudeInput.value = cookies.latitude;
+    if (cookies.longitude) longitudeInput.value = cookies.longitude;
+  }
 
   // Apply unit/time preferences to toggles
-  const unitTemp = (cookies.unitTemp || "c").toLowerCase();
-  const unitWind = (cookies.unitWind || "kmh").toLowerCase();
-  const time12h = cookies.time12h === "1";
+  const unitTemp = getPref("prefUnitTemp", cookies.unitTemp || "c").toLowerCase();
+  const unitWind = getPref("prefUnitWind", cookies.unitWind || "kmh").toLowerCase();
+  const time12h = getPref("prefTime12h", cookies.time12h || "0") === "1";
+  setPref("prefUnitTemp", unitTemp);
+  setPref("prefUnitWind", unitWind);
+  setPref("prefTime12h", time12h ? "1" : "0");
   const unitTempC = document.getElementById("unitTempC");
   const unitTempF = document.getElementById("unitTempF");
   const unitWindKmh = document.getElementById("unitWindKmh");
@@ -488,9 +569,92 @@ async function useMyLocation() {
   }
 }
 
+// ---- Clear-night notifications (Web Push) ----
+let pushPublicKey = null;
+
+// Subscriptions are remembered per location so the button can turn them off again
+function pushLocationKey() {
+  const lat = parseFloat(document.getElementById("latitude").value).toFixed(3);
+  const lon = parseFloat(document.getElementById("longitude").value).toFixed(3);
+  return `aweatherPush:${lat},${lon}`;
+}
+
+// Show the button only when the browser supports push and the server has it enabled
+async function updateNotifyButton() {
+  const btn = document.getElementById("notifyBtn");
+  if (!btn || !("serviceWorker" in navigator) || !("PushManager" in window)) return;
+  if (pushPublicKey === null) {
+    try {
+      const resp = await fetch("/push/key");
+      if (!resp.ok) return;
+      pushPublicKey = (await resp.json()).public_key;
+    } catch (_) {
+      return;
+    }
+  }
+  const subscribed = localStorage.getItem(pushLocationKey()) !== null;
+  btn.textContent = subscribed ? "stop clear-night notifications here" : "notify me about clear nights here";
+  btn.style.display = "inline-block";
+}
+
+function base64UrlToBytes(value) {
+  const padded = (value + "===".slice((value.length + 3) % 4)).replace(/-/g, "+").replace(/_/g, "/");
+  return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0));
+}
+
+async function toggleNotifications() {
+  const btn = document.getElementById("notifyBtn");
+  const key = pushLocationKey();
+  const existing = localStorage.getItem(key);
+  clearError();
+  btn.disabled = true;
+  try {
+    if (existing !== null) {
+      const resp = await fetch(`/push/subscriptions/${encodeURIComponent(existing)}`, { method: "DELETE" });
+      if (!resp.ok && resp.status !== 404) throw new Error("Unsubscribe failed: " + resp.statusText);
+      localStorage.removeItem(key);
+      return;
+    }
+
+    if ((await Notification.requestPermission()) !== "granted") {
+      setError("Notifications are blocked. Allow them in your browser settings to get clear-night alerts.");
+      return;
+    }
+    const registration = await navigator.serviceWorker.register("/sw.js");
+    await navigator.serviceWorker.ready;
+    let subscription = await registration.pushManager.getSubscription();
+    if (!subscription) {
+      subscription = await registration.pushManager.subscribe({
+        userVisibleOnly: true,
+        applicationServerKey: base64UrlToBytes(pushPublicKey),
+      });
+    }
+    const cityName = document.getElementById("city").value;
+    const resp = await fetch("/push/subscriptions", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({
+        name: cityName ? cityName.split(",")[0].trim() : "",
+        latitude: parseFloat(document.getElementById("latitude").value),
+        longitude: parseFloat(document.getElementById("longitude").value),
+        subscription: subscription.toJSON(),
+      }),
+    });
+    if (!resp.ok) throw new Error("Subscribe failed: " + resp.statusText);
+    localStorage.setItem(key, (await resp.json()).id);
+  } catch (err) {
+    console.error(err);
+    setError("Couldn't set up notifications. Please try again later.");
+  } finally {
+    btn.disabled = false;
+    updateNotifyButton();
+  }
+}
+
 // Expose functions for inline handlers
 window.fetchSuggestions = fetchSuggestions;
 window.fetchWeather = fetchWeather;
 window.useMyLocation = useMyLocation;
+window.toggleNotifications = toggleNotifications;
 
 
@@ -0,0 +1,33 @@
+// aweather service worker: shows clear-night notifications pushed by the server
+
+self.addEventListener("push", (event) => {
+  let data = {};
+  try {
+    data = event.data ? event.data.json() : {};
+  } catch (_) {
+    data = { title: "aweather", body: event.data ? event.data.text() : "" };
+  }
+  event.waitUntil(
+    self.registration.showNotification(data.title || "aweather", {
+      body: data.body || "",
+      tag: data.tag,
+      icon: "/static/favicon-192x192.png",
+      badge: "/static/favicon-32x32.png",
+      data: { url: data.url || "/" },
+    })
+  );
+});
+
+// Focus an open aweather tab or open the forecast for the notified location
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+  const url = new URL(event.notification.data.url || "/", self.location.origin).href;
+  event.waitUntil(
+    self.clients.matchAll({ type: "window", includeUncontrolled: true }).then((clientList) => {
+      for (const client of clientList) {
+        if (client.url === url && "focus" in client) return client.focus();
+      }
+      return self.clients.openWindow(url);
+    })
+  );
+});
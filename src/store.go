@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is the local embedded database for state that must survive restarts.
+// Values are stored as JSON in named buckets.
+type Store struct {
+	db *bolt.DB
+}
+
+// errNotFound is returned by Store.Get for missing keys
+var errNotFound = errors.New("not found")
+
+// errStoreFull is returned by Insert for a bucket that holds as many records as it may
+var errStoreFull = errors.New("too many records")
+
+// openStore opens (or creates) the database file at path
+func openStore(path string) (*Store, error) {
+	return openStoreTimeout(path, 5*time.Second)
+}
+
+// openStoreTimeout opens the database, waiting up to timeout for another process to release it
+func openStoreTimeout(path string, timeout time.Duration) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, fmt.Errorf("open store %s: %w", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// storeFromConfig opens the database named by the db setting; it returns nil when there is none
+func storeFromConfig(cfg Config) (*Store, error) {
+	if cfg.DB == "" {
+		return nil, nil
+	}
+	return openStore(cfg.DB)
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Get decodes the value stored under key into v, or returns errNotFound
+func (s *Store) Get(bucket, key string, v any) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return errNotFound
+		}
+		data := b.Get([]byte(key))
+		if data == nil {
+			return errNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+// Put stores v as JSON under key, creating the bucket if needed
+func (s *Store) Put(bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %s/%s: %w", bucket, key, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Insert stores v as JSON under a new key, unless bucket already holds limit records; 0 means no
+// limit. Counting and storing happen in one transaction, so concurrent inserts cannot overshoot.
+func (s *Store) Insert(bucket, key string, v any, limit int) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encode %s/%s: %w", bucket, key, err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		if limit > 0 && b.Stats().KeyN >= limit {
+			return errStoreFull
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// PutAll stores each value as JSON under its key, in a single transaction
+func (s *Store) PutAll(bucket string, values map[string]any) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, v := range values {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("encode %s/%s: %w", bucket, key, err)
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes key; deleting a missing key is not an error
+func (s *Store) Delete(bucket, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// DeleteAll removes keys in a single transaction
+func (s *Store) DeleteAll(bucket string, keys []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		for _, key := range keys {
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ForEach calls fn with every key and raw JSON value in bucket, in key order
+func (s *Store) ForEach(bucket string, fn func(key string, data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// Update decodes the value under key into v, if there is one, and stores v again after fn
+// has changed it, in a single transaction. An error from fn leaves the value unchanged.
+func (s *Store) Update(bucket, key string, v any, fn func() error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		if data := b.Get([]byte(key)); data != nil {
+			if err := json.Unmarshal(data, v); err != nil {
+				return err
+			}
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("encode %s/%s: %w", bucket, key, err)
+		}
+		return b.Put([]byte(key), data)
+	})
+}
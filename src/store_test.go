@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := openStore(filepath.Join(t.TempDir(), "aweather.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStore(t *testing.T) {
+	store := openTestStore(t)
+
+	type item struct {
+		Name string `json:"name"`
+	}
+	var got item
+	if err := store.Get("items", "a", &got); !errors.Is(err, errNotFound) {
+		t.Fatalf("expected errNotFound from a missing bucket, got %v", err)
+	}
+
+	for _, key := range []string{"b", "a"} {
+		if err := store.Put("items", key, item{Name: "item " + key}); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if err := store.Get("items", "a", &got); err != nil || got.Name != "item a" {
+		t.Fatalf("unexpected get result %+v, %v", got, err)
+	}
+
+	keys := []string{}
+	if err := store.ForEach("items", func(key string, data []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatalf("for each: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("expected keys in order, got %v", keys)
+	}
+
+	if err := store.Delete("items", "a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := store.Get("items", "a", &got); !errors.Is(err, errNotFound) {
+		t.Fatalf("expected errNotFound after delete, got %v", err)
+	}
+	if err := store.Delete("missing", "a"); err != nil {
+		t.Fatalf("deleting from a missing bucket: %v", err)
+	}
+}
+
+func TestStore_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aweather.db")
+	store, err := openStore(path)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	if err := store.Put("items", "a", 42); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	store.Close()
+
+	store, err = openStore(path)
+	if err != nil {
+		t.Fatalf("reopen store: %v", err)
+	}
+	defer store.Close()
+	var got int
+	if err := store.Get("items", "a", &got); err != nil || got != 42 {
+		t.Fatalf("expected value to survive reopen, got %d, %v", got, err)
+	}
+}
+
+func TestStore_Update(t *testing.T) {
+	store := openTestStore(t)
+	increment := func() error {
+		var n int
+		return store.Update("counters", "a", &n, func() error {
+			n++
+			return nil
+		})
+	}
+	for i := 0; i < 3; i++ {
+		if err := increment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errFull := errors.New("full")
+	var n int
+	if err := store.Update("counters", "a", &n, func() error {
+		n = 100
+		return errFull
+	}); !errors.Is(err, errFull) {
+		t.Fatalf("expected the error from fn, got %v", err)
+	}
+	if err := store.Get("counters", "a", &n); err != nil || n != 3 {
+		t.Errorf("counter = %d, %v; want 3 and the failed update discarded", n, err)
+	}
+}
+
+func TestStore_PutAllDeleteAll(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.PutAll("counters", map[string]any{"a": 1, "b": 2, "c": 3}); err != nil {
+		t.Fatalf("put all: %v", err)
+	}
+	if err := store.DeleteAll("counters", []string{"a", "c", "missing"}); err != nil {
+		t.Fatalf("delete all: %v", err)
+	}
+	var keys []string
+	store.ForEach("counters", func(key string, _ []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != "b" {
+		t.Fatalf("expected only b to be left, got %v", keys)
+	}
+	if err := store.DeleteAll("missing", []string{"a"}); err != nil {
+		t.Fatalf("deleting from a missing bucket: %v", err)
+	}
+}
+
+func TestStore_InsertLimit(t *testing.T) {
+	store := openTestStore(t)
+	var wg sync.WaitGroup
+	var inserted, full atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			switch err := store.Insert("records", strconv.Itoa(i), i, 5); {
+			case err == nil:
+				inserted.Add(1)
+			case errors.Is(err, errStoreFull):
+				full.Add(1)
+			default:
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if inserted.Load() != 5 || full.Load() != 15 {
+		t.Fatalf("inserted %d, refused %d; want 5 and 15", inserted.Load(), full.Load())
+	}
+	if err := store.Insert("other", "a", 1, 0); err != nil {
+		t.Fatalf("insert without a limit: %v", err)
+	}
+}
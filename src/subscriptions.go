@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	subscriptionsBucket     = "subscriptions"
+	subscriptionStateBucket = "subscription_state"
+	SchedulerInterval       = 30 * time.Minute // default time between forecast checks
+	defaultMinHours         = 2
+)
+
+// Subscription asks for a webhook call when a clear window of at least MinHours appears or disappears
+type Subscription struct {
+	ID            string    `json:"id"`
+	Name          string    `json:"name,omitempty"`
+	Latitude      float64   `json:"latitude"`
+	Longitude     float64   `json:"longitude"`
+	MaxCloudCover int64     `json:"max_cloud_cover,omitempty"` // percentage; 0 means MaxCloudCover
+	MaxWindSpeed  float64   `json:"max_wind_speed,omitempty"`  // km/h; 0 means MaxWindSpeed
+	MinHours      int       `json:"min_hours"`
+	WebhookURL    string    `json:"webhook_url"`
+	Secret        string    `json:"secret"` // HMAC-SHA256 key for X-Aweather-Signature
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// subscriptionState remembers the window announced for each night (YYYY-MM-DD) so it is sent only once
+type subscriptionState struct {
+	Announced map[string]EmbedWindow `json:"announced"`
+}
+
+// WebhookEvent is the JSON payload POSTed to subscribers
+type WebhookEvent struct {
+	Event          string      `json:"event"` // "window_appeared" or "window_disappeared"
+	SubscriptionID string      `json:"subscription_id"`
+	Name           string      `json:"name,omitempty"`
+	Latitude       float64     `json:"latitude"`
+	Longitude      float64     `json:"longitude"`
+	Night          string      `json:"night"`  // evening the night starts on, YYYY-MM-DD
+	Window         EmbedWindow `json:"window"` // for window_disappeared, the window announced before
+	Score          int         `json:"score"`
+	SentAt         time.Time   `json:"sent_at"`
+}
+
+const (
+	eventWindowAppeared    = "window_appeared"
+	eventWindowDisappeared = "window_disappeared"
+)
+
+// Subscriptions serves the subscription API and runs the background checks, for webhooks and
+// for the other notifiers added to it
+type Subscriptions struct {
+	store      *Store
+	client     *http.Client
+	notifiers  []notifier
+	maxRecords int // subscriptions kept at most, 0 for no limit
+
+	now      func() time.Time
+	forecast forecastLookup
+}
+
+// forecastLookup returns the forecast for a location
+type forecastLookup func(ctx context.Context, lat, lon float64) (DataPoints, error)
+
+// notifier is a channel that tells its subscribers about clear windows, such as webhooks or
+// browser push. The scheduler calls notify on every run with a lookup shared by all channels.
+type notifier interface {
+	notify(ctx context.Context, forecast forecastLookup)
+}
+
+// newSubscriptions creates the subscription service. Webhooks to loopback and private
+// addresses are refused unless allowPrivate is set; new subscriptions are refused once
+// maxRecords are stored.
+func newSubscriptions(store *Store, allowPrivate bool, maxRecords int) *Subscriptions {
+	return &Subscriptions{
+		store:      store,
+		client:     newWebhookClient(allowPrivate),
+		maxRecords: maxRecords,
+		now:        time.Now,
+		forecast:   fetchForecast,
+	}
+}
+
+// handleCreate registers a subscription from a JSON body and returns it with its ID and secret
+func (s *Subscriptions) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sub Subscription
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sub); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if err := validateSubscription(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub.ID = randomHex(16)
+	sub.Secret = randomHex(32)
+	sub.CreatedAt = s.now().UTC()
+
+	err := s.store.Insert(subscriptionsBucket, sub.ID, sub, s.maxRecords)
+	if errors.Is(err, errStoreFull) {
+		slog.WarnContext(r.Context(), "subscription limit reached", "limit", s.maxRecords)
+		http.Error(w, "No more subscriptions can be created", http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "saving subscription", "error", err)
+		http.Error(w, "Unable to save subscription", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "created subscription", "subscription", sub.ID, coords(sub.Latitude, sub.Longitude))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/subscriptions/"+sub.ID)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(sub); err != nil {
+		slog.ErrorContext(r.Context(), "encoding subscription", "error", err)
+	}
+}
+
+// handleItem returns or deletes a subscription; the unguessable ID acts as the credential
+func (s *Subscriptions) handleItem(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var sub Subscription
+	err := s.store.Get(subscriptionsBucket, id, &sub)
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "loading subscription", "subscription", id, "error", err)
+		http.Error(w, "Unable to load subscription", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sub.Secret = ""
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(sub); err != nil {
+			slog.ErrorContext(r.Context(), "encoding subscription", "error", err)
+		}
+	case http.MethodDelete:
+		if err := s.store.Delete(subscriptionsBucket, id); err != nil {
+			slog.ErrorContext(r.Context(), "deleting subscription", "subscription", id, "error", err)
+			http.Error(w, "Unable to delete subscription", http.StatusInternalServerError)
+			return
+		}
+		_ = s.store.Delete(subscriptionStateBucket, id)
+		slog.InfoContext(r.Context(), "deleted subscription", "subscription", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validateSubscription checks user input and fills in defaults
+func validateSubscription(sub *Subscription) error {
+	if _, _, ok := parseCoordinates(float64ToString(sub.Latitude), float64ToString(sub.Longitude)); !ok {
+		return errors.New("latitude and longitude are out of range")
+	}
+	if sub.MaxCloudCover < 0 || sub.MaxCloudCover > 100 {
+		return errors.New("max_cloud_cover must be between 1 and 100")
+	}
+	if sub.MaxWindSpeed < 0 || sub.MaxWindSpeed > 200 {
+		return errors.New("max_wind_speed must be between 1 and 200")
+	}
+	if sub.MinHours == 0 {
+		sub.MinHours = defaultMinHours
+	}
+	if sub.MinHours < 1 || sub.MinHours > 12 {
+		return errors.New("min_hours must be between 1 and 12")
+	}
+	u, err := url.Parse(sub.WebhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook_url must be an http or https URL")
+	}
+	sub.Name = strings.TrimSpace(sub.Name)
+	if len(sub.Name) > 100 {
+		return errors.New("name is too long")
+	}
+	return nil
+}
+
+// addNotifier has the scheduler check n's subscriptions too; call it before Run
+func (s *Subscriptions) addNotifier(n notifier) {
+	s.notifiers = append(s.notifiers, n)
+}
+
+// Run checks all subscriptions now and then every interval until ctx is cancelled
+func (s *Subscriptions) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.runOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runOnce runs every notifier, webhooks first. Each location's forecast is fetched once per
+// run, however many subscriptions of any channel are there.
+func (s *Subscriptions) runOnce(ctx context.Context) {
+	forecast := s.runForecasts()
+	s.notify(ctx, forecast)
+	for _, n := range s.notifiers {
+		if ctx.Err() != nil {
+			return
+		}
+		n.notify(ctx, forecast)
+	}
+}
+
+// runForecasts returns a lookup that fetches each location at most once, for a single run
+func (s *Subscriptions) runForecasts() forecastLookup {
+	type result struct {
+		points DataPoints
+		err    error
+	}
+	fetched := map[[2]float64]result{}
+	return func(ctx context.Context, lat, lon float64) (DataPoints, error) {
+		key := [2]float64{lat, lon}
+		if r, ok := fetched[key]; ok {
+			return r.points, r.err
+		}
+		points, err := s.forecast(ctx, lat, lon)
+		fetched[key] = result{points: points, err: err}
+		return points, err
+	}
+}
+
+// notify evaluates every webhook subscription and delivers pending events
+func (s *Subscriptions) notify(ctx context.Context, forecast forecastLookup) {
+	subs := []Subscription{}
+	err := s.store.ForEach(subscriptionsBucket, func(key string, data []byte) error {
+		var sub Subscription
+		if err := json.Unmarshal(data, &sub); err != nil {
+			slog.Warn("skipping unreadable subscription", "subscription", key, "error", err)
+			return nil
+		}
+		subs = append(subs, sub)
+		return nil
+	})
+	if err != nil {
+		slog.Error("listing subscriptions", "error", err)
+		return
+	}
+
+	for _, sub := range subs {
+		if ctx.Err() != nil {
+			return
+		}
+		points, err := forecast(ctx, sub.Latitude, sub.Longitude)
+		if err != nil {
+			slog.Warn("subscription forecast failed", "subscription", sub.ID, "error", err)
+			continue
+		}
+
+		var state subscriptionState
+		if err := s.store.Get(subscriptionStateBucket, sub.ID, &state); err != nil && !errors.Is(err, errNotFound) {
+			slog.Warn("reading subscription state", "subscription", sub.ID, "error", err)
+		}
+		events, next := evaluateSubscription(sub, points, state, s.now())
+
+		for _, event := range events {
+			if err := s.deliver(ctx, sub, event); err != nil {
+				// Keep the previous state for this night so the event is retried on the next run
+				slog.Warn("webhook failed", "subscription", sub.ID, "event", event.Event, "error", err)
+				if previous, ok := state.Announced[event.Night]; ok {
+					next.Announced[event.Night] = previous
+				} else {
+					delete(next.Announced, event.Night)
+				}
+				continue
+			}
+			slog.Info("sent webhook", "subscription", sub.ID, "event", event.Event, "night", event.Night)
+		}
+
+		if err := s.store.Put(subscriptionStateBucket, sub.ID, next); err != nil {
+			slog.Error("saving subscription state", "subscription", sub.ID, "error", err)
+		}
+	}
+}
+
+// evaluateSubscription compares qualifying windows in the forecast with those already announced.
+// It returns the events to send and the state after sending all of them.
+func evaluateSubscription(sub Subscription, points DataPoints, state subscriptionState, now time.Time) ([]WebhookEvent, subscriptionState) {
+	maxCloud, maxWind := PrintOptions{MaxCloudCover: sub.MaxCloudCover, MaxWindSpeed: sub.MaxWindSpeed}.thresholds()
+	next := subscriptionState{Announced: map[string]EmbedWindow{}}
+	events := []WebhookEvent{}
+
+	newEvent := func(kind string, night string, window EmbedWindow, score int) WebhookEvent {
+		return WebhookEvent{
+			Event:          kind,
+			SubscriptionID: sub.ID,
+			Name:           sub.Name,
+			Latitude:       sub.Latitude,
+			Longitude:      sub.Longitude,
+			Night:          night,
+			Window:         window,
+			Score:          score,
+			SentAt:         now.UTC(),
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, night := range points.Nights(maxCloud, maxWind) {
+		if !night.End.After(now) {
+			continue
+		}
+		date := night.Date.Format("2006-01-02")
+		seen[date] = true
+		announced, wasAnnounced := state.Announced[date]
+
+		if night.Best.Hours >= sub.MinHours {
+			window := EmbedWindow{Start: night.Best.Start, End: night.Best.End, Hours: night.Best.Hours}
+			next.Announced[date] = window
+			if !wasAnnounced {
+				events = append(events, newEvent(eventWindowAppeared, date, window, night.Score()))
+			}
+			// A window that only moved or changed length is not announced again
+			continue
+		}
+		if wasAnnounced {
+			events = append(events, newEvent(eventWindowDisappeared, date, announced, night.Score()))
+		}
+	}
+
+	// Nights no longer in the forecast have ended; forget them silently
+	for date, window := range state.Announced {
+		if !seen[date] && window.End.After(now) {
+			next.Announced[date] = window
+		}
+	}
+	return events, next
+}
+
+// deliver POSTs a signed event to the subscriber's webhook
+func (s *Subscriptions) deliver(ctx context.Context, sub Subscription, event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	mac := hmac.New(sha256.New, []byte(sub.Secret))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "aweather-webhook")
+	req.Header.Set("X-Aweather-Event", event.Event)
+	req.Header.Set("X-Aweather-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook status: %s", resp.Status)
+	}
+	return nil
+}
+
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// newWebhookClient returns a client for subscriber URLs. The address check runs at dial time,
+// after DNS resolution, so a public hostname cannot point the server at internal services.
+func newWebhookClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     60 * time.Second,
+		},
+		// Redirects could lead anywhere; subscribers must register the final URL
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// randomHex returns n random bytes as a hex string
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// cloudyFirstNight returns feedTestPoints with the first night overcast
+func cloudyFirstNight(secondNightCloud int64) DataPoints {
+	points := feedTestPoints(secondNightCloud)
+	for i := range points {
+		if points[i].Time.Before(time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)) {
+			points[i].LowClouds = 90
+		}
+	}
+	return points
+}
+
+func TestEvaluateSubscription(t *testing.T) {
+	sub := Subscription{ID: "sub1", Latitude: 50.45, Longitude: 30.52, MinHours: 3}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	// First night clear (10h), second night only 2h: one event
+	events, state := evaluateSubscription(sub, feedTestPoints(90), subscriptionState{}, now)
+	if len(events) != 1 || events[0].Event != eventWindowAppeared || events[0].Night != "2024-03-01" || events[0].Window.Hours != 10 {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	// Same forecast again: nothing new
+	events, state = evaluateSubscription(sub, feedTestPoints(90), state, now.Add(time.Hour))
+	if len(events) != 0 {
+		t.Fatalf("expected no repeated events, got %+v", events)
+	}
+
+	// Second night clears up: it is announced, the first is not repeated
+	events, state = evaluateSubscription(sub, feedTestPoints(0), state, now.Add(2*time.Hour))
+	if len(events) != 1 || events[0].Night != "2024-03-02" {
+		t.Fatalf("expected second night to appear, got %+v", events)
+	}
+
+	// First night clouds over: it disappears with the window announced before
+	events, state = evaluateSubscription(sub, cloudyFirstNight(0), state, now.Add(3*time.Hour))
+	if len(events) != 1 || events[0].Event != eventWindowDisappeared || events[0].Night != "2024-03-01" || events[0].Window.Hours != 10 {
+		t.Fatalf("expected first night to disappear, got %+v", events)
+	}
+	if _, ok := state.Announced["2024-03-01"]; ok {
+		t.Fatalf("expected disappeared night to be removed from state")
+	}
+
+	// After the second night has ended, its entry is dropped without an event
+	events, state = evaluateSubscription(sub, cloudyFirstNight(0), state, time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC))
+	if len(events) != 0 || len(state.Announced) != 0 {
+		t.Fatalf("expected ended nights to be forgotten silently, got %+v / %+v", events, state)
+	}
+}
+
+func TestEvaluateSubscription_Thresholds(t *testing.T) {
+	// Clouds at 30% fail the default 25% limit but pass a custom 40%
+	points := feedTestPoints(0)
+	for i := range points {
+		points[i].HighClouds = 30
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if events, _ := evaluateSubscription(Subscription{MinHours: 1}, points, subscriptionState{}, now); len(events) != 0 {
+		t.Fatalf("expected no events with default thresholds, got %+v", events)
+	}
+	if events, _ := evaluateSubscription(Subscription{MinHours: 1, MaxCloudCover: 40}, points, subscriptionState{}, now); len(events) != 2 {
+		t.Fatalf("expected 2 events with a 40%% cloud limit, got %+v", events)
+	}
+}
+
+// webhookReceiver records POSTed events and can be told to fail
+type webhookReceiver struct {
+	mu     sync.Mutex
+	events []WebhookEvent
+	bodies [][]byte
+	sigs   []string
+	status int
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if rcv.status != 0 {
+		w.WriteHeader(rcv.status)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var event WebhookEvent
+	_ = json.Unmarshal(body, &event)
+	rcv.events = append(rcv.events, event)
+	rcv.bodies = append(rcv.bodies, body)
+	rcv.sigs = append(rcv.sigs, r.Header.Get("X-Aweather-Signature"))
+}
+
+func (rcv *webhookReceiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.events)
+}
+
+func TestSubscriptions_RunOnce(t *testing.T) {
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	s := newSubscriptions(openTestStore(t), true, 0)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	forecast := feedTestPoints(90)
+	s.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) { return forecast, nil }
+
+	sub := Subscription{ID: "sub1", Latitude: 50.45, Longitude: 30.52, MinHours: 3, WebhookURL: ts.URL + "/hook", Secret: "s3cret"}
+	if err := s.store.Put(subscriptionsBucket, sub.ID, sub); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	s.runOnce(context.Background())
+	if receiver.count() != 1 {
+		t.Fatalf("expected 1 webhook call, got %d", receiver.count())
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(receiver.bodies[0])
+	if receiver.sigs[0] != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatalf("invalid signature %q", receiver.sigs[0])
+	}
+
+	// Deduplicated on the next run
+	s.runOnce(context.Background())
+	if receiver.count() != 1 {
+		t.Fatalf("expected no repeated webhook, got %d calls", receiver.count())
+	}
+
+	// Failed deliveries are retried on the next run
+	forecast = cloudyFirstNight(90)
+	receiver.mu.Lock()
+	receiver.status = http.StatusInternalServerError
+	receiver.mu.Unlock()
+	s.runOnce(context.Background())
+
+	receiver.mu.Lock()
+	receiver.status = 0
+	receiver.mu.Unlock()
+	s.runOnce(context.Background())
+	if receiver.count() != 2 || receiver.events[1].Event != eventWindowDisappeared {
+		t.Fatalf("expected disappeared event after retry, got %+v", receiver.events)
+	}
+}
+
+// notifierFunc adapts a function to the notifier interface
+type notifierFunc func(ctx context.Context, forecast forecastLookup)
+
+func (f notifierFunc) notify(ctx context.Context, forecast forecastLookup) { f(ctx, forecast) }
+
+// Webhooks and the other notifiers share one forecast fetch per location and run
+func TestSubscriptions_NotifiersShareForecasts(t *testing.T) {
+	s := newSubscriptions(openTestStore(t), true, 0)
+	s.now = func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) }
+	fetches := 0
+	s.forecast = func(ctx context.Context, lat, lon float64) (DataPoints, error) {
+		fetches++
+		return feedTestPoints(90), nil
+	}
+	sub := Subscription{ID: "sub1", Latitude: 50.45, Longitude: 30.52, MinHours: 12, WebhookURL: "http://127.0.0.1:1/hook", Secret: "s3cret"}
+	if err := s.store.Put(subscriptionsBucket, sub.ID, sub); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	notified := 0
+	s.addNotifier(notifierFunc(func(ctx context.Context, forecast forecastLookup) {
+		notified++
+		for _, place := range [][2]float64{{50.45, 30.52}, {50.45, 30.52}, {49.84, 24.03}} {
+			if _, err := forecast(ctx, place[0], place[1]); err != nil {
+				t.Errorf("forecast: %v", err)
+			}
+		}
+	}))
+
+	s.runOnce(context.Background())
+	if notified != 1 || fetches != 2 {
+		t.Fatalf("notified %d times with %d fetches, want 1 with one fetch per location", notified, fetches)
+	}
+	// Every run fetches anew
+	s.runOnce(context.Background())
+	if fetches != 4 {
+		t.Fatalf("expected fresh forecasts on the next run, got %d fetches", fetches)
+	}
+}
+
+func TestSubscriptions_API(t *testing.T) {
+	s := newSubscriptions(openTestStore(t), false, 0)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subscriptions", s.handleCreate)
+	mux.HandleFunc("/subscriptions/{id}", s.handleItem)
+
+	body := `{"name":"Club","latitude":50.45,"longitude":30.52,"min_hours":3,"webhook_url":"https://example.com/hook"}`
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body)))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var created Subscription
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(created.ID) != 32 || len(created.Secret) != 64 || created.MinHours != 3 {
+		t.Fatalf("unexpected subscription %+v", created)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/subscriptions/"+created.ID, nil))
+	var fetched Subscription
+	_ = json.Unmarshal(rec.Body.Bytes(), &fetched)
+	if rec.Code != http.StatusOK || fetched.Name != "Club" || fetched.Secret != "" {
+		t.Fatalf("unexpected GET result %d %+v", rec.Code, fetched)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/subscriptions/"+created.ID, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/subscriptions/"+created.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 after delete, got %d", rec.Code)
+	}
+}
+
+func TestSubscriptions_Limit(t *testing.T) {
+	s := newSubscriptions(openTestStore(t), false, 2)
+	create := func() int {
+		body := `{"latitude":50.45,"longitude":30.52,"webhook_url":"https://example.com/hook"}`
+		rec := httptest.NewRecorder()
+		s.handleCreate(rec, httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body)))
+		return rec.Code
+	}
+	for i := 0; i < 2; i++ {
+		if code := create(); code != http.StatusCreated {
+			t.Fatalf("subscription %d: expected 201, got %d", i+1, code)
+		}
+	}
+	if code := create(); code != http.StatusInsufficientStorage {
+		t.Fatalf("over the limit: expected 507, got %d", code)
+	}
+
+	// Deleting one makes room again
+	var id string
+	_ = s.store.ForEach(subscriptionsBucket, func(key string, _ []byte) error { id = key; return nil })
+	if err := s.store.Delete(subscriptionsBucket, id); err != nil {
+		t.Fatal(err)
+	}
+	if code := create(); code != http.StatusCreated {
+		t.Fatalf("after a delete: expected 201, got %d", code)
+	}
+}
+
+func TestSubscriptions_CreateInvalid(t *testing.T) {
+	s := newSubscriptions(openTestStore(t), false, 0)
+	for _, body := range []string{
+		`not json`,
+		`{"latitude":95,"longitude":30,"webhook_url":"https://example.com"}`,
+		`{"latitude":50,"longitude":30,"webhook_url":"ftp://example.com"}`,
+		`{"latitude":50,"longitude":30,"webhook_url":"https://example.com","min_hours":20}`,
+		`{"latitude":50,"longitude":30,"webhook_url":"https://example.com","max_cloud_cover":120}`,
+		`{"latitude":50,"longitude":30,"webhook_url":"https://example.com","unknown":1}`,
+	} {
+		rec := httptest.NewRecorder()
+		s.handleCreate(rec, httptest.NewRequest(http.MethodPost, "/subscriptions", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d", body, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.handleCreate(rec, httptest.NewRequest(http.MethodGet, "/subscriptions", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", rec.Code)
+	}
+}
+
+func TestWebhookClient_RefusesPrivateAddresses(t *testing.T) {
+	receiver := &webhookReceiver{}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	s := newSubscriptions(openTestStore(t), false, 0)
+	err := s.deliver(context.Background(), Subscription{WebhookURL: ts.URL}, WebhookEvent{Event: eventWindowAppeared})
+	if !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("expected errPrivateAddress, got %v", err)
+	}
+	if receiver.count() != 0 {
+		t.Fatalf("expected no request to reach the loopback receiver")
+	}
+}
@@ -34,6 +34,28 @@ func calculateRiseSet(t time.Time, lat, lon float64, body string) (time.Time, ti
 	return sunEvents.Sunrise.DateTime, sunEvents.Sunset.DateTime
 }
 
+// darknessSunAltitude is the Sun altitude (degrees) below which the sky counts as dark.
+// Nautical twilight keeps short summer nights usable at mid latitudes.
+const darknessSunAltitude = -12.0
+
+// sunAltitude returns the topocentric elevation of the Sun in degrees
+func sunAltitude(t time.Time, lat, lon float64) float64 {
+	pos, _ := sampa.GetSunPosition(t, makeLocation(lat, lon), nil)
+	return pos.TopocentricElevationAngle
+}
+
+// moonAltitude returns the topocentric elevation of the Moon in degrees
+func moonAltitude(t time.Time, lat, lon float64) float64 {
+	pos, _ := sampa.GetMoonPosition(t, makeLocation(lat, lon), nil)
+	return pos.TopocentricElevationAngle
+}
+
+// moonPhase returns the name of the Moon phase, e.g. "Waxing Gibbous"
+func moonPhase(t time.Time, lat, lon float64) string {
+	pos, _ := sampa.GetMoonPosition(t, makeLocation(lat, lon), nil)
+	return pos.Phase.String()
+}
+
 // makeLocation builds a sampa.Location from coordinates
 func makeLocation(lat, lon float64) sampa.Location {
 	return sampa.Location{Latitude: lat, Longitude: lon}
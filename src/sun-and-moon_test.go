@@ -85,3 +85,26 @@ func TestCalculateSunRiseSet(t *testing.T) {
 		})
 	}
 }
+
+func TestMoonPhase(t *testing.T) {
+	if got := moonPhase(time.Date(2024, 1, 25, 18, 0, 0, 0, time.UTC), 50.45, 30.52); got != "Full Moon" {
+		t.Errorf("expected Full Moon, got %q", got)
+	}
+	if got := moonPhase(time.Date(2024, 1, 11, 12, 0, 0, 0, time.UTC), 50.45, 30.52); got != "New Moon" {
+		t.Errorf("expected New Moon, got %q", got)
+	}
+}
+
+func TestSunAndMoonAltitude(t *testing.T) {
+	noon := time.Date(2024, 6, 21, 10, 0, 0, 0, time.UTC) // ~13:00 local in Kyiv
+	midnight := time.Date(2024, 12, 21, 22, 0, 0, 0, time.UTC)
+	if alt := sunAltitude(noon, 50.45, 30.52); alt < 50 {
+		t.Errorf("expected high Sun at summer noon, got %.1f", alt)
+	}
+	if alt := sunAltitude(midnight, 50.45, 30.52); alt > darknessSunAltitude {
+		t.Errorf("expected dark sky at winter midnight, got %.1f", alt)
+	}
+	if alt := moonAltitude(midnight, 50.45, 30.52); alt < -90 || alt > 90 {
+		t.Errorf("Moon altitude out of range: %.1f", alt)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	TelegramAPIEndpoint = "https://api.telegram.org"
+	telegramPollTimeout = 30 * time.Second
+	telegramMaxMessage  = 4096 // characters, after entity parsing
+)
+
+// Telegram is a ChatProvider for the Telegram Bot API using long polling
+type Telegram struct {
+	endpoint string // base URL without the /bot<token> part, configurable for tests
+	token    string
+	client   *http.Client
+	timeout  time.Duration // long-poll timeout passed to getUpdates
+	offset   int64
+}
+
+func newTelegram(token string) *Telegram {
+	return &Telegram{
+		endpoint: TelegramAPIEndpoint,
+		token:    token,
+		client:   &http.Client{Timeout: telegramPollTimeout + 10*time.Second},
+		timeout:  telegramPollTimeout,
+	}
+}
+
+func (t *Telegram) Name() string { return "telegram" }
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID int64  `json:"message_id"`
+	Text      string `json:"text"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	From *struct {
+		Username string `json:"username"`
+	} `json:"from"`
+}
+
+// call POSTs a Bot API method and decodes its result
+func (t *Telegram) call(ctx context.Context, method string, params any, result any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/bot%s/%s", t.endpoint, t.token, method), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		// The URL contains the token; keep it out of logs
+		return fmt.Errorf("telegram %s: request failed", method)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		Description string          `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram %s: status %d: %w", method, resp.StatusCode, err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("telegram %s: %w", method, errBotUnauthorized)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram %s: %s", method, envelope.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, result)
+}
+
+// Poll long-polls getUpdates and acknowledges everything it returns
+func (t *Telegram) Poll(ctx context.Context) ([]ChatMessage, error) {
+	var updates []telegramUpdate
+	err := t.call(ctx, "getUpdates", map[string]any{
+		"offset":          t.offset,
+		"timeout":         int(t.timeout.Seconds()),
+		"allowed_updates": []string{"message"},
+	}, &updates)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []ChatMessage{}
+	for _, update := range updates {
+		t.offset = max(t.offset, update.UpdateID+1)
+		if update.Message == nil || update.Message.Text == "" {
+			continue
+		}
+		msg := ChatMessage{
+			ChatID:    strconv.FormatInt(update.Message.Chat.ID, 10),
+			MessageID: strconv.FormatInt(update.Message.MessageID, 10),
+			Text:      update.Message.Text,
+		}
+		if update.Message.From != nil {
+			msg.From = update.Message.From.Username
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// Reply sends the text with the table in a <pre> block, trimmed to Telegram's message size
+func (t *Telegram) Reply(ctx context.Context, to ChatMessage, reply ChatReply) error {
+	text := html.EscapeString(reply.Text)
+	if reply.Code != "" {
+		code := []rune(reply.Code)
+		room := telegramMaxMessage - len([]rune(reply.Text)) - len("\n\n…")
+		if len(code) > room {
+			code = append(code[:max(room, 0)], '…')
+		}
+		text += "\n\n<pre>" + html.EscapeString(string(code)) + "</pre>"
+	}
+
+	params := map[string]any{
+		"chat_id":    to.ChatID,
+		"text":       text,
+		"parse_mode": "HTML",
+	}
+	if id, err := strconv.ParseInt(to.MessageID, 10, 64); err == nil {
+		params["reply_parameters"] = map[string]any{"message_id": id, "allow_sending_without_reply": true}
+	}
+	return t.call(ctx, "sendMessage", params, nil)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTelegram serves getUpdates and sendMessage like the Bot API
+type fakeTelegram struct {
+	mu      sync.Mutex
+	updates []telegramUpdate
+	offsets []int64
+	sent    []map[string]any
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var params map[string]any
+	_ = json.NewDecoder(r.Body).Decode(&params)
+
+	switch r.URL.Path {
+	case "/bottest-token/getUpdates":
+		offset := int64(params["offset"].(float64))
+		f.offsets = append(f.offsets, offset)
+		pending := []telegramUpdate{}
+		for _, u := range f.updates {
+			if u.UpdateID >= offset {
+				pending = append(pending, u)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": pending})
+	case "/bottest-token/sendMessage":
+		f.sent = append(f.sent, params)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": map[string]any{}})
+	default:
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "description": "Unauthorized"})
+	}
+}
+
+func (f *fakeTelegram) sentMessages() []map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]any(nil), f.sent...)
+}
+
+func telegramTextUpdate(id int64, chat int64, text string) telegramUpdate {
+	msg := &telegramMessage{MessageID: id * 10, Text: text}
+	msg.Chat.ID = chat
+	return telegramUpdate{UpdateID: id, Message: msg}
+}
+
+func TestTelegram_Poll(t *testing.T) {
+	fake := &fakeTelegram{updates: []telegramUpdate{
+		telegramTextUpdate(5, -100, "/tonight"),
+		{UpdateID: 6},
+		telegramTextUpdate(7, -100, "/forecast Lviv"),
+	}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	tg := newTelegram("test-token")
+	tg.endpoint = ts.URL
+	messages, err := tg.Poll(context.Background())
+	if err != nil {
+		t.Fatalf("poll: %v", err)
+	}
+	if len(messages) != 2 || messages[0].ChatID != "-100" || messages[0].MessageID != "50" || messages[1].Text != "/forecast Lviv" {
+		t.Fatalf("unexpected messages %+v", messages)
+	}
+
+	// Updates are acknowledged with the next offset
+	if messages, err := tg.Poll(context.Background()); err != nil || len(messages) != 0 {
+		t.Fatalf("expected no repeated messages, got %+v, %v", messages, err)
+	}
+	if fake.offsets[1] != 8 {
+		t.Errorf("expected offset 8, got %v", fake.offsets)
+	}
+}
+
+func TestTelegram_ReplyEscapesAndTrims(t *testing.T) {
+	fake := &fakeTelegram{}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	tg := newTelegram("test-token")
+	tg.endpoint = ts.URL
+	code := strings.Repeat("<table row>\n", 1000)
+	if err := tg.Reply(context.Background(), ChatMessage{ChatID: "42", MessageID: "7"}, ChatReply{Text: "A & B", Code: code}); err != nil {
+		t.Fatalf("reply: %v", err)
+	}
+	sent := fake.sentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("expected one message, got %d", len(sent))
+	}
+	text := sent[0]["text"].(string)
+	if sent[0]["chat_id"] != "42" || sent[0]["parse_mode"] != "HTML" || !strings.HasPrefix(text, "A &amp; B\n\n<pre>&lt;table row&gt;") || !strings.HasSuffix(text, "…</pre>") {
+		t.Errorf("unexpected message %v", sent[0])
+	}
+}
+
+func TestTelegram_Unauthorized(t *testing.T) {
+	ts := httptest.NewServer(&fakeTelegram{})
+	defer ts.Close()
+
+	tg := newTelegram("wrong-token")
+	tg.endpoint = ts.URL
+	b := newTestBot()
+	b.provider = tg
+
+	done := make(chan struct{})
+	go func() {
+		b.Run(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the bot to stop on a rejected token")
+	}
+}
+
+func TestBot_RunWithTelegram(t *testing.T) {
+	fake := &fakeTelegram{updates: []telegramUpdate{
+		telegramTextUpdate(1, -100, "/tonight"),
+		telegramTextUpdate(2, -100, "good evening"),
+		telegramTextUpdate(3, -100, "/forecast@aweather_bot Lviv"),
+	}}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	tg := newTelegram("test-token")
+	tg.endpoint = ts.URL
+	tg.timeout = 0
+	b := newTestBot()
+	b.provider = tg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx)
+		close(done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fake.sentMessages()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	sent := fake.sentMessages()
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 replies, got %d", len(sent))
+	}
+	if !strings.HasPrefix(sent[0]["text"].(string), "club – Friday, March 1") || !strings.HasPrefix(sent[1]["text"].(string), "Lviv, Lviv Oblast, Ukraine") {
+		t.Errorf("unexpected replies %v", sent)
+	}
+	if reply := sent[1]["reply_parameters"].(map[string]any); reply["message_id"] != float64(30) {
+		t.Errorf("expected reply to message 30, got %v", reply)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceFlushInterval = 5 * time.Second
+	traceMaxQueued     = 4096 // spans kept while the collector is unreachable
+)
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// tracer exports spans when tracing is enabled; nil disables tracing
+var tracer *Tracer
+
+// Tracer batches finished spans and sends them to an OTLP/HTTP collector as JSON
+type Tracer struct {
+	endpoint string // full URL of the traces resource, usually ending in /v1/traces
+	headers  http.Header
+	service  string
+	client   *http.Client
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+}
+
+// tracerFromConfig configures OTLP export to otlp_endpoint, or returns nil when it is not set
+func tracerFromConfig(cfg Config) (*Tracer, error) {
+	endpoint := cfg.OTLPEndpoint
+	if endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("otlp_endpoint must be an http(s) URL, got %q", endpoint)
+	}
+	// A bare collector address gets the standard OTLP/HTTP traces path
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+
+	// otlp_headers="authorization=Bearer abc,x-tenant=astro" for hosted collectors
+	headers := http.Header{}
+	if raw := cfg.OTLPHeaders; raw != "" {
+		for _, pair := range strings.Split(raw, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				return nil, fmt.Errorf("invalid otlp_headers entry %q", pair)
+			}
+			headers.Set(strings.TrimSpace(key), strings.TrimSpace(value))
+		}
+	}
+
+	service := cfg.OTLPService
+	if service == "" {
+		service = "aweather"
+	}
+	return newTracer(u.String(), headers, service), nil
+}
+
+func newTracer(endpoint string, headers http.Header, service string) *Tracer {
+	return &Tracer{endpoint: endpoint, headers: headers, service: service, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Run exports queued spans periodically until ctx is cancelled
+func (t *Tracer) Run(ctx context.Context) {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := t.flush(ctx); err != nil {
+				slog.Warn("exporting traces", "error", err)
+			}
+		}
+	}
+}
+
+// Shutdown exports the spans still queued, once the server has finished its requests
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.flush(ctx)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= traceMaxQueued {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, s)
+}
+
+// flush sends all queued spans in one request
+func (t *Tracer) flush(ctx context.Context) error {
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		slog.Warn("dropped spans, the trace collector is not keeping up", "spans", dropped)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(t.export(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range t.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector status: %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding (ExportTraceServiceRequest). IDs are hex and 64-bit integers are strings.
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is STATUS_CODE_ERROR
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func (t *Tracer) export(spans []*Span) otlpExport {
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = []otlpAttribute{otlpAttr("service.name", t.service)}
+	var ss otlpScopeSpans
+	ss.Scope.Name = "aweather"
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != ([8]byte{}) {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttr(a.key, a.value))
+		}
+		if s.failed {
+			span.Status = &otlpStatus{Code: 2, Message: s.message}
+		}
+		ss.Spans = append(ss.Spans, span)
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return otlpExport{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func otlpAttr(key string, value any) otlpAttribute {
+	switch v := value.(type) {
+	case bool:
+		return otlpAttribute{key, map[string]any{"boolValue": v}}
+	case int:
+		return otlpAttribute{key, map[string]any{"intValue": strconv.Itoa(v)}}
+	case float64:
+		return otlpAttribute{key, map[string]any{"doubleValue": v}}
+	default:
+		return otlpAttribute{key, map[string]any{"stringValue": fmt.Sprint(v)}}
+	}
+}
+
+// Span times one operation. A nil *Span is valid and does nothing, which is what
+// startSpan returns while tracing is disabled.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	failed   bool
+	message  string
+}
+
+type spanAttr struct {
+	key   string
+	value any
+}
+
+type spanKey struct{}
+
+// startSpan starts a child of the span in ctx, of the caller's trace from the request headers,
+// or a new trace
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: tracer, name: name, kind: kind, start: time.Now()}
+	rand.Read(s.spanID[:])
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else if info, ok := ctx.Value(requestInfoKey{}).(requestInfo); ok {
+		// The request ID is a trace ID, so logs and traces of a request share it
+		hex.Decode(s.traceID[:], []byte(info.id))
+		hex.Decode(s.parentID[:], []byte(info.parent))
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttr records an attribute; values are strings, ints, float64s or bools
+func (s *Span) SetAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, spanAttr{key, value})
+}
+
+// Fail marks the span as failed
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.failed, s.message = true, err.Error()
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.tracer.enqueue(s)
+}
+
+// traceparent is the W3C header continuing this span's trace in a downstream call
+func (s *Span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// withTracing starts a server span for each request, named after the ServeMux pattern that matched
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := startSpan(r.Context(), r.Method, spanKindServer)
+		if span == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		r, route := trackRoute(r.WithContext(ctx))
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if route.pattern != "" {
+			span.name = r.Method + " " + route.pattern
+			span.SetAttr("http.route", route.pattern)
+		}
+		span.SetAttr("http.request.method", r.Method)
+		span.SetAttr("url.path", r.URL.Path)
+		span.SetAttr("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.Fail(fmt.Errorf("status %d", rec.status))
+		}
+		span.End()
+	})
+}
+
+// tracingRoundTripper adds a client span to upstream calls and passes the trace on in traceparent
+type tracingRoundTripper struct {
+	base http.RoundTripper
+}
+
+func (t *tracingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := startSpan(req.Context(), req.Method+" "+upstreamEndpoint(req.URL.String()), spanKindClient)
+	if span == nil {
+		return t.base.RoundTrip(req)
+	}
+	defer span.End()
+	req = req.Clone(ctx)
+	req.Header.Set("traceparent", span.traceparent())
+	// Query strings hold coordinates, so only the path is recorded
+	span.SetAttr("http.request.method", req.Method)
+	span.SetAttr("server.address", req.URL.Hostname())
+	span.SetAttr("url.path", req.URL.Path)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		span.Fail(err)
+		return nil, err
+	}
+	span.SetAttr("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.Fail(fmt.Errorf("upstream status: %s", resp.Status))
+	}
+	return resp, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectorStandIn records the OTLP/HTTP export requests it receives
+type collectorStandIn struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []otlpExport
+	headers  []http.Header
+}
+
+func newCollectorStandIn(t *testing.T) *collectorStandIn {
+	c := &collectorStandIn{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export request: %s %s (%s)", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var export otlpExport
+		if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+			t.Errorf("export is not OTLP JSON: %v", err)
+		}
+		c.mu.Lock()
+		c.requests = append(c.requests, export)
+		c.headers = append(c.headers, r.Header.Clone())
+		c.mu.Unlock()
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// spans returns every exported span by name
+func (c *collectorStandIn) spans() map[string][]otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := map[string][]otlpSpan{}
+	for _, export := range c.requests {
+		for _, rs := range export.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans[span.Name] = append(spans[span.Name], span)
+				}
+			}
+		}
+	}
+	return spans
+}
+
+// useTracer enables tracing for the test
+func useTracer(t *testing.T, endpoint string) *Tracer {
+	tr := newTracer(endpoint, http.Header{"Authorization": {"Bearer secret"}}, "aweather-test")
+	tracer = tr
+	t.Cleanup(func() { tracer = nil })
+	return tr
+}
+
+func spanAttrValue(span otlpSpan, key string) any {
+	for _, a := range span.Attributes {
+		if a.Key == key {
+			for _, v := range a.Value {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func TestTracerFromConfig(t *testing.T) {
+	cfg := defaultConfig()
+	if tr, err := tracerFromConfig(cfg); tr != nil || err != nil {
+		t.Fatalf("expected tracing to be disabled by default, got %v, %v", tr, err)
+	}
+
+	cfg.OTLPEndpoint = "http://collector:4318"
+	cfg.OTLPHeaders = "authorization=Bearer abc, x-tenant=astro"
+	tr, err := tracerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.endpoint != "http://collector:4318/v1/traces" || tr.service != "aweather" {
+		t.Errorf("unexpected tracer: %s %s", tr.endpoint, tr.service)
+	}
+	if tr.headers.Get("Authorization") != "Bearer abc" || tr.headers.Get("X-Tenant") != "astro" {
+		t.Errorf("unexpected headers: %v", tr.headers)
+	}
+
+	for _, tt := range []struct{ endpoint, headers string }{
+		{"collector:4318", ""},
+		{"grpc://collector:4317", ""},
+		{"http://collector:4318", "no-equals-sign"},
+	} {
+		cfg.OTLPEndpoint = tt.endpoint
+		cfg.OTLPHeaders = tt.headers
+		if _, err := tracerFromConfig(cfg); err == nil {
+			t.Errorf("expected an error for %q / %q", tt.endpoint, tt.headers)
+		}
+	}
+}
+
+func TestStartSpan_Disabled(t *testing.T) {
+	ctx := context.Background()
+	got, span := startSpan(ctx, "noop", spanKindInternal)
+	if span != nil || got != ctx {
+		t.Fatal("expected no span while tracing is disabled")
+	}
+	// A nil span is safe to use
+	span.SetAttr("key", "value")
+	span.Fail(context.Canceled)
+	span.End()
+}
+
+func TestTracing_WeatherRequest(t *testing.T) {
+	setupCache()
+	collector := newCollectorStandIn(t)
+	tr := useTracer(t, collector.URL+"/v1/traces")
+
+	var upstreamTraceparent string
+	now := time.Now().UTC()
+	payload := fakeForecastJSON(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), 72, func(int) int64 { return 0 })
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		w.Write(payload)
+	}))
+	defer upstream.Close()
+	original := OpenMeteoAPIEndpoint
+	OpenMeteoAPIEndpoint = upstream.URL + "?"
+	defer func() { OpenMeteoAPIEndpoint = original }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/weather", handleWeather)
+	handler := withRequestLog(withTracing(withMetrics(withRoute(mux))))
+
+	const traceID, callerSpan = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := httptest.NewRequest(http.MethodGet, "/weather?lat=50.45&lon=30.52", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-"+callerSpan+"-01")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := collector.headers[0].Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("collector headers not sent, Authorization = %q", got)
+	}
+	if got := collector.requests[0].ResourceSpans[0].Resource.Attributes; len(got) != 1 || got[0].Value["stringValue"] != "aweather-test" {
+		t.Errorf("unexpected resource attributes: %v", got)
+	}
+
+	spans := collector.spans()
+	server := spans["GET /weather"]
+	if len(server) != 1 {
+		t.Fatalf("expected one server span, got %v", spans)
+	}
+	root := server[0]
+	if root.TraceID != traceID || root.ParentSpanID != callerSpan || root.Kind != spanKindServer {
+		t.Errorf("server span does not continue the caller's trace: %+v", root)
+	}
+	if spanAttrValue(root, "http.route") != "/weather" || spanAttrValue(root, "http.response.status_code") != "200" {
+		t.Errorf("unexpected server span attributes: %v", root.Attributes)
+	}
+
+	// The hourly table needs no astronomy pass
+	if len(spans["astronomy"]) != 0 {
+		t.Errorf("unexpected astronomy span for /weather")
+	}
+	for _, name := range []string{"cache.get", "GET forecast"} {
+		if len(spans[name]) != 1 {
+			t.Fatalf("expected one %q span, got %d", name, len(spans[name]))
+		}
+		if s := spans[name][0]; s.TraceID != traceID || s.ParentSpanID != root.SpanID {
+			t.Errorf("%q is not a child of the server span: %+v", name, s)
+		}
+	}
+	if hit := spanAttrValue(spans["cache.get"][0], "cache.hit"); hit != false {
+		t.Errorf("cache.hit = %v, want false", hit)
+	}
+
+	client := spans["GET forecast"][0]
+	if client.Kind != spanKindClient || spanAttrValue(client, "server.address") != "127.0.0.1" {
+		t.Errorf("unexpected client span: %+v", client)
+	}
+	if want := "00-" + traceID + "-" + client.SpanID + "-01"; upstreamTraceparent != want {
+		t.Errorf("upstream traceparent = %q, want %q", upstreamTraceparent, want)
+	}
+	// Coordinates in the query string stay out of the trace
+	for _, a := range client.Attributes {
+		if v, _ := a.Value["stringValue"].(string); strings.Contains(v, "50.45") {
+			t.Errorf("client span records coordinates: %v", client.Attributes)
+		}
+	}
+
+	// One rise/set calculation per day in the table
+	if n := len(spans["calculateRiseSet"]); n != 3 {
+		t.Errorf("expected 3 calculateRiseSet spans, got %d", n)
+	}
+}
+
+func TestTracing_UpstreamError(t *testing.T) {
+	setupCache()
+	collector := newCollectorStandIn(t)
+	tr := useTracer(t, collector.URL+"/v1/traces")
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	ctx, span := startSpan(context.Background(), "test", spanKindInternal)
+	var response OpenMeteoAPIResponse
+	if err := response.FetchData(ctx, upstream.URL+"?", "temperature_2m", "1", "2"); err == nil {
+		t.Fatal("expected an error")
+	}
+	span.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := collector.spans()
+	client := spans["GET other"]
+	if len(client) != 1 || client[0].Status == nil || client[0].Status.Code != 2 {
+		t.Fatalf("expected a failed client span, got %+v", spans)
+	}
+	if spanAttrValue(client[0], "http.response.status_code") != "503" {
+		t.Errorf("unexpected client span attributes: %v", client[0].Attributes)
+	}
+	// A new trace starts without a request
+	if client[0].TraceID != spans["test"][0].TraceID || spans["test"][0].ParentSpanID != "" {
+		t.Errorf("unexpected trace: %+v", spans)
+	}
+}
+
+func TestTracer_QueueBound(t *testing.T) {
+	tr := newTracer("http://127.0.0.1:0/v1/traces", nil, "aweather")
+	for i := 0; i < traceMaxQueued+10; i++ {
+		tr.enqueue(&Span{})
+	}
+	if len(tr.queue) != traceMaxQueued || tr.dropped != 10 {
+		t.Errorf("queue = %d, dropped = %d", len(tr.queue), tr.dropped)
+	}
+}
@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 //go:embed templates/index.html
@@ -33,27 +36,53 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Log HTTP request
-	log.Printf("INFO: From: %s | User-Agent: %s | Path: %s", r.RemoteAddr, r.UserAgent(), r.URL.Path)
-
-	// Retrieve cookies
-	cityNameCookie, _ := r.Cookie("cityName")
-	latCookie, _ := r.Cookie("latitude")
-	lonCookie, _ := r.Cookie("longitude")
-
-	cityName := ""
-	latitude := ""
-	longitude := ""
+	// Query parameters (permalinks) take precedence over cookies
+	q := r.URL.Query()
+	cityName := cookieValue(r, "cityName")
+	latitude := cookieValue(r, "latitude")
+	longitude := cookieValue(r, "longitude")
+	ogTitle := "aweather — forecast for astrophotographers"
+	ogImage := "/static/favicon-512x512.png"
+	if lat, lon, ok := parseCoordinates(q.Get("lat"), q.Get("lon")); ok {
+		latitude = float64ToString(lat)
+		longitude = float64ToString(lon)
+		// A shared location without a name must not inherit our own saved city name
+		cityName = strings.TrimSpace(q.Get("name"))
+
+		// Per-location pages get a forecast preview for link unfurling
+		ogParams := url.Values{"lat": {latitude}, "lon": {longitude}}
+		for _, key := range []string{"name", "time_12h", "max_cloud", "max_wind"} {
+			if v := strings.TrimSpace(q.Get(key)); v != "" {
+				ogParams.Set(key, v)
+			}
+		}
+		ogImage = baseURL(r) + "/og.png?" + ogParams.Encode()
+		if cityName != "" {
+			ogTitle = "aweather — " + cityName + " tonight"
+		}
+	}
 
-	// Set defaults if cookies exist
-	if cityNameCookie != nil {
-		cityName = cityNameCookie.Value
+	unitTemp := firstNonEmpty(q.Get("unit_temp"), cookieValue(r, "unitTemp"))
+	unitWind := firstNonEmpty(q.Get("unit_wind"), cookieValue(r, "unitWind"))
+	time12h := firstNonEmpty(q.Get("time_12h"), cookieValue(r, "time12h"))
+	opts := parsePrintOptions(url.Values{
+		"unit_temp": {unitTemp},
+		"unit_wind": {unitWind},
+		"time_12h":  {time12h},
+		"max_cloud": {q.Get("max_cloud")},
+		"max_wind":  {q.Get("max_wind")},
+	})
+
+	maxCloud, maxWind := "", ""
+	if opts.MaxCloudCover > 0 {
+		maxCloud = strconv.FormatInt(opts.MaxCloudCover, 10)
 	}
-	if latCookie != nil {
-		latitude = latCookie.Value
+	if opts.MaxWindSpeed > 0 {
+		maxWind = strconv.FormatFloat(opts.MaxWindSpeed, 'f', -1, 64)
 	}
-	if lonCookie != nil {
-		longitude = lonCookie.Value
+	time12hValue := "0"
+	if opts.Use12Hour {
+		time12hValue = "1"
 	}
 
 	// Render template with automatic HTML escaping
@@ -62,9 +91,16 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		CityName  string
 		Latitude  string
 		Longitude string
-	}{cityName, latitude, longitude}
+		UnitTemp  string
+		UnitWind  string
+		Time12h   string
+		MaxCloud  string
+		MaxWind   string
+		OGTitle   string
+		OGImage   string
+	}{cityName, latitude, longitude, opts.TemperatureUnit, opts.WindSpeedUnit, time12hValue, maxCloud, maxWind, ogTitle, ogImage}
 	if err := indexTmpl.Execute(w, data); err != nil {
-		log.Printf("ERROR: rendering index: %v", err)
+		slog.ErrorContext(r.Context(), "rendering index", "error", err)
 		http.Error(w, "Template rendering error", http.StatusInternalServerError)
 		return
 	}
@@ -79,9 +115,6 @@ func handleWeather(w http.ResponseWriter, r *http.Request) {
 
 	lat := r.URL.Query().Get("lat")
 	lon := r.URL.Query().Get("lon")
-	unitTemp := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("unit_temp")))
-	unitWind := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("unit_wind")))
-	time12h := strings.TrimSpace(r.URL.Query().Get("time_12h")) == "1"
 
 	if lat == "" || lon == "" {
 		http.Error(w, "Latitude and longitude are required", http.StatusBadRequest)
@@ -95,16 +128,23 @@ func handleWeather(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("INFO: Requested weather data for lat: %s, lon: %s", lat, lon)
+	slog.InfoContext(r.Context(), "forecast requested", coords(latitude, longitude))
 
-	data := OpenMeteoAPIResponse{}
-	if err := data.FetchData(OpenMeteoAPIEndpoint, OpenMeteoAPIParams, float64ToString(latitude), float64ToString(longitude)); err != nil {
-		log.Printf("ERROR: fetching weather from Open‑Meteo: %v", err)
+	points, freshness, err := fetchForecastFreshness(r.Context(), latitude, longitude)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching weather from Open-Meteo", "error", err)
 		http.Error(w, "Upstream weather service unavailable", http.StatusBadGateway)
 		return
 	}
-	opts := PrintOptions{TemperatureUnit: unitTemp, WindSpeedUnit: unitWind, Use12Hour: time12h}
-	weatherTable := data.Points().setMoonIllumination().setSeeing().PrintWithOptions(opts)
+	if setForecastCaching(w, r, freshness, "") {
+		return
+	}
+	opts := parsePrintOptions(r.URL.Query())
+	weatherTable, err := points.PrintWithOptionsContext(r.Context(), opts)
+	if err != nil {
+		forecastCancelled(w)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprint(w, weatherTable)
@@ -125,8 +165,9 @@ func handleSuggestions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	suggestions, err := fetchSuggestions(query)
+	suggestions, err := fetchSuggestions(r.Context(), query)
 	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching suggestions from Open-Meteo", "error", err)
 		http.Error(w, "Unable to fetch suggestions", http.StatusInternalServerError)
 		return
 	}
@@ -161,14 +202,14 @@ func handleReverseGeocoding(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("INFO: Reverse geocoding for lat: %s, lon: %s", latStr, lonStr)
-	suggestion, _ := fetchReverseGeocoding(float64ToString(lat), float64ToString(lon))
+	slog.InfoContext(r.Context(), "reverse geocoding requested", coords(lat, lon))
+	suggestion, _ := fetchReverseGeocoding(r.Context(), float64ToString(lat), float64ToString(lon))
 
 	w.Header().Set("Content-Type", "application/json")
 	// Always return 200 with either a suggestion or an empty object to keep UX smooth
 	if suggestion == nil {
 		if _, err := w.Write([]byte(`{}`)); err != nil {
-			log.Printf("ERROR: reverse-geocoding write: %v", err)
+			slog.ErrorContext(r.Context(), "writing reverse geocoding", "error", err)
 		}
 		return
 	}
@@ -185,7 +226,6 @@ func handleRobots(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("INFO: From: %s | User-Agent: %s | Path: %s", r.RemoteAddr, r.UserAgent(), r.URL.Path)
 	serveEmbeddedFile(w, "static/robots.txt", "text/plain")
 }
 
@@ -196,7 +236,6 @@ func handleFavicon(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("INFO: From: %s | User-Agent: %s | Path: %s", r.RemoteAddr, r.UserAgent(), r.URL.Path)
 	serveEmbeddedFile(w, "static/favicon.ico", "image/x-icon")
 }
 
@@ -207,20 +246,6 @@ func handleSitemap(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("INFO: From: %s | User-Agent: %s | Path: %s", r.RemoteAddr, r.UserAgent(), r.URL.Path)
-
-	scheme := r.Header.Get("X-Forwarded-Proto")
-	if scheme == "" {
-		// Prefer https unless explicitly forwarded otherwise
-		if r.TLS != nil {
-			scheme = "https"
-		} else {
-			scheme = "https"
-		}
-	}
-	host := r.Host
-	baseURL := fmt.Sprintf("%s://%s", scheme, host)
-
 	sitemap := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
 <urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
   <url>
@@ -228,13 +253,167 @@ func handleSitemap(w http.ResponseWriter, r *http.Request) {
     <changefreq>daily</changefreq>
     <priority>1.0</priority>
   </url>
-</urlset>`, baseURL)
+</urlset>`, baseURL(r))
 
 	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write([]byte(sitemap)); err != nil {
-		log.Printf("ERROR: Could not write sitemap.xml: %v", err)
+		slog.ErrorContext(r.Context(), "writing sitemap.xml", "error", err)
+	}
+}
+
+// withDeadline cancels a request's context after timeout, which aborts its upstream calls
+func withDeadline(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// fetchForecast fetches the hourly forecast for coordinates and fills in all derived values.
+// Cancelling ctx aborts the upstream call and the astronomy calculations.
+func fetchForecast(ctx context.Context, lat, lon float64) (DataPoints, error) {
+	points, freshness, err := fetchForecastFreshness(ctx, lat, lon)
+	if err != nil {
+		return nil, err
+	}
+	return withAstronomy(ctx, points, freshness)
+}
+
+// fetchForecastFreshness fetches the hourly forecast without Dark and MoonUp, and tells how old
+// it is. Handlers answer conditional requests from the freshness before calling withAstronomy,
+// and only those that show nights or darkness call it at all.
+func fetchForecastFreshness(ctx context.Context, lat, lon float64) (DataPoints, Freshness, error) {
+	data := OpenMeteoAPIResponse{}
+	if err := data.FetchData(ctx, OpenMeteoAPIEndpoint, OpenMeteoAPIParams, float64ToString(lat), float64ToString(lon)); err != nil {
+		return nil, Freshness{}, err
+	}
+	return data.Points().setSeeing().setMoonIllumination(), data.Freshness, nil
+}
+
+// withAstronomy sets Dark and MoonUp, which nights and charts need. They only depend on the
+// hours and the place of the forecast f, so they are cached under its digest.
+func withAstronomy(ctx context.Context, points DataPoints, f Freshness) (DataPoints, error) {
+	cacheKey := "astro:" + f.Digest
+	if f.Digest != "" {
+		if flags, err := cacheGet(ctx, cacheKey); err == nil && len(flags) == len(points) {
+			return points.setAstronomyFlags(flags), nil
+		}
+	}
+
+	_, span := startSpan(ctx, "astronomy", spanKindInternal)
+	defer span.End()
+	span.SetAttr("points", len(points))
+	points, err := points.setSunAndMoon(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if f.Digest != "" {
+		if err := cache.Set(cacheKey, points.astronomyFlags()); err != nil {
+			slog.WarnContext(ctx, "caching astronomy failed", "error", err)
+		}
+	}
+	return points, nil
+}
+
+// setFreshnessHeaders reports the age of the forecast in Age, and marks a copy served
+// because Open-Meteo failed with X-Forecast-Stale
+func setFreshnessHeaders(w http.ResponseWriter, f Freshness) {
+	if !f.FetchedAt.IsZero() {
+		w.Header().Set("Age", strconv.Itoa(int(f.Age(time.Now()).Seconds())))
+	}
+	if f.Stale {
+		w.Header().Set("X-Forecast-Stale", "1")
+	}
+}
+
+// parsePrintOptions reads display units, 12/24h and thresholds from query parameters.
+// Unknown units fall back to defaults; invalid or out-of-range thresholds are ignored.
+func parsePrintOptions(q url.Values) PrintOptions {
+	opts := PrintOptions{
+		TemperatureUnit: "c",
+		WindSpeedUnit:   "kmh",
+		Use12Hour:       strings.TrimSpace(q.Get("time_12h")) == "1",
+	}
+	if strings.ToLower(strings.TrimSpace(q.Get("unit_temp"))) == "f" {
+		opts.TemperatureUnit = "f"
+	}
+	if strings.ToLower(strings.TrimSpace(q.Get("unit_wind"))) == "mph" {
+		opts.WindSpeedUnit = "mph"
+	}
+	if v, err := strconv.ParseInt(strings.TrimSpace(q.Get("max_cloud")), 10, 64); err == nil && v > 0 && v <= 100 {
+		opts.MaxCloudCover = v
+	}
+	if v, err := strconv.ParseFloat(strings.TrimSpace(q.Get("max_wind")), 64); err == nil && v > 0 && v <= 200 {
+		opts.MaxWindSpeed = v
+	}
+	return opts
+}
+
+// parseCoordinates validates latitude and longitude strings and their ranges
+func parseCoordinates(latStr, lonStr string) (float64, float64, bool) {
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(latStr), 64)
+	lon, err2 := strconv.ParseFloat(strings.TrimSpace(lonStr), 64)
+	if err1 != nil || err2 != nil {
+		return 0, 0, false
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return 0, 0, false
+	}
+	return lat, lon, true
+}
+
+// cookieValue returns the decoded value of the named cookie or an empty string.
+// The frontend writes cookies with encodeURIComponent.
+func cookieValue(r *http.Request, name string) string {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	if v, err := url.PathUnescape(c.Value); err == nil {
+		return v
+	}
+	return c.Value
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// permalinkPath links to the full forecast for a place, keeping display preferences from q
+func permalinkPath(name string, lat, lon float64, q url.Values) string {
+	params := url.Values{}
+	if name != "" {
+		params.Set("name", name)
+	}
+	params.Set("lat", float64ToString(lat))
+	params.Set("lon", float64ToString(lon))
+	for _, key := range []string{"unit_temp", "unit_wind", "time_12h", "max_cloud", "max_wind"} {
+		if v := q.Get(key); v != "" {
+			params.Set(key, v)
+		}
+	}
+	return "/?" + params.Encode()
+}
+
+// baseURL returns the public scheme and host of the site: public_url when it is configured,
+// otherwise as seen by the client, which trusts the Host and X-Forwarded-Proto headers
+func baseURL(r *http.Request) string {
+	if PublicURL != "" {
+		return PublicURL
+	}
+	scheme := r.Header.Get("X-Forwarded-Proto")
+	if scheme == "" {
+		// Prefer https unless explicitly forwarded otherwise
+		scheme = "https"
 	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
 }
 
 func float64ToString(f float64) string {
@@ -246,12 +425,12 @@ func serveEmbeddedFile(w http.ResponseWriter, path, contentType string) {
 	data, err := StaticFiles.ReadFile(path)
 	if err != nil {
 		http.Error(w, "Not found", http.StatusNotFound)
-		log.Printf("ERROR: Could not read %s: %v", path, err)
+		slog.Error("reading embedded file", "path", path, "error", err)
 		return
 	}
 	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(data); err != nil {
-		log.Printf("ERROR: Could not write %s: %v", path, err)
+		slog.Error("writing embedded file", "path", path, "error", err)
 	}
 }
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandleIndex(t *testing.T) {
@@ -27,7 +32,105 @@ func TestHandleIndex(t *testing.T) {
 	}
 }
 
+func TestHandleIndex_QueryOverridesCookies(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/?name=Star%20Party&lat=45.5&lon=-1.25&unit_temp=f&unit_wind=mph&time_12h=1&max_cloud=40&max_wind=20", nil)
+	req.AddCookie(&http.Cookie{Name: "cityName", Value: "Kyiv%2C%20Ukraine"})
+	req.AddCookie(&http.Cookie{Name: "latitude", Value: "50.45"})
+	req.AddCookie(&http.Cookie{Name: "longitude", Value: "30.52"})
+	req.AddCookie(&http.Cookie{Name: "unitTemp", Value: "c"})
+	rec := httptest.NewRecorder()
+
+	handleIndex(rec, req)
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`id="city" type="text" value="Star Party"`,
+		`id="latitude" value="45.500000"`,
+		`id="longitude" value="-1.250000"`,
+		`id="prefUnitTemp" value="f"`,
+		`id="prefUnitWind" value="mph"`,
+		`id="prefTime12h" value="1"`,
+		`id="prefMaxCloud" value="40"`,
+		`id="prefMaxWind" value="20"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected body to contain %q", want)
+		}
+	}
+}
+
+func TestHandleIndex_OpenGraphForPermalink(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/?name=Kyiv&lat=50.45&lon=30.52", nil)
+	req.Host = "example.com"
+	rec := httptest.NewRecorder()
+	handleIndex(rec, req)
+	body := rec.Body.String()
+	if !strings.Contains(body, `<meta property="og:image" content="https://example.com/og.png?lat=50.450000&amp;lon=30.520000&amp;name=Kyiv">`) {
+		t.Fatalf("expected per-location og:image, body: %s", body)
+	}
+	if !strings.Contains(body, `<meta property="og:title" content="aweather — Kyiv tonight">`) {
+		t.Fatalf("expected per-location og:title")
+	}
+
+	// A configured public URL wins over the Host the request came with
+	defer func(prev string) { PublicURL = prev }(PublicURL)
+	PublicURL = "https://aweather.example"
+	req.Host = "attacker.example"
+	rec = httptest.NewRecorder()
+	handleIndex(rec, req)
+	if !strings.Contains(rec.Body.String(), `content="https://aweather.example/og.png?lat=50.450000`) {
+		t.Fatalf("expected og:image on the public URL, body: %s", rec.Body.String())
+	}
+
+	// Without coordinates the generic image is used
+	rec = httptest.NewRecorder()
+	handleIndex(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if !strings.Contains(rec.Body.String(), `<meta property="og:image" content="/static/favicon-512x512.png">`) {
+		t.Fatalf("expected default og:image")
+	}
+}
+
+func TestHandleIndex_CookiesWithoutQuery(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/?lat=999&lon=0", nil) // invalid coordinates are ignored
+	req.AddCookie(&http.Cookie{Name: "cityName", Value: "Kyiv%2C%20Ukraine"})
+	req.AddCookie(&http.Cookie{Name: "latitude", Value: "50.45"})
+	req.AddCookie(&http.Cookie{Name: "longitude", Value: "30.52"})
+	req.AddCookie(&http.Cookie{Name: "unitWind", Value: "mph"})
+	rec := httptest.NewRecorder()
+
+	handleIndex(rec, req)
+
+	body := rec.Body.String()
+	for _, want := range []string{
+		`value="Kyiv, Ukraine"`,
+		`id="latitude" value="50.45"`,
+		`id="prefUnitTemp" value="c"`,
+		`id="prefUnitWind" value="mph"`,
+		`id="prefMaxCloud" value=""`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected body to contain %q", want)
+		}
+	}
+}
+
+func TestParsePrintOptions(t *testing.T) {
+	q := url.Values{"unit_temp": {"F"}, "unit_wind": {"bogus"}, "time_12h": {"1"}, "max_cloud": {"150"}, "max_wind": {"12.5"}}
+	opts := parsePrintOptions(q)
+	if opts.TemperatureUnit != "f" || opts.WindSpeedUnit != "kmh" || !opts.Use12Hour {
+		t.Fatalf("unexpected units: %+v", opts)
+	}
+	if opts.MaxCloudCover != 0 {
+		t.Fatalf("expected out-of-range max_cloud to be ignored, got %d", opts.MaxCloudCover)
+	}
+	if opts.MaxWindSpeed != 12.5 {
+		t.Fatalf("expected max_wind 12.5, got %v", opts.MaxWindSpeed)
+	}
+}
+
 func TestHandleWeather(t *testing.T) {
+	setupCache()
+
 	// Valid request
 	req := httptest.NewRequest(http.MethodGet, "/weather?lat=51.509865&lon=-0.118092", nil)
 	rec := httptest.NewRecorder()
@@ -400,6 +503,11 @@ func TestMethodNotAllowed(t *testing.T) {
 		{"robots", handleRobots, "/robots.txt"},
 		{"favicon", handleFavicon, "/favicon.ico"},
 		{"sitemap", handleSitemap, "/sitemap.xml"},
+		{"embed", handleEmbed, "/embed"},
+		{"embed json", handleEmbedJSON, "/embed.json"},
+		{"chart", handleChart, "/chart.svg"},
+		{"og image", handleOGImage, "/og.png"},
+		{"feed", handleFeed, "/feed.atom"},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -422,3 +530,55 @@ func TestFloat64ToString(t *testing.T) {
 		t.Fatalf("Expected 1.200000, got %s", got)
 	}
 }
+
+func TestHandleWeather_Deadline(t *testing.T) {
+	endpoint, _, cancelled := hangingUpstream(t)
+	original := OpenMeteoAPIEndpoint
+	OpenMeteoAPIEndpoint = endpoint + "?"
+	defer func() { OpenMeteoAPIEndpoint = original }()
+
+	// Nothing cached: the upstream call is abandoned at the deadline
+	setupCache()
+	handler := withDeadline(200*time.Millisecond, http.HandlerFunc(handleWeather))
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/weather?lat=50.45&lon=30.52", nil))
+	if rec.Code != http.StatusBadGateway || time.Since(start) > 2*time.Second {
+		t.Errorf("status = %d after %v", rec.Code, time.Since(start))
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream call kept running after the deadline")
+	}
+
+	// With a stale copy, it is served before the deadline
+	seedForecast(t, 50.45, 30.52, 2*time.Hour)
+	handler = withDeadline(staleHeadroom+200*time.Millisecond, http.HandlerFunc(handleWeather))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/weather?lat=50.45&lon=30.52", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Forecast-Stale") != "1" {
+		t.Errorf("status = %d, stale = %q", rec.Code, rec.Header().Get("X-Forecast-Stale"))
+	}
+}
+
+func TestWithAstronomy_Cached(t *testing.T) {
+	setupCache()
+	points := feedTestPoints(90)
+	want, err := points.setSunAndMoon(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := Freshness{Digest: "0a1b2c"}
+	got, err := withAstronomy(context.Background(), points, f)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("withAstronomy differs from setSunAndMoon: %v", err)
+	}
+
+	// The second pass over the same forecast reads the flags from the cache
+	cache.Set("astro:"+f.Digest, bytes.Repeat([]byte{3}, len(points)))
+	got, err = withAstronomy(context.Background(), points, f)
+	if err != nil || !got[0].Dark || !got[0].MoonUp {
+		t.Errorf("cached flags not used: %+v, %v", got[0], err)
+	}
+}
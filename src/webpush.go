@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	webPushRecordSize = 4096
+	vapidTokenTTL     = 12 * time.Hour // push services reject tokens valid for more than 24h
+)
+
+var b64 = base64.RawURLEncoding
+
+// VAPIDKeys identify this server to push services (RFC 8292)
+type VAPIDKeys struct {
+	private *ecdsa.PrivateKey
+}
+
+// generateVAPIDKeys creates a new P-256 key pair
+func generateVAPIDKeys() (*VAPIDKeys, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &VAPIDKeys{private: key}, nil
+}
+
+// MarshalJSON stores the private key as base64url PKCS#8
+func (k *VAPIDKeys) MarshalJSON() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]string{"private_key": b64.EncodeToString(der)})
+}
+
+func (k *VAPIDKeys) UnmarshalJSON(data []byte) error {
+	var stored struct {
+		PrivateKey string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return err
+	}
+	der, err := b64.DecodeString(stored.PrivateKey)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return err
+	}
+	private, ok := key.(*ecdsa.PrivateKey)
+	if !ok || private.Curve != elliptic.P256() {
+		return errors.New("vapid key is not a P-256 ECDSA key")
+	}
+	k.private = private
+	return nil
+}
+
+// PublicKey returns the uncompressed public key as base64url, the applicationServerKey for pushManager.subscribe
+func (k *VAPIDKeys) PublicKey() string {
+	public, err := k.private.PublicKey.ECDH()
+	if err != nil {
+		panic(fmt.Sprintf("vapid public key: %v", err))
+	}
+	return b64.EncodeToString(public.Bytes())
+}
+
+// Authorization returns the "vapid t=<JWT>, k=<key>" header value for a push endpoint
+func (k *VAPIDKeys) Authorization(endpoint, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidTokenTTL).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	input := header + "." + b64.EncodeToString(claims)
+
+	// ES256 signatures are r || s, each padded to 32 bytes (RFC 7518)
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", input, b64.EncodeToString(sig), k.PublicKey()), nil
+}
+
+// encryptPushPayload encrypts a message for a subscription as a single aes128gcm record (RFC 8291)
+func encryptPushPayload(p256dh, auth, plaintext []byte) ([]byte, error) {
+	serverKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptPushRecord(p256dh, auth, plaintext, serverKey, salt)
+}
+
+func encryptPushRecord(p256dh, auth, plaintext []byte, serverKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(auth) != 16 {
+		return nil, errors.New("auth secret must be 16 bytes")
+	}
+	// One record: plaintext, the 0x02 last-record delimiter and the 16-byte tag must fit
+	if len(plaintext)+1+16 > webPushRecordSize {
+		return nil, errors.New("push payload is too large")
+	}
+	clientKey, err := ecdh.P256().NewPublicKey(p256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	shared, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), p256dh...)
+	keyInfo = append(keyInfo, serverPublic...)
+	ikm := hkdf(auth, shared, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, 16+4+1+len(serverPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(serverPublic)))
+	header = append(header, serverPublic...)
+	return gcm.Seal(header, nonce, append(append([]byte{}, plaintext...), 0x02), nil), nil
+}
+
+// hkdf is HKDF-SHA-256 (RFC 5869) for outputs of at most one hash block
+func hkdf(salt, secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{0x01})
+	return expand.Sum(nil)[:length]
+}
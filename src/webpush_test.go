@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 8291 section 5 example
+func TestEncryptPushRecord_RFC8291(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := b64.DecodeString(s)
+		if err != nil {
+			t.Fatalf("decode %q: %v", s, err)
+		}
+		return b
+	}
+	serverKey, err := ecdh.P256().NewPrivateKey(decode("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatalf("server key: %v", err)
+	}
+	got, err := encryptPushRecord(
+		decode("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"),
+		decode("BTBZMqHH6r4Tts7J_aSIgg"),
+		[]byte("When I grow up, I want to be a watermelon"),
+		serverKey,
+		decode("DGv6ra1nlYgDCS1FRnbzlw"),
+	)
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if b64.EncodeToString(got) != want {
+		t.Fatalf("unexpected record\n got %s\nwant %s", b64.EncodeToString(got), want)
+	}
+}
+
+// decryptPushRecord is the user agent side of RFC 8291
+func decryptPushRecord(clientKey *ecdh.PrivateKey, auth, record []byte) ([]byte, error) {
+	if len(record) < 21 {
+		return nil, errors.New("record too short")
+	}
+	salt, idlen := record[:16], int(record[20])
+	if binary.BigEndian.Uint32(record[16:20]) != webPushRecordSize || len(record) < 21+idlen {
+		return nil, errors.New("bad header")
+	}
+	serverPublic, err := ecdh.P256().NewPublicKey(record[21 : 21+idlen])
+	if err != nil {
+		return nil, err
+	}
+	shared, err := clientKey.ECDH(serverPublic)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), clientKey.PublicKey().Bytes()...)
+	keyInfo = append(keyInfo, serverPublic.Bytes()...)
+	ikm := hkdf(auth, shared, keyInfo, 32)
+	block, err := aes.NewCipher(hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12), record[21+idlen:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) == 0 || plain[len(plain)-1] != 0x02 {
+		return nil, errors.New("missing last-record delimiter")
+	}
+	return plain[:len(plain)-1], nil
+}
+
+func TestEncryptPushPayload_RoundTrip(t *testing.T) {
+	clientKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	auth := []byte("0123456789abcdef")
+	record, err := encryptPushPayload(clientKey.PublicKey().Bytes(), auth, []byte(`{"title":"Clear night"}`))
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	plain, err := decryptPushRecord(clientKey, auth, record)
+	if err != nil || string(plain) != `{"title":"Clear night"}` {
+		t.Fatalf("unexpected round trip %q, %v", plain, err)
+	}
+
+	if _, err := encryptPushPayload(clientKey.PublicKey().Bytes(), auth, make([]byte, webPushRecordSize)); err == nil {
+		t.Errorf("expected an error for an oversized payload")
+	}
+	if _, err := encryptPushPayload([]byte("short"), auth, nil); err == nil {
+		t.Errorf("expected an error for an invalid client key")
+	}
+}
+
+// verifyVAPID checks the Authorization header the way a push service does and returns the JWT claims
+func verifyVAPID(t *testing.T, header string) (map[string]any, string) {
+	t.Helper()
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(header, "vapid "), ", ") {
+		name, value, _ := strings.Cut(part, "=")
+		fields[name] = value
+	}
+	rawKey, err := b64.DecodeString(fields["k"])
+	if err != nil {
+		t.Fatalf("decode k: %v", err)
+	}
+	x, y := new(big.Int).SetBytes(rawKey[1:33]), new(big.Int).SetBytes(rawKey[33:])
+	public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	parts := strings.Split(fields["t"], ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed JWT %q", fields["t"])
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		t.Fatalf("malformed signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(public, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		t.Fatalf("invalid VAPID signature")
+	}
+	rawClaims, _ := b64.DecodeString(parts[1])
+	claims := map[string]any{}
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		t.Fatalf("claims: %v", err)
+	}
+	return claims, fields["k"]
+}
+
+func TestVAPIDKeys(t *testing.T) {
+	keys, err := generateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	header, err := keys.Authorization("https://push.example.com/send/abc?x=1", "mailto:admin@example.com", now)
+	if err != nil {
+		t.Fatalf("authorization: %v", err)
+	}
+	claims, k := verifyVAPID(t, header)
+	if claims["aud"] != "https://push.example.com" || claims["sub"] != "mailto:admin@example.com" || claims["exp"] != float64(now.Add(12*time.Hour).Unix()) {
+		t.Errorf("unexpected claims %v", claims)
+	}
+	if k != keys.PublicKey() || len(k) != 87 {
+		t.Errorf("unexpected public key %q", k)
+	}
+
+	// Keys survive a JSON round trip through the store
+	data, err := json.Marshal(keys)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	restored := &VAPIDKeys{}
+	if err := json.Unmarshal(data, restored); err != nil || restored.PublicKey() != keys.PublicKey() {
+		t.Fatalf("unexpected restored key %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//go:embed templates/embed.html
+var embedHTML string
+
+var embedTmpl = template.Must(template.New("embed").Parse(embedHTML))
+
+// EmbedForecast is the next night's summary served by /embed.json and rendered by /embed
+type EmbedForecast struct {
+	Name      string      `json:"name,omitempty"`
+	Latitude  float64     `json:"latitude"`
+	Longitude float64     `json:"longitude"`
+	Night     *EmbedNight `json:"night"` // nil when there is no dark night in the forecast range
+}
+
+type EmbedNight struct {
+	Date       string       `json:"date"` // evening the night starts on, YYYY-MM-DD
+	Start      time.Time    `json:"start"`
+	End        time.Time    `json:"end"`
+	BestWindow *EmbedWindow `json:"best_window"` // nil when no hour is "ok"
+	Moon       EmbedMoon    `json:"moon"`
+	Hours      []EmbedHour  `json:"hours"`
+}
+
+type EmbedWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Hours int       `json:"hours"`
+}
+
+type EmbedMoon struct {
+	Illumination int64     `json:"illumination"` // percentage
+	Rise         time.Time `json:"rise"`
+	Set          time.Time `json:"set"`
+	UpHours      int       `json:"up_hours"` // dark hours with the Moon above the horizon
+}
+
+type EmbedHour struct {
+	Time       time.Time `json:"time"`
+	OK         bool      `json:"ok"`
+	LowClouds  int64     `json:"cloud_cover_low"`
+	MidClouds  int64     `json:"cloud_cover_mid"`
+	HighClouds int64     `json:"cloud_cover_high"`
+	WindSpeed  float64   `json:"wind_speed"` // km/h
+	WindGusts  float64   `json:"wind_gusts"` // km/h
+	Seeing     float64   `json:"seeing"`
+	MoonUp     bool      `json:"moon_up"`
+}
+
+// embedBar is a single hourly cloud bar in the HTML widget
+type embedBar struct {
+	Label  string
+	Height int64 // percentage of the bar area, the cloudiest layer wins
+	OK     bool
+	MoonUp bool
+}
+
+func handleEmbed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	forecast, opts, ok := embedForecastFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	timeFmt := "15:04"
+	if opts.Use12Hour {
+		timeFmt = "3:04pm"
+	}
+
+	view := struct {
+		Forecast EmbedForecast
+		Title    string
+		Date     string
+		Window   string
+		Moon     string
+		Bars     []embedBar
+		Link     string
+	}{
+		Forecast: forecast,
+		Title:    forecast.Name,
+		Link:     permalinkPath(forecast.Name, forecast.Latitude, forecast.Longitude, r.URL.Query()),
+	}
+	if view.Title == "" {
+		view.Title = fmt.Sprintf("%.3f, %.3f", forecast.Latitude, forecast.Longitude)
+	}
+
+	if n := forecast.Night; n != nil {
+		view.Date = n.Start.Format("Monday, January 2")
+		view.Window = "no clear window"
+		if n.BestWindow != nil {
+			view.Window = fmt.Sprintf("best: %s – %s (%dh)", n.BestWindow.Start.Format(timeFmt), n.BestWindow.End.Format(timeFmt), n.BestWindow.Hours)
+		}
+		view.Moon = fmt.Sprintf("moon %d%% | rise %s | set %s", n.Moon.Illumination, n.Moon.Rise.Format(timeFmt), n.Moon.Set.Format(timeFmt))
+		for _, h := range n.Hours {
+			label := h.Time.Format("15")
+			if opts.Use12Hour {
+				label = strings.TrimSuffix(h.Time.Format("3pm"), "m")
+			}
+			view.Bars = append(view.Bars, embedBar{
+				Label:  label,
+				Height: max(h.LowClouds, h.MidClouds, h.HighClouds, 0),
+				OK:     h.OK,
+				MoonUp: h.MoonUp,
+			})
+		}
+	}
+
+	// Allow framing from any site. X-Frame-Options is deliberately not set: it cannot express "allow all".
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors *")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := embedTmpl.Execute(w, view); err != nil {
+		slog.ErrorContext(r.Context(), "rendering embed", "error", err)
+		http.Error(w, "Template rendering error", http.StatusInternalServerError)
+		return
+	}
+}
+
+func handleEmbedJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Club sites fetch this from their own origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	forecast, _, ok := embedForecastFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(forecast); err != nil {
+		http.Error(w, "Unable to encode forecast", http.StatusInternalServerError)
+		return
+	}
+}
+
+// embedForecastFromRequest validates query parameters and builds the widget data.
+// It writes an error response, or 304 Not Modified when the client's copy is current, and
+// returns false in either case.
+func embedForecastFromRequest(w http.ResponseWriter, r *http.Request) (EmbedForecast, PrintOptions, bool) {
+	q := r.URL.Query()
+	lat, lon, ok := parseCoordinates(q.Get("lat"), q.Get("lon"))
+	if !ok {
+		http.Error(w, "Valid latitude and longitude are required", http.StatusBadRequest)
+		return EmbedForecast{}, PrintOptions{}, false
+	}
+	opts := parsePrintOptions(q)
+
+	points, freshness, err := fetchForecastFreshness(r.Context(), lat, lon)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "fetching weather from Open-Meteo", "error", err)
+		http.Error(w, "Upstream weather service unavailable", http.StatusBadGateway)
+		return EmbedForecast{}, PrintOptions{}, false
+	}
+	now := time.Now()
+	if setForecastCaching(w, r, freshness, hourVariant(now)) {
+		return EmbedForecast{}, PrintOptions{}, false
+	}
+	if points, err = withAstronomy(r.Context(), points, freshness); err != nil {
+		forecastCancelled(w)
+		return EmbedForecast{}, PrintOptions{}, false
+	}
+
+	forecast := newEmbedForecast(points, opts, now)
+	forecast.Name = strings.TrimSpace(q.Get("name"))
+	forecast.Latitude = lat
+	forecast.Longitude = lon
+	return forecast, opts, true
+}
+
+// newEmbedForecast summarises the first night that has not ended at now
+func newEmbedForecast(points DataPoints, opts PrintOptions, now time.Time) EmbedForecast {
+	forecast := EmbedForecast{}
+	maxCloud, maxWind := opts.thresholds()
+	night, ok := points.Nights(maxCloud, maxWind).Next(now)
+	if !ok {
+		return forecast
+	}
+
+	forecast.Night = newEmbedNight(night, maxCloud, maxWind)
+	return forecast
+}
+
+// newEmbedNight converts a night to its JSON form
+func newEmbedNight(night Night, maxCloud int64, maxWind float64) *EmbedNight {
+	moonRise, moonSet := calculateRiseSet(night.Date, night.Points[0].Lat, night.Points[0].Lon, "moon")
+	embedNight := &EmbedNight{
+		Date:  night.Date.Format("2006-01-02"),
+		Start: night.Start,
+		End:   night.End,
+		Moon: EmbedMoon{
+			Illumination: night.MoonIllum,
+			Rise:         moonRise,
+			Set:          moonSet,
+			UpHours:      night.MoonUpHours,
+		},
+	}
+	if night.Best.Hours > 0 {
+		embedNight.BestWindow = &EmbedWindow{Start: night.Best.Start, End: night.Best.End, Hours: night.Best.Hours}
+	}
+	for _, p := range night.Points {
+		embedNight.Hours = append(embedNight.Hours, EmbedHour{
+			Time:       p.Time,
+			OK:         p.isGood(maxCloud, maxWind),
+			LowClouds:  p.LowClouds,
+			MidClouds:  p.MidClouds,
+			HighClouds: p.HighClouds,
+			WindSpeed:  p.WindSpeed,
+			WindGusts:  p.WindGusts,
+			Seeing:     p.Seeing,
+			MoonUp:     p.MoonUp,
+		})
+	}
+	return embedNight
+}
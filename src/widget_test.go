@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleEmbed(t *testing.T) {
+	setupCache()
+	fakeForecastServer(t, func(i int) int64 { return 0 })
+
+	req := httptest.NewRequest(http.MethodGet, "/embed?lat=50.45&lon=30.52&name=Club%20Observatory", nil)
+	rec := httptest.NewRecorder()
+	handleEmbed(rec, req)
+
+	res := rec.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if csp := res.Header.Get("Content-Security-Policy"); !strings.Contains(csp, "frame-ancestors *") {
+		t.Fatalf("expected embeddable CSP, got %q", csp)
+	}
+	if xfo := res.Header.Get("X-Frame-Options"); xfo != "" {
+		t.Fatalf("expected no X-Frame-Options, got %q", xfo)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"Club Observatory", "best: ", "moon ", `class="bar ok"`, "/?lat=50.450000&amp;lon=30.520000&amp;name=Club"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected body to contain %q", want)
+		}
+	}
+}
+
+func TestHandleEmbedJSON(t *testing.T) {
+	setupCache()
+	// Overcast every other hour: the best window is a single hour
+	fakeForecastServer(t, func(i int) int64 { return int64(i%2) * 100 })
+
+	req := httptest.NewRequest(http.MethodGet, "/embed.json?lat=50.45&lon=30.52", nil)
+	rec := httptest.NewRecorder()
+	handleEmbedJSON(rec, req)
+
+	res := rec.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	if origin := res.Header.Get("Access-Control-Allow-Origin"); origin != "*" {
+		t.Fatalf("expected CORS header, got %q", origin)
+	}
+	var got EmbedForecast
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if got.Night == nil || len(got.Night.Hours) == 0 {
+		t.Fatalf("expected a night with hours, got %+v", got)
+	}
+	if got.Night.BestWindow == nil || got.Night.BestWindow.Hours != 1 {
+		t.Fatalf("expected a 1h best window, got %+v", got.Night.BestWindow)
+	}
+}
+
+func TestHandleEmbed_InvalidCoordinates(t *testing.T) {
+	for _, path := range []string{"/embed", "/embed?lat=91&lon=0", "/embed.json?lat=x&lon=1"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		rec := httptest.NewRecorder()
+		if strings.HasPrefix(path, "/embed.json") {
+			handleEmbedJSON(rec, req)
+		} else {
+			handleEmbed(rec, req)
+		}
+		if rec.Result().StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", path, rec.Result().StatusCode)
+		}
+	}
+}